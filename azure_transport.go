@@ -2,20 +2,43 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Azure/azure-storage-blob-go/azblob"
 )
 
+const (
+	azureIMDSTokenURL     = "http://169.254.169.254/metadata/identity/oauth2/token"
+	azureStorageResource  = "https://storage.azure.com/"
+	azureTokenRefreshLead = 5 * time.Minute
+)
+
 type azureTransport struct {
 	serviceURL *azblob.ServiceURL
 }
 
+type azureIMDSToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   string `json:"expires_in"`
+}
+
 func newAzureTransport() (http.RoundTripper, error) {
-	credential, err := azblob.NewSharedKeyCredential(conf.ABSName, conf.ABSKey)
+	var (
+		credential azblob.Credential
+		err        error
+	)
+
+	if len(conf.ABSKey) > 0 {
+		credential, err = azblob.NewSharedKeyCredential(conf.ABSName, conf.ABSKey)
+	} else {
+		credential, err = newAzureManagedIdentityCredential()
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -36,11 +59,110 @@ func newAzureTransport() (http.RoundTripper, error) {
 	return azureTransport{&serviceURL}, nil
 }
 
+// newAzureManagedIdentityCredential creates a token credential that obtains
+// and refreshes tokens using the Azure Instance Metadata Service
+func newAzureManagedIdentityCredential() (azblob.Credential, error) {
+	token, expiresIn, err := requestAzureIMDSToken()
+	if err != nil {
+		return nil, fmt.Errorf("Can't obtain Azure managed identity token: %s", err)
+	}
+
+	// The refresher is called right away, so the first call only schedules
+	// the next refresh according to the lifetime of the initial token
+	initial := true
+
+	refresher := func(credential azblob.TokenCredential) time.Duration {
+		if initial {
+			initial = false
+			return azureTokenRefreshDelay(expiresIn)
+		}
+
+		token, expiresIn, err := requestAzureIMDSToken()
+		if err != nil {
+			logWarning("Can't refresh Azure managed identity token: %s", err)
+			return time.Minute
+		}
+
+		credential.SetToken(token)
+
+		return azureTokenRefreshDelay(expiresIn)
+	}
+
+	return azblob.NewTokenCredential(token, refresher), nil
+}
+
+func azureTokenRefreshDelay(expiresIn time.Duration) time.Duration {
+	if expiresIn > 2*azureTokenRefreshLead {
+		return expiresIn - azureTokenRefreshLead
+	}
+
+	return expiresIn / 2
+}
+
+func requestAzureIMDSToken() (string, time.Duration, error) {
+	query := url.Values{}
+	query.Set("api-version", "2018-02-01")
+	query.Set("resource", azureStorageResource)
+	if len(conf.ABSClientID) > 0 {
+		query.Set("client_id", conf.ABSClientID)
+	}
+
+	req, err := http.NewRequest("GET", azureIMDSTokenURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Metadata", "true")
+
+	client := http.Client{Timeout: 10 * time.Second}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("Status: %s", res.Status)
+	}
+
+	var token azureIMDSToken
+
+	if err = json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return "", 0, err
+	}
+
+	expiresIn, err := strconv.Atoi(token.ExpiresIn)
+	if err != nil {
+		return "", 0, fmt.Errorf("Invalid token expiration: %s", token.ExpiresIn)
+	}
+
+	return token.AccessToken, time.Duration(expiresIn) * time.Second, nil
+}
+
+func (t azureTransport) List(ctx context.Context, bucket, prefix string, limit int) ([]string, error) {
+	containerURL := t.serviceURL.NewContainerURL(strings.ToLower(bucket))
+
+	res, err := containerURL.ListBlobsFlatSegment(ctx, azblob.Marker{}, azblob.ListBlobsSegmentOptions{
+		Prefix:     prefix,
+		MaxResults: int32(limit),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(res.Segment.BlobItems))
+	for _, item := range res.Segment.BlobItems {
+		keys = append(keys, item.Name)
+	}
+
+	return keys, nil
+}
+
 func (t azureTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
 	containerURL := t.serviceURL.NewContainerURL(strings.ToLower(req.URL.Host))
 	blobURL := containerURL.NewBlockBlobURL(strings.TrimPrefix(req.URL.Path, "/"))
 
-	get, err := blobURL.Download(context.Background(), 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	get, err := blobURL.Download(req.Context(), 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
 	if err != nil {
 		return nil, err
 	}
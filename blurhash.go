@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	blurhashPathPrefix = "/blurhash"
+
+	// blurhashImageSize is the size the image is shrunk to before encoding.
+	// BlurHash keeps only a few components, so more pixels don't improve the result
+	blurhashImageSize = 32
+
+	blurhashDefaultXComponents = 4
+	blurhashDefaultYComponents = 3
+	blurhashMaxComponents      = 9
+
+	blurhashCharacters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+)
+
+func blurhashEncode83(sb *strings.Builder, value, length int) {
+	for i := length - 1; i >= 0; i-- {
+		digit := (value / int(math.Pow(83, float64(i)))) % 83
+		sb.WriteByte(blurhashCharacters[digit])
+	}
+}
+
+func srgbToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSrgb(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
+
+// encodeBlurhash encodes the 8-bit RGB pixels to a BlurHash string
+// with the provided number of components
+func encodeBlurhash(pixels []byte, width, height, xComponents, yComponents int) string {
+	factors := make([][3]float64, 0, xComponents*yComponents)
+
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			var r, g, b float64
+
+			for y := 0; y < height; y++ {
+				basisY := math.Cos(math.Pi * float64(j) * float64(y) / float64(height))
+
+				for x := 0; x < width; x++ {
+					basis := basisY * math.Cos(math.Pi*float64(i)*float64(x)/float64(width))
+					p := pixels[(y*width+x)*3:]
+
+					r += basis * srgbToLinear(p[0])
+					g += basis * srgbToLinear(p[1])
+					b += basis * srgbToLinear(p[2])
+				}
+			}
+
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+
+			scale := normalisation / float64(width*height)
+
+			factors = append(factors, [3]float64{r * scale, g * scale, b * scale})
+		}
+	}
+
+	var sb strings.Builder
+
+	blurhashEncode83(&sb, (xComponents-1)+(yComponents-1)*9, 1)
+
+	dc, ac := factors[0], factors[1:]
+
+	maxValue := 1.0
+
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			actualMax = math.Max(actualMax, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+
+		quantisedMax := maxInt(0, minInt(82, int(math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+
+		blurhashEncode83(&sb, quantisedMax, 1)
+	} else {
+		blurhashEncode83(&sb, 0, 1)
+	}
+
+	blurhashEncode83(&sb, linearToSrgb(dc[0])<<16+linearToSrgb(dc[1])<<8+linearToSrgb(dc[2]), 4)
+
+	for _, f := range ac {
+		var q [3]int
+		for c := range f {
+			q[c] = maxInt(0, minInt(18, int(math.Floor(signPow(f[c]/maxValue, 0.5)*9+9.5))))
+		}
+
+		blurhashEncode83(&sb, q[0]*19*19+q[1]*19+q[2], 2)
+	}
+
+	return sb.String()
+}
+
+func parseBlurhashComponents(r *http.Request, name string, def int) (int, error) {
+	str := r.URL.Query().Get(name)
+	if len(str) == 0 {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(str)
+	if err != nil || n < 1 || n > blurhashMaxComponents {
+		return 0, newError(
+			404,
+			fmt.Sprintf("Invalid BlurHash components number: %s", str),
+			fmt.Sprintf("BlurHash components number should be between 1 and %d", blurhashMaxComponents),
+		).SetCategory("invalid_options")
+	}
+
+	return n, nil
+}
+
+func calcBlurhash(imgdata *imageData, xComponents, yComponents int) (string, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	defer vipsCleanup()
+
+	img := new(vipsImage)
+	defer img.Clear()
+
+	if err := loadThumbnail(img, imgdata, blurhashImageSize); err != nil {
+		return "", err
+	}
+
+	pixels, err := img.SRGBPixels()
+	if err != nil {
+		return "", err
+	}
+
+	return encodeBlurhash(pixels, img.Width(), img.Height(), xComponents, yComponents), nil
+}
+
+func handleBlurhash(reqID string, rw http.ResponseWriter, r *http.Request) {
+	ctx, timeoutCancel := context.WithTimeout(r.Context(), time.Duration(conf.WriteTimeout)*time.Second)
+	defer timeoutCancel()
+
+	ctx, err := parseSourcePath(ctx, r, blurhashPathPrefix)
+	if err != nil {
+		panic(err)
+	}
+
+	xComponents, err := parseBlurhashComponents(r, "x", blurhashDefaultXComponents)
+	if err != nil {
+		panic(err)
+	}
+
+	yComponents, err := parseBlurhashComponents(r, "y", blurhashDefaultYComponents)
+	if err != nil {
+		panic(err)
+	}
+
+	ctx, downloadcancel, err := downloadImage(ctx, r.Header)
+	defer downloadcancel()
+	if err != nil {
+		incrementErrorsTotal("download")
+		panic(err)
+	}
+
+	checkTimeout(ctx)
+
+	// Encoding decodes the image, so it shares the limit with processing
+	defer acquireProcessingSem(ctx)()
+
+	hash, err := calcBlurhash(getImageData(ctx), xComponents, yComponents)
+	if err != nil {
+		incrementErrorsTotal("processing")
+		panic(newError(422, err.Error(), "Invalid source image").SetCategory("invalid_source_image"))
+	}
+
+	rw.Header().Set("Content-Type", "text/plain")
+	rw.Header().Set("Content-Length", strconv.Itoa(len(hash)))
+	rw.WriteHeader(200)
+	rw.Write([]byte(hash))
+
+	imageURL := getImageURL(ctx)
+	logResponse(reqID, r, 200, nil, &imageURL, nil)
+}
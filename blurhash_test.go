@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type BlurhashTestSuite struct{ MainTestSuite }
+
+func (s *BlurhashTestSuite) TestEncodeSolidWhite() {
+	pixels := bytes.Repeat([]byte{255, 255, 255}, 8*6)
+
+	hash := encodeBlurhash(pixels, 8, 6, 4, 3)
+
+	// Size flag for 4x3 components
+	assert.Equal(s.T(), "L", hash[:1])
+	// White DC component
+	assert.Equal(s.T(), "TSUA", hash[2:6])
+}
+
+func (s *BlurhashTestSuite) TestEncodeLength() {
+	pixels := make([]byte, 16*16*3)
+	for i := range pixels {
+		pixels[i] = byte(i)
+	}
+
+	for x := 1; x <= blurhashMaxComponents; x++ {
+		for y := 1; y <= blurhashMaxComponents; y++ {
+			assert.Len(s.T(), encodeBlurhash(pixels, 16, 16, x, y), 4+2*x*y)
+		}
+	}
+}
+
+func TestBlurhash(t *testing.T) {
+	suite.Run(t, new(BlurhashTestSuite))
+}
@@ -0,0 +1,34 @@
+// +build brotli
+
+package main
+
+/*
+#cgo pkg-config: libbrotlienc
+#include <brotli/encode.h>
+*/
+import "C"
+import (
+	"errors"
+	"unsafe"
+)
+
+const brotliSupported = true
+
+func brotliCompress(data []byte, level int) ([]byte, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+
+	size := C.BrotliEncoderMaxCompressedSize(C.size_t(len(data)))
+	buf := make([]byte, int(size))
+
+	if C.BrotliEncoderCompress(
+		C.int(level), C.BROTLI_DEFAULT_WINDOW, C.BROTLI_MODE_TEXT,
+		C.size_t(len(data)), (*C.uint8_t)(unsafe.Pointer(&data[0])),
+		&size, (*C.uint8_t)(unsafe.Pointer(&buf[0])),
+	) == C.BROTLI_FALSE {
+		return nil, errors.New("Can't compress data using Brotli")
+	}
+
+	return buf[:int(size)], nil
+}
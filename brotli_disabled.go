@@ -0,0 +1,11 @@
+// +build !brotli
+
+package main
+
+import "errors"
+
+const brotliSupported = false
+
+func brotliCompress(data []byte, level int) ([]byte, error) {
+	return nil, errors.New("imgproxy is built without Brotli support")
+}
@@ -18,6 +18,7 @@ type bufPool struct {
 	defaultSize int
 	maxSize     int
 	buffers     []*bytes.Buffer
+	inUse       int
 
 	calls   intSlice
 	callInd int
@@ -37,6 +38,8 @@ func newBufPool(name string, n int, defaultSize int) *bufPool {
 		pool.buffers[i] = new(bytes.Buffer)
 	}
 
+	setBufferPoolSize(name, n)
+
 	return &pool
 }
 
@@ -65,10 +68,8 @@ func (p *bufPool) calibrateAndClean() {
 		runtime.GC()
 	}
 
-	if prometheusEnabled {
-		setPrometheusBufferDefaultSize(p.name, p.defaultSize)
-		setPrometheusBufferMaxSize(p.name, p.maxSize)
-	}
+	setBufferDefaultSize(p.name, p.defaultSize)
+	setBufferMaxSize(p.name, p.maxSize)
 }
 
 func (p *bufPool) Get(size int) *bytes.Buffer {
@@ -113,6 +114,9 @@ func (p *bufPool) Get(size int) *bytes.Buffer {
 
 	buf.Reset()
 
+	p.inUse++
+	setBuffersInUse(p.name, p.inUse)
+
 	growSize := maxInt(size, p.defaultSize)
 
 	if growSize > buf.Cap() {
@@ -126,6 +130,9 @@ func (p *bufPool) Put(buf *bytes.Buffer) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
+	p.inUse--
+	setBuffersInUse(p.name, p.inUse)
+
 	if buf.Len() > 0 {
 		p.calls[p.callInd] = buf.Len()
 		p.callInd++
@@ -143,8 +150,8 @@ func (p *bufPool) Put(buf *bytes.Buffer) {
 		if b == nil {
 			p.buffers[i] = buf
 
-			if prometheusEnabled && buf.Cap() > 0 {
-				observePrometheusBufferSize(p.name, buf.Cap())
+			if buf.Cap() > 0 {
+				observeBufferSize(p.name, buf.Cap())
 			}
 
 			return
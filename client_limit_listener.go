@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// clientLimitListener limits the number of simultaneous connections
+// from a single client IP. Connections that exceed the limit are closed
+// right after they are accepted
+type clientLimitListener struct {
+	net.Listener
+
+	limit int
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+type clientLimitConn struct {
+	net.Conn
+
+	l         *clientLimitListener
+	ip        string
+	closeOnce sync.Once
+}
+
+func newClientLimitListener(l net.Listener, limit int) net.Listener {
+	return &clientLimitListener{
+		Listener: l,
+		limit:    limit,
+		counts:   make(map[string]int),
+	}
+}
+
+func (l *clientLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip := clientIP(conn.RemoteAddr())
+
+		if l.acquire(ip) {
+			return &clientLimitConn{Conn: conn, l: l, ip: ip}, nil
+		}
+
+		logWarning("Too many connections from %s", ip)
+		conn.Close()
+	}
+}
+
+func (l *clientLimitListener) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.counts[ip] >= l.limit {
+		return false
+	}
+
+	l.counts[ip]++
+
+	return true
+}
+
+func (l *clientLimitListener) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.counts[ip] <= 1 {
+		delete(l.counts, ip)
+	} else {
+		l.counts[ip]--
+	}
+}
+
+func (c *clientLimitConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() { c.l.release(c.ip) })
+	return err
+}
+
+func clientIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	return host
+}
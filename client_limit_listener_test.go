@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type ClientLimitListenerTestSuite struct{ MainTestSuite }
+
+func (s *ClientLimitListenerTestSuite) TestLimit() {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(s.T(), err)
+
+	l := newClientLimitListener(ln, 1)
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	require.Nil(s.T(), err)
+	defer c1.Close()
+
+	first := <-accepted
+
+	// The second connection from the same IP is closed by the listener
+	c2, err := net.Dial("tcp", ln.Addr().String())
+	require.Nil(s.T(), err)
+	defer c2.Close()
+
+	c2.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = c2.Read(make([]byte, 1))
+	assert.NotNil(s.T(), err)
+	assert.Len(s.T(), accepted, 0)
+
+	// Closing the first connection releases the slot
+	first.Close()
+
+	c3, err := net.Dial("tcp", ln.Addr().String())
+	require.Nil(s.T(), err)
+	defer c3.Close()
+
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(time.Second):
+		s.T().Error("Connection wasn't accepted after the slot was released")
+	}
+}
+
+func TestClientLimitListener(t *testing.T) {
+	suite.Run(t, new(ClientLimitListenerTestSuite))
+}
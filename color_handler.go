@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+const (
+	colorPathPrefix = "/color"
+
+	// averageColorSize is the size the image is shrunk to before
+	// calculating the average color
+	averageColorSize = 64
+)
+
+type averageColor struct {
+	Color string `json:"color"`
+}
+
+// loadThumbnail loads the image shrunk so its largest side is not greater than size.
+// Scale-on-load is used when possible, so the image is never fully decoded
+func loadThumbnail(img *vipsImage, imgdata *imageData, size int) error {
+	if err := img.Load(imgdata.Data, imgdata.Type, 1, 1.0, 1); err != nil {
+		return err
+	}
+
+	scale := float64(size) / float64(maxInt(img.Width(), img.Height()))
+
+	if scale < 1 && canScaleOnLoad(imgdata.Type, scale) {
+		if err := img.Load(imgdata.Data, imgdata.Type, calcJpegShink(scale, imgdata.Type), scale, 1); err != nil {
+			return err
+		}
+
+		scale = float64(size) / float64(maxInt(img.Width(), img.Height()))
+	}
+
+	if scale < 1 {
+		return img.Resize(scale, img.HasAlpha(), true)
+	}
+
+	return nil
+}
+
+func calcAverageColor(imgdata *imageData) (rgbColor, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	defer vipsCleanup()
+
+	img := new(vipsImage)
+	defer img.Clear()
+
+	if err := loadThumbnail(img, imgdata, averageColorSize); err != nil {
+		return rgbColor{}, err
+	}
+
+	return img.AverageColor()
+}
+
+func handleColor(reqID string, rw http.ResponseWriter, r *http.Request) {
+	ctx, timeoutCancel := context.WithTimeout(r.Context(), time.Duration(conf.WriteTimeout)*time.Second)
+	defer timeoutCancel()
+
+	ctx, err := parseSourcePath(ctx, r, colorPathPrefix)
+	if err != nil {
+		panic(err)
+	}
+
+	ctx, downloadcancel, err := downloadImage(ctx, r.Header)
+	defer downloadcancel()
+	if err != nil {
+		incrementErrorsTotal("download")
+		panic(err)
+	}
+
+	checkTimeout(ctx)
+
+	// Calculating the color decodes the image, so it shares the limit with processing
+	defer acquireProcessingSem(ctx)()
+
+	color, err := calcAverageColor(getImageData(ctx))
+	if err != nil {
+		incrementErrorsTotal("processing")
+		panic(newError(422, err.Error(), "Invalid source image").SetCategory("invalid_source_image"))
+	}
+
+	data, err := json.Marshal(averageColor{
+		Color: fmt.Sprintf("#"+hexColorLongFormat, color.R, color.G, color.B),
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	rw.WriteHeader(200)
+	rw.Write(data)
+
+	imageURL := getImageURL(ctx)
+	logResponse(reqID, r, 200, nil, &imageURL, nil)
+}
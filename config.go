@@ -6,6 +6,7 @@ import (
 	"flag"
 	"fmt"
 	"math"
+	"net/http"
 	"os"
 	"regexp"
 	"runtime"
@@ -37,6 +38,49 @@ func strEnvConfig(s *string, name string) {
 	}
 }
 
+func strSliceEnvConfig(s *[]string, name string) {
+	if env := os.Getenv(name); len(env) > 0 {
+		parts := strings.Split(env, ",")
+
+		for i, p := range parts {
+			parts[i] = strings.TrimSpace(p)
+		}
+
+		*s = parts
+	} else {
+		*s = []string{}
+	}
+}
+
+// bucketsEnvConfig parses comma-separated histogram buckets in seconds.
+// Malformed or unsorted buckets are ignored so the defaults are used
+func bucketsEnvConfig(b *[]float64, name string) {
+	env := os.Getenv(name)
+	if len(env) == 0 {
+		return
+	}
+
+	parts := strings.Split(env, ",")
+	buckets := make([]float64, len(parts))
+
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			logWarning("Invalid %s: %s, using default buckets", name, env)
+			return
+		}
+
+		if i > 0 && v <= buckets[i-1] {
+			logWarning("%s should be sorted ascending, using default buckets", name)
+			return
+		}
+
+		buckets[i] = v
+	}
+
+	*b = buckets
+}
+
 func boolEnvConfig(b *bool, name string) {
 	if env, err := strconv.ParseBool(os.Getenv(name)); err == nil {
 		*b = env
@@ -60,32 +104,82 @@ func imageTypesEnvConfig(it *[]imageType, name string) {
 	}
 }
 
-func formatQualityEnvConfig(m map[imageType]int, name string) {
+func formatQualityEnvConfig(m map[imageType]int, name string) error {
 	if env := os.Getenv(name); len(env) > 0 {
 		parts := strings.Split(env, ",")
 
 		for _, p := range parts {
 			i := strings.Index(p, "=")
 			if i < 0 {
-				logWarning("Invalid format quality string: %s", p)
-				continue
+				return fmt.Errorf("Invalid format quality string: %s", p)
 			}
 
 			imgtypeStr, qStr := strings.TrimSpace(p[:i]), strings.TrimSpace(p[i+1:])
 
 			imgtype, ok := imageTypes[imgtypeStr]
 			if !ok {
-				logWarning("Invalid format: %s", p)
+				return fmt.Errorf("Invalid format: %s", p)
 			}
 
 			q, err := strconv.Atoi(qStr)
-			if err != nil || q <= 0 || q > 100 {
-				logWarning("Invalid quality: %s", p)
+			if err != nil {
+				return fmt.Errorf("Invalid quality: %s", p)
 			}
 
 			m[imgtype] = q
 		}
 	}
+
+	return nil
+}
+
+func customResponseHeadersEnvConfig(m map[string]string, name, separator string) error {
+	if env := os.Getenv(name); len(env) > 0 {
+		for _, p := range strings.Split(env, separator) {
+			i := strings.Index(p, "=")
+			if i < 0 {
+				return fmt.Errorf("Invalid response header string: %s", p)
+			}
+
+			key := http.CanonicalHeaderKey(strings.TrimSpace(p[:i]))
+			value := strings.TrimSpace(p[i+1:])
+
+			switch key {
+			case "Content-Type", "Content-Length", "Content-Encoding", "Content-Disposition":
+				return fmt.Errorf("Response header %s can't be customized", key)
+			}
+
+			m[key] = value
+		}
+	}
+
+	return nil
+}
+
+func colorEnvConfig(c *rgbColor, name string) error {
+	if env := strings.TrimSpace(os.Getenv(name)); len(env) > 0 {
+		color, err := colorFromHex(env)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+
+		*c = color
+	}
+
+	return nil
+}
+
+func gravityEnvConfig(g *gravityType, name string) error {
+	if env := strings.TrimSpace(os.Getenv(name)); len(env) > 0 {
+		gt, ok := gravityTypes[env]
+		if !ok {
+			return fmt.Errorf("Invalid %s: %s\n", name, env)
+		}
+
+		*g = gt
+	}
+
+	return nil
 }
 
 func hexEnvConfig(b *[]securityKey, name string) error {
@@ -182,6 +276,81 @@ func presetFileConfig(p presets, filepath string) error {
 	return nil
 }
 
+func s3ProfilesEnvConfig(p *[]s3Profile, name string) error {
+	var names []string
+	strSliceEnvConfig(&names, name)
+
+	profiles := make([]s3Profile, 0, len(names))
+
+	for _, n := range names {
+		if len(n) == 0 {
+			continue
+		}
+
+		prefix := fmt.Sprintf("IMGPROXY_S3_PROFILE_%s_", strings.ToUpper(n))
+
+		profile := s3Profile{Name: n}
+
+		strSliceEnvConfig(&profile.Buckets, prefix+"BUCKETS")
+		strEnvConfig(&profile.Region, prefix+"REGION")
+		strEnvConfig(&profile.Endpoint, prefix+"ENDPOINT")
+		strEnvConfig(&profile.AccessKeyID, prefix+"ACCESS_KEY_ID")
+		strEnvConfig(&profile.SecretAccessKey, prefix+"SECRET_ACCESS_KEY")
+		strEnvConfig(&profile.AssumeRoleArn, prefix+"ASSUME_ROLE_ARN")
+
+		if len(profile.Buckets) == 0 {
+			return fmt.Errorf("S3 profile %s has no buckets, set %sBUCKETS", n, prefix)
+		}
+
+		if (len(profile.AccessKeyID) > 0) != (len(profile.SecretAccessKey) > 0) {
+			return fmt.Errorf("S3 profile %s should have both access key ID and secret access key", n)
+		}
+
+		profiles = append(profiles, profile)
+	}
+
+	*p = profiles
+
+	return nil
+}
+
+func sourceHeadersEnvConfig(sh *[]sourceHeader, name string) error {
+	if env := os.Getenv(name); len(env) > 0 {
+		for _, headerStr := range strings.Split(env, `\;`) {
+			if err := parseSourceHeader(sh, headerStr); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func sourceHeadersFileConfig(sh *[]sourceHeader, filepath string) error {
+	if len(filepath) == 0 {
+		return nil
+	}
+
+	f, err := os.Open(filepath)
+	if err != nil {
+		return fmt.Errorf("Can't open file %s\n", filepath)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if err := parseSourceHeader(sh, scanner.Text()); err != nil {
+			return err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Failed to read source headers file: %s", err)
+	}
+
+	return nil
+}
+
 func patternsEnvConfig(s *[]*regexp.Regexp, name string) {
 	if env := os.Getenv(name); len(env) > 0 {
 		parts := strings.Split(env, ",")
@@ -215,21 +384,51 @@ func regexpFromPattern(pattern string) *regexp.Regexp {
 }
 
 type config struct {
-	Network          string
-	Bind             string
-	ReadTimeout      int
-	WriteTimeout     int
-	KeepAliveTimeout int
-	DownloadTimeout  int
-	Concurrency      int
-	MaxClients       int
-
-	TTL                     int
-	CacheControlPassthrough bool
-	SetCanonicalHeader      bool
+	Network             string
+	Bind                string
+	ReadTimeout         int
+	WriteTimeout        int
+	KeepAliveTimeout    int
+	DownloadTimeout     int
+	DownloadRetries     int
+	StreamResponse      bool
+	Concurrency         int
+	DownloadConcurrency int
+	VipsConcurrency     int
+	DownloadKeepAlive   int
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxClients          int
+
+	MaxConnectionsPerClient int
+
+	MaxHeaderBytes int
+
+	GracefulShutdownTimeout int
+	ShutdownDrainDelay      int
+
+	AssetsDownloadTimeout int
+	FastRetryTimeout      int
+	ProcessingTimeout     int
+
+	TTL                      int
+	MaxTTL                   int
+	CacheControlPassthrough  bool
+	CacheHeadersPrecedence   string
+	IgnoreSourceCacheHeaders bool
+	SetCanonicalHeader       bool
 
 	SoReuseport bool
 
+	TLSCert         string
+	TLSKey          string
+	TLSMinVersion   string
+	TLSRedirectBind string
+
+	HTTP2Enabled              bool
+	HTTP2Cleartext            bool
+	HTTP2MaxConcurrentStreams int
+
 	PathPrefix string
 
 	MaxSrcDimension    int
@@ -237,29 +436,54 @@ type config struct {
 	MaxSrcFileSize     int
 	MaxAnimationFrames int
 	MaxSvgCheckBytes   int
-
-	JpegProgressive       bool
-	PngInterlaced         bool
-	PngQuantize           bool
-	PngQuantizationColors int
-	AvifSpeed             int
-	Quality               int
-	FormatQuality         map[imageType]int
-	GZipCompression       int
-	StripMetadata         bool
-	StripColorProfile     bool
-	AutoRotate            bool
-
-	EnableWebpDetection bool
-	EnforceWebp         bool
-	EnableAvifDetection bool
-	EnforceAvif         bool
-	EnableClientHints   bool
+	MaxBlurSigma       float64
+
+	DisallowAnimated              bool
+	DisallowAnimatedUseFirstFrame bool
+
+	JpegProgressive         bool
+	JpegNoSubsample         bool
+	JpegSingleBandGrayscale bool
+	PngInterlaced           bool
+	PngQuantize             bool
+	PngQuantizationColors   int
+	GifDither               float64
+	GifEffort               int
+	GifBitdepth             int
+	WebpLossless            bool
+	WebpNearLossless        int
+	AvifSpeed               int
+	Quality                 int
+	FormatQuality           map[imageType]int
+	CompressionProfile      int
+	GZipCompression         int
+	BrotliCompression       int
+	StripMetadata           bool
+	KeepCopyright           bool
+	StripColorProfile       bool
+	AutoRotate              bool
+	RawUseEmbeddedPreview   bool
+	RawHalfSize             bool
+	RawQuality              int
+	SmartCropFallback       gravityType
+
+	EnableFaceDetection  bool
+	FaceDetectionURL     string
+	FaceDetectionTimeout int
+
+	EnableWebpDetection   bool
+	EnforceWebp           bool
+	EnableAvifDetection   bool
+	EnforceAvif           bool
+	EnableFormatDetection bool
+	EnableClientHints     bool
 
 	SkipProcessingFormats []imageType
+	SkipNoopProcessing    bool
 
-	UseLinearColorspace bool
-	DisableShrinkOnLoad bool
+	UseLinearColorspace       bool
+	LinearColorspaceThreshold float64
+	DisableShrinkOnLoad       bool
 
 	Keys          []securityKey
 	Salts         []securityKey
@@ -268,46 +492,101 @@ type config struct {
 
 	Secret string
 
+	AdminSecret        string
+	StorageCheckPrefix string
+
 	AllowOrigin string
 
-	UserAgent string
+	UserAgent      string
+	ForwardHeaders []string
+	SourceHeaders  []sourceHeader
+
+	CustomResponseHeaders  map[string]string
+	CustomHeadersSeparator string
 
 	IgnoreSslVerification bool
 	DevelopmentErrorsMode bool
 
 	AllowedSources      []*regexp.Regexp
+	AllowLoopback       bool
+	AllowPrivateSources bool
 	LocalFileSystemRoot string
 	S3Enabled           bool
 	S3Region            string
 	S3Endpoint          string
+	S3AssumeRoleArn     string
+	S3SSE               string
+	S3SSEKMSKeyID       string
+	S3Profiles          []s3Profile
 	GCSEnabled          bool
 	GCSKey              string
+	GCSKeyFile          string
+	GCSCheckBucket      string
 	ABSEnabled          bool
 	ABSName             string
 	ABSKey              string
 	ABSEndpoint         string
+	ABSClientID         string
+	SwiftEnabled        bool
+	SwiftUsername       string
+	SwiftPassword       string
+	SwiftAuthURL        string
+	SwiftTenant         string
+	SwiftDomain         string
+	SwiftRegion         string
+
+	PersistURLTemplate string
+
+	CachePath   string
+	CacheSizeMB int
+	CacheTTL    int
 
-	ETagEnabled bool
+	RedisURL          string
+	RedisKeyPrefix    string
+	RedisTimeout      int
+	RedisMaxValueSize int
+
+	ETagEnabled    bool
+	ETagFromSource bool
 
 	BaseURL string
 
 	Presets     presets
 	OnlyPresets bool
 
-	WatermarkData    string
-	WatermarkPath    string
-	WatermarkURL     string
-	WatermarkOpacity float64
+	EnableQueryOptions bool
+
+	WatermarkData          string
+	WatermarkPath          string
+	WatermarkURL           string
+	WatermarkOpacity       float64
+	WatermarkFont          string
+	WatermarkFontSize      int
+	WatermarkTextMaxLength int
+	WatermarksPath         string
+	WatermarkMaxMemory     int
+
+	LutsPath string
 
 	FallbackImageData string
 	FallbackImagePath string
 	FallbackImageURL  string
 
+	FallbackImageHTTPCode int
+
+	ErrorImage      bool
+	ErrorImageColor rgbColor
+
 	NewRelicAppName string
 	NewRelicKey     string
 
-	PrometheusBind      string
-	PrometheusNamespace string
+	PrometheusBind              string
+	PrometheusNamespace         string
+	PrometheusDownloadBuckets   []float64
+	PrometheusProcessingBuckets []float64
+
+	StatsdAddr   string
+	StatsdPrefix string
 
 	BugsnagKey        string
 	BugsnagStage      string
@@ -323,6 +602,7 @@ type config struct {
 	ReportDownloadingErrors bool
 
 	EnableDebugHeaders bool
+	EnableServerTiming bool
 
 	FreeMemoryInterval             int
 	DownloadBufferSize             int
@@ -333,26 +613,52 @@ type config struct {
 var conf = config{
 	Network:                        "tcp",
 	Bind:                           ":8080",
+	TLSMinVersion:                  "1.2",
+	HTTP2Enabled:                   true,
+	HTTP2MaxConcurrentStreams:      10,
 	ReadTimeout:                    10,
 	WriteTimeout:                   10,
 	KeepAliveTimeout:               10,
+	GracefulShutdownTimeout:        5,
+	MaxHeaderBytes:                 1 << 20,
 	DownloadTimeout:                5,
 	Concurrency:                    runtime.NumCPU() * 2,
+	DownloadKeepAlive:              600,
+	VipsConcurrency:                1,
 	TTL:                            3600,
+	MaxTTL:                         31536000,
+	CacheHeadersPrecedence:         cacheHeadersPrecedenceCacheControl,
+	CacheSizeMB:                    1024,
+	CacheTTL:                       3600,
+	RedisKeyPrefix:                 "imgproxy:",
+	SwiftDomain:                    "Default",
+	RedisTimeout:                   1,
+	RedisMaxValueSize:              1024 * 1024,
 	MaxSrcResolution:               16800000,
 	MaxAnimationFrames:             1,
 	MaxSvgCheckBytes:               32 * 1024,
+	MaxBlurSigma:                   100,
 	SignatureSize:                  32,
 	PngQuantizationColors:          256,
+	GifDither:                      1,
+	GifEffort:                      7,
+	GifBitdepth:                    8,
 	Quality:                        80,
 	AvifSpeed:                      5,
 	FormatQuality:                  map[imageType]int{imageTypeAVIF: 50},
 	StripMetadata:                  true,
 	StripColorProfile:              true,
 	AutoRotate:                     true,
+	RawQuality:                     3,
+	SmartCropFallback:              gravityCenter,
+	FaceDetectionTimeout:           5,
+	LinearColorspaceThreshold:      1,
 	UserAgent:                      fmt.Sprintf("imgproxy/%s", version),
 	Presets:                        make(presets),
 	WatermarkOpacity:               1,
+	WatermarkFont:                  "sans",
+	WatermarkFontSize:              16,
+	WatermarkTextMaxLength:         256,
 	BugsnagStage:                   "production",
 	HoneybadgerEnv:                 "production",
 	SentryEnvironment:              "production",
@@ -361,6 +667,10 @@ var conf = config{
 	ReportDownloadingErrors:        true,
 	FreeMemoryInterval:             10,
 	BufferPoolCalibrationThreshold: 1024,
+	FallbackImageHTTPCode:          200,
+	ErrorImageColor:                rgbColor{242, 242, 242},
+	CustomResponseHeaders:          make(map[string]string),
+	CustomHeadersSeparator:         `\;`,
 }
 
 func configure() error {
@@ -378,22 +688,51 @@ func configure() error {
 	intEnvConfig(&conf.ReadTimeout, "IMGPROXY_READ_TIMEOUT")
 	intEnvConfig(&conf.WriteTimeout, "IMGPROXY_WRITE_TIMEOUT")
 	intEnvConfig(&conf.KeepAliveTimeout, "IMGPROXY_KEEP_ALIVE_TIMEOUT")
+	intEnvConfig(&conf.GracefulShutdownTimeout, "IMGPROXY_GRACEFUL_SHUTDOWN_TIMEOUT")
+	intEnvConfig(&conf.ShutdownDrainDelay, "IMGPROXY_SHUTDOWN_DRAIN_DELAY")
 	intEnvConfig(&conf.DownloadTimeout, "IMGPROXY_DOWNLOAD_TIMEOUT")
+	intEnvConfig(&conf.DownloadRetries, "IMGPROXY_DOWNLOAD_RETRIES")
+	boolEnvConfig(&conf.StreamResponse, "IMGPROXY_STREAM_RESPONSE")
+	intEnvConfig(&conf.FastRetryTimeout, "IMGPROXY_FAST_RETRY_TIMEOUT")
+	intEnvConfig(&conf.ProcessingTimeout, "IMGPROXY_PROCESSING_TIMEOUT")
 	intEnvConfig(&conf.Concurrency, "IMGPROXY_CONCURRENCY")
+	intEnvConfig(&conf.DownloadConcurrency, "IMGPROXY_DOWNLOAD_CONCURRENCY")
+	intEnvConfig(&conf.VipsConcurrency, "IMGPROXY_VIPS_CONCURRENCY")
+	intEnvConfig(&conf.DownloadKeepAlive, "IMGPROXY_DOWNLOAD_KEEP_ALIVE")
+	intEnvConfig(&conf.MaxIdleConns, "IMGPROXY_MAX_IDLE_CONNS")
+	intEnvConfig(&conf.MaxIdleConnsPerHost, "IMGPROXY_MAX_IDLE_CONNS_PER_HOST")
 	intEnvConfig(&conf.MaxClients, "IMGPROXY_MAX_CLIENTS")
+	intEnvConfig(&conf.MaxConnectionsPerClient, "IMGPROXY_MAX_CONNECTIONS_PER_CLIENT")
+	intEnvConfig(&conf.MaxHeaderBytes, "IMGPROXY_MAX_HEADER_BYTES")
+
+	intEnvConfig(&conf.AssetsDownloadTimeout, "IMGPROXY_ASSETS_DOWNLOAD_TIMEOUT")
 
 	intEnvConfig(&conf.TTL, "IMGPROXY_TTL")
+	intEnvConfig(&conf.MaxTTL, "IMGPROXY_MAX_TTL")
 	boolEnvConfig(&conf.CacheControlPassthrough, "IMGPROXY_CACHE_CONTROL_PASSTHROUGH")
+	boolEnvConfig(&conf.CacheControlPassthrough, "IMGPROXY_USE_SOURCE_CACHE_CONTROL")
+	strEnvConfig(&conf.CacheHeadersPrecedence, "IMGPROXY_CACHE_HEADERS_PRECEDENCE")
+	boolEnvConfig(&conf.IgnoreSourceCacheHeaders, "IMGPROXY_IGNORE_SOURCE_CACHE_HEADERS")
 	boolEnvConfig(&conf.SetCanonicalHeader, "IMGPROXY_SET_CANONICAL_HEADER")
 
 	boolEnvConfig(&conf.SoReuseport, "IMGPROXY_SO_REUSEPORT")
 
+	strEnvConfig(&conf.TLSCert, "IMGPROXY_TLS_CERT")
+	strEnvConfig(&conf.TLSKey, "IMGPROXY_TLS_KEY")
+	strEnvConfig(&conf.TLSMinVersion, "IMGPROXY_TLS_MIN_VERSION")
+	strEnvConfig(&conf.TLSRedirectBind, "IMGPROXY_TLS_REDIRECT_BIND")
+
+	boolEnvConfig(&conf.HTTP2Enabled, "IMGPROXY_HTTP2_ENABLED")
+	boolEnvConfig(&conf.HTTP2Cleartext, "IMGPROXY_HTTP2_CLEARTEXT")
+	intEnvConfig(&conf.HTTP2MaxConcurrentStreams, "IMGPROXY_HTTP2_MAX_CONCURRENT_STREAMS")
+
 	strEnvConfig(&conf.PathPrefix, "IMGPROXY_PATH_PREFIX")
 
 	intEnvConfig(&conf.MaxSrcDimension, "IMGPROXY_MAX_SRC_DIMENSION")
 	megaIntEnvConfig(&conf.MaxSrcResolution, "IMGPROXY_MAX_SRC_RESOLUTION")
 	intEnvConfig(&conf.MaxSrcFileSize, "IMGPROXY_MAX_SRC_FILE_SIZE")
 	intEnvConfig(&conf.MaxSvgCheckBytes, "IMGPROXY_MAX_SVG_CHECK_BYTES")
+	floatEnvConfig(&conf.MaxBlurSigma, "IMGPROXY_MAX_BLUR_SIGMA")
 
 	if _, ok := os.LookupEnv("IMGPROXY_MAX_GIF_FRAMES"); ok {
 		logWarning("`IMGPROXY_MAX_GIF_FRAMES` is deprecated and will be removed in future versions. Use `IMGPROXY_MAX_ANIMATION_FRAMES` instead")
@@ -401,31 +740,63 @@ func configure() error {
 	}
 	intEnvConfig(&conf.MaxAnimationFrames, "IMGPROXY_MAX_ANIMATION_FRAMES")
 
+	boolEnvConfig(&conf.DisallowAnimated, "IMGPROXY_DISALLOW_ANIMATED")
+	boolEnvConfig(&conf.DisallowAnimatedUseFirstFrame, "IMGPROXY_DISALLOW_ANIMATED_USE_FIRST_FRAME")
+
 	patternsEnvConfig(&conf.AllowedSources, "IMGPROXY_ALLOWED_SOURCES")
+	boolEnvConfig(&conf.AllowLoopback, "IMGPROXY_ALLOW_LOOPBACK")
+	boolEnvConfig(&conf.AllowPrivateSources, "IMGPROXY_ALLOW_PRIVATE_SOURCES")
 
 	intEnvConfig(&conf.AvifSpeed, "IMGPROXY_AVIF_SPEED")
 	boolEnvConfig(&conf.JpegProgressive, "IMGPROXY_JPEG_PROGRESSIVE")
+	boolEnvConfig(&conf.JpegNoSubsample, "IMGPROXY_JPEG_NO_SUBSAMPLE")
+	boolEnvConfig(&conf.JpegSingleBandGrayscale, "IMGPROXY_JPEG_SINGLE_BAND_GRAYSCALE")
 	boolEnvConfig(&conf.PngInterlaced, "IMGPROXY_PNG_INTERLACED")
 	boolEnvConfig(&conf.PngQuantize, "IMGPROXY_PNG_QUANTIZE")
 	intEnvConfig(&conf.PngQuantizationColors, "IMGPROXY_PNG_QUANTIZATION_COLORS")
+	floatEnvConfig(&conf.GifDither, "IMGPROXY_GIF_DITHER")
+	intEnvConfig(&conf.GifEffort, "IMGPROXY_GIF_EFFORT")
+	intEnvConfig(&conf.GifBitdepth, "IMGPROXY_GIF_BITDEPTH")
+	boolEnvConfig(&conf.WebpLossless, "IMGPROXY_WEBP_LOSSLESS")
+	intEnvConfig(&conf.WebpNearLossless, "IMGPROXY_WEBP_NEAR_LOSSLESS")
 	intEnvConfig(&conf.Quality, "IMGPROXY_QUALITY")
-	formatQualityEnvConfig(conf.FormatQuality, "IMGPROXY_FORMAT_QUALITY")
+	if err := formatQualityEnvConfig(conf.FormatQuality, "IMGPROXY_FORMAT_QUALITY"); err != nil {
+		return err
+	}
+	intEnvConfig(&conf.CompressionProfile, "IMGPROXY_COMPRESSION_PROFILE")
 	intEnvConfig(&conf.GZipCompression, "IMGPROXY_GZIP_COMPRESSION")
+	intEnvConfig(&conf.BrotliCompression, "IMGPROXY_BROTLI_COMPRESSION")
 	boolEnvConfig(&conf.StripMetadata, "IMGPROXY_STRIP_METADATA")
+	boolEnvConfig(&conf.KeepCopyright, "IMGPROXY_KEEP_COPYRIGHT")
 	boolEnvConfig(&conf.StripColorProfile, "IMGPROXY_STRIP_COLOR_PROFILE")
 	boolEnvConfig(&conf.AutoRotate, "IMGPROXY_AUTO_ROTATE")
+	boolEnvConfig(&conf.RawUseEmbeddedPreview, "IMGPROXY_RAW_USE_EMBEDDED_PREVIEW")
+	boolEnvConfig(&conf.RawHalfSize, "IMGPROXY_RAW_HALF_SIZE")
+	intEnvConfig(&conf.RawQuality, "IMGPROXY_RAW_QUALITY")
 
 	boolEnvConfig(&conf.EnableWebpDetection, "IMGPROXY_ENABLE_WEBP_DETECTION")
 	boolEnvConfig(&conf.EnforceWebp, "IMGPROXY_ENFORCE_WEBP")
 	boolEnvConfig(&conf.EnableAvifDetection, "IMGPROXY_ENABLE_AVIF_DETECTION")
 	boolEnvConfig(&conf.EnforceAvif, "IMGPROXY_ENFORCE_AVIF")
+	boolEnvConfig(&conf.EnableFormatDetection, "IMGPROXY_ENABLE_FORMAT_DETECTION")
+	boolEnvConfig(&conf.EnableFormatDetection, "IMGPROXY_AUTO_FORMAT")
 	boolEnvConfig(&conf.EnableClientHints, "IMGPROXY_ENABLE_CLIENT_HINTS")
 
 	imageTypesEnvConfig(&conf.SkipProcessingFormats, "IMGPROXY_SKIP_PROCESSING_FORMATS")
+	boolEnvConfig(&conf.SkipNoopProcessing, "IMGPROXY_SKIP_NOOP_PROCESSING")
 
 	boolEnvConfig(&conf.UseLinearColorspace, "IMGPROXY_USE_LINEAR_COLORSPACE")
+	floatEnvConfig(&conf.LinearColorspaceThreshold, "IMGPROXY_LINEAR_COLORSPACE_THRESHOLD")
 	boolEnvConfig(&conf.DisableShrinkOnLoad, "IMGPROXY_DISABLE_SHRINK_ON_LOAD")
 
+	if err := gravityEnvConfig(&conf.SmartCropFallback, "IMGPROXY_SMART_CROP_FALLBACK"); err != nil {
+		return err
+	}
+
+	boolEnvConfig(&conf.EnableFaceDetection, "IMGPROXY_ENABLE_FACE_DETECTION")
+	strEnvConfig(&conf.FaceDetectionURL, "IMGPROXY_FACE_DETECTION_URL")
+	intEnvConfig(&conf.FaceDetectionTimeout, "IMGPROXY_FACE_DETECTION_TIMEOUT")
+
 	if err := hexEnvConfig(&conf.Keys, "IMGPROXY_KEY"); err != nil {
 		return err
 	}
@@ -443,9 +814,25 @@ func configure() error {
 
 	strEnvConfig(&conf.Secret, "IMGPROXY_SECRET")
 
+	strEnvConfig(&conf.AdminSecret, "IMGPROXY_ADMIN_SECRET")
+	strEnvConfig(&conf.StorageCheckPrefix, "IMGPROXY_STORAGE_CHECK_PREFIX")
+
 	strEnvConfig(&conf.AllowOrigin, "IMGPROXY_ALLOW_ORIGIN")
 
 	strEnvConfig(&conf.UserAgent, "IMGPROXY_USER_AGENT")
+	strSliceEnvConfig(&conf.ForwardHeaders, "IMGPROXY_FORWARD_HEADERS")
+
+	if err := sourceHeadersEnvConfig(&conf.SourceHeaders, "IMGPROXY_SOURCE_HEADERS"); err != nil {
+		return err
+	}
+	if err := sourceHeadersFileConfig(&conf.SourceHeaders, os.Getenv("IMGPROXY_SOURCE_HEADERS_PATH")); err != nil {
+		return err
+	}
+
+	strEnvConfig(&conf.CustomHeadersSeparator, "IMGPROXY_CUSTOM_HEADERS_SEPARATOR")
+	if err := customResponseHeadersEnvConfig(conf.CustomResponseHeaders, "IMGPROXY_CUSTOM_RESPONSE_HEADERS", conf.CustomHeadersSeparator); err != nil {
+		return err
+	}
 
 	boolEnvConfig(&conf.IgnoreSslVerification, "IMGPROXY_IGNORE_SSL_VERIFICATION")
 	boolEnvConfig(&conf.DevelopmentErrorsMode, "IMGPROXY_DEVELOPMENT_ERRORS_MODE")
@@ -455,16 +842,45 @@ func configure() error {
 	boolEnvConfig(&conf.S3Enabled, "IMGPROXY_USE_S3")
 	strEnvConfig(&conf.S3Region, "IMGPROXY_S3_REGION")
 	strEnvConfig(&conf.S3Endpoint, "IMGPROXY_S3_ENDPOINT")
+	strEnvConfig(&conf.S3AssumeRoleArn, "IMGPROXY_S3_ASSUME_ROLE_ARN")
+	strEnvConfig(&conf.S3SSE, "IMGPROXY_S3_SSE")
+	strEnvConfig(&conf.S3SSEKMSKeyID, "IMGPROXY_S3_SSE_KMS_KEY_ID")
+	if err := s3ProfilesEnvConfig(&conf.S3Profiles, "IMGPROXY_S3_PROFILES"); err != nil {
+		return err
+	}
 
 	boolEnvConfig(&conf.GCSEnabled, "IMGPROXY_USE_GCS")
 	strEnvConfig(&conf.GCSKey, "IMGPROXY_GCS_KEY")
+	strEnvConfig(&conf.GCSKeyFile, "IMGPROXY_GCS_KEY_FILE")
+	strEnvConfig(&conf.GCSCheckBucket, "IMGPROXY_GCS_CHECK_BUCKET")
 
 	boolEnvConfig(&conf.ABSEnabled, "IMGPROXY_USE_ABS")
 	strEnvConfig(&conf.ABSName, "IMGPROXY_ABS_NAME")
 	strEnvConfig(&conf.ABSKey, "IMGPROXY_ABS_KEY")
 	strEnvConfig(&conf.ABSEndpoint, "IMGPROXY_ABS_ENDPOINT")
+	strEnvConfig(&conf.ABSClientID, "IMGPROXY_ABS_CLIENT_ID")
+
+	boolEnvConfig(&conf.SwiftEnabled, "IMGPROXY_USE_SWIFT")
+	strEnvConfig(&conf.SwiftUsername, "IMGPROXY_SWIFT_USERNAME")
+	strEnvConfig(&conf.SwiftPassword, "IMGPROXY_SWIFT_PASSWORD")
+	strEnvConfig(&conf.SwiftAuthURL, "IMGPROXY_SWIFT_AUTH_URL")
+	strEnvConfig(&conf.SwiftTenant, "IMGPROXY_SWIFT_TENANT")
+	strEnvConfig(&conf.SwiftDomain, "IMGPROXY_SWIFT_DOMAIN")
+	strEnvConfig(&conf.SwiftRegion, "IMGPROXY_SWIFT_REGION")
+
+	strEnvConfig(&conf.PersistURLTemplate, "IMGPROXY_PERSIST_URL_TEMPLATE")
+
+	strEnvConfig(&conf.CachePath, "IMGPROXY_CACHE_PATH")
+	intEnvConfig(&conf.CacheSizeMB, "IMGPROXY_CACHE_SIZE_MB")
+	intEnvConfig(&conf.CacheTTL, "IMGPROXY_CACHE_TTL")
+
+	strEnvConfig(&conf.RedisURL, "IMGPROXY_REDIS_URL")
+	strEnvConfig(&conf.RedisKeyPrefix, "IMGPROXY_REDIS_KEY_PREFIX")
+	intEnvConfig(&conf.RedisTimeout, "IMGPROXY_REDIS_TIMEOUT")
+	intEnvConfig(&conf.RedisMaxValueSize, "IMGPROXY_REDIS_MAX_VALUE_SIZE")
 
 	boolEnvConfig(&conf.ETagEnabled, "IMGPROXY_USE_ETAG")
+	boolEnvConfig(&conf.ETagFromSource, "IMGPROXY_ETAG_FROM_SOURCE")
 
 	strEnvConfig(&conf.BaseURL, "IMGPROXY_BASE_URL")
 
@@ -476,20 +892,40 @@ func configure() error {
 	}
 	boolEnvConfig(&conf.OnlyPresets, "IMGPROXY_ONLY_PRESETS")
 
+	boolEnvConfig(&conf.EnableQueryOptions, "IMGPROXY_ENABLE_QUERY_OPTIONS")
+
 	strEnvConfig(&conf.WatermarkData, "IMGPROXY_WATERMARK_DATA")
 	strEnvConfig(&conf.WatermarkPath, "IMGPROXY_WATERMARK_PATH")
 	strEnvConfig(&conf.WatermarkURL, "IMGPROXY_WATERMARK_URL")
 	floatEnvConfig(&conf.WatermarkOpacity, "IMGPROXY_WATERMARK_OPACITY")
+	strEnvConfig(&conf.WatermarkFont, "IMGPROXY_WATERMARK_FONT")
+	intEnvConfig(&conf.WatermarkFontSize, "IMGPROXY_WATERMARK_FONT_SIZE")
+	intEnvConfig(&conf.WatermarkTextMaxLength, "IMGPROXY_WATERMARK_TEXT_MAX_LENGTH")
+	strEnvConfig(&conf.WatermarksPath, "IMGPROXY_WATERMARKS")
+	intEnvConfig(&conf.WatermarkMaxMemory, "IMGPROXY_WATERMARK_MAX_MEMORY")
+
+	strEnvConfig(&conf.LutsPath, "IMGPROXY_LUTS_PATH")
 
 	strEnvConfig(&conf.FallbackImageData, "IMGPROXY_FALLBACK_IMAGE_DATA")
 	strEnvConfig(&conf.FallbackImagePath, "IMGPROXY_FALLBACK_IMAGE_PATH")
 	strEnvConfig(&conf.FallbackImageURL, "IMGPROXY_FALLBACK_IMAGE_URL")
+	intEnvConfig(&conf.FallbackImageHTTPCode, "IMGPROXY_FALLBACK_IMAGE_HTTP_CODE")
+
+	boolEnvConfig(&conf.ErrorImage, "IMGPROXY_ERROR_IMAGE")
+	if err := colorEnvConfig(&conf.ErrorImageColor, "IMGPROXY_ERROR_IMAGE_COLOR"); err != nil {
+		return err
+	}
 
 	strEnvConfig(&conf.NewRelicAppName, "IMGPROXY_NEW_RELIC_APP_NAME")
 	strEnvConfig(&conf.NewRelicKey, "IMGPROXY_NEW_RELIC_KEY")
 
 	strEnvConfig(&conf.PrometheusBind, "IMGPROXY_PROMETHEUS_BIND")
 	strEnvConfig(&conf.PrometheusNamespace, "IMGPROXY_PROMETHEUS_NAMESPACE")
+	bucketsEnvConfig(&conf.PrometheusDownloadBuckets, "IMGPROXY_PROMETHEUS_DOWNLOAD_BUCKETS")
+	bucketsEnvConfig(&conf.PrometheusProcessingBuckets, "IMGPROXY_PROMETHEUS_PROCESSING_BUCKETS")
+
+	strEnvConfig(&conf.StatsdAddr, "IMGPROXY_STATSD_ADDR")
+	strEnvConfig(&conf.StatsdPrefix, "IMGPROXY_STATSD_PREFIX")
 
 	strEnvConfig(&conf.BugsnagKey, "IMGPROXY_BUGSNAG_KEY")
 	strEnvConfig(&conf.BugsnagStage, "IMGPROXY_BUGSNAG_STAGE")
@@ -503,6 +939,7 @@ func configure() error {
 	strEnvConfig(&conf.AirbrakeEnv, "IMGPROXY_AIRBRAKE_ENVIRONMENT")
 	boolEnvConfig(&conf.ReportDownloadingErrors, "IMGPROXY_REPORT_DOWNLOADING_ERRORS")
 	boolEnvConfig(&conf.EnableDebugHeaders, "IMGPROXY_ENABLE_DEBUG_HEADERS")
+	boolEnvConfig(&conf.EnableServerTiming, "IMGPROXY_ENABLE_SERVER_TIMING")
 
 	intEnvConfig(&conf.FreeMemoryInterval, "IMGPROXY_FREE_MEMORY_INTERVAL")
 	intEnvConfig(&conf.DownloadBufferSize, "IMGPROXY_DOWNLOAD_BUFFER_SIZE")
@@ -521,6 +958,20 @@ func configure() error {
 		conf.AllowInsecure = true
 	}
 
+	if conf.SmartCropFallback == gravitySmart || conf.SmartCropFallback == gravityFocusPoint || conf.SmartCropFallback == gravityFace {
+		return fmt.Errorf("Smart crop fallback can't be smart, focus point, or face gravity")
+	}
+
+	if conf.EnableFaceDetection {
+		if len(conf.FaceDetectionURL) == 0 {
+			return fmt.Errorf("Face detection URL should be set when face detection is enabled")
+		}
+
+		if conf.FaceDetectionTimeout <= 0 {
+			return fmt.Errorf("Face detection timeout should be greater than 0, now - %d\n", conf.FaceDetectionTimeout)
+		}
+	}
+
 	if conf.SignatureSize < 1 || conf.SignatureSize > 32 {
 		return fmt.Errorf("Signature size should be within 1 and 32, now - %d\n", conf.SignatureSize)
 	}
@@ -529,6 +980,27 @@ func configure() error {
 		return fmt.Errorf("Bind address is not defined")
 	}
 
+	if (len(conf.TLSCert) > 0) != (len(conf.TLSKey) > 0) {
+		return fmt.Errorf("Both TLS certificate and key should be set")
+	}
+
+	if _, ok := tlsVersions[conf.TLSMinVersion]; !ok {
+		return fmt.Errorf("Invalid TLS min version: %s", conf.TLSMinVersion)
+	}
+
+	if len(conf.TLSRedirectBind) > 0 {
+		if len(conf.TLSCert) == 0 {
+			return fmt.Errorf("TLS redirect requires TLS certificate and key to be set")
+		}
+		if conf.TLSRedirectBind == conf.Bind {
+			return fmt.Errorf("Can't use the same binding for the main server and the TLS redirect server")
+		}
+	}
+
+	if conf.HTTP2MaxConcurrentStreams <= 0 {
+		return fmt.Errorf("HTTP/2 max concurrent streams should be greater than 0, now - %d\n", conf.HTTP2MaxConcurrentStreams)
+	}
+
 	if conf.ReadTimeout <= 0 {
 		return fmt.Errorf("Read timeout should be greater than 0, now - %d\n", conf.ReadTimeout)
 	}
@@ -536,6 +1008,36 @@ func configure() error {
 	if conf.WriteTimeout <= 0 {
 		return fmt.Errorf("Write timeout should be greater than 0, now - %d\n", conf.WriteTimeout)
 	}
+
+	if conf.FastRetryTimeout < 0 {
+		return fmt.Errorf("Fast retry timeout should be greater than or equal to 0, now - %d\n", conf.FastRetryTimeout)
+	} else if conf.FastRetryTimeout >= conf.WriteTimeout {
+		return fmt.Errorf("Fast retry timeout should be less than write timeout, now - %d\n", conf.FastRetryTimeout)
+	}
+
+	if conf.ProcessingTimeout < 0 {
+		return fmt.Errorf("Processing timeout should be greater than or equal to 0, now - %d\n", conf.ProcessingTimeout)
+	} else if conf.ProcessingTimeout > 0 && conf.FastRetryTimeout >= conf.ProcessingTimeout {
+		return fmt.Errorf("Fast retry timeout should be less than processing timeout, now - %d\n", conf.FastRetryTimeout)
+	}
+
+	for i, h := range conf.ForwardHeaders {
+		conf.ForwardHeaders[i] = http.CanonicalHeaderKey(h)
+
+		switch conf.ForwardHeaders[i] {
+		case "User-Agent", "Authorization", "Cookie", "Host", "Connection", "Content-Length", "Transfer-Encoding", "Accept-Encoding":
+			return fmt.Errorf("Header %s can't be forwarded", h)
+		}
+	}
+
+	if conf.GracefulShutdownTimeout < 0 {
+		return fmt.Errorf("Graceful shutdown timeout should be greater than or equal to 0, now - %d\n", conf.GracefulShutdownTimeout)
+	}
+
+	if conf.ShutdownDrainDelay < 0 {
+		return fmt.Errorf("Shutdown drain delay should be greater than or equal to 0, now - %d\n", conf.ShutdownDrainDelay)
+	}
+
 	if conf.KeepAliveTimeout < 0 {
 		return fmt.Errorf("KeepAlive timeout should be greater than or equal to 0, now - %d\n", conf.KeepAliveTimeout)
 	}
@@ -544,10 +1046,50 @@ func configure() error {
 		return fmt.Errorf("Download timeout should be greater than 0, now - %d\n", conf.DownloadTimeout)
 	}
 
+	if conf.DownloadRetries < 0 {
+		return fmt.Errorf("Download retries number should be greater than or equal to 0, now - %d\n", conf.DownloadRetries)
+	}
+
+	if conf.AssetsDownloadTimeout < 0 {
+		return fmt.Errorf("Assets download timeout should be greater than or equal to 0, now - %d\n", conf.AssetsDownloadTimeout)
+	}
+
 	if conf.Concurrency <= 0 {
 		return fmt.Errorf("Concurrency should be greater than 0, now - %d\n", conf.Concurrency)
 	}
 
+	if conf.DownloadConcurrency < 0 {
+		return fmt.Errorf("Download concurrency should be greater than or equal to 0, now - %d\n", conf.DownloadConcurrency)
+	}
+
+	if conf.VipsConcurrency <= 0 {
+		return fmt.Errorf("Vips concurrency should be greater than 0, now - %d\n", conf.VipsConcurrency)
+	}
+
+	if conf.DownloadKeepAlive < 0 {
+		return fmt.Errorf("Download keep-alive should be greater than or equal to 0, now - %d\n", conf.DownloadKeepAlive)
+	}
+
+	if conf.MaxIdleConns < 0 {
+		return fmt.Errorf("Max idle connections should be greater than or equal to 0, now - %d\n", conf.MaxIdleConns)
+	} else if conf.MaxIdleConns == 0 {
+		conf.MaxIdleConns = conf.Concurrency
+	}
+
+	if conf.MaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("Max idle connections per host should be greater than or equal to 0, now - %d\n", conf.MaxIdleConnsPerHost)
+	} else if conf.MaxIdleConnsPerHost == 0 {
+		conf.MaxIdleConnsPerHost = conf.Concurrency
+	}
+
+	if conf.MaxConnectionsPerClient < 0 {
+		return fmt.Errorf("Max connections per client should be greater than or equal to 0, now - %d\n", conf.MaxConnectionsPerClient)
+	}
+
+	if conf.MaxHeaderBytes <= 0 {
+		return fmt.Errorf("Max header bytes should be greater than 0, now - %d\n", conf.MaxHeaderBytes)
+	}
+
 	if conf.MaxClients <= 0 {
 		conf.MaxClients = conf.Concurrency * 10
 	}
@@ -556,6 +1098,14 @@ func configure() error {
 		return fmt.Errorf("TTL should be greater than 0, now - %d\n", conf.TTL)
 	}
 
+	if conf.MaxTTL <= 0 {
+		return fmt.Errorf("Max TTL should be greater than 0, now - %d\n", conf.MaxTTL)
+	}
+
+	if conf.CacheHeadersPrecedence != cacheHeadersPrecedenceCacheControl && conf.CacheHeadersPrecedence != cacheHeadersPrecedenceExpires {
+		return fmt.Errorf("Cache headers precedence should be %s or %s, now - %s\n", cacheHeadersPrecedenceCacheControl, cacheHeadersPrecedenceExpires, conf.CacheHeadersPrecedence)
+	}
+
 	if conf.MaxSrcDimension < 0 {
 		return fmt.Errorf("Max src dimension should be greater than or equal to 0, now - %d\n", conf.MaxSrcDimension)
 	} else if conf.MaxSrcDimension > 0 {
@@ -570,6 +1120,10 @@ func configure() error {
 		return fmt.Errorf("Max src file size should be greater than or equal to 0, now - %d\n", conf.MaxSrcFileSize)
 	}
 
+	if conf.MaxBlurSigma <= 0 {
+		return fmt.Errorf("Max blur sigma should be greater than 0, now - %f\n", conf.MaxBlurSigma)
+	}
+
 	if conf.MaxAnimationFrames <= 0 {
 		return fmt.Errorf("Max animation frames should be greater than 0, now - %d\n", conf.MaxAnimationFrames)
 	}
@@ -580,12 +1134,42 @@ func configure() error {
 		return fmt.Errorf("Png quantization colors can't be greater than 256, now - %d\n", conf.PngQuantizationColors)
 	}
 
+	if conf.GifDither < 0 || conf.GifDither > 1 {
+		return fmt.Errorf("GIF dither should be between 0 and 1, now - %f\n", conf.GifDither)
+	}
+
+	if conf.GifEffort < 1 || conf.GifEffort > 10 {
+		return fmt.Errorf("GIF effort should be between 1 and 10, now - %d\n", conf.GifEffort)
+	}
+
+	if conf.GifBitdepth < 1 || conf.GifBitdepth > 8 {
+		return fmt.Errorf("GIF bitdepth should be between 1 and 8, now - %d\n", conf.GifBitdepth)
+	}
+
+	if conf.WebpNearLossless < 0 || conf.WebpNearLossless > 100 {
+		return fmt.Errorf("WebP near-lossless should be between 0 and 100, now - %d\n", conf.WebpNearLossless)
+	}
+
 	if conf.Quality <= 0 {
 		return fmt.Errorf("Quality should be greater than 0, now - %d\n", conf.Quality)
 	} else if conf.Quality > 100 {
 		return fmt.Errorf("Quality can't be greater than 100, now - %d\n", conf.Quality)
 	}
 
+	for imgtype, q := range conf.FormatQuality {
+		if q <= 0 {
+			return fmt.Errorf("Quality for %s should be greater than 0, now - %d\n", imgtype, q)
+		} else if q > 100 {
+			return fmt.Errorf("Quality for %s can't be greater than 100, now - %d\n", imgtype, q)
+		}
+	}
+
+	if conf.CompressionProfile < 0 {
+		return fmt.Errorf("Compression profile should be greater than or equal to 0, now - %d\n", conf.CompressionProfile)
+	} else if conf.CompressionProfile > maxCompressionLevel {
+		return fmt.Errorf("Compression profile can't be greater than %d, now - %d\n", maxCompressionLevel, conf.CompressionProfile)
+	}
+
 	if conf.AvifSpeed <= 0 {
 		return fmt.Errorf("Avif speed should be greater than 0, now - %d\n", conf.AvifSpeed)
 	} else if conf.AvifSpeed > 8 {
@@ -602,6 +1186,32 @@ func configure() error {
 		logWarning("GZip compression is deprecated and can be removed in future versions")
 	}
 
+	if conf.BrotliCompression < 0 {
+		return fmt.Errorf("Brotli compression should be greater than or equal to 0, now - %d\n", conf.BrotliCompression)
+	} else if conf.BrotliCompression > 11 {
+		return fmt.Errorf("Brotli compression can't be greater than 11, now - %d\n", conf.BrotliCompression)
+	}
+
+	if conf.BrotliCompression > 0 && !brotliSupported {
+		return fmt.Errorf("Brotli compression requires imgproxy to be built with the `brotli` build tag")
+	}
+
+	if conf.RawQuality < 0 {
+		return fmt.Errorf("RAW quality should be greater than or equal to 0, now - %d\n", conf.RawQuality)
+	} else if conf.RawQuality > 3 {
+		return fmt.Errorf("RAW quality can't be greater than 3, now - %d\n", conf.RawQuality)
+	}
+
+	if (conf.RawHalfSize || conf.RawQuality != 3) && !librawSupported {
+		return fmt.Errorf("RAW decoding options require imgproxy to be built with the `libraw` build tag")
+	}
+
+	if conf.LinearColorspaceThreshold <= 0 {
+		return fmt.Errorf("Linear colorspace threshold should be greater than 0, now - %f\n", conf.LinearColorspaceThreshold)
+	} else if conf.LinearColorspaceThreshold > 1 {
+		return fmt.Errorf("Linear colorspace threshold can't be greater than 1, now - %f\n", conf.LinearColorspaceThreshold)
+	}
+
 	if conf.IgnoreSslVerification {
 		logWarning("Ignoring SSL verification is very unsafe")
 	}
@@ -622,17 +1232,109 @@ func configure() error {
 		}
 	}
 
+	switch conf.S3SSE {
+	case "", "AES256", "aws:kms":
+	default:
+		return fmt.Errorf("Invalid S3 server-side encryption: %s", conf.S3SSE)
+	}
+
+	if len(conf.S3SSEKMSKeyID) > 0 && conf.S3SSE != "aws:kms" {
+		return fmt.Errorf("IMGPROXY_S3_SSE_KMS_KEY_ID requires IMGPROXY_S3_SSE to be aws:kms")
+	}
+
 	if _, ok := os.LookupEnv("IMGPROXY_USE_GCS"); !ok && len(conf.GCSKey) > 0 {
 		logWarning("Set IMGPROXY_USE_GCS to true since it may be required by future versions to enable GCS support")
 		conf.GCSEnabled = true
 	}
 
+	if conf.SwiftEnabled && (len(conf.SwiftAuthURL) == 0 || len(conf.SwiftUsername) == 0 || len(conf.SwiftTenant) == 0) {
+		return fmt.Errorf("Swift requires IMGPROXY_SWIFT_AUTH_URL, IMGPROXY_SWIFT_USERNAME, and IMGPROXY_SWIFT_TENANT to be set")
+	}
+
+	if len(conf.GCSKey) > 0 && len(conf.GCSKeyFile) > 0 {
+		return fmt.Errorf("Only one of IMGPROXY_GCS_KEY and IMGPROXY_GCS_KEY_FILE can be set")
+	}
+
+	if len(conf.PersistURLTemplate) > 0 {
+		switch {
+		case strings.HasPrefix(conf.PersistURLTemplate, "s3://"):
+			if !conf.S3Enabled {
+				return fmt.Errorf("Persisting to S3 requires IMGPROXY_USE_S3 to be true")
+			}
+		case strings.HasPrefix(conf.PersistURLTemplate, "gs://"):
+			if !conf.GCSEnabled {
+				return fmt.Errorf("Persisting to GCS requires IMGPROXY_USE_GCS to be true")
+			}
+		default:
+			return fmt.Errorf("Persist URL template should start with s3:// or gs://, now - %s\n", conf.PersistURLTemplate)
+		}
+	}
+
+	if conf.CacheSizeMB <= 0 {
+		return fmt.Errorf("Cache size should be greater than 0, now - %d\n", conf.CacheSizeMB)
+	}
+
+	if conf.CacheTTL <= 0 {
+		return fmt.Errorf("Cache TTL should be greater than 0, now - %d\n", conf.CacheTTL)
+	}
+
+	if len(conf.CachePath) > 0 && len(conf.RedisURL) > 0 {
+		return fmt.Errorf("Only one of IMGPROXY_CACHE_PATH and IMGPROXY_REDIS_URL can be set")
+	}
+
+	if conf.RedisTimeout <= 0 {
+		return fmt.Errorf("Redis timeout should be greater than 0, now - %d\n", conf.RedisTimeout)
+	}
+
+	if conf.RedisMaxValueSize <= 0 {
+		return fmt.Errorf("Redis max value size should be greater than 0, now - %d\n", conf.RedisMaxValueSize)
+	}
+
+	if len(conf.StorageCheckPrefix) > 0 {
+		if len(conf.AdminSecret) == 0 {
+			return fmt.Errorf("Storage check requires IMGPROXY_ADMIN_SECRET to be set")
+		}
+
+		switch {
+		case strings.HasPrefix(conf.StorageCheckPrefix, "s3://"):
+			if !conf.S3Enabled {
+				return fmt.Errorf("Checking S3 requires IMGPROXY_USE_S3 to be true")
+			}
+		case strings.HasPrefix(conf.StorageCheckPrefix, "gs://"):
+			if !conf.GCSEnabled {
+				return fmt.Errorf("Checking GCS requires IMGPROXY_USE_GCS to be true")
+			}
+		case strings.HasPrefix(conf.StorageCheckPrefix, "abs://"), strings.HasPrefix(conf.StorageCheckPrefix, "az://"):
+			if !conf.ABSEnabled {
+				return fmt.Errorf("Checking Azure Blob Storage requires IMGPROXY_USE_ABS to be true")
+			}
+		default:
+			return fmt.Errorf("Storage check prefix should start with s3://, gs://, abs://, or az://, now - %s\n", conf.StorageCheckPrefix)
+		}
+	}
+
+	if conf.FallbackImageHTTPCode != 0 && (conf.FallbackImageHTTPCode < 200 || conf.FallbackImageHTTPCode > 599) {
+		return fmt.Errorf("Fallback image HTTP code should be between 200 and 599, now - %d\n", conf.FallbackImageHTTPCode)
+	}
+
 	if conf.WatermarkOpacity <= 0 {
 		return fmt.Errorf("Watermark opacity should be greater than 0")
 	} else if conf.WatermarkOpacity > 1 {
 		return fmt.Errorf("Watermark opacity should be less than or equal to 1")
 	}
 
+	if conf.WatermarkFontSize <= 0 {
+		return fmt.Errorf("Watermark font size should be greater than 0, now - %d\n", conf.WatermarkFontSize)
+	}
+
+	if conf.WatermarkTextMaxLength <= 0 {
+		return fmt.Errorf("Watermark text max length should be greater than 0, now - %d\n", conf.WatermarkTextMaxLength)
+	}
+
+	if conf.WatermarkMaxMemory < 0 {
+		return fmt.Errorf("Watermark max memory should be greater than or equal to 0, now - %d\n", conf.WatermarkMaxMemory)
+	}
+
 	if len(conf.PrometheusBind) > 0 && conf.PrometheusBind == conf.Bind {
 		return fmt.Errorf("Can't use the same binding for the main server and Prometheus")
 	}
@@ -10,6 +10,7 @@ import (
 var (
 	errInvalidSignature         = errors.New("Invalid signature")
 	errInvalidSignatureEncoding = errors.New("Invalid signature encoding")
+	errExpiredURL               = errors.New("Expired URL")
 )
 
 type securityKey []byte
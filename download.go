@@ -1,34 +1,77 @@
 package main
 
 import (
+	"bytes"
 	"compress/gzip"
 	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/imgproxy/imgproxy/v2/imagemeta"
 )
 
+const (
+	cacheHeadersPrecedenceCacheControl = "cache-control"
+	cacheHeadersPrecedenceExpires      = "expires"
+)
+
 var (
 	downloadClient *http.Client
+	// assetsDownloadClient is used to download trusted assets like watermarks
+	// and fallback images
+	assetsDownloadClient *http.Client
 
 	imageDataCtxKey          = ctxKey("imageData")
 	cacheControlHeaderCtxKey = ctxKey("cacheControlHeader")
 	expiresHeaderCtxKey      = ctxKey("expiresHeader")
-
-	errSourceDimensionsTooBig      = newError(422, "Source image dimensions are too big", "Invalid source image")
-	errSourceResolutionTooBig      = newError(422, "Source image resolution is too big", "Invalid source image")
-	errSourceFileTooBig            = newError(422, "Source image file is too big", "Invalid source image")
-	errSourceImageTypeNotSupported = newError(422, "Source image type not supported", "Invalid source image")
+	sourceETagHeaderCtxKey   = ctxKey("sourceETagHeader")
+	frameImageDataCtxKey     = ctxKey("frameImageData")
+
+	errSourceDimensionsTooBig      = newError(422, "Source image dimensions are too big", "Invalid source image").SetCategory("source_dimensions_too_big")
+	errSourceResolutionTooBig      = newError(422, "Source image resolution is too big", "Invalid source image").SetCategory("source_resolution_too_big")
+	errSourceFileTooBig            = newError(422, "Source image file is too big", "Invalid source image").SetCategory("source_file_too_big")
+	errSourceImageTypeNotSupported = newError(422, "Source image type not supported", "Invalid source image").SetCategory("source_type_not_supported")
+
+	errSourceAddressNotAllowed = errors.New("Source address is not allowed")
+	errSourceHeadNotSupported  = errors.New("Source doesn't support HEAD requests")
+
+	// privateNetworks contains RFC1918, CGNAT, link-local, and IPv6 unique local networks
+	privateNetworks = mustParseCIDRs(
+		"10.0.0.0/8",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"100.64.0.0/10",
+		"169.254.0.0/16",
+		"fc00::/7",
+		"fe80::/10",
+	)
 )
 
-const msgSourceImageIsUnreachable = "Source image is unreachable"
+const (
+	msgSourceImageIsUnreachable = "Source image is unreachable"
+	msgSourceNotAllowed         = "Source is not allowed"
+	msgSourceRateLimited        = "Source image is rate limited"
+
+	maxRedirects = 10
+
+	downloadRetryDelay = 100 * time.Millisecond
+
+	// downloadBufMaxInitSize limits the buffer preallocated for the source
+	// image when the file size is not limited
+	downloadBufMaxInitSize = 16 * 1024 * 1024
+
+	dataURIPrefix = "data:"
+)
 
 var downloadBufPool *bufPool
 
@@ -38,38 +81,122 @@ type limitReader struct {
 }
 
 func (lr *limitReader) Read(p []byte) (n int, err error) {
+	if lr.left < 0 {
+		return 0, errSourceFileTooBig
+	}
+
+	// Read at most one byte over the limit so we can abort the download
+	// right after the limit is exceeded without reading the rest of the body
+	if len(p) > lr.left+1 {
+		p = p[:lr.left+1]
+	}
+
 	n, err = lr.r.Read(p)
 	lr.left -= n
 
-	if err == nil && lr.left < 0 {
+	if lr.left < 0 {
 		err = errSourceFileTooBig
 	}
 
 	return
 }
 
-func initDownloading() error {
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+
+	return nets
+}
+
+func isPrivateIP(ip net.IP) bool {
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// verifySourceAddress is used as a dialer control function.
+// It's called after the host is resolved, so it can't be bypassed with DNS rebinding
+func verifySourceAddress(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errSourceAddressNotAllowed
+	}
+
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		if !conf.AllowLoopback {
+			return errSourceAddressNotAllowed
+		}
+	} else if isPrivateIP(ip) && !conf.AllowPrivateSources {
+		return errSourceAddressNotAllowed
+	}
+
+	return nil
+}
+
+func newHTTPTransport(dialer *net.Dialer) *http.Transport {
 	transport := &http.Transport{
 		Proxy:               http.ProxyFromEnvironment,
-		MaxIdleConns:        conf.Concurrency,
-		MaxIdleConnsPerHost: conf.Concurrency,
+		MaxIdleConns:        conf.MaxIdleConns,
+		MaxIdleConnsPerHost: conf.MaxIdleConnsPerHost,
 		DisableCompression:  true,
-		DialContext:         (&net.Dialer{KeepAlive: 600 * time.Second}).DialContext,
+		DialContext:         dialer.DialContext,
+	}
+
+	if conf.DownloadKeepAlive > 0 {
+		keepAlive := time.Duration(conf.DownloadKeepAlive) * time.Second
+
+		dialer.KeepAlive = keepAlive
+		transport.IdleConnTimeout = keepAlive
+	} else {
+		// Some sources reset reused connections, so keep-alive can be disabled entirely
+		dialer.KeepAlive = -1
+		transport.DisableKeepAlives = true
 	}
 
 	if conf.IgnoreSslVerification {
 		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	}
 
+	return transport
+}
+
+func initDownloading() error {
+	transport := newHTTPTransport(&net.Dialer{Control: verifySourceAddress})
+
+	// Assets are trusted, so they can be downloaded from private networks
+	assetsTransport := newHTTPTransport(&net.Dialer{})
+
+	registerProtocol := func(scheme string, rt http.RoundTripper) {
+		transport.RegisterProtocol(scheme, rt)
+		assetsTransport.RegisterProtocol(scheme, rt)
+	}
+
 	if conf.LocalFileSystemRoot != "" {
-		transport.RegisterProtocol("local", newFsTransport())
+		registerProtocol("local", newFsTransport())
 	}
 
 	if conf.S3Enabled {
 		if t, err := newS3Transport(); err != nil {
 			return err
 		} else {
-			transport.RegisterProtocol("s3", t)
+			registerProtocol("s3", t)
+			registerStorageLister("s3", t)
 		}
 	}
 
@@ -77,7 +204,8 @@ func initDownloading() error {
 		if t, err := newGCSTransport(); err != nil {
 			return err
 		} else {
-			transport.RegisterProtocol("gs", t)
+			registerProtocol("gs", t)
+			registerStorageLister("gs", t)
 		}
 	}
 
@@ -85,13 +213,41 @@ func initDownloading() error {
 		if t, err := newAzureTransport(); err != nil {
 			return err
 		} else {
-			transport.RegisterProtocol("abs", t)
+			registerProtocol("abs", t)
+			registerProtocol("az", t)
+			registerStorageLister("abs", t)
+			registerStorageLister("az", t)
+		}
+	}
+
+	if conf.SwiftEnabled {
+		if t, err := newSwiftTransport(); err != nil {
+			return err
+		} else {
+			registerProtocol("swift", t)
 		}
 	}
 
 	downloadClient = &http.Client{
 		Timeout:   time.Duration(conf.DownloadTimeout) * time.Second,
-		Transport: transport,
+		Transport: newSourceHeadersTransport(transport, conf.SourceHeaders),
+		// Redirect targets should pass the same checks as the source URL
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("Stopped after %d redirects", maxRedirects)
+			}
+			return checkSourceURL(req.URL.String())
+		},
+	}
+
+	assetsDownloadTimeout := conf.AssetsDownloadTimeout
+	if assetsDownloadTimeout == 0 {
+		assetsDownloadTimeout = conf.DownloadTimeout
+	}
+
+	assetsDownloadClient = &http.Client{
+		Timeout:   time.Duration(assetsDownloadTimeout) * time.Second,
+		Transport: assetsTransport,
 	}
 
 	downloadBufPool = newBufPool("download", conf.Concurrency, conf.DownloadBufferSize)
@@ -129,6 +285,9 @@ func checkTypeAndDimensions(r io.Reader) (imageType, error) {
 	if err == imagemeta.ErrFormat {
 		return imageTypeUnknown, errSourceImageTypeNotSupported
 	}
+	if err == errSourceFileTooBig {
+		return imageTypeUnknown, err
+	}
 	if err != nil {
 		return imageTypeUnknown, newUnexpectedError(checkTimeoutErr(err).Error(), 0)
 	}
@@ -146,10 +305,19 @@ func checkTypeAndDimensions(r io.Reader) (imageType, error) {
 }
 
 func readAndCheckImage(r io.Reader, contentLength int) (*imageData, error) {
+	// Content-Length is declared by the source, so we reject it before
+	// allocating the buffer. This way the initial allocation never exceeds
+	// the allowed file size, and limitReader guards the actual body size
 	if conf.MaxSrcFileSize > 0 && contentLength > conf.MaxSrcFileSize {
 		return nil, errSourceFileTooBig
 	}
 
+	// When the file size is not limited, we can't trust Content-Length at all,
+	// so the buffer is preallocated partially and grows while the body is read
+	if conf.MaxSrcFileSize == 0 {
+		contentLength = minInt(contentLength, downloadBufMaxInitSize)
+	}
+
 	buf := downloadBufPool.Get(contentLength)
 	cancel := func() { downloadBufPool.Put(buf) }
 
@@ -165,47 +333,232 @@ func readAndCheckImage(r io.Reader, contentLength int) (*imageData, error) {
 
 	if _, err = buf.ReadFrom(r); err != nil {
 		cancel()
-		return nil, newError(404, checkTimeoutErr(err).Error(), msgSourceImageIsUnreachable)
+
+		if err == errSourceFileTooBig {
+			return nil, err
+		}
+
+		return nil, newError(404, checkTimeoutErr(err).Error(), msgSourceImageIsUnreachable).SetCategory("source_unreachable")
 	}
 
 	return &imageData{buf.Bytes(), imgtype, cancel}, nil
 }
 
-func requestImage(imageURL string) (*http.Response, error) {
-	req, err := http.NewRequest("GET", imageURL, nil)
+// forwardedHeaders picks the headers allowed by IMGPROXY_FORWARD_HEADERS
+// from the incoming request headers
+func forwardedHeaders(header http.Header) http.Header {
+	if len(conf.ForwardHeaders) == 0 || header == nil {
+		return nil
+	}
+
+	fwd := make(http.Header)
+
+	for _, name := range conf.ForwardHeaders {
+		if values, ok := header[name]; ok {
+			fwd[name] = values
+		}
+	}
+
+	return fwd
+}
+
+func requestImage(client *http.Client, imageURL string, header http.Header) (*http.Response, error) {
+	return requestImageWithMethod(client, "GET", imageURL, header)
+}
+
+func requestImageWithMethod(client *http.Client, method, imageURL string, header http.Header) (*http.Response, error) {
+	// Retries share the client timeout, so they can't extend the total download time
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if client.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, client.Timeout)
+	}
+
+	for attempt := 0; ; attempt++ {
+		res, retry, err := doRequestImage(ctx, client, method, imageURL, header)
+
+		delay := downloadRetryDelay * time.Duration(1<<uint(attempt))
+
+		if retry && attempt < conf.DownloadRetries && hasTimeFor(ctx, delay) {
+			if res != nil {
+				res.Body.Close()
+			}
+
+			logWarning("Retrying the image request in %s (attempt %d of %d): %s", delay, attempt+1, conf.DownloadRetries, err)
+			incrementDownloadRetriesTotal()
+
+			time.Sleep(delay)
+			continue
+		}
+
+		if res == nil {
+			cancel()
+			return res, err
+		}
+
+		// The body is read after we return, so the context is canceled
+		// when the body is closed
+		res.Body = &cancelOnCloseBody{ReadCloser: res.Body, cancel: cancel}
+
+		return res, err
+	}
+}
+
+// doRequestImage makes a single image request. It also reports whether
+// the request failed because of a transient error and can be retried
+func doRequestImage(ctx context.Context, client *http.Client, method, imageURL string, header http.Header) (*http.Response, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, method, imageURL, nil)
 	if err != nil {
-		return nil, newError(404, err.Error(), msgSourceImageIsUnreachable).SetUnexpected(conf.ReportDownloadingErrors)
+		return nil, false, newError(404, err.Error(), msgSourceImageIsUnreachable).SetCategory("source_unreachable").SetUnexpected(conf.ReportDownloadingErrors)
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
 	}
 
+	// Forwarded headers should never override our own ones
 	req.Header.Set("User-Agent", conf.UserAgent)
 
-	res, err := downloadClient.Do(req)
+	res, err := client.Do(req)
 	if err != nil {
-		return res, newError(404, checkTimeoutErr(err).Error(), msgSourceImageIsUnreachable).SetUnexpected(conf.ReportDownloadingErrors)
+		if errors.Is(err, errSourceAddressNotAllowed) {
+			return res, false, newError(403, err.Error(), msgSourceNotAllowed).SetCategory("source_not_allowed")
+		}
+
+		if uerr, ok := err.(*url.Error); ok {
+			if ierr, ok := uerr.Err.(*imgproxyError); ok {
+				return res, false, ierr
+			}
+		}
+
+		// Connection errors are transient, but there is no point in retrying
+		// when the timeout is exceeded
+		retry := ctx.Err() == nil
+
+		return res, retry, newError(404, checkTimeoutErr(err).Error(), msgSourceImageIsUnreachable).SetCategory("source_unreachable").SetUnexpected(conf.ReportDownloadingErrors)
+	}
+
+	// Rate limiting is not a bug, so it's not reported as unexpected error.
+	// The request is not retried either since the source asked us to wait
+	if res.StatusCode == 429 || (res.StatusCode == 503 && len(res.Header.Get("Retry-After")) > 0) {
+		msg := fmt.Sprintf("Source is rate limited; Status: %d; Retry-After: %s", res.StatusCode, res.Header.Get("Retry-After"))
+		return res, false, newError(429, msg, msgSourceRateLimited).SetCategory("source_rate_limited").SetRetryAfter(res.Header.Get("Retry-After"))
 	}
 
 	if res.StatusCode != 200 {
 		body, _ := ioutil.ReadAll(res.Body)
 		msg := fmt.Sprintf("Can't download image; Status: %d; %s", res.StatusCode, string(body))
-		return res, newError(404, msg, msgSourceImageIsUnreachable).SetUnexpected(conf.ReportDownloadingErrors)
+		return res, res.StatusCode >= 500, newError(404, msg, msgSourceImageIsUnreachable).SetCategory("source_unreachable").SetUnexpected(conf.ReportDownloadingErrors)
 	}
 
-	return res, nil
+	return res, false, nil
 }
 
-func downloadImage(ctx context.Context) (context.Context, context.CancelFunc, error) {
+// hasTimeFor checks if the context deadline allows to wait for the delay
+// and make one more request
+func hasTimeFor(ctx context.Context, delay time.Duration) bool {
+	deadline, ok := ctx.Deadline()
+	return !ok || time.Until(deadline) > delay
+}
+
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnCloseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// checkSourceURL checks if the source URL is allowed by IMGPROXY_ALLOWED_SOURCES
+// and doesn't point to a loopback address
+func checkSourceURL(imageURL string) error {
+	if !isAllowedSource(imageURL) {
+		return newError(403, fmt.Sprintf("Source URL is not allowed: %s", imageURL), msgSourceNotAllowed).SetCategory("source_not_allowed")
+	}
+
+	if !conf.AllowLoopback && isLoopbackURL(imageURL) {
+		return newError(403, fmt.Sprintf("Source URL points to a loopback address: %s", imageURL), msgSourceNotAllowed).SetCategory("source_not_allowed")
+	}
+
+	return nil
+}
+
+func isLoopbackURL(imageURL string) bool {
+	u, err := url.Parse(imageURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback() || ip.IsUnspecified()
+	}
+
+	return false
+}
+
+// dataURIImageData decodes the image from the data URI
+// of the form data:[<mediatype>][;base64],<data>
+func dataURIImageData(imageURL string) (*imageData, error) {
+	comma := strings.IndexByte(imageURL, ',')
+	if comma < 0 {
+		return nil, newError(422, "Invalid data URI: data is missing", "Invalid source image").SetCategory("invalid_data_uri")
+	}
+
+	header := imageURL[len(dataURIPrefix):comma]
+	payload := imageURL[comma+1:]
+
+	var (
+		data []byte
+		err  error
+	)
+
+	if strings.HasSuffix(header, ";base64") {
+		// Accept both standard and URL-safe alphabets with or without padding
+		payload = strings.NewReplacer("-", "+", "_", "/").Replace(strings.TrimRight(payload, "="))
+		data, err = base64.RawStdEncoding.DecodeString(payload)
+	} else {
+		var unescaped string
+		unescaped, err = url.PathUnescape(payload)
+		data = []byte(unescaped)
+	}
+
+	if err != nil {
+		return nil, newError(422, fmt.Sprintf("Can't decode data URI: %s", err), "Invalid source image").SetCategory("invalid_data_uri")
+	}
+
+	return readAndCheckImage(bytes.NewReader(data), len(data))
+}
+
+func downloadImage(ctx context.Context, header http.Header) (context.Context, context.CancelFunc, error) {
 	imageURL := getImageURL(ctx)
 
+	if strings.HasPrefix(imageURL, dataURIPrefix) {
+		imgdata, err := dataURIImageData(imageURL)
+		if err != nil {
+			return ctx, func() {}, err
+		}
+
+		ctx = context.WithValue(ctx, imageDataCtxKey, imgdata)
+
+		return ctx, imgdata.Close, nil
+	}
+
 	if newRelicEnabled {
 		newRelicCancel := startNewRelicSegment(ctx, "Downloading image")
 		defer newRelicCancel()
 	}
 
-	if prometheusEnabled {
-		defer startPrometheusDuration(prometheusDownloadDuration)()
-	}
+	defer startDownloadDuration()()
 
-	res, err := requestImage(imageURL)
+	res, err := requestImage(downloadClient, imageURL, forwardedHeaders(header))
 	if res != nil {
 		defer res.Body.Close()
 	}
@@ -234,16 +587,121 @@ func downloadImage(ctx context.Context) (context.Context, context.CancelFunc, er
 	}
 
 	ctx = context.WithValue(ctx, imageDataCtxKey, imgdata)
-	ctx = context.WithValue(ctx, cacheControlHeaderCtxKey, res.Header.Get("Cache-Control"))
-	ctx = context.WithValue(ctx, expiresHeaderCtxKey, res.Header.Get("Expires"))
+	ctx = withSourceHeaders(ctx, res.Header)
 
 	return ctx, imgdata.Close, err
 }
 
+// fetchSourceHeaders requests the source image headers without downloading its body.
+// Only HTTP(S) sources are requested since other transports may not support HEAD requests
+func fetchSourceHeaders(ctx context.Context, header http.Header) (context.Context, error) {
+	imageURL := getImageURL(ctx)
+
+	if !strings.HasPrefix(imageURL, "http://") && !strings.HasPrefix(imageURL, "https://") {
+		return ctx, errSourceHeadNotSupported
+	}
+
+	res, err := requestImageWithMethod(downloadClient, "HEAD", imageURL, forwardedHeaders(header))
+	if res != nil {
+		res.Body.Close()
+	}
+	if err != nil {
+		return ctx, err
+	}
+
+	return withSourceHeaders(ctx, res.Header), nil
+}
+
+func withSourceHeaders(ctx context.Context, header http.Header) context.Context {
+	ctx = context.WithValue(ctx, cacheControlHeaderCtxKey, header.Get("Cache-Control"))
+	ctx = context.WithValue(ctx, expiresHeaderCtxKey, header.Get("Expires"))
+	ctx = context.WithValue(ctx, sourceETagHeaderCtxKey, header.Get("ETag"))
+	return ctx
+}
+
+// downloadFrameImage downloads the image requested with the frame_url option
+func downloadFrameImage(ctx context.Context) (context.Context, context.CancelFunc, error) {
+	frameURL := getProcessingOptions(ctx).FrameURL
+
+	res, err := requestImage(downloadClient, frameURL, nil)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return ctx, func() {}, err
+	}
+
+	imgdata, err := readAndCheckImage(res.Body, int(res.ContentLength))
+	if err != nil {
+		return ctx, func() {}, err
+	}
+
+	ctx = context.WithValue(ctx, frameImageDataCtxKey, imgdata)
+
+	return ctx, imgdata.Close, nil
+}
+
 func getImageData(ctx context.Context) *imageData {
 	return ctx.Value(imageDataCtxKey).(*imageData)
 }
 
+func getFrameImageData(ctx context.Context) *imageData {
+	return ctx.Value(frameImageDataCtxKey).(*imageData)
+}
+
+// sourceCacheHeaders returns the source Cache-Control and Expires headers
+// resolved according to IMGPROXY_CACHE_HEADERS_PRECEDENCE.
+// When Expires takes precedence, the source Cache-Control max-age is replaced with
+// the one calculated from Expires so downstream caches don't prefer the source max-age.
+// Directives restricting caching like private or no-store are kept
+func sourceCacheHeaders(ctx context.Context) (cacheControl, expires string) {
+	if conf.IgnoreSourceCacheHeaders {
+		return "", ""
+	}
+
+	cacheControl = getCacheControlHeader(ctx)
+	expires = getExpiresHeader(ctx)
+
+	if conf.CacheHeadersPrecedence == cacheHeadersPrecedenceExpires && len(expires) > 0 {
+		// Invalid Expires means that the response is already expired
+		maxAge := 0
+		if t, err := http.ParseTime(expires); err == nil {
+			maxAge = maxInt(0, int(time.Until(t)/time.Second))
+		}
+
+		cacheControl = replaceMaxAge(cacheControl, maxAge)
+	}
+
+	return
+}
+
+func replaceMaxAge(cacheControl string, maxAge int) string {
+	directives := make([]string, 0, 4)
+	restricted := false
+
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+		name := strings.ToLower(strings.SplitN(directive, "=", 2)[0])
+
+		switch name {
+		case "", "max-age", "s-maxage", "public":
+			continue
+		case "private", "no-store", "no-cache":
+			restricted = true
+		}
+
+		directives = append(directives, directive)
+	}
+
+	directives = append(directives, fmt.Sprintf("max-age=%d", maxAge))
+
+	if !restricted {
+		directives = append(directives, "public")
+	}
+
+	return strings.Join(directives, ", ")
+}
+
 func getCacheControlHeader(ctx context.Context) string {
 	str, _ := ctx.Value(cacheControlHeaderCtxKey).(string)
 	return str
@@ -253,3 +711,13 @@ func getExpiresHeader(ctx context.Context) string {
 	str, _ := ctx.Value(expiresHeaderCtxKey).(string)
 	return str
 }
+
+// getSourceETag returns the source ETag if it's a strong one.
+// Weak ETags don't guarantee byte-for-byte equality, so they can't be used to derive our ETag
+func getSourceETag(ctx context.Context) string {
+	str, _ := ctx.Value(sourceETagHeaderCtxKey).(string)
+	if strings.HasPrefix(str, "W/") {
+		return ""
+	}
+	return str
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type DownloadTestSuite struct{ MainTestSuite }
+
+// startServer starts the source server that responds with the provided status codes
+// one by one. The last status code is used for the rest of the requests
+func (s *DownloadTestSuite) startServer(requests *int32, statuses ...int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(requests, 1))
+
+		status := statuses[minInt(n, len(statuses))-1]
+
+		rw.WriteHeader(status)
+		rw.Write([]byte("body"))
+	}))
+}
+
+func (s *DownloadTestSuite) request(url string, timeout time.Duration) (*http.Response, error) {
+	res, err := requestImage(&http.Client{Timeout: timeout}, url, nil)
+	if res != nil {
+		res.Body.Close()
+	}
+
+	return res, err
+}
+
+func (s *DownloadTestSuite) TestRetryOn5xx() {
+	conf.DownloadRetries = 2
+
+	var requests int32
+
+	server := s.startServer(&requests, 500, 502, 200)
+	defer server.Close()
+
+	res, err := s.request(server.URL, 5*time.Second)
+
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), 200, res.StatusCode)
+	assert.Equal(s.T(), int32(3), atomic.LoadInt32(&requests))
+}
+
+func (s *DownloadTestSuite) TestRetryLimit() {
+	conf.DownloadRetries = 2
+
+	var requests int32
+
+	server := s.startServer(&requests, 500)
+	defer server.Close()
+
+	_, err := s.request(server.URL, 5*time.Second)
+
+	require.NotNil(s.T(), err)
+	assert.Equal(s.T(), 404, err.(*imgproxyError).StatusCode)
+	assert.Equal(s.T(), int32(3), atomic.LoadInt32(&requests))
+}
+
+func (s *DownloadTestSuite) TestNoRetryOn4xx() {
+	conf.DownloadRetries = 2
+
+	var requests int32
+
+	server := s.startServer(&requests, 404)
+	defer server.Close()
+
+	_, err := s.request(server.URL, 5*time.Second)
+
+	require.NotNil(s.T(), err)
+	assert.Equal(s.T(), int32(1), atomic.LoadInt32(&requests))
+}
+
+func (s *DownloadTestSuite) TestRetryStopsAtDownloadTimeout() {
+	conf.DownloadRetries = 10
+
+	var requests int32
+
+	server := s.startServer(&requests, 500)
+	defer server.Close()
+
+	start := time.Now()
+
+	// The first retry is made after 100ms, and the second one would be made
+	// after 200ms more, which exceeds the timeout
+	_, err := s.request(server.URL, 250*time.Millisecond)
+
+	require.NotNil(s.T(), err)
+	assert.Equal(s.T(), int32(2), atomic.LoadInt32(&requests))
+	assert.Less(s.T(), int64(time.Since(start)), int64(250*time.Millisecond))
+}
+
+// startRateLimitedServer starts the source server that responds with the provided
+// status code and Retry-After header
+func (s *DownloadTestSuite) startRateLimitedServer(requests *int32, status int, retryAfter string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+
+		if len(retryAfter) > 0 {
+			rw.Header().Set("Retry-After", retryAfter)
+		}
+
+		rw.WriteHeader(status)
+	}))
+}
+
+func (s *DownloadTestSuite) TestRateLimited() {
+	conf.DownloadRetries = 2
+
+	var requests int32
+
+	server := s.startRateLimitedServer(&requests, 429, "120")
+	defer server.Close()
+
+	_, err := s.request(server.URL, 5*time.Second)
+
+	require.NotNil(s.T(), err)
+
+	ierr := err.(*imgproxyError)
+	assert.Equal(s.T(), 429, ierr.StatusCode)
+	assert.Equal(s.T(), "source_rate_limited", ierr.Category())
+	assert.Equal(s.T(), "120", ierr.RetryAfter)
+	assert.False(s.T(), ierr.Unexpected)
+
+	// The source asked us to wait, so the request is not retried
+	assert.Equal(s.T(), int32(1), atomic.LoadInt32(&requests))
+}
+
+func (s *DownloadTestSuite) TestUnavailableWithRetryAfter() {
+	conf.DownloadRetries = 2
+
+	var requests int32
+
+	server := s.startRateLimitedServer(&requests, 503, "120")
+	defer server.Close()
+
+	_, err := s.request(server.URL, 5*time.Second)
+
+	require.NotNil(s.T(), err)
+
+	ierr := err.(*imgproxyError)
+	assert.Equal(s.T(), 429, ierr.StatusCode)
+	assert.Equal(s.T(), "source_rate_limited", ierr.Category())
+	assert.Equal(s.T(), "120", ierr.RetryAfter)
+	assert.Equal(s.T(), int32(1), atomic.LoadInt32(&requests))
+}
+
+func (s *DownloadTestSuite) TestUnavailableWithoutRetryAfter() {
+	conf.DownloadRetries = 2
+
+	var requests int32
+
+	server := s.startRateLimitedServer(&requests, 503, "")
+	defer server.Close()
+
+	_, err := s.request(server.URL, 5*time.Second)
+
+	require.NotNil(s.T(), err)
+
+	ierr := err.(*imgproxyError)
+	assert.Equal(s.T(), 404, ierr.StatusCode)
+	assert.Equal(s.T(), "source_unreachable", ierr.Category())
+	assert.Empty(s.T(), ierr.RetryAfter)
+
+	// 503 without Retry-After is a transient error
+	assert.Equal(s.T(), int32(3), atomic.LoadInt32(&requests))
+}
+
+func (s *DownloadTestSuite) TestRetryAfterResponseHeader() {
+	conf.ErrorImage = false
+
+	var requests int32
+
+	server := s.startRateLimitedServer(&requests, 429, "120")
+	defer server.Close()
+
+	_, err := s.request(server.URL, 5*time.Second)
+	require.NotNil(s.T(), err)
+
+	req := httptest.NewRequest(http.MethodGet, "/unsafe/plain/http://images.dev/lorem/ipsum.jpg", nil)
+	req = req.WithContext(setTimerSince(req.Context()))
+
+	rw := httptest.NewRecorder()
+	handlePanic("test-request-id", rw, req, err)
+
+	assert.Equal(s.T(), 429, rw.Code)
+	assert.Equal(s.T(), "120", rw.Header().Get("Retry-After"))
+}
+
+func (s *DownloadTestSuite) getPngData() []byte {
+	buf := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 10, 10))))
+
+	return buf.Bytes()
+}
+
+func (s *DownloadTestSuite) TestReadImageUntrustedContentLength() {
+	conf.MaxSrcFileSize = 0
+
+	data := s.getPngData()
+
+	// Content-Length is not trusted when the file size is not limited,
+	// so the huge declared size doesn't cause a huge allocation
+	imgdata, err := readAndCheckImage(bytes.NewReader(data), 1<<40)
+	require.Nil(s.T(), err)
+	defer imgdata.Close()
+
+	assert.Equal(s.T(), imageTypePNG, imgdata.Type)
+	assert.Equal(s.T(), data, imgdata.Data)
+}
+
+func (s *DownloadTestSuite) TestReadImageTooBigContentLength() {
+	data := s.getPngData()
+
+	conf.MaxSrcFileSize = len(data) - 1
+
+	_, err := readAndCheckImage(bytes.NewReader(data), len(data))
+
+	assert.Equal(s.T(), errSourceFileTooBig, err)
+}
+
+func (s *DownloadTestSuite) TestReadImageTooBigBody() {
+	data := s.getPngData()
+
+	conf.MaxSrcFileSize = len(data) - 1
+
+	// The source may declare no Content-Length or a wrong one
+	_, err := readAndCheckImage(bytes.NewReader(data), 0)
+
+	assert.Equal(s.T(), errSourceFileTooBig, err)
+	assert.Equal(s.T(), 422, err.(*imgproxyError).StatusCode)
+}
+
+func (s *DownloadTestSuite) TestDataURIBase64() {
+	data := s.getPngData()
+
+	imgdata, err := dataURIImageData("data:image/png;base64," + base64.StdEncoding.EncodeToString(data))
+	require.Nil(s.T(), err)
+	defer imgdata.Close()
+
+	assert.Equal(s.T(), imageTypePNG, imgdata.Type)
+	assert.Equal(s.T(), data, imgdata.Data)
+}
+
+func (s *DownloadTestSuite) TestDataURIBase64URLSafe() {
+	data := s.getPngData()
+
+	imgdata, err := dataURIImageData("data:;base64," + base64.RawURLEncoding.EncodeToString(data))
+	require.Nil(s.T(), err)
+	defer imgdata.Close()
+
+	assert.Equal(s.T(), imageTypePNG, imgdata.Type)
+	assert.Equal(s.T(), data, imgdata.Data)
+}
+
+func (s *DownloadTestSuite) TestDataURIPercentEncoded() {
+	data := s.getPngData()
+
+	imgdata, err := dataURIImageData("data:image/png," + url.PathEscape(string(data)))
+	require.Nil(s.T(), err)
+	defer imgdata.Close()
+
+	assert.Equal(s.T(), imageTypePNG, imgdata.Type)
+	assert.Equal(s.T(), data, imgdata.Data)
+}
+
+func (s *DownloadTestSuite) TestDataURIInvalid() {
+	uris := []string{
+		"data:image/png;base64",
+		"data:image/png;base64,!!!",
+		"data:image/png,%zz",
+		"data:text/plain,hello",
+	}
+
+	for _, uri := range uris {
+		_, err := dataURIImageData(uri)
+		require.NotNil(s.T(), err, uri)
+
+		assert.Equal(s.T(), 422, err.(*imgproxyError).StatusCode, uri)
+	}
+}
+
+func (s *DownloadTestSuite) TestDownloadImageDataURI() {
+	data := s.getPngData()
+
+	ctx := context.WithValue(context.Background(), imageURLCtxKey, "data:image/png;base64,"+base64.StdEncoding.EncodeToString(data))
+
+	ctx, cancel, err := downloadImage(ctx, http.Header{})
+	require.Nil(s.T(), err)
+	defer cancel()
+
+	imgdata := getImageData(ctx)
+	assert.Equal(s.T(), imageTypePNG, imgdata.Type)
+	assert.Equal(s.T(), data, imgdata.Data)
+}
+
+func TestDownload(t *testing.T) {
+	suite.Run(t, new(DownloadTestSuite))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+)
+
+// errorImageMaxResolution limits the placeholder size. Error responses
+// don't require downloading anything, so the limit protects from
+// load amplification with requests that are meant to fail
+const errorImageMaxResolution = 4 * 1024 * 1024
+
+// respondWithErrorImage responds with a solid color placeholder
+// of the requested dimensions and format instead of the error message.
+// Returns false if the placeholder can't be generated, e.g. when the URL
+// can't be parsed, the requested dimensions are unknown or too large,
+// or all the processing slots are busy
+func respondWithErrorImage(rw http.ResponseWriter, r *http.Request, ierr *imgproxyError) bool {
+	ctx, err := parsePath(r.Context(), r)
+	if err != nil {
+		return false
+	}
+
+	po := getProcessingOptions(ctx)
+
+	width, height := errorImageSize(po)
+	if width == 0 || height == 0 || width*height > minInt(conf.MaxSrcResolution, errorImageMaxResolution) {
+		return false
+	}
+
+	if po.Format == imageTypeUnknown || po.Format == imageTypeSVG || !imageTypeSaveSupport(po.Format) {
+		po.Format = imageTypePNG
+	}
+
+	// Placeholders are generated within the processing concurrency limit.
+	// We don't wait for a free slot since it's not worth delaying the error response
+	releaseProcessingSem, ok := tryAcquireProcessingSem()
+	if !ok {
+		return false
+	}
+	defer releaseProcessingSem()
+
+	data, cancel, err := generateErrorImage(ctx, width, height)
+	if err != nil {
+		logWarning("Can't generate error image: %s", err)
+		return false
+	}
+	defer cancel()
+
+	rw.Header().Set("Content-Type", po.Format.Mime())
+	rw.Header().Set("Cache-Control", "no-cache")
+
+	setCustomResponseHeaders(rw)
+
+	rw.WriteHeader(ierr.StatusCode)
+	rw.Write(data)
+
+	return true
+}
+
+// errorImageSize calculates the placeholder size.
+// When only one dimension is requested, the placeholder is square
+func errorImageSize(po *processingOptions) (int, int) {
+	width, height := po.Width, po.Height
+
+	if width == 0 {
+		width = height
+	}
+	if height == 0 {
+		height = width
+	}
+
+	return scaleInt(width, po.Dpr), scaleInt(height, po.Dpr)
+}
+
+func generateErrorImage(ctx context.Context, width, height int) ([]byte, context.CancelFunc, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	defer vipsCleanup()
+
+	po := getProcessingOptions(ctx)
+
+	img := new(vipsImage)
+	defer img.Clear()
+
+	if err := img.Solid(width, height, conf.ErrorImageColor); err != nil {
+		return nil, func() {}, err
+	}
+
+	return img.Save(po.Format, po.getQuality(), po.getSaveOptions())
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type ErrorImageTestSuite struct {
+	MainTestSuite
+
+	oldProcessingSem chan struct{}
+}
+
+func (s *ErrorImageTestSuite) SetupTest() {
+	s.MainTestSuite.SetupTest()
+
+	s.oldProcessingSem = processingSem
+	processingSem = make(chan struct{}, 1)
+}
+
+func (s *ErrorImageTestSuite) TearDownTest() {
+	processingSem = s.oldProcessingSem
+
+	s.MainTestSuite.TearDownTest()
+}
+
+func (s *ErrorImageTestSuite) respond(uri string) (*httptest.ResponseRecorder, bool) {
+	rw := httptest.NewRecorder()
+	ierr := newError(404, "Not found", "Not found")
+
+	ok := respondWithErrorImage(rw, httptest.NewRequest(http.MethodGet, uri, nil), ierr)
+
+	return rw, ok
+}
+
+func (s *ErrorImageTestSuite) TestErrorImageSize() {
+	po := newProcessingOptions()
+	po.Width = 100
+	po.Dpr = 2
+
+	width, height := errorImageSize(po)
+
+	assert.Equal(s.T(), 200, width)
+	assert.Equal(s.T(), 200, height)
+}
+
+func (s *ErrorImageTestSuite) TestRespond() {
+	rw, ok := s.respond("/unsafe/rs:fit:100:50/plain/http://example.com/test.jpg@png")
+
+	assert.True(s.T(), ok)
+	assert.Equal(s.T(), 404, rw.Code)
+	assert.Equal(s.T(), "image/png", rw.Header().Get("Content-Type"))
+
+	config, err := png.DecodeConfig(rw.Body)
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), 100, config.Width)
+	assert.Equal(s.T(), 50, config.Height)
+
+	// The processing slot should be released
+	assert.Empty(s.T(), processingSem)
+}
+
+func (s *ErrorImageTestSuite) TestRespondTooLarge() {
+	_, ok := s.respond("/unsafe/rs:fit:4000:4000/plain/http://example.com/test.jpg@png")
+
+	assert.False(s.T(), ok)
+}
+
+func (s *ErrorImageTestSuite) TestRespondNoFreeProcessingSlots() {
+	processingSem <- struct{}{}
+	defer func() { <-processingSem }()
+
+	_, ok := s.respond("/unsafe/rs:fit:100:50/plain/http://example.com/test.jpg@png")
+
+	assert.False(s.T(), ok)
+}
+
+func (s *ErrorImageTestSuite) TestRespondUnknownSize() {
+	_, ok := s.respond("/unsafe/plain/http://example.com/test.jpg@png")
+
+	assert.False(s.T(), ok)
+}
+
+func TestErrorImage(t *testing.T) {
+	suite.Run(t, new(ErrorImageTestSuite))
+}
@@ -11,6 +11,10 @@ type imgproxyError struct {
 	Message       string
 	PublicMessage string
 	Unexpected    bool
+	// RetryAfter is the value of the Retry-After response header
+	RetryAfter string
+
+	category string
 
 	stack []uintptr
 }
@@ -36,6 +40,29 @@ func (e *imgproxyError) SetUnexpected(u bool) *imgproxyError {
 	return e
 }
 
+func (e *imgproxyError) SetRetryAfter(retryAfter string) *imgproxyError {
+	e.RetryAfter = retryAfter
+	return e
+}
+
+// SetCategory sets the stable error category used as a metrics label.
+// Unlike the message, the category doesn't contain any request details
+func (e *imgproxyError) SetCategory(category string) *imgproxyError {
+	e.category = category
+	return e
+}
+
+func (e *imgproxyError) Category() string {
+	switch {
+	case len(e.category) > 0:
+		return e.category
+	case e.Unexpected:
+		return "unexpected"
+	default:
+		return "other"
+	}
+}
+
 func newError(status int, msg string, pub string) *imgproxyError {
 	return &imgproxyError{
 		StatusCode:    status,
@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"hash"
+	"strings"
 	"sync"
 )
 
@@ -26,12 +27,62 @@ var eTagCalcPool = sync.Pool{
 	},
 }
 
+// encodedETag returns the ETag of the encoded representation of the response
+func encodedETag(eTag, encoding string) string {
+	if strings.HasSuffix(eTag, `"`) {
+		return eTag[:len(eTag)-1] + "-" + encoding + `"`
+	}
+	return eTag + "-" + encoding
+}
+
+// matchETag checks if the If-None-Match header value matches the ETag
+// of any encoding of the response and returns the matched ETag.
+// Weak comparison is used as required for If-None-Match
+func matchETag(eTag, ifNoneMatch string) (string, bool) {
+	if len(ifNoneMatch) == 0 {
+		return "", false
+	}
+
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return eTag, true
+	}
+
+	candidates := []string{
+		eTag,
+		encodedETag(eTag, encodingGzip),
+		encodedETag(eTag, encodingBrotli),
+	}
+
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+
+		for _, c := range candidates {
+			if tag == c {
+				return c, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// calcETag calculates the strong ETag of the response.
+// The ETag is derived from the source image data, the config, and the processing options,
+// so different transformations of the same image don't share the ETag.
+// When IMGPROXY_ETAG_FROM_SOURCE is enabled and the source has a strong ETag,
+// the source ETag is used instead of the source image data
 func calcETag(ctx context.Context) string {
 	c := eTagCalcPool.Get().(*eTagCalc)
 	defer eTagCalcPool.Put(c)
 
 	c.hash.Reset()
-	c.hash.Write(getImageData(ctx).Data)
+	if sourceETag := getSourceETag(ctx); conf.ETagFromSource && len(sourceETag) > 0 {
+		c.hash.Write([]byte(getImageURL(ctx)))
+		c.hash.Write([]byte{0})
+		c.hash.Write([]byte(sourceETag))
+	} else {
+		c.hash.Write(getImageData(ctx).Data)
+	}
 	footprint := c.hash.Sum(nil)
 
 	c.hash.Reset()
@@ -40,5 +91,5 @@ func calcETag(ctx context.Context) string {
 	c.enc.Encode(conf)
 	c.enc.Encode(getProcessingOptions(ctx))
 
-	return hex.EncodeToString(c.hash.Sum(nil))
+	return `"` + hex.EncodeToString(c.hash.Sum(nil)) + `"`
 }
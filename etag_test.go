@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type ETagTestSuite struct{ MainTestSuite }
+
+func (s *ETagTestSuite) TestMatchETag() {
+	eTag := `"abcdef"`
+
+	matched, ok := matchETag(eTag, `"abcdef"`)
+	assert.True(s.T(), ok)
+	assert.Equal(s.T(), eTag, matched)
+}
+
+func (s *ETagTestSuite) TestMatchETagList() {
+	matched, ok := matchETag(`"abcdef"`, `"123456", W/"abcdef"`)
+	assert.True(s.T(), ok)
+	assert.Equal(s.T(), `"abcdef"`, matched)
+}
+
+func (s *ETagTestSuite) TestMatchETagEncoded() {
+	matched, ok := matchETag(`"abcdef"`, `"abcdef-br"`)
+	assert.True(s.T(), ok)
+	assert.Equal(s.T(), `"abcdef-br"`, matched)
+}
+
+func (s *ETagTestSuite) TestMatchETagWildcard() {
+	_, ok := matchETag(`"abcdef"`, "*")
+	assert.True(s.T(), ok)
+}
+
+func (s *ETagTestSuite) TestMatchETagMismatch() {
+	_, ok := matchETag(`"abcdef"`, `"123456"`)
+	assert.False(s.T(), ok)
+
+	_, ok = matchETag(`"abcdef"`, "")
+	assert.False(s.T(), ok)
+}
+
+func TestETag(t *testing.T) {
+	suite.Run(t, new(ETagTestSuite))
+}
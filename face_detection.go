@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+var (
+	faceDetectionClient *http.Client
+
+	detectedFacesCtxKey = ctxKey("detectedFaces")
+)
+
+// detectedFace is a face bounding box. Coordinates and sizes are relative
+// to the image dimensions and are within [0, 1]
+type detectedFace struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+type faceDetectionResponse struct {
+	Faces []detectedFace `json:"faces"`
+}
+
+func initFaceDetection() {
+	if !conf.EnableFaceDetection {
+		return
+	}
+
+	faceDetectionClient = &http.Client{
+		Timeout: time.Duration(conf.FaceDetectionTimeout) * time.Second,
+	}
+}
+
+// detectFaces sends the image to the face detection service
+// and returns the detected faces
+func detectFaces(ctx context.Context, imgdata *imageData) ([]detectedFace, error) {
+	req, err := http.NewRequest("POST", conf.FaceDetectionURL, bytes.NewReader(imgdata.Data))
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", imgdata.Type.Mime())
+	req.Header.Set("User-Agent", conf.UserAgent)
+
+	res, err := faceDetectionClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("Face detection service responded with %d status code", res.StatusCode)
+	}
+
+	var faces faceDetectionResponse
+
+	if err = json.NewDecoder(res.Body).Decode(&faces); err != nil {
+		return nil, fmt.Errorf("Can't parse face detection response: %s", err)
+	}
+
+	return faces.Faces, nil
+}
+
+// largestFace returns the face with the largest area
+func largestFace(faces []detectedFace) (face detectedFace, ok bool) {
+	for _, f := range faces {
+		if f.Width <= 0 || f.Height <= 0 {
+			continue
+		}
+
+		if !ok || f.Width*f.Height > face.Width*face.Height {
+			face, ok = f, true
+		}
+	}
+
+	return
+}
+
+// withDetectedFaces detects faces in the source image if face gravity is requested.
+// The detection requires a request to the face detection service, so it's done
+// in the request handler before the image is processed, and the detected faces
+// are passed to processing through the context
+func withDetectedFaces(ctx context.Context) context.Context {
+	po := getProcessingOptions(ctx)
+
+	if !conf.EnableFaceDetection || (po.Gravity.Type != gravityFace && po.Crop.Gravity.Type != gravityFace) {
+		return ctx
+	}
+
+	faces, err := detectFaces(ctx, getImageData(ctx))
+	if err != nil {
+		logWarning("Can't detect faces: %s", err)
+		return ctx
+	}
+
+	return context.WithValue(ctx, detectedFacesCtxKey, faces)
+}
+
+func getDetectedFaces(ctx context.Context) []detectedFace {
+	faces, _ := ctx.Value(detectedFacesCtxKey).([]detectedFace)
+	return faces
+}
+
+// resolveFaceGravity replaces face gravities with focus point gravities
+// pointing to the center of the largest detected face.
+// If no face is detected, smart gravity is used
+func resolveFaceGravity(po *processingOptions, faces []detectedFace) {
+	if po.Gravity.Type != gravityFace && po.Crop.Gravity.Type != gravityFace {
+		return
+	}
+
+	resolved := gravityOptions{Type: gravitySmart}
+
+	if face, ok := largestFace(faces); ok {
+		resolved = gravityOptions{
+			Type: gravityFocusPoint,
+			X:    math.Min(math.Max(face.X+face.Width/2, 0), 1),
+			Y:    math.Min(math.Max(face.Y+face.Height/2, 0), 1),
+		}
+	} else {
+		logDebug("No faces detected, falling back to smart gravity")
+	}
+
+	if po.Gravity.Type == gravityFace {
+		po.Gravity = resolved
+	}
+	if po.Crop.Gravity.Type == gravityFace {
+		po.Crop.Gravity = resolved
+	}
+}
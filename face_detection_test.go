@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type FaceDetectionTestSuite struct{ MainTestSuite }
+
+func (s *FaceDetectionTestSuite) detect(po *processingOptions, response string) (context.Context, int) {
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requests++
+		rw.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(rw, response)
+	}))
+	defer server.Close()
+
+	conf.EnableFaceDetection = true
+	conf.FaceDetectionURL = server.URL
+	initFaceDetection()
+
+	ctx := context.WithValue(context.Background(), processingOptionsCtxKey, po)
+	ctx = context.WithValue(ctx, imageDataCtxKey, &imageData{Data: []byte("image"), Type: imageTypeJPEG})
+
+	return withDetectedFaces(ctx), requests
+}
+
+func (s *FaceDetectionTestSuite) resolve(response string) *processingOptions {
+	po := newProcessingOptions()
+	po.Gravity.Type = gravityFace
+
+	ctx, _ := s.detect(po, response)
+
+	resolveFaceGravity(po, getDetectedFaces(ctx))
+
+	return po
+}
+
+func (s *FaceDetectionTestSuite) TestLargestFace() {
+	po := s.resolve(`{"faces":[{"x":0.1,"y":0.1,"width":0.1,"height":0.1},{"x":0.5,"y":0.2,"width":0.4,"height":0.2}]}`)
+
+	assert.Equal(s.T(), gravityFocusPoint, po.Gravity.Type)
+	assert.InDelta(s.T(), 0.7, po.Gravity.X, 0.0001)
+	assert.InDelta(s.T(), 0.3, po.Gravity.Y, 0.0001)
+}
+
+func (s *FaceDetectionTestSuite) TestNoFaces() {
+	po := s.resolve(`{"faces":[]}`)
+
+	assert.Equal(s.T(), gravitySmart, po.Gravity.Type)
+}
+
+func (s *FaceDetectionTestSuite) TestDetectionFailed() {
+	po := s.resolve(`invalid`)
+
+	assert.Equal(s.T(), gravitySmart, po.Gravity.Type)
+}
+
+func (s *FaceDetectionTestSuite) TestNoDetectionWithoutFaceGravity() {
+	po := newProcessingOptions()
+
+	ctx, requests := s.detect(po, `{"faces":[]}`)
+
+	assert.Zero(s.T(), requests)
+	assert.Nil(s.T(), getDetectedFaces(ctx))
+}
+
+func TestFaceDetection(t *testing.T) {
+	suite.Run(t, new(FaceDetectionTestSuite))
+}
@@ -3,11 +3,15 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
@@ -21,9 +25,14 @@ func newGCSTransport() (http.RoundTripper, error) {
 		err    error
 	)
 
-	if len(conf.GCSKey) > 0 {
+	// When neither key nor key file is set, the application default credentials
+	// are used. This includes workload identity on GKE
+	switch {
+	case len(conf.GCSKey) > 0:
 		client, err = storage.NewClient(context.Background(), option.WithCredentialsJSON([]byte(conf.GCSKey)))
-	} else {
+	case len(conf.GCSKeyFile) > 0:
+		client, err = storage.NewClient(context.Background(), option.WithCredentialsFile(conf.GCSKeyFile))
+	default:
 		client, err = storage.NewClient(context.Background())
 	}
 
@@ -31,10 +40,33 @@ func newGCSTransport() (http.RoundTripper, error) {
 		return nil, fmt.Errorf("Can't create GCS client: %s", err)
 	}
 
+	if len(conf.GCSCheckBucket) > 0 {
+		if err = checkGCSBucket(client, conf.GCSCheckBucket); err != nil {
+			return nil, err
+		}
+	}
+
 	return gcsTransport{client}, nil
 }
 
+// checkGCSBucket fetches the bucket metadata to make sure the credentials
+// are valid and the bucket is reachable
+func checkGCSBucket(client *storage.Client, bucket string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(conf.DownloadTimeout)*time.Second)
+	defer cancel()
+
+	if _, err := client.Bucket(bucket).Attrs(ctx); err != nil {
+		return fmt.Errorf("Can't access GCS bucket %s, check the credentials and the bucket permissions: %s", bucket, err)
+	}
+
+	return nil
+}
+
 func (t gcsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodPut {
+		return t.put(req)
+	}
+
 	bkt := t.client.Bucket(req.URL.Host)
 	obj := bkt.Object(strings.TrimPrefix(req.URL.Path, "/"))
 
@@ -64,3 +96,51 @@ func (t gcsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 		Request:       req,
 	}, nil
 }
+
+func (t gcsTransport) List(ctx context.Context, bucket, prefix string, limit int) ([]string, error) {
+	it := t.client.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+
+	keys := make([]string, 0, limit)
+	for len(keys) < limit {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, attrs.Name)
+	}
+
+	return keys, nil
+}
+
+func (t gcsTransport) put(req *http.Request) (*http.Response, error) {
+	bkt := t.client.Bucket(req.URL.Host)
+	obj := bkt.Object(strings.TrimPrefix(req.URL.Path, "/"))
+
+	writer := obj.NewWriter(context.Background())
+	writer.ContentType = req.Header.Get("Content-Type")
+
+	if _, err := io.Copy(writer, req.Body); err != nil {
+		writer.Close()
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: 200,
+		Proto:      "HTTP/1.0",
+		ProtoMajor: 1,
+		ProtoMinor: 0,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Close:      true,
+		Request:    req,
+	}, nil
+}
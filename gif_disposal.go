@@ -0,0 +1,80 @@
+package main
+
+import "errors"
+
+const (
+	gifDisposalBackground = 2
+
+	// gifDisposalField is the image field that tells the GIF saver
+	// which disposal method the frames should use
+	gifDisposalField = "imgproxy-gif-disposal"
+)
+
+var errGifMalformed = errors.New("Malformed GIF data")
+
+// setGifDisposal sets the disposal method of every GIF frame in place.
+// Frames without the graphic control extension are left untouched
+func setGifDisposal(data []byte, disposal int) error {
+	if len(data) < 13 || string(data[:3]) != "GIF" {
+		return errGifMalformed
+	}
+
+	pos := 13
+
+	// Skip the global color table
+	if data[10]&0x80 != 0 {
+		pos += 3 << (data[10]&0x07 + 1)
+	}
+
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21:
+			if pos+1 >= len(data) {
+				return errGifMalformed
+			}
+
+			// Graphic control extension has a single 4-byte sub-block
+			// that starts with the packed fields byte
+			if data[pos+1] == 0xF9 && pos+3 < len(data) && data[pos+2] == 4 {
+				data[pos+3] = data[pos+3]&^0x1C | byte(disposal<<2)&0x1C
+			}
+
+			pos += 2
+		case 0x2C:
+			if pos+10 > len(data) {
+				return errGifMalformed
+			}
+
+			packed := data[pos+9]
+			pos += 10
+
+			// Skip the local color table
+			if packed&0x80 != 0 {
+				pos += 3 << (packed&0x07 + 1)
+			}
+
+			// Skip the LZW minimum code size
+			pos++
+		case 0x3B:
+			return nil
+		default:
+			return errGifMalformed
+		}
+
+		// Skip data sub-blocks
+		for {
+			if pos >= len(data) {
+				return errGifMalformed
+			}
+
+			size := int(data[pos])
+			pos += size + 1
+
+			if size == 0 {
+				break
+			}
+		}
+	}
+
+	return errGifMalformed
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type GifDisposalTestSuite struct{ MainTestSuite }
+
+func (s *GifDisposalTestSuite) encodeGif(framesCount int, globalPalette bool) []byte {
+	palette := color.Palette{color.Transparent, color.White, color.Black}
+
+	anim := &gif.GIF{}
+
+	for i := 0; i < framesCount; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 10, 10), palette)
+		frame.SetColorIndex(i, i, 2)
+
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+		anim.Disposal = append(anim.Disposal, gif.DisposalNone)
+	}
+
+	if globalPalette {
+		anim.Config = image.Config{ColorModel: palette, Width: 10, Height: 10}
+	}
+
+	buf := new(bytes.Buffer)
+	require.Nil(s.T(), gif.EncodeAll(buf, anim))
+
+	return buf.Bytes()
+}
+
+func (s *GifDisposalTestSuite) TestSetGifDisposal() {
+	for _, globalPalette := range []bool{false, true} {
+		data := s.encodeGif(3, globalPalette)
+
+		require.Nil(s.T(), setGifDisposal(data, gifDisposalBackground))
+
+		anim, err := gif.DecodeAll(bytes.NewReader(data))
+		require.Nil(s.T(), err)
+
+		assert.Len(s.T(), anim.Image, 3)
+		assert.Equal(s.T(), []byte{gif.DisposalBackground, gif.DisposalBackground, gif.DisposalBackground}, anim.Disposal)
+		assert.Equal(s.T(), []int{10, 10, 10}, anim.Delay)
+		assert.Equal(s.T(), uint8(2), anim.Image[1].ColorIndexAt(1, 1))
+	}
+}
+
+func (s *GifDisposalTestSuite) TestSetGifDisposalMalformed() {
+	data := s.encodeGif(2, false)
+
+	assert.Equal(s.T(), errGifMalformed, setGifDisposal(data[:len(data)-10], gifDisposalBackground))
+	assert.Equal(s.T(), errGifMalformed, setGifDisposal([]byte("not a gif"), gifDisposalBackground))
+}
+
+func TestGifDisposal(t *testing.T) {
+	suite.Run(t, new(GifDisposalTestSuite))
+}
@@ -12,6 +12,7 @@ require (
 	github.com/bugsnag/bugsnag-go/v2 v2.1.1
 	github.com/getsentry/sentry-go v0.11.0
 	github.com/go-ole/go-ole v1.2.4 // indirect
+	github.com/gomodule/redigo v1.8.5
 	github.com/honeybadger-io/honeybadger-go v0.5.0
 	github.com/ianlancetaylor/cgosymbolizer v0.0.0-20201204192058-7acc97e53614 // indirect
 	github.com/matoous/go-nanoid/v2 v2.0.0
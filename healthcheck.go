@@ -16,6 +16,8 @@ func healthcheck() int {
 	strEnvConfig(&network, "IMGPROXY_NETWORK")
 	strEnvConfig(&bind, "IMGPROXY_BIND")
 
+	network, bind = bindNetwork(network, bind)
+
 	httpc := http.Client{
 		Transport: &http.Transport{
 			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
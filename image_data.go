@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"os"
 )
@@ -37,6 +38,57 @@ func getWatermarkData() (*imageData, error) {
 	return nil, nil
 }
 
+type watermarkSource struct {
+	Data string `json:"data"`
+	Path string `json:"path"`
+	URL  string `json:"url"`
+}
+
+func getNamedWatermarksData() (map[string]*imageData, error) {
+	wms := make(map[string]*imageData)
+
+	if len(conf.WatermarksPath) == 0 {
+		return wms, nil
+	}
+
+	f, err := os.Open(conf.WatermarksPath)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read watermarks list: %s", err)
+	}
+	defer f.Close()
+
+	sources := make(map[string]watermarkSource)
+
+	if err = json.NewDecoder(f).Decode(&sources); err != nil {
+		return nil, fmt.Errorf("Can't parse watermarks list: %s", err)
+	}
+
+	for name, src := range sources {
+		desc := fmt.Sprintf("watermark %s", name)
+
+		var imgdata *imageData
+
+		switch {
+		case len(src.Data) > 0:
+			imgdata, err = base64ImageData(src.Data, desc)
+		case len(src.Path) > 0:
+			imgdata, err = fileImageData(src.Path, desc)
+		case len(src.URL) > 0:
+			imgdata, err = remoteImageData(src.URL, desc)
+		default:
+			err = fmt.Errorf("Source of %s is not specified", desc)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		wms[name] = imgdata
+	}
+
+	return wms, nil
+}
+
 func getFallbackImageData() (*imageData, error) {
 	if len(conf.FallbackImageData) > 0 {
 		return base64ImageData(conf.FallbackImageData, "fallback image")
@@ -87,7 +139,7 @@ func fileImageData(path, desc string) (*imageData, error) {
 }
 
 func remoteImageData(imageURL, desc string) (*imageData, error) {
-	res, err := requestImage(imageURL)
+	res, err := requestImage(assetsDownloadClient, imageURL, nil)
 	if res != nil {
 		defer res.Body.Close()
 	}
@@ -27,11 +27,15 @@ const (
 	imageTypeAVIF    = imageType(C.AVIF)
 	imageTypeBMP     = imageType(C.BMP)
 	imageTypeTIFF    = imageType(C.TIFF)
+	imageTypeRAW     = imageType(C.RAW)
+	imageTypePDF     = imageType(C.PDF)
 
 	contentDispositionFilenameFallback = "image"
 )
 
 var (
+	contentDispositionFilenameReplacer = strings.NewReplacer("\r", "", "\n", "", "\"", "", "\\", "")
+
 	imageTypes = map[string]imageType{
 		"jpeg": imageTypeJPEG,
 		"jpg":  imageTypeJPEG,
@@ -44,6 +48,8 @@ var (
 		"avif": imageTypeAVIF,
 		"bmp":  imageTypeBMP,
 		"tiff": imageTypeTIFF,
+		"raw":  imageTypeRAW,
+		"pdf":  imageTypePDF,
 	}
 
 	mimes = map[imageType]string{
@@ -57,19 +63,20 @@ var (
 		imageTypeAVIF: "image/avif",
 		imageTypeBMP:  "image/bmp",
 		imageTypeTIFF: "image/tiff",
+		imageTypePDF:  "application/pdf",
 	}
 
 	contentDispositionsFmt = map[imageType]string{
-		imageTypeJPEG: "inline; filename=\"%s.jpg\"",
-		imageTypePNG:  "inline; filename=\"%s.png\"",
-		imageTypeWEBP: "inline; filename=\"%s.webp\"",
-		imageTypeGIF:  "inline; filename=\"%s.gif\"",
-		imageTypeICO:  "inline; filename=\"%s.ico\"",
-		imageTypeSVG:  "inline; filename=\"%s.svg\"",
-		imageTypeHEIC: "inline; filename=\"%s.heic\"",
-		imageTypeAVIF: "inline; filename=\"%s.avif\"",
-		imageTypeBMP:  "inline; filename=\"%s.bmp\"",
-		imageTypeTIFF: "inline; filename=\"%s.tiff\"",
+		imageTypeJPEG: "%s; filename=\"%s.jpg\"",
+		imageTypePNG:  "%s; filename=\"%s.png\"",
+		imageTypeWEBP: "%s; filename=\"%s.webp\"",
+		imageTypeGIF:  "%s; filename=\"%s.gif\"",
+		imageTypeICO:  "%s; filename=\"%s.ico\"",
+		imageTypeSVG:  "%s; filename=\"%s.svg\"",
+		imageTypeHEIC: "%s; filename=\"%s.heic\"",
+		imageTypeAVIF: "%s; filename=\"%s.avif\"",
+		imageTypeBMP:  "%s; filename=\"%s.bmp\"",
+		imageTypeTIFF: "%s; filename=\"%s.tiff\"",
 	}
 )
 
@@ -99,27 +106,45 @@ func (it imageType) Mime() string {
 	return "application/octet-stream"
 }
 
-func (it imageType) ContentDisposition(filename string) string {
+// ContentDisposition returns the Content-Disposition header value.
+// When attachment is true, browsers download the image instead of displaying it
+func (it imageType) ContentDisposition(filename string, attachment bool) string {
+	disposition := "inline"
+	if attachment {
+		disposition = "attachment"
+	}
+
 	format, ok := contentDispositionsFmt[it]
 	if !ok {
-		return "inline"
+		return disposition
+	}
+
+	// Filename comes from the URL, so we don't let it break the header
+	filename = contentDispositionFilenameReplacer.Replace(filename)
+	if len(filename) == 0 {
+		filename = contentDispositionFilenameFallback
 	}
 
-	return fmt.Sprintf(format, filename)
+	return fmt.Sprintf(format, disposition, filename)
 }
 
-func (it imageType) ContentDispositionFromURL(imageURL string) string {
+func (it imageType) ContentDispositionFromURL(imageURL string, attachment bool) string {
 	url, err := url.Parse(imageURL)
 	if err != nil {
-		return it.ContentDisposition(contentDispositionFilenameFallback)
+		return it.ContentDisposition(contentDispositionFilenameFallback, attachment)
 	}
 
 	_, filename := filepath.Split(url.Path)
 	if len(filename) == 0 {
-		return it.ContentDisposition(contentDispositionFilenameFallback)
+		return it.ContentDisposition(contentDispositionFilenameFallback, attachment)
 	}
 
-	return it.ContentDisposition(strings.TrimSuffix(filename, filepath.Ext(filename)))
+	return it.ContentDisposition(strings.TrimSuffix(filename, filepath.Ext(filename)), attachment)
+}
+
+// IsTextual checks if the image format is a textual one that can be compressed
+func (it imageType) IsTextual() bool {
+	return it == imageTypeSVG
 }
 
 func (it imageType) SupportsAlpha() bool {
@@ -0,0 +1,17 @@
+package imagemeta
+
+import (
+	"io"
+)
+
+var pdfMagick = []byte("%PDF-")
+
+// DecodePdfMeta doesn't read the document dimensions since PDF pages
+// have no pixel dimensions until they are rendered
+func DecodePdfMeta(r io.Reader) (Meta, error) {
+	return &meta{format: "pdf", width: 1, height: 1}, nil
+}
+
+func init() {
+	RegisterFormat(string(pdfMagick), DecodePdfMeta)
+}
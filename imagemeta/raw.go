@@ -0,0 +1,206 @@
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	tiffDtUndefined = 7
+
+	tiffCompression          = 259
+	tiffStripOffsets         = 273
+	tiffStripByteCounts      = 279
+	tiffJpegInterchange      = 513
+	tiffJpegInterchangeLen   = 514
+	tiffCompressionOldJpeg   = 6
+	tiffCompressionJpeg      = 7
+	rawPreviewMaxIFDs        = 32
+	rawPreviewMaxValues      = 32
+	rawPreviewMaxJpegMarkers = 64
+
+	jpegSof1Marker  = 0xc1 // Start Of Frame (Extended Sequential).
+	jpegSof3Marker  = 0xc3 // Start Of Frame (Lossless).
+	jpegDhtMarker   = 0xc4 // Define Huffman Table.
+	jpegJpgMarker   = 0xc8 // JPEG extensions.
+	jpegDacMarker   = 0xcc // Define Arithmetic Coding.
+	jpegSof15Marker = 0xcf // Start Of Frame (Differential Lossless, Arithmetic).
+)
+
+type rawPreviewFinder struct {
+	data      []byte
+	byteOrder binary.ByteOrder
+
+	visited map[int]bool
+
+	offset int
+	size   int
+}
+
+// FindRawPreview looks for the largest embedded JPEG preview
+// in a TIFF-based RAW camera file and returns its offset and size
+func FindRawPreview(data []byte) (int, int, error) {
+	if len(data) < 8 {
+		return 0, 0, TiffFormatError("malformed header")
+	}
+
+	f := rawPreviewFinder{data: data, visited: make(map[int]bool)}
+
+	switch {
+	case bytes.Equal(tiffLeHeader, data[0:4]):
+		f.byteOrder = binary.LittleEndian
+	case bytes.Equal(tiffBeHeader, data[0:4]):
+		f.byteOrder = binary.BigEndian
+	default:
+		return 0, 0, TiffFormatError("malformed header")
+	}
+
+	f.walk(int(f.byteOrder.Uint32(data[4:8])))
+
+	if f.size == 0 {
+		return 0, 0, TiffFormatError("embedded preview not found")
+	}
+
+	return f.offset, f.size, nil
+}
+
+func (f *rawPreviewFinder) entryValues(entry []byte) []int {
+	datatype := f.byteOrder.Uint16(entry[2:4])
+	count := int(f.byteOrder.Uint32(entry[4:8]))
+
+	var itemSize int
+
+	switch datatype {
+	case tiffDtShort:
+		itemSize = 2
+	case tiffDtLong, tiffDtUndefined:
+		itemSize = 4
+	default:
+		return nil
+	}
+
+	if count <= 0 || count > rawPreviewMaxValues {
+		return nil
+	}
+
+	values := entry[8:12]
+
+	if count*itemSize > 4 {
+		offset := int(f.byteOrder.Uint32(entry[8:12]))
+		if offset < 0 || offset+count*itemSize > len(f.data) {
+			return nil
+		}
+		values = f.data[offset : offset+count*itemSize]
+	}
+
+	res := make([]int, count)
+
+	for i := range res {
+		if itemSize == 2 {
+			res[i] = int(f.byteOrder.Uint16(values[i*2:]))
+		} else {
+			res[i] = int(f.byteOrder.Uint32(values[i*4:]))
+		}
+	}
+
+	return res
+}
+
+func (f *rawPreviewFinder) walk(ifdOffset int) {
+	for ifdOffset > 0 && ifdOffset+2 <= len(f.data) && len(f.visited) < rawPreviewMaxIFDs {
+		if f.visited[ifdOffset] {
+			return
+		}
+		f.visited[ifdOffset] = true
+
+		numItems := int(f.byteOrder.Uint16(f.data[ifdOffset:]))
+		entriesEnd := ifdOffset + 2 + numItems*12
+
+		if entriesEnd+4 > len(f.data) {
+			return
+		}
+
+		var (
+			compression              int
+			stripOffsets, stripSizes []int
+			jpegOffset, jpegSize     int
+			subIFDs                  []int
+		)
+
+		for i := ifdOffset + 2; i < entriesEnd; i += 12 {
+			entry := f.data[i : i+12]
+			values := f.entryValues(entry)
+
+			if len(values) == 0 {
+				continue
+			}
+
+			switch f.byteOrder.Uint16(entry[0:2]) {
+			case tiffCompression:
+				compression = values[0]
+			case tiffStripOffsets:
+				stripOffsets = values
+			case tiffStripByteCounts:
+				stripSizes = values
+			case tiffJpegInterchange:
+				jpegOffset = values[0]
+			case tiffJpegInterchangeLen:
+				jpegSize = values[0]
+			case tiffSubIFDs:
+				subIFDs = values
+			}
+		}
+
+		f.checkCandidate(jpegOffset, jpegSize)
+
+		isJpeg := compression == tiffCompressionOldJpeg || compression == tiffCompressionJpeg
+		if isJpeg && len(stripOffsets) == 1 && len(stripSizes) == 1 {
+			f.checkCandidate(stripOffsets[0], stripSizes[0])
+		}
+
+		for _, subIFD := range subIFDs {
+			f.walk(subIFD)
+		}
+
+		ifdOffset = int(f.byteOrder.Uint32(f.data[entriesEnd:]))
+	}
+}
+
+func (f *rawPreviewFinder) checkCandidate(offset, size int) {
+	if size <= f.size || offset <= 0 || offset+size > len(f.data) {
+		return
+	}
+
+	if isBaselineJpeg(f.data[offset : offset+size]) {
+		f.offset, f.size = offset, size
+	}
+}
+
+// isBaselineJpeg checks if data is a JPEG that can be decoded by common decoders.
+// RAW files often store sensor data as lossless JPEG which is not the case
+func isBaselineJpeg(data []byte) bool {
+	if len(data) < 4 || data[0] != 0xff || data[1] != jpegSoiMarker {
+		return false
+	}
+
+	for i, n := 2, 0; i+4 <= len(data) && n < rawPreviewMaxJpegMarkers; n++ {
+		if data[i] != 0xff {
+			return false
+		}
+
+		switch marker := data[i+1]; {
+		case marker == jpegSof0Marker, marker == jpegSof1Marker, marker == jpegSof2Marker:
+			return true
+		case marker >= jpegSof3Marker && marker <= jpegSof15Marker &&
+			marker != jpegDhtMarker && marker != jpegJpgMarker && marker != jpegDacMarker:
+			return false
+		case marker == jpegSosMarker:
+			// Scan data can't be started before the frame
+			return false
+		}
+
+		i += 2 + int(binary.BigEndian.Uint16(data[i+2:i+4]))
+	}
+
+	return false
+}
@@ -10,6 +10,8 @@ import (
 var (
 	tiffLeHeader = []byte("II\x2A\x00")
 	tiffBeHeader = []byte("MM\x00\x2A")
+
+	cr2Signature = []byte("CR")
 )
 
 const (
@@ -17,8 +19,14 @@ const (
 	tiffDtShort = 3
 	tiffDtLong  = 4
 
-	tiffImageWidth  = 256
-	tiffImageLength = 257
+	tiffNewSubfileType = 254
+	tiffImageWidth     = 256
+	tiffImageLength    = 257
+	tiffMake           = 271
+	tiffSubIFDs        = 330
+	tiffDNGVersion     = 50706
+
+	tiffSubfileReducedImage = 1
 )
 
 type tiffReader interface {
@@ -60,7 +68,22 @@ func DecodeTiffMeta(rr io.Reader) (Meta, error) {
 
 	ifdOffset := int(byteOrder.Uint32(tmp[4:8]))
 
-	if _, err := r.Discard(ifdOffset - 8); err != nil {
+	// RAW camera files are TIFF-based, so we need to check some details
+	// to distinguish them
+	isRaw := false
+
+	if ifdOffset >= 10 {
+		if _, err := io.ReadFull(r, tmp[0:2]); err != nil {
+			return nil, err
+		}
+
+		// CR2 has its signature right after the header
+		isRaw = bytes.Equal(cr2Signature, tmp[0:2])
+
+		if _, err := r.Discard(ifdOffset - 10); err != nil {
+			return nil, err
+		}
+	} else if _, err := r.Discard(ifdOffset - 8); err != nil {
 		return nil, err
 	}
 
@@ -69,7 +92,8 @@ func DecodeTiffMeta(rr io.Reader) (Meta, error) {
 	}
 	numItems := int(byteOrder.Uint16(tmp[0:2]))
 
-	var width, height int
+	var width, height, subfileType int
+	var hasSubIFDs, hasMake bool
 
 	for i := 0; i < numItems; i++ {
 		if _, err := io.ReadFull(r, tmp[:]); err != nil {
@@ -78,7 +102,20 @@ func DecodeTiffMeta(rr io.Reader) (Meta, error) {
 
 		tag := byteOrder.Uint16(tmp[0:2])
 
-		if tag != tiffImageWidth && tag != tiffImageLength {
+		switch tag {
+		case tiffSubIFDs:
+			hasSubIFDs = true
+			continue
+		case tiffMake:
+			hasMake = true
+			continue
+		case tiffDNGVersion:
+			// DNGVersion tag is required by the DNG specification
+			isRaw = true
+			continue
+		}
+
+		if tag != tiffImageWidth && tag != tiffImageLength && tag != tiffNewSubfileType {
 			continue
 		}
 
@@ -97,22 +134,37 @@ func DecodeTiffMeta(rr io.Reader) (Meta, error) {
 			return nil, TiffFormatError("unsupported IFD entry datatype")
 		}
 
-		if tag == tiffImageWidth {
+		switch tag {
+		case tiffImageWidth:
 			width = value
-		} else {
+		case tiffImageLength:
 			height = value
+		case tiffNewSubfileType:
+			subfileType = value
 		}
+	}
 
-		if width > 0 && height > 0 {
-			return &meta{
-				format: "tiff",
-				width:  width,
-				height: height,
-			}, nil
-		}
+	if width == 0 || height == 0 {
+		return nil, TiffFormatError("image dimensions are not specified")
+	}
+
+	// Most of RAW formats (NEF, ARW, etc.) store a reduced preview in the first IFD
+	// and the main image in a sub-IFD. Regular TIFF files can have the same layout,
+	// so we also require the camera maker tag
+	if subfileType == tiffSubfileReducedImage && hasSubIFDs && hasMake {
+		isRaw = true
+	}
+
+	format := "tiff"
+	if isRaw {
+		format = "raw"
 	}
 
-	return nil, TiffFormatError("image dimensions are not specified")
+	return &meta{
+		format: format,
+		width:  width,
+		height: height,
+	}, nil
 }
 
 func init() {
@@ -19,6 +19,7 @@ var ErrWebpInvalidFormat = errors.New("webp: invalid format")
 
 var (
 	webpFccALPH = riff.FourCC{'A', 'L', 'P', 'H'}
+	webpFccANMF = riff.FourCC{'A', 'N', 'M', 'F'}
 	webpFccVP8  = riff.FourCC{'V', 'P', '8', ' '}
 	webpFccVP8L = riff.FourCC{'V', 'P', '8', 'L'}
 	webpFccVP8X = riff.FourCC{'V', 'P', '8', 'X'}
@@ -100,6 +101,62 @@ func DecodeWebpMeta(r io.Reader) (Meta, error) {
 	}
 }
 
+// WebpFrameInfo contains rendering flags of an animated WebP frame
+type WebpFrameInfo struct {
+	// DisposeToBackground means the frame area should be cleared
+	// to transparent before rendering the next frame
+	DisposeToBackground bool
+	// Blend means the frame should be alpha-blended with the canvas
+	// instead of replacing the canvas pixels
+	Blend bool
+}
+
+// DecodeWebpFrames reads rendering flags of the animated WebP frames.
+// Returns an empty slice if the image is not animated
+func DecodeWebpFrames(r io.Reader) ([]WebpFrameInfo, error) {
+	formType, riffReader, err := riff.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	if formType != webpFccWEBP {
+		return nil, ErrWebpInvalidFormat
+	}
+
+	var (
+		frames []WebpFrameInfo
+		buf    [16]byte
+	)
+
+	for {
+		chunkID, chunkLen, chunkData, err := riffReader.Next()
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if chunkID != webpFccANMF {
+			continue
+		}
+
+		if chunkLen < 16 {
+			return nil, ErrWebpInvalidFormat
+		}
+
+		if _, err := io.ReadFull(chunkData, buf[:]); err != nil {
+			return nil, err
+		}
+
+		flags := buf[15]
+
+		frames = append(frames, WebpFrameInfo{
+			DisposeToBackground: flags&1 != 0,
+			Blend:               flags&2 == 0,
+		})
+	}
+}
+
 func init() {
 	RegisterFormat("RIFF????WEBPVP8", DecodeWebpMeta)
 }
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const infoPathPrefix = "/info"
+
+// infoExifFields maps the EXIF fields returned by the info endpoint
+// to the names libvips uses for them
+var infoExifFields = map[string]string{
+	"Make":             "exif-ifd0-Make",
+	"Model":            "exif-ifd0-Model",
+	"Orientation":      "exif-ifd0-Orientation",
+	"Software":         "exif-ifd0-Software",
+	"Artist":           "exif-ifd0-Artist",
+	"Copyright":        "exif-ifd0-Copyright",
+	"DateTimeOriginal": "exif-ifd2-DateTimeOriginal",
+	"ExposureTime":     "exif-ifd2-ExposureTime",
+	"FNumber":          "exif-ifd2-FNumber",
+	"ISOSpeedRatings":  "exif-ifd2-ISOSpeedRatings",
+	"FocalLength":      "exif-ifd2-FocalLength",
+}
+
+type imageInfo struct {
+	Format     imageType         `json:"format"`
+	Width      int               `json:"width"`
+	Height     int               `json:"height"`
+	Size       int               `json:"size"`
+	ColorSpace string            `json:"color_space"`
+	HasAlpha   bool              `json:"has_alpha"`
+	Frames     int               `json:"frames"`
+	Exif       map[string]string `json:"exif"`
+}
+
+// parseSourcePath parses the URL that looks like %prefix/%signature/%encoded_url.
+// The signature is calculated the same way as for the processing URL without options
+func parseSourcePath(ctx context.Context, r *http.Request, prefix string) (context.Context, error) {
+	path := trimAfter(r.RequestURI, '?')
+
+	if len(conf.PathPrefix) > 0 {
+		path = strings.TrimPrefix(path, conf.PathPrefix)
+	}
+
+	path = strings.TrimPrefix(strings.TrimPrefix(path, prefix), "/")
+
+	parts := strings.Split(path, "/")
+
+	if len(parts) < 2 {
+		return ctx, newError(404, fmt.Sprintf("Invalid path: %s", path), msgInvalidURL).SetCategory("invalid_url")
+	}
+
+	if !conf.AllowInsecure {
+		if err := validatePath(parts[0], strings.TrimPrefix(path, parts[0])); err != nil {
+			return ctx, newError(403, err.Error(), msgForbidden).SetCategory("invalid_signature")
+		}
+	}
+
+	imageURL, _, err := decodeURL(parts[1:])
+	if err != nil {
+		return ctx, newError(404, err.Error(), msgInvalidURL).SetCategory("invalid_url")
+	}
+
+	if err = checkSourceURL(imageURL); err != nil {
+		return ctx, err
+	}
+
+	return context.WithValue(ctx, imageURLCtxKey, imageURL), nil
+}
+
+// exifSuffixRe matches the end of the description libvips appends to the EXIF values:
+// "value (description, format, N components, M bytes)"
+var exifSuffixRe = regexp.MustCompile(`, [^,]+, \d+ components, \d+ bytes\)$`)
+
+// exifValue trims the description libvips appends to the EXIF values.
+// Both the value and the description may contain " (", so when the value
+// is a string we look for the split where the description equals the value
+func exifValue(str string) string {
+	loc := exifSuffixRe.FindStringIndex(str)
+	if loc == nil {
+		return str
+	}
+
+	// "value (description"
+	str = str[:loc[0]]
+
+	first := -1
+
+	for i := 0; ; {
+		j := strings.Index(str[i:], " (")
+		if j < 0 {
+			break
+		}
+		j += i
+
+		if str[:j] == str[j+2:] {
+			return str[:j]
+		}
+
+		if first < 0 {
+			first = j
+		}
+
+		i = j + 1
+	}
+
+	if first < 0 {
+		return str
+	}
+
+	return str[:first]
+}
+
+func readImageInfo(imgdata *imageData) (*imageInfo, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	defer vipsCleanup()
+
+	img := new(vipsImage)
+	defer img.Clear()
+
+	// Loaders read only the header until the pixels are requested,
+	// so no image data is decoded here
+	if err := img.Load(imgdata.Data, imgdata.Type, 1, 1.0, 1); err != nil {
+		return nil, err
+	}
+
+	frames, err := img.GetIntDefault("n-pages", 1)
+	if err != nil {
+		return nil, err
+	}
+
+	info := imageInfo{
+		Format:     imgdata.Type,
+		Width:      img.Width(),
+		Height:     img.Height(),
+		Size:       len(imgdata.Data),
+		ColorSpace: img.Interpretation(),
+		HasAlpha:   img.HasAlpha(),
+		Frames:     frames,
+		Exif:       make(map[string]string),
+	}
+
+	for name, field := range infoExifFields {
+		value, err := img.GetStringDefault(field, "")
+		if err != nil {
+			return nil, err
+		}
+
+		if len(value) > 0 {
+			info.Exif[name] = exifValue(value)
+		}
+	}
+
+	return &info, nil
+}
+
+func handleInfo(reqID string, rw http.ResponseWriter, r *http.Request) {
+	ctx, timeoutCancel := context.WithTimeout(r.Context(), time.Duration(conf.WriteTimeout)*time.Second)
+	defer timeoutCancel()
+
+	ctx, err := parseSourcePath(ctx, r, infoPathPrefix)
+	if err != nil {
+		panic(err)
+	}
+
+	// libvips is used to read the image info, so the info requests
+	// share the processing slots with the processing ones
+	var releaseProcessingSem func()
+
+	if downloadSem == nil {
+		releaseProcessingSem = acquireProcessingSem(ctx)
+		defer releaseProcessingSem()
+	}
+
+	releaseDownloadSem := acquireDownloadSem(ctx)
+	defer releaseDownloadSem()
+
+	ctx, downloadcancel, err := downloadImage(ctx, r.Header)
+	releaseDownloadSem()
+	defer downloadcancel()
+	if err != nil {
+		incrementErrorsTotal("download")
+		panic(err)
+	}
+
+	checkTimeout(ctx)
+
+	if downloadSem != nil {
+		releaseProcessingSem = acquireProcessingSem(ctx)
+		defer releaseProcessingSem()
+	}
+
+	info, err := readImageInfo(getImageData(ctx))
+	if err != nil {
+		incrementErrorsTotal("processing")
+		panic(newError(422, err.Error(), "Invalid source image").SetCategory("invalid_source_image"))
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		panic(err)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	rw.WriteHeader(200)
+	rw.Write(data)
+
+	imageURL := getImageURL(ctx)
+	logResponse(reqID, r, 200, nil, &imageURL, nil)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type InfoTestSuite struct {
+	MainTestSuite
+
+	oldProcessingSem chan struct{}
+	server           *httptest.Server
+}
+
+func (s *InfoTestSuite) SetupTest() {
+	s.MainTestSuite.SetupTest()
+
+	s.oldProcessingSem = processingSem
+	processingSem = make(chan struct{}, 1)
+
+	conf.AllowInsecure = true
+	conf.AllowLoopback = true
+	conf.AllowPrivateSources = true
+
+	img := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	for x := 0; x < 100; x++ {
+		for y := 0; y < 50; y++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	require.Nil(s.T(), jpeg.Encode(buf, img, nil))
+
+	s.server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "image/jpeg")
+		rw.Write(buf.Bytes())
+	}))
+}
+
+func (s *InfoTestSuite) TearDownTest() {
+	s.server.Close()
+
+	processingSem = s.oldProcessingSem
+
+	s.MainTestSuite.TearDownTest()
+}
+
+func (s *InfoTestSuite) request() *httptest.ResponseRecorder {
+	r := newRouter("")
+	r.PanicHandler = handlePanic
+	r.GET(infoPathPrefix+"/", handleInfo, false)
+
+	imageURL := base64.RawURLEncoding.EncodeToString([]byte(s.server.URL + "/test.jpg"))
+
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, infoPathPrefix+"/unsafe/"+imageURL, nil))
+
+	return rw
+}
+
+func (s *InfoTestSuite) TestInfo() {
+	rw := s.request()
+
+	require.Equal(s.T(), 200, rw.Code)
+	assert.Equal(s.T(), "application/json", rw.Header().Get("Content-Type"))
+
+	var info struct {
+		Format   string
+		Width    int
+		Height   int
+		Frames   int
+		HasAlpha bool `json:"has_alpha"`
+	}
+	require.Nil(s.T(), json.Unmarshal(rw.Body.Bytes(), &info))
+
+	assert.Equal(s.T(), "jpeg", info.Format)
+	assert.Equal(s.T(), 100, info.Width)
+	assert.Equal(s.T(), 50, info.Height)
+	assert.Equal(s.T(), 1, info.Frames)
+	assert.False(s.T(), info.HasAlpha)
+
+	// The processing slot should be released
+	assert.Empty(s.T(), processingSem)
+}
+
+func (s *InfoTestSuite) TestInfoWaitsForProcessingSlot() {
+	conf.WriteTimeout = 1
+
+	processingSem <- struct{}{}
+	defer func() { <-processingSem }()
+
+	rw := s.request()
+
+	assert.Equal(s.T(), 503, rw.Code)
+}
+
+func (s *InfoTestSuite) TestExifValue() {
+	testCases := []struct {
+		value    string
+		expected string
+	}{
+		{"NIKON D810 (NIKON D810, ASCII, 11 components, 11 bytes)", "NIKON D810"},
+		{"16/1 (f/16.0, Rational, 1 components, 8 bytes)", "16/1"},
+		{"1 (Top-left, Short, 1 components, 2 bytes)", "1"},
+		{
+			"Adobe Photoshop Lightroom 6.1 (Windows) (Adobe Photoshop Lightroom 6.1 (Windows), ASCII, 40 components, 40 bytes)",
+			"Adobe Photoshop Lightroom 6.1 (Windows)",
+		},
+		{"Lightroom (Windows)", "Lightroom (Windows)"},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(s.T(), tc.expected, exifValue(tc.value))
+	}
+}
+
+func TestInfo(t *testing.T) {
+	suite.Run(t, new(InfoTestSuite))
+}
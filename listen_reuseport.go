@@ -12,7 +12,8 @@ import (
 )
 
 func listenReuseport(network, address string) (net.Listener, error) {
-	if !conf.SoReuseport {
+	// SO_REUSEPORT makes no sense for Unix sockets
+	if !conf.SoReuseport || isUnixNetwork(network) {
 		return net.Listen(network, address)
 	}
 
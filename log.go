@@ -7,6 +7,10 @@ import (
 	logrus "github.com/sirupsen/logrus"
 )
 
+// logMachineReadable is true when the log format is meant to be parsed,
+// so response logs contain all the details as separate fields
+var logMachineReadable bool
+
 func initLog() error {
 	logFormat := "pretty"
 	strEnvConfig(&logFormat, "IMGPROXY_LOG_FORMAT")
@@ -14,8 +18,10 @@ func initLog() error {
 	switch logFormat {
 	case "structured":
 		logrus.SetFormatter(&logStructuredFormatter{})
+		logMachineReadable = true
 	case "json":
 		logrus.SetFormatter(&logrus.JSONFormatter{})
+		logMachineReadable = true
 	default:
 		logrus.SetFormatter(newLogPrettyFormatter())
 	}
@@ -85,9 +91,21 @@ func logResponse(reqID string, r *http.Request, status int, err *imgproxyError,
 		fields["processing_options"] = po
 	}
 
+	duration := getTimerSince(r.Context())
+
+	if logMachineReadable {
+		fields["path"] = r.RequestURI
+		fields["duration"] = duration.Seconds()
+		fields["bytes_written"] = getBytesWritten(r.Context())
+
+		if po != nil && po.Format != imageTypeUnknown {
+			fields["format"] = po.Format.String()
+		}
+	}
+
 	logrus.WithFields(fields).Logf(
 		level,
-		"Completed in %s %s", getTimerSince(r.Context()), r.RequestURI,
+		"Completed in %s %s", duration, r.RequestURI,
 	)
 }
 
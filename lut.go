@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	lutFileExt     = ".cube"
+	lutMaxSize     = 256
+	lutDefaultSize = 0
+)
+
+// lut3D is a 3D color lookup table loaded from a .cube file.
+// Data contains Size^3 RGB triplets, red changes fastest.
+// DomainMin and DomainMax define the input values range the LUT covers
+type lut3D struct {
+	Size int
+	Data []float32
+
+	DomainMin [3]float64
+	DomainMax [3]float64
+}
+
+var luts = make(map[string]*lut3D)
+
+func loadLuts() error {
+	if len(conf.LutsPath) == 0 {
+		return nil
+	}
+
+	files, err := ioutil.ReadDir(conf.LutsPath)
+	if err != nil {
+		return fmt.Errorf("Can't read LUTs dir: %s", err)
+	}
+
+	for _, f := range files {
+		if f.IsDir() || !strings.EqualFold(filepath.Ext(f.Name()), lutFileExt) {
+			continue
+		}
+
+		name := strings.TrimSuffix(f.Name(), filepath.Ext(f.Name()))
+
+		lut, err := loadLutFile(filepath.Join(conf.LutsPath, f.Name()))
+		if err != nil {
+			return fmt.Errorf("Can't load LUT %s: %s", name, err)
+		}
+
+		luts[name] = lut
+	}
+
+	return nil
+}
+
+func loadLutFile(path string) (*lut3D, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseCubeLut(f)
+}
+
+// parseCubeLut parses a 3D LUT in the Adobe/Resolve .cube format
+func parseCubeLut(r io.Reader) (*lut3D, error) {
+	lut := &lut3D{
+		Size:      lutDefaultSize,
+		DomainMin: [3]float64{0, 0, 0},
+		DomainMax: [3]float64{1, 1, 1},
+	}
+
+	scanner := bufio.NewScanner(r)
+
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+
+		switch fields[0] {
+		case "TITLE":
+			continue
+		case "LUT_1D_SIZE":
+			return nil, fmt.Errorf("1D LUTs are not supported")
+		case "LUT_3D_SIZE":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("Invalid LUT size at line %d", lineNum)
+			}
+
+			size, err := strconv.Atoi(fields[1])
+			if err != nil || size < 2 || size > lutMaxSize {
+				return nil, fmt.Errorf("Invalid LUT size at line %d: %s", lineNum, fields[1])
+			}
+
+			lut.Size = size
+			lut.Data = make([]float32, 0, size*size*size*3)
+		case "DOMAIN_MIN", "DOMAIN_MAX":
+			if len(fields) != 4 {
+				return nil, fmt.Errorf("Invalid LUT domain at line %d", lineNum)
+			}
+
+			domain := &lut.DomainMin
+			if fields[0] == "DOMAIN_MAX" {
+				domain = &lut.DomainMax
+			}
+
+			for i := 0; i < 3; i++ {
+				v, err := strconv.ParseFloat(fields[i+1], 64)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid LUT domain at line %d", lineNum)
+				}
+				domain[i] = v
+			}
+		default:
+			if lut.Size == lutDefaultSize {
+				return nil, fmt.Errorf("LUT data found before LUT_3D_SIZE at line %d", lineNum)
+			}
+
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("Invalid LUT data at line %d", lineNum)
+			}
+
+			if len(lut.Data) == cap(lut.Data) {
+				return nil, fmt.Errorf("Too many LUT entries at line %d", lineNum)
+			}
+
+			for i := 0; i < 3; i++ {
+				v, err := strconv.ParseFloat(fields[i], 64)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid LUT data at line %d", lineNum)
+				}
+				lut.Data = append(lut.Data, float32(v))
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if lut.Size == lutDefaultSize {
+		return nil, fmt.Errorf("LUT_3D_SIZE is not defined")
+	}
+
+	if len(lut.Data) != cap(lut.Data) {
+		return nil, fmt.Errorf("Expected %d LUT entries, got %d", cap(lut.Data)/3, len(lut.Data)/3)
+	}
+
+	for c := 0; c < 3; c++ {
+		if lut.DomainMax[c] <= lut.DomainMin[c] {
+			return nil, fmt.Errorf("LUT DOMAIN_MAX should be greater than DOMAIN_MIN")
+		}
+	}
+
+	return lut, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type LutTestSuite struct{ MainTestSuite }
+
+const identityCubeLut = `# Identity LUT
+TITLE "Identity"
+LUT_3D_SIZE 2
+
+0 0 0
+1 0 0
+0 1 0
+1 1 0
+0 0 1
+1 0 1
+0 1 1
+1 1 1
+`
+
+func (s *LutTestSuite) TestParseCube() {
+	lut, err := parseCubeLut(strings.NewReader(identityCubeLut))
+
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), 2, lut.Size)
+	assert.Len(s.T(), lut.Data, 2*2*2*3)
+	assert.Equal(s.T(), []float32{1, 0, 0}, lut.Data[3:6])
+}
+
+func (s *LutTestSuite) TestParseCubeDomain() {
+	data := strings.Replace(identityCubeLut, "LUT_3D_SIZE 2", "LUT_3D_SIZE 2\nDOMAIN_MIN 0 0.5 0\nDOMAIN_MAX 2 2 2", 1)
+
+	lut, err := parseCubeLut(strings.NewReader(data))
+
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), [3]float64{0, 0.5, 0}, lut.DomainMin)
+	assert.Equal(s.T(), [3]float64{2, 2, 2}, lut.DomainMax)
+	// Domain describes the input range, so the output values are kept as is
+	assert.Equal(s.T(), []float32{1, 1, 1}, lut.Data[21:24])
+}
+
+func (s *LutTestSuite) TestParseCubeDefaultDomain() {
+	lut, err := parseCubeLut(strings.NewReader(identityCubeLut))
+
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), [3]float64{0, 0, 0}, lut.DomainMin)
+	assert.Equal(s.T(), [3]float64{1, 1, 1}, lut.DomainMax)
+}
+
+func (s *LutTestSuite) TestParseCubeInvalidDomain() {
+	data := strings.Replace(identityCubeLut, "LUT_3D_SIZE 2", "LUT_3D_SIZE 2\nDOMAIN_MIN 1 0 0\nDOMAIN_MAX 1 1 1", 1)
+
+	_, err := parseCubeLut(strings.NewReader(data))
+
+	require.Error(s.T(), err)
+}
+
+func (s *LutTestSuite) TestParseCubeNoSize() {
+	_, err := parseCubeLut(strings.NewReader("0 0 0\n"))
+
+	require.Error(s.T(), err)
+}
+
+func (s *LutTestSuite) TestParseCubeMissingEntries() {
+	data := strings.Replace(identityCubeLut, "1 1 1\n", "", 1)
+
+	_, err := parseCubeLut(strings.NewReader(data))
+
+	require.Error(s.T(), err)
+}
+
+func (s *LutTestSuite) TestParseCube1D() {
+	_, err := parseCubeLut(strings.NewReader("LUT_1D_SIZE 2\n0 0 0\n1 1 1\n"))
+
+	require.Error(s.T(), err)
+}
+
+// makeLut creates the LUT of the provided size using f to calculate the nodes
+func (s *LutTestSuite) makeLut(size int, f func(r, g, b float32) [3]float32) *lut3D {
+	lut := &lut3D{
+		Size:      size,
+		DomainMin: [3]float64{0, 0, 0},
+		DomainMax: [3]float64{1, 1, 1},
+	}
+
+	last := float32(size - 1)
+
+	for b := 0; b < size; b++ {
+		for g := 0; g < size; g++ {
+			for r := 0; r < size; r++ {
+				node := f(float32(r)/last, float32(g)/last, float32(b)/last)
+				lut.Data = append(lut.Data, node[:]...)
+			}
+		}
+	}
+
+	return lut
+}
+
+func (s *LutTestSuite) applyLut(lut *lut3D, color rgbColor) []byte {
+	img := new(vipsImage)
+	defer img.Clear()
+
+	require.Nil(s.T(), img.Solid(4, 4, color))
+	require.Nil(s.T(), img.ApplyLut(lut))
+
+	pixels, err := img.SRGBPixels()
+	require.Nil(s.T(), err)
+
+	return pixels[:3]
+}
+
+func (s *LutTestSuite) TestApplyIdentityLut() {
+	lut := s.makeLut(5, func(r, g, b float32) [3]float32 { return [3]float32{r, g, b} })
+
+	px := s.applyLut(lut, rgbColor{200, 100, 50})
+
+	assert.InDelta(s.T(), 200, int(px[0]), 1)
+	assert.InDelta(s.T(), 100, int(px[1]), 1)
+	assert.InDelta(s.T(), 50, int(px[2]), 1)
+}
+
+func (s *LutTestSuite) TestApplyLut() {
+	// Swaps red and blue and inverts green
+	lut := s.makeLut(5, func(r, g, b float32) [3]float32 { return [3]float32{b, 1 - g, r} })
+
+	px := s.applyLut(lut, rgbColor{200, 100, 50})
+
+	assert.InDelta(s.T(), 50, int(px[0]), 1)
+	assert.InDelta(s.T(), 155, int(px[1]), 1)
+	assert.InDelta(s.T(), 200, int(px[2]), 1)
+}
+
+func (s *LutTestSuite) TestApplyLutDomain() {
+	lut := s.makeLut(5, func(r, g, b float32) [3]float32 { return [3]float32{r, g, b} })
+	lut.DomainMax = [3]float64{2, 2, 2}
+
+	// Pixel values are mapped to the [0, 2] domain,
+	// so the identity LUT halves them
+	px := s.applyLut(lut, rgbColor{200, 100, 50})
+
+	assert.InDelta(s.T(), 100, int(px[0]), 1)
+	assert.InDelta(s.T(), 50, int(px[1]), 1)
+	assert.InDelta(s.T(), 25, int(px[2]), 1)
+}
+
+func TestLut(t *testing.T) {
+	suite.Run(t, new(LutTestSuite))
+}
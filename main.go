@@ -32,12 +32,22 @@ func initialize() error {
 
 	initPrometheus()
 
+	if err := initStatsd(); err != nil {
+		return err
+	}
+
 	if err := initDownloading(); err != nil {
 		return err
 	}
 
 	initErrorsReporting()
 
+	initFaceDetection()
+
+	if err := loadLuts(); err != nil {
+		return err
+	}
+
 	if err := initVips(); err != nil {
 		return err
 	}
@@ -55,7 +65,16 @@ func run() error {
 		return err
 	}
 
-	defer shutdownVips()
+	defer func() {
+		// Shutting down libvips while some images are still being processed
+		// can crash the process instead of letting it exit
+		if n := getInFlightRequests(); n > 0 {
+			logWarning("libvips is not shut down since %d requests are still in flight", n)
+			return
+		}
+
+		shutdownVips()
+	}()
 	defer closeErrorsReporting()
 
 	go func() {
@@ -86,6 +105,10 @@ func run() error {
 	}
 	defer shutdownServer(s)
 
+	// libvips and watermarks are loaded and the server is started,
+	// so we're ready to process images
+	setServerReady(true)
+
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 
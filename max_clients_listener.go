@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// maxClientsListener limits the number of simultaneous connections like
+// netutil.LimitListener does. Additionally, it counts the times the limit
+// was reached so the backpressure can be monitored
+type maxClientsListener struct {
+	net.Listener
+
+	sem       chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type maxClientsConn struct {
+	net.Conn
+
+	l           *maxClientsListener
+	releaseOnce sync.Once
+}
+
+func newMaxClientsListener(l net.Listener, n int) net.Listener {
+	return &maxClientsListener{
+		Listener: l,
+		sem:      make(chan struct{}, n),
+		done:     make(chan struct{}),
+	}
+}
+
+func (l *maxClientsListener) acquire() bool {
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	default:
+	}
+
+	// The limit is reached, so we wait for a connection to be closed
+	incrementConnectionsLimitedTotal()
+
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+func (l *maxClientsListener) release() {
+	<-l.sem
+}
+
+func (l *maxClientsListener) Accept() (net.Conn, error) {
+	if !l.acquire() {
+		// The listener is closed, so Accept returns the proper error
+		return l.Listener.Accept()
+	}
+
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		l.release()
+		return nil, err
+	}
+
+	return &maxClientsConn{Conn: conn, l: l}, nil
+}
+
+func (l *maxClientsListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.done) })
+	return err
+}
+
+func (c *maxClientsConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.l.release)
+	return err
+}
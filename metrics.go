@@ -0,0 +1,221 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The functions below are the single place where the metrics are emitted,
+// so all the enabled metrics backends share the same call sites
+
+func startDuration(observe func(time.Duration)) func() {
+	t := time.Now()
+	return func() {
+		observe(time.Since(t))
+	}
+}
+
+func incrementRequestsTotal() {
+	if prometheusEnabled {
+		prometheusRequestsTotal.Inc()
+	}
+
+	if statsdEnabled {
+		statsdCount("requests_total", 1)
+	}
+}
+
+// startRequestInProgress tracks the number of images that are being processed.
+// Call the returned function when the processing is finished
+func startRequestInProgress() func() {
+	addRequestsInProgress(1)
+	return func() { addRequestsInProgress(-1) }
+}
+
+func addRequestsInProgress(delta int) {
+	if prometheusEnabled {
+		prometheusRequestsInProgress.Add(float64(delta))
+	}
+
+	if statsdEnabled {
+		statsdGaugeDelta("requests_in_progress", delta)
+	}
+}
+
+func addDownloadsInProgress(delta int) {
+	if prometheusEnabled {
+		prometheusDownloadsInProgress.Add(float64(delta))
+	}
+
+	if statsdEnabled {
+		statsdGaugeDelta("downloads_in_progress", delta)
+	}
+}
+
+func incrementDownloadsLimitedTotal() {
+	if prometheusEnabled {
+		prometheusDownloadsLimited.Inc()
+	}
+
+	if statsdEnabled {
+		statsdCount("downloads_limited_total", 1)
+	}
+}
+
+func setMaxClients(n int) {
+	if prometheusEnabled {
+		prometheusMaxClients.Set(float64(n))
+	}
+
+	if statsdEnabled {
+		statsdGauge("max_clients", n)
+	}
+}
+
+func incrementConnectionsLimitedTotal() {
+	if prometheusEnabled {
+		prometheusConnectionsLimited.Inc()
+	}
+
+	if statsdEnabled {
+		statsdCount("connections_limited_total", 1)
+	}
+}
+
+// incrementResponsesTotal counts responses by status code and resulting format.
+// Only StatsD has this metric since Prometheus metrics are kept unlabeled
+func incrementResponsesTotal(status int, format imageType) {
+	if statsdEnabled {
+		tags := []string{statsdTag("status", strconv.Itoa(status))}
+		if format != imageTypeUnknown {
+			tags = append(tags, statsdTag("format", format.String()))
+		}
+
+		statsdCount("responses_total", 1, tags...)
+	}
+}
+
+func incrementErrorsTotal(t string) {
+	if prometheusEnabled {
+		prometheusErrorsTotal.With(prometheus.Labels{"type": t}).Inc()
+	}
+
+	if statsdEnabled {
+		statsdCount("errors_total", 1, statsdTag("type", t))
+	}
+}
+
+func incrementErrorResponsesTotal(category string) {
+	if prometheusEnabled {
+		prometheusErrorResponses.With(prometheus.Labels{"category": category}).Inc()
+	}
+
+	if statsdEnabled {
+		statsdCount("error_responses_total", 1, statsdTag("category", category))
+	}
+}
+
+func startRequestDuration() func() {
+	return startDuration(func(d time.Duration) {
+		if prometheusEnabled {
+			prometheusRequestDuration.Observe(d.Seconds())
+		}
+
+		if statsdEnabled {
+			statsdTiming("request_duration", d)
+		}
+	})
+}
+
+func startDownloadDuration() func() {
+	return startDuration(func(d time.Duration) {
+		if prometheusEnabled {
+			prometheusDownloadDuration.Observe(d.Seconds())
+		}
+
+		if statsdEnabled {
+			statsdTiming("download_duration", d)
+		}
+	})
+}
+
+func incrementDownloadRetriesTotal() {
+	if prometheusEnabled {
+		prometheusDownloadRetries.Inc()
+	}
+
+	if statsdEnabled {
+		statsdCount("download_retries_total", 1)
+	}
+}
+
+// startProcessingDuration starts measuring the processing duration.
+// The resulting format is read when the duration is recorded,
+// so it's already resolved by the processing
+func startProcessingDuration(po *processingOptions) func() {
+	return startDuration(func(d time.Duration) {
+		if prometheusEnabled {
+			prometheusProcessingDuration.Observe(d.Seconds())
+		}
+
+		if statsdEnabled {
+			if po.Format != imageTypeUnknown {
+				statsdTiming("processing_duration", d, statsdTag("format", po.Format.String()))
+			} else {
+				statsdTiming("processing_duration", d)
+			}
+		}
+	})
+}
+
+func observeBufferSize(t string, size int) {
+	if prometheusEnabled {
+		prometheusBufferSize.With(prometheus.Labels{"type": t}).Observe(float64(size))
+	}
+
+	if statsdEnabled {
+		statsdHistogram("buffer_size", size, statsdTag("type", t))
+	}
+}
+
+func setBufferDefaultSize(t string, size int) {
+	if prometheusEnabled {
+		prometheusBufferDefaultSize.With(prometheus.Labels{"type": t}).Set(float64(size))
+	}
+
+	if statsdEnabled {
+		statsdGauge("buffer_default_size", size, statsdTag("type", t))
+	}
+}
+
+func setBufferMaxSize(t string, size int) {
+	if prometheusEnabled {
+		prometheusBufferMaxSize.With(prometheus.Labels{"type": t}).Set(float64(size))
+	}
+
+	if statsdEnabled {
+		statsdGauge("buffer_max_size", size, statsdTag("type", t))
+	}
+}
+
+func setBufferPoolSize(t string, size int) {
+	if prometheusEnabled {
+		prometheusBufferPoolSize.With(prometheus.Labels{"type": t}).Set(float64(size))
+	}
+
+	if statsdEnabled {
+		statsdGauge("buffer_pool_size", size, statsdTag("type", t))
+	}
+}
+
+func setBuffersInUse(t string, n int) {
+	if prometheusEnabled {
+		prometheusBuffersInUse.With(prometheus.Labels{"type": t}).Set(float64(n))
+	}
+
+	if statsdEnabled {
+		statsdGauge("buffers_in_use", n, statsdTag("type", t))
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// persistURL builds the URL of the object the result is persisted to.
+// The key depends on the same request data as the result cache key,
+// so different results of the same path don't overwrite each other
+func persistURL(r *http.Request) string {
+	path := trimAfter(r.RequestURI, '?')
+
+	if len(conf.PathPrefix) > 0 {
+		path = strings.TrimPrefix(path, conf.PathPrefix)
+	}
+
+	path = strings.TrimPrefix(path, "/")
+
+	// Drop the signature
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		path = path[i+1:]
+	}
+
+	// The query is a part of the object key, so "?" is escaped
+	if query := resultQuery(r); len(query) > 0 {
+		path += "%3F" + url.PathEscape(query)
+	}
+
+	h := sha256.New()
+	h.Write([]byte(path))
+	writeResultVariant(h, r)
+
+	return strings.NewReplacer(
+		"%path", path,
+		"%hash", hex.EncodeToString(h.Sum(nil)),
+	).Replace(conf.PersistURLTemplate)
+}
+
+// checkPersistURLTemplate checks that %path can distinguish the results.
+// It can't contain the headers we vary on, so %hash should be used instead
+func checkPersistURLTemplate() error {
+	if !strings.Contains(conf.PersistURLTemplate, "%path") {
+		return nil
+	}
+
+	if headers := resultVaryHeaders(); len(headers) > 0 {
+		return fmt.Errorf("Persist URL template can't use %%path when the result depends on the %s headers, use %%hash instead", strings.Join(headers, ", "))
+	}
+
+	return nil
+}
+
+func persistImage(ctx context.Context, r *http.Request, data []byte) error {
+	if newRelicEnabled {
+		newRelicCancel := startNewRelicSegment(ctx, "Persisting image")
+		defer newRelicCancel()
+	}
+
+	destURL := persistURL(r)
+
+	req, err := http.NewRequest("PUT", destURL, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("Can't persist image to %s: %s", destURL, err)
+	}
+
+	req.Header.Set("Content-Type", getProcessingOptions(ctx).Format.Mime())
+
+	res, err := downloadClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Can't persist image to %s: %s", destURL, checkTimeoutErr(err))
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("Can't persist image to %s; Status: %d; %s", destURL, res.StatusCode, string(body))
+	}
+
+	return nil
+}
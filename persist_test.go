@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type PersistTestSuite struct {
+	MainTestSuite
+
+	oldVaryHeaders []string
+}
+
+func (s *PersistTestSuite) SetupTest() {
+	s.MainTestSuite.SetupTest()
+
+	s.oldVaryHeaders = varyHeaders
+	varyHeaders = nil
+}
+
+func (s *PersistTestSuite) TearDownTest() {
+	varyHeaders = s.oldVaryHeaders
+
+	s.MainTestSuite.TearDownTest()
+}
+
+func (s *PersistTestSuite) persistURL(path string, header http.Header) string {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+
+	return persistURL(r)
+}
+
+func (s *PersistTestSuite) TestPersistURLPath() {
+	conf.PersistURLTemplate = "s3://test/%path"
+
+	assert.Equal(
+		s.T(),
+		"s3://test/rs:fit:100/plain/http://images.dev/lorem/ipsum.jpg",
+		s.persistURL("/signature/rs:fit:100/plain/http://images.dev/lorem/ipsum.jpg", nil),
+	)
+}
+
+func (s *PersistTestSuite) TestPersistURLQuery() {
+	conf.PersistURLTemplate = "s3://test/%path"
+	conf.EnableQueryOptions = true
+
+	path := "/signature/plain/http://images.dev/lorem/ipsum.jpg"
+
+	assert.Equal(s.T(), "s3://test/plain/http://images.dev/lorem/ipsum.jpg%3Fh=50&w=100", s.persistURL(path+"?w=100&h=50", nil))
+	// The query is canonical, so the order of the arguments doesn't matter
+	assert.Equal(s.T(), s.persistURL(path+"?w=100&h=50", nil), s.persistURL(path+"?h=50&w=100", nil))
+	assert.NotEqual(s.T(), s.persistURL(path+"?w=100", nil), s.persistURL(path+"?w=500", nil))
+
+	conf.PersistURLTemplate = "s3://test/%hash"
+
+	assert.NotEqual(s.T(), s.persistURL(path+"?w=100", nil), s.persistURL(path+"?w=500", nil))
+}
+
+func (s *PersistTestSuite) TestPersistURLVaryHeaders() {
+	conf.PersistURLTemplate = "s3://test/%hash"
+	varyHeaders = []string{"Accept", "Accept-Encoding"}
+
+	path := "/signature/plain/http://images.dev/lorem/ipsum.jpg"
+
+	webp := s.persistURL(path, http.Header{"Accept": {"image/webp"}})
+	jpeg := s.persistURL(path, http.Header{"Accept": {"image/jpeg"}})
+	assert.NotEqual(s.T(), webp, jpeg)
+
+	// Compression is applied when responding, so it doesn't affect the key
+	gzip := s.persistURL(path, http.Header{"Accept": {"image/webp"}, "Accept-Encoding": {"gzip"}})
+	assert.Equal(s.T(), webp, gzip)
+}
+
+func (s *PersistTestSuite) TestCheckPersistURLTemplate() {
+	conf.PersistURLTemplate = "s3://test/%path"
+	varyHeaders = []string{"Accept-Encoding"}
+
+	assert.Nil(s.T(), checkPersistURLTemplate())
+
+	varyHeaders = []string{"Accept", "Accept-Encoding"}
+
+	assert.NotNil(s.T(), checkPersistURLTemplate())
+
+	conf.PersistURLTemplate = "s3://test/%hash"
+
+	assert.Nil(s.T(), checkPersistURLTemplate())
+}
+
+func (s *PersistTestSuite) TestPersistImageStatus() {
+	for _, status := range []int{200, 201, 204, 403} {
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.WriteHeader(status)
+		}))
+
+		conf.PersistURLTemplate = srv.URL + "/%hash"
+
+		po := newProcessingOptions()
+		po.Format = imageTypePNG
+
+		ctx := context.WithValue(context.Background(), processingOptionsCtxKey, po)
+		r := httptest.NewRequest(http.MethodGet, "/signature/plain/http://images.dev/lorem/ipsum.jpg", nil)
+
+		err := persistImage(ctx, r, []byte("data"))
+		if status == 403 {
+			require.NotNil(s.T(), err)
+		} else {
+			require.Nil(s.T(), err, status)
+		}
+
+		srv.Close()
+	}
+}
+
+func TestPersist(t *testing.T) {
+	suite.Run(t, new(PersistTestSuite))
+}
@@ -1,10 +1,21 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"strings"
 )
 
+const presetsPath = "/presets"
+
+// redactedPresetOptions are the options whose arguments may contain
+// sensitive data like credentials in URLs, so they're not exposed
+var redactedPresetOptions = map[string]bool{
+	"frame_url": true,
+	"fru":       true,
+}
+
 type presets map[string]urlOptions
 
 func parsePreset(p presets, presetStr string) error {
@@ -54,3 +65,38 @@ func checkPresets(p presets) error {
 
 	return nil
 }
+
+// presetsStrings returns the presets options as they're written in the URLs.
+// Arguments of the options that may contain sensitive data are redacted
+func presetsStrings(p presets) map[string][]string {
+	res := make(map[string][]string, len(p))
+
+	for name, opts := range p {
+		strs := make([]string, len(opts))
+
+		for i, opt := range opts {
+			if redactedPresetOptions[opt.Name] {
+				strs[i] = opt.Name + ":[REDACTED]"
+			} else {
+				strs[i] = strings.Join(append([]string{opt.Name}, opt.Args...), ":")
+			}
+		}
+
+		res[name] = strs
+	}
+
+	return res
+}
+
+func handlePresets(reqID string, rw http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(presetsStrings(conf.Presets))
+	if err != nil {
+		panic(err)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(200)
+	rw.Write(data)
+	logResponse(reqID, r, 200, nil, nil, nil)
+}
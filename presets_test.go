@@ -108,6 +108,18 @@ func (s *PresetsTestSuite) TestCheckPresetsInvalid() {
 	assert.Error(s.T(), err)
 }
 
+func (s *PresetsTestSuite) TestPresetsStrings() {
+	p := make(presets)
+
+	require.Nil(s.T(), parsePreset(p, "test=resize:fit:100:200/sharpen:2"))
+	require.Nil(s.T(), parsePreset(p, "framed=frame_url:aHR0cHM6Ly91c2VyOnBhc3NAZXhhbXBsZS5jb20vZnJhbWUucG5n/fru:abc"))
+
+	assert.Equal(s.T(), map[string][]string{
+		"test":   {"resize:fit:100:200", "sharpen:2"},
+		"framed": {"frame_url:[REDACTED]", "fru:[REDACTED]"},
+	}, presetsStrings(p))
+}
+
 func TestPresets(t *testing.T) {
 	suite.Run(t, new(PresetsTestSuite))
 }
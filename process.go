@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"math"
 	"runtime"
+	"time"
 
 	"github.com/imgproxy/imgproxy/v2/imagemeta"
 )
@@ -15,9 +16,17 @@ const (
 
 	// https://chromium.googlesource.com/webm/libwebp/+/refs/heads/master/src/webp/encode.h#529
 	webpMaxDimension = 16383.0
+
+	// The maximum number of saves while searching for the quality that fits max_bytes
+	maxBytesIterations = 10
+
+	defaultWatermarkName = ""
 )
 
-var errConvertingNonSvgToSvg = newError(422, "Converting non-SVG images to SVG is not supported", "Converting non-SVG images to SVG is not supported")
+var (
+	errConvertingNonSvgToSvg = newError(422, "Converting non-SVG images to SVG is not supported", "Converting non-SVG images to SVG is not supported").SetCategory("unsupported_conversion")
+	errSourceAnimated        = newError(422, "Animated source images are not allowed", "Invalid source image").SetCategory("source_animated")
+)
 
 func imageTypeLoadSupport(imgtype imageType) bool {
 	return imgtype == imageTypeSVG ||
@@ -29,9 +38,15 @@ func imageTypeSaveSupport(imgtype imageType) bool {
 	return imgtype == imageTypeSVG || vipsTypeSupportSave[imgtype]
 }
 
+func imageTypeSupportsHighBitDepth(imgtype imageType) bool {
+	return imgtype == imageTypePNG || imgtype == imageTypeTIFF
+}
+
 func imageTypeGoodForWeb(imgtype imageType) bool {
 	return imgtype != imageTypeTIFF &&
-		imgtype != imageTypeBMP
+		imgtype != imageTypeBMP &&
+		imgtype != imageTypeRAW &&
+		imgtype != imageTypePDF
 }
 
 func canSwitchFormat(src, dst, want imageType) bool {
@@ -41,6 +56,35 @@ func canSwitchFormat(src, dst, want imageType) bool {
 			vipsSupportAnimation(want))
 }
 
+// autoFormat selects the resulting format by the source image transparency:
+// JPEG for opaque images and PNG for images with alpha. If the source image can't
+// be converted without losing the animation, its own format is used when possible
+func autoFormat(imgdata *imageData) imageType {
+	img := new(vipsImage)
+	defer img.Clear()
+
+	want := imageTypeUnknown
+
+	// Only the header is read here, the image isn't decoded
+	if err := img.Load(imgdata.Data, imgdata.Type, 1, 1.0, 1); err == nil {
+		if img.HasAlpha() {
+			want = imageTypePNG
+		} else {
+			want = imageTypeJPEG
+		}
+	}
+
+	if want != imageTypeUnknown && canSwitchFormat(imgdata.Type, imageTypeUnknown, want) {
+		return want
+	}
+
+	if imageTypeSaveSupport(imgdata.Type) && imageTypeGoodForWeb(imgdata.Type) {
+		return imgdata.Type
+	}
+
+	return imageTypeJPEG
+}
+
 func extractMeta(img *vipsImage, baseAngle int, useOrientation bool) (int, int, int, bool) {
 	width := img.Width()
 	height := img.Height()
@@ -86,7 +130,10 @@ func calcScale(width, height int, po *processingOptions, imgtype imageType) floa
 		dstH = srcH
 	}
 
-	if dstW == srcW && dstH == srcH {
+	if po.Megapixels > 0 {
+		// Keep the aspect ratio and hit the target pixel count
+		shrink = math.Sqrt(srcW * srcH / (po.Megapixels * 1000000))
+	} else if dstW == srcW && dstH == srcH {
 		shrink = 1
 	} else {
 		wshrink := srcW / dstW
@@ -113,6 +160,8 @@ func calcScale(width, height int, po *processingOptions, imgtype imageType) floa
 		case rt == resizeFit:
 			shrink = math.Max(wshrink, hshrink)
 		default:
+			// Both fill and min make the image cover the given size,
+			// fill then crops the projecting parts while min keeps them
 			shrink = math.Min(wshrink, hshrink)
 		}
 	}
@@ -121,7 +170,10 @@ func calcScale(width, height int, po *processingOptions, imgtype imageType) floa
 		shrink = 1
 	}
 
-	shrink /= po.Dpr
+	// Megapixels define the resulting pixel count, so dpr isn't applied to them
+	if po.Megapixels == 0 {
+		shrink /= po.Dpr
+	}
 
 	if shrink > srcW {
 		shrink = srcW
@@ -170,6 +222,16 @@ func calcJpegShink(scale float64, imgtype imageType) int {
 	return 1
 }
 
+// calcDprSize returns the requested result dimensions multiplied by dpr.
+// Megapixels take precedence over the dimensions, so they are ignored in this case
+func calcDprSize(po *processingOptions) (int, int) {
+	if po.Megapixels > 0 {
+		return 0, 0
+	}
+
+	return scaleInt(po.Width, po.Dpr), scaleInt(po.Height, po.Dpr)
+}
+
 func calcCropSize(orig int, crop float64) int {
 	switch {
 	case crop == 0.0:
@@ -181,6 +243,43 @@ func calcCropSize(orig int, crop float64) int {
 	}
 }
 
+// calcZoomedCropSize returns the crop size divided by zoom.
+// When crop isn't set, the whole source size is zoomed
+func calcZoomedCropSize(orig, crop int, zoom float64) int {
+	if zoom == 1 {
+		return crop
+	}
+
+	return minInt(orig, maxInt(1, scaleInt(minNonZeroInt(crop, orig), 1/zoom)))
+}
+
+// calcAspectRatioCropSize returns the size of the largest area of the given size
+// that has the required aspect ratio. The missing result dimension is then
+// derived by calcScale since the area already has the required ratio
+func calcAspectRatioCropSize(width, height int, ratio float64) (int, int) {
+	if float64(width)/float64(height) > ratio {
+		return maxInt(1, roundToInt(float64(height)*ratio)), height
+	}
+
+	return width, maxInt(1, roundToInt(float64(width)/ratio))
+}
+
+// calcExtendAspectRatioSize returns the size of the canvas that has the aspect ratio
+// of the requested size and contains the whole image. The image is only padded, never cropped
+func calcExtendAspectRatioSize(width, height, dprWidth, dprHeight int) (int, int) {
+	if dprWidth <= 0 || dprHeight <= 0 {
+		return width, height
+	}
+
+	ratio := float64(dprWidth) / float64(dprHeight)
+
+	if float64(width)/float64(height) < ratio {
+		return maxInt(width, int(math.Round(float64(height)*ratio))), height
+	}
+
+	return width, maxInt(height, int(math.Round(float64(width)/ratio)))
+}
+
 func calcPosition(width, height, innerWidth, innerHeight int, gravity *gravityOptions, allowOverflow bool) (left, top int) {
 	if gravity.Type == gravityFocusPoint {
 		pointX := scaleInt(width, gravity.X)
@@ -245,7 +344,8 @@ func cropImage(img *vipsImage, cropWidth, cropHeight int, gravity *gravityOption
 		if err := img.CopyMemory(); err != nil {
 			return err
 		}
-		if err := img.SmartCrop(cropWidth, cropHeight); err != nil {
+		logDebug("Smart crop with %s strategy", gravity.Strategy)
+		if err := img.SmartCrop(cropWidth, cropHeight, gravity.Strategy); err != nil {
 			return err
 		}
 		// Applying additional modifications after smart crop causes SIGSEGV on Alpine
@@ -257,23 +357,54 @@ func cropImage(img *vipsImage, cropWidth, cropHeight int, gravity *gravityOption
 	return img.Crop(left, top, cropWidth, cropHeight)
 }
 
+// getWatermark returns the requested named watermark
+// falling back to the default one
+func getWatermark(opts *watermarkOptions) *imageData {
+	if wmData, ok := watermarks[opts.Name]; ok {
+		return wmData
+	}
+
+	return watermarks[defaultWatermarkName]
+}
+
+func hasWatermark(opts *watermarkOptions) bool {
+	return getWatermark(opts) != nil || len(opts.Text) > 0
+}
+
 func prepareWatermark(wm *vipsImage, wmData *imageData, opts *watermarkOptions, imgWidth, imgHeight int) error {
-	if err := wm.Load(wmData.Data, wmData.Type, 1, 1.0, 1); err != nil {
-		return err
+	var (
+		data    []byte
+		imgtype imageType
+	)
+
+	if len(opts.Text) > 0 {
+		font := fmt.Sprintf("%s %d", conf.WatermarkFont, conf.WatermarkFontSize)
+		// The text is rendered not larger than the image
+		// since larger watermarks are downscaled anyway
+		if err := wm.Text(opts.Text, font, imgWidth, imgHeight); err != nil {
+			return err
+		}
+		// Rendered text has alpha so we need a format that supports it
+		imgtype = imageTypePNG
+	} else {
+		if err := wm.Load(wmData.Data, wmData.Type, 1, 1.0, 1); err != nil {
+			return err
+		}
+		data, imgtype = wmData.Data, wmData.Type
 	}
 
 	po := newProcessingOptions()
 	po.ResizingType = resizeFit
 	po.Dpr = 1
 	po.Enlarge = true
-	po.Format = wmData.Type
+	po.Format = imgtype
 
 	if opts.Scale > 0 {
 		po.Width = maxInt(scaleInt(imgWidth, opts.Scale), 1)
 		po.Height = maxInt(scaleInt(imgHeight, opts.Scale), 1)
 	}
 
-	if err := transformImage(context.Background(), wm, wmData.Data, po, wmData.Type); err != nil {
+	if err := transformImage(context.Background(), wm, data, po, imgtype); err != nil {
 		return err
 	}
 
@@ -287,7 +418,19 @@ func prepareWatermark(wm *vipsImage, wmData *imageData, opts *watermarkOptions,
 
 	left, top := calcPosition(imgWidth, imgHeight, wm.Width(), wm.Height(), &opts.Gravity, true)
 
-	return wm.Embed(imgWidth, imgHeight, left, top, rgbColor{0, 0, 0}, true)
+	return wm.Embed(imgWidth, imgHeight, left, top, rgbColor{0, 0, 0}, 0)
+}
+
+// watermarkFitsMemory checks if the image and the full-size RGBA watermark
+// fit IMGPROXY_WATERMARK_MAX_MEMORY together
+func watermarkFitsMemory(img *vipsImage) bool {
+	if conf.WatermarkMaxMemory <= 0 {
+		return true
+	}
+
+	wmSize := int64(img.Width()) * int64(img.Height()) * 4
+
+	return img.MemorySize()+wmSize <= int64(conf.WatermarkMaxMemory)*1024*1024
 }
 
 func applyWatermark(img *vipsImage, wmData *imageData, opts *watermarkOptions, framesCount int) error {
@@ -295,6 +438,14 @@ func applyWatermark(img *vipsImage, wmData *imageData, opts *watermarkOptions, f
 		return err
 	}
 
+	if !watermarkFitsMemory(img) {
+		logWarning(
+			"Watermark is skipped: %dx%d image with watermark exceeds IMGPROXY_WATERMARK_MAX_MEMORY",
+			img.Width(), img.Height(),
+		)
+		return nil
+	}
+
 	if err := img.CopyMemory(); err != nil {
 		return err
 	}
@@ -320,6 +471,57 @@ func applyWatermark(img *vipsImage, wmData *imageData, opts *watermarkOptions, f
 	return img.ApplyWatermark(wm, opacity)
 }
 
+// applyFrame stretches the frame image to the image dimensions
+// and composites it over the image
+func applyFrame(img *vipsImage, frameData *imageData, framesCount int) error {
+	if err := img.RgbColourspace(); err != nil {
+		return err
+	}
+
+	if err := img.CopyMemory(); err != nil {
+		return err
+	}
+
+	frame := new(vipsImage)
+	defer frame.Clear()
+
+	width := img.Width()
+	height := img.Height() / framesCount
+
+	if err := frame.Load(frameData.Data, frameData.Type, 1, 1.0, 1); err != nil {
+		return err
+	}
+
+	if err := frame.Rad2Float(); err != nil {
+		return err
+	}
+
+	if err := frame.RgbColourspace(); err != nil {
+		return err
+	}
+
+	if err := frame.EnsureAlpha(); err != nil {
+		return err
+	}
+
+	if err := frame.Stretch(width, height); err != nil {
+		return err
+	}
+
+	// Resized image may be a pixel off, so we fit it to the exact size
+	if err := frame.Embed(width, height, 0, 0, rgbColor{0, 0, 0}, 0); err != nil {
+		return err
+	}
+
+	if framesCount > 1 {
+		if err := frame.Replicate(width, img.Height()); err != nil {
+			return err
+		}
+	}
+
+	return img.ApplyWatermark(frame, 1)
+}
+
 func copyMemoryAndCheckTimeout(ctx context.Context, img *vipsImage) error {
 	err := img.CopyMemory()
 	checkTimeout(ctx)
@@ -332,6 +534,13 @@ func transformImage(ctx context.Context, img *vipsImage, data []byte, po *proces
 		trimmed bool
 	)
 
+	if po.BitDepth == 16 {
+		img.HighBitDepth = imageTypeSupportsHighBitDepth(po.Format) && img.IsHighBitDepth()
+		if !img.HighBitDepth {
+			logWarning("16-bit depth is supported only for PNG and TIFF results of high bit depth sources, the result will be 8-bit")
+		}
+	}
+
 	if po.Trim.Enabled {
 		if err = img.Trim(po.Trim.Threshold, po.Trim.Smart, po.Trim.Color, po.Trim.EqualHor, po.Trim.EqualVer); err != nil {
 			return err
@@ -347,6 +556,21 @@ func transformImage(ctx context.Context, img *vipsImage, data []byte, po *proces
 	cropWidth := calcCropSize(srcWidth, po.Crop.Width)
 	cropHeight := calcCropSize(srcHeight, po.Crop.Height)
 
+	// Zoom narrows the area to crop, so the area is scaled up
+	// and more of its detail gets to the result
+	cropWidth = calcZoomedCropSize(srcWidth, cropWidth, po.ZoomWidth)
+	cropHeight = calcZoomedCropSize(srcHeight, cropHeight, po.ZoomHeight)
+
+	if po.AspectRatio > 0 {
+		if po.Width > 0 && po.Height > 0 {
+			logWarning("Aspect ratio is ignored since both width and height are set")
+		} else {
+			cropWidth, cropHeight = calcAspectRatioCropSize(
+				minNonZeroInt(cropWidth, srcWidth), minNonZeroInt(cropHeight, srcHeight), po.AspectRatio,
+			)
+		}
+	}
+
 	cropGravity := po.Crop.Gravity
 	if cropGravity.Type == gravityUnknown {
 		cropGravity = po.Gravity
@@ -395,7 +619,12 @@ func transformImage(ctx context.Context, img *vipsImage, data []byte, po *proces
 	}
 
 	iccImported := false
-	convertToLinear := conf.UseLinearColorspace && scale != 1
+
+	// Linear colorspace conversion is pretty expensive and doesn't make much sense
+	// for slight resizes, so we use it only when scale change exceeds the threshold
+	linearThreshold := po.LinearColorspaceThreshold
+	convertToLinear := conf.UseLinearColorspace && !po.FastMode &&
+		(scale < linearThreshold || scale > 1/linearThreshold)
 
 	if convertToLinear {
 		if err = img.ImportColourProfile(); err != nil {
@@ -417,7 +646,7 @@ func transformImage(ctx context.Context, img *vipsImage, data []byte, po *proces
 	hasAlpha := img.HasAlpha()
 
 	if scale != 1 {
-		if err = img.Resize(scale, hasAlpha); err != nil {
+		if err = img.Resize(scale, hasAlpha, po.FastMode); err != nil {
 			return err
 		}
 	}
@@ -440,21 +669,22 @@ func transformImage(ctx context.Context, img *vipsImage, data []byte, po *proces
 		return err
 	}
 
-	dprWidth := scaleInt(po.Width, po.Dpr)
-	dprHeight := scaleInt(po.Height, po.Dpr)
+	dprWidth, dprHeight := calcDprSize(po)
 
 	if err = cropImage(img, cropWidth, cropHeight, &cropGravity); err != nil {
 		return err
 	}
-	if err = cropImage(img, dprWidth, dprHeight, &po.Gravity); err != nil {
-		return err
+	if po.ResizingType != resizeMin {
+		if err = cropImage(img, dprWidth, dprHeight, &po.Gravity); err != nil {
+			return err
+		}
 	}
 
 	if po.Format == imageTypeWEBP {
 		webpLimitShrink := float64(maxInt(img.Width(), img.Height())) / webpMaxDimension
 
 		if webpLimitShrink > 1.0 {
-			if err = img.Resize(1.0/webpLimitShrink, hasAlpha); err != nil {
+			if err = img.Resize(1.0/webpLimitShrink, hasAlpha, po.FastMode); err != nil {
 				return err
 			}
 			logWarning("WebP dimension size is limited to %d. The image is rescaled to %dx%d", int(webpMaxDimension), img.Width(), img.Height())
@@ -465,6 +695,29 @@ func transformImage(ctx context.Context, img *vipsImage, data []byte, po *proces
 		}
 	}
 
+	// Gamma correction and normalization are done before converting back from linear colorspace
+	if po.Gamma != 1 {
+		if err = img.Gamma(po.Gamma); err != nil {
+			return err
+		}
+	}
+
+	if po.Normalize.Enabled {
+		if err = img.Normalize(po.Normalize.Clip); err != nil {
+			return err
+		}
+	}
+
+	if po.RoundCorner.Enabled {
+		if err = img.RoundCorners(scaleInt(po.RoundCorner.Rx, po.Dpr), scaleInt(po.RoundCorner.Ry, po.Dpr)); err != nil {
+			return err
+		}
+
+		// Corners are transparent now, so the image will be flattened
+		// with the background color if the format doesn't support alpha
+		hasAlpha = true
+	}
+
 	keepProfile := !po.StripColorProfile && po.Format.SupportsColourProfile()
 
 	if iccImported {
@@ -502,23 +755,53 @@ func transformImage(ctx context.Context, img *vipsImage, data []byte, po *proces
 	transparentBg := po.Format.SupportsAlpha() && !po.Flatten
 
 	if hasAlpha && !transparentBg {
-		if err = img.Flatten(po.Background); err != nil {
+		if po.Format.SupportsAlpha() && po.BackgroundAlpha < 1 {
+			err = img.Background(po.Background, po.BackgroundAlpha)
+		} else {
+			err = img.Flatten(po.Background)
+		}
+		if err != nil {
 			return err
 		}
 	}
 
+	// Extended areas are filled the same way as the image background
+	bgAlpha := 1.0
+	if transparentBg {
+		bgAlpha = 0
+	} else if po.Format.SupportsAlpha() {
+		bgAlpha = po.BackgroundAlpha
+	}
+
 	if err = copyMemoryAndCheckTimeout(ctx, img); err != nil {
 		return err
 	}
 
 	if po.Blur > 0 {
-		if err = img.Blur(po.Blur); err != nil {
+		if po.BlurMode == blurBox {
+			err = img.BoxBlur(po.Blur)
+		} else {
+			err = img.Blur(po.Blur)
+		}
+		if err != nil {
 			return err
 		}
 	}
 
 	if po.Sharpen > 0 {
-		if err = img.Sharpen(po.Sharpen); err != nil {
+		if err = img.Unsharp(po.Sharpen, po.SharpenAmount, po.SharpenThreshold); err != nil {
+			return err
+		}
+	}
+
+	if pixels := scaleInt(po.Pixelate, po.Dpr); pixels > 1 {
+		if err = img.Pixelate(pixels); err != nil {
+			return err
+		}
+	}
+
+	if len(po.Filter) > 0 {
+		if err = img.ApplyLut(luts[po.Filter]); err != nil {
 			return err
 		}
 	}
@@ -528,45 +811,89 @@ func transformImage(ctx context.Context, img *vipsImage, data []byte, po *proces
 	}
 
 	if po.Extend.Enabled && (dprWidth > img.Width() || dprHeight > img.Height()) {
-		offX, offY := calcPosition(dprWidth, dprHeight, img.Width(), img.Height(), &po.Extend.Gravity, false)
-		if err = img.Embed(dprWidth, dprHeight, offX, offY, po.Background, transparentBg); err != nil {
+		// The image may be larger than the requested size along one side
+		// when it isn't cropped, so we extend only the smaller side
+		extendWidth, extendHeight := maxInt(dprWidth, img.Width()), maxInt(dprHeight, img.Height())
+
+		offX, offY := calcPosition(extendWidth, extendHeight, img.Width(), img.Height(), &po.Extend.Gravity, false)
+		if err = img.Embed(extendWidth, extendHeight, offX, offY, po.Background, bgAlpha); err != nil {
 			return err
 		}
 	}
 
+	if po.ExtendAspectRatio.Enabled {
+		extendWidth, extendHeight := calcExtendAspectRatioSize(img.Width(), img.Height(), dprWidth, dprHeight)
+
+		if extendWidth > img.Width() || extendHeight > img.Height() {
+			offX, offY := calcPosition(extendWidth, extendHeight, img.Width(), img.Height(), &po.ExtendAspectRatio.Gravity, false)
+			if err = img.Embed(extendWidth, extendHeight, offX, offY, po.Background, bgAlpha); err != nil {
+				return err
+			}
+		}
+	}
+
 	if po.Padding.Enabled {
 		paddingTop := scaleInt(po.Padding.Top, po.Dpr)
 		paddingRight := scaleInt(po.Padding.Right, po.Dpr)
 		paddingBottom := scaleInt(po.Padding.Bottom, po.Dpr)
 		paddingLeft := scaleInt(po.Padding.Left, po.Dpr)
+
+		paddingColor, paddingAlpha := po.Background, bgAlpha
+		if po.Padding.HasColor {
+			paddingColor, paddingAlpha = po.Padding.Color, 1.0
+		}
+
 		if err = img.Embed(
 			img.Width()+paddingLeft+paddingRight,
 			img.Height()+paddingTop+paddingBottom,
 			paddingLeft,
 			paddingTop,
-			po.Background,
-			transparentBg,
+			paddingColor,
+			paddingAlpha,
 		); err != nil {
 			return err
 		}
 	}
 
-	if po.Watermark.Enabled && watermark != nil {
-		if err = applyWatermark(img, watermark, &po.Watermark, 1); err != nil {
+	if po.Grayscale {
+		if err = img.GrayscaleColourspace(); err != nil {
 			return err
 		}
 	}
 
-	if err = img.RgbColourspace(); err != nil {
+	if po.Watermark.Enabled && hasWatermark(&po.Watermark) {
+		if err = applyWatermark(img, getWatermark(&po.Watermark), &po.Watermark, 1); err != nil {
+			return err
+		}
+	}
+
+	if len(po.FrameURL) > 0 {
+		if err = applyFrame(img, getFrameImageData(ctx), 1); err != nil {
+			return err
+		}
+	}
+
+	// Single-band JPEGs may break consumers that expect 3 channels,
+	// so we keep grayscale images single-band only when it's explicitly allowed
+	if po.Grayscale && po.Format == imageTypeJPEG && conf.JpegSingleBandGrayscale {
+		// RGB colour profile can't be used with a single-band image
+		if err = img.RemoveColourProfile(); err != nil {
+			return err
+		}
+	} else if err = img.RgbColourspace(); err != nil {
 		return err
 	}
 
-	if err := img.CastUchar(); err != nil {
+	if img.HighBitDepth {
+		if err := img.CastUshort(); err != nil {
+			return err
+		}
+	} else if err := img.CastUchar(); err != nil {
 		return err
 	}
 
 	if po.StripMetadata {
-		if err := img.Strip(); err != nil {
+		if err := img.Strip(po.KeepCopyright); err != nil {
 			return err
 		}
 	}
@@ -574,6 +901,23 @@ func transformImage(ctx context.Context, img *vipsImage, data []byte, po *proces
 	return copyMemoryAndCheckTimeout(ctx, img)
 }
 
+// webpFramesClearPixels checks if any frame of the animated WebP
+// can make the canvas pixels more transparent
+func webpFramesClearPixels(data []byte) bool {
+	frames, err := imagemeta.DecodeWebpFrames(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+
+	for _, f := range frames {
+		if f.DisposeToBackground || !f.Blend {
+			return true
+		}
+	}
+
+	return false
+}
+
 func transformAnimated(ctx context.Context, img *vipsImage, data []byte, po *processingOptions, imgtype imageType) error {
 	if po.Trim.Enabled {
 		logWarning("Trim is not supported for animated images")
@@ -627,6 +971,10 @@ func transformAnimated(ctx context.Context, img *vipsImage, data []byte, po *pro
 	po.Watermark.Enabled = false
 	defer func() { po.Watermark.Enabled = watermarkEnabled }()
 
+	frameURL := po.FrameURL
+	po.FrameURL = ""
+	defer func() { po.FrameURL = frameURL }()
+
 	frames := make([]*vipsImage, framesCount)
 	defer func() {
 		for _, frame := range frames {
@@ -637,6 +985,10 @@ func transformAnimated(ctx context.Context, img *vipsImage, data []byte, po *pro
 	}()
 
 	for i := 0; i < framesCount; i++ {
+		// Each frame is processed by a chain of libvips operations,
+		// so we check the timeout before starting the next one
+		checkTimeout(ctx)
+
 		frame := new(vipsImage)
 
 		if err = img.Extract(frame, 0, i*frameHeight, imgWidth, frameHeight); err != nil {
@@ -658,8 +1010,14 @@ func transformAnimated(ctx context.Context, img *vipsImage, data []byte, po *pro
 		return err
 	}
 
-	if watermarkEnabled && watermark != nil {
-		if err = applyWatermark(img, watermark, &po.Watermark, framesCount); err != nil {
+	if watermarkEnabled && hasWatermark(&po.Watermark) {
+		if err = applyWatermark(img, getWatermark(&po.Watermark), &po.Watermark, framesCount); err != nil {
+			return err
+		}
+	}
+
+	if len(frameURL) > 0 {
+		if err = applyFrame(img, getFrameImageData(ctx), framesCount); err != nil {
 			return err
 		}
 	}
@@ -672,20 +1030,19 @@ func transformAnimated(ctx context.Context, img *vipsImage, data []byte, po *pro
 		return err
 	}
 
-	if len(delay) == 0 {
-		delay = make([]int, framesCount)
-		for i := range delay {
-			delay[i] = 40
-		}
-	} else if len(delay) > framesCount {
-		delay = delay[:framesCount]
-	}
-
 	img.SetInt("page-height", frames[0].Height())
-	img.SetIntSlice("delay", delay)
+	img.SetIntSlice("delay", framesDelay(delay, gifDelay, framesCount))
 	img.SetInt("loop", loop)
 	img.SetInt("n-pages", framesCount)
 
+	if imgtype == imageTypeWEBP && po.Format == imageTypeGIF && img.HasAlpha() && webpFramesClearPixels(data) {
+		// libvips composes animated WebP frames according to their disposal and blending
+		// methods, so every frame is a full canvas. GIF frames are rendered over
+		// the previous ones by default, so pixels that become transparent would show
+		// the previous frame through. We dispose GIF frames to background to prevent ghosting
+		img.SetInt(gifDisposalField, gifDisposalBackground)
+	}
+
 	// Legacy fields
 	// TODO: remove this in major update
 	if gifLoop >= 0 {
@@ -698,6 +1055,218 @@ func transformAnimated(ctx context.Context, img *vipsImage, data []byte, po *pro
 	return nil
 }
 
+// framesDelay returns the delay of each frame in milliseconds.
+// Old libvips versions provide only the legacy gif-delay field that is in centiseconds
+// and is the same for all frames, so we translate it to make animated WebP keep the timing
+func framesDelay(delay []int, gifDelay, framesCount int) []int {
+	if len(delay) >= framesCount {
+		return delay[:framesCount]
+	}
+
+	frameDelay := 40
+	if len(delay) > 0 {
+		frameDelay = delay[len(delay)-1]
+	} else if gifDelay > 0 {
+		frameDelay = gifDelay * 10
+	}
+
+	res := make([]int, framesCount)
+	copy(res, delay)
+	for i := len(delay); i < framesCount; i++ {
+		res[i] = frameDelay
+	}
+
+	return res
+}
+
+// noopOptions are the processing options that don't force processing
+// when they differ from the defaults. The ones that can still change
+// the result are checked by isNoopProcessing separately
+var noopOptions = map[string]bool{
+	"ResizingType":              true,
+	"Width":                     true,
+	"Height":                    true,
+	"Megapixels":                true,
+	"Dpr":                       true,
+	"Gravity":                   true,
+	"Enlarge":                   true,
+	"Extend":                    true,
+	"ExtendAspectRatio":         true,
+	"Format":                    true,
+	"AutoFormat":                true,
+	"BitDepth":                  true,
+	"MaxBytes":                  true,
+	"Background":                true,
+	"BackgroundAlpha":           true,
+	"BlurMode":                  true,
+	"SharpenAmount":             true,
+	"SharpenThreshold":          true,
+	"AutoRotate":                true,
+	"Frame":                     true,
+	"LinearColorspaceThreshold": true,
+	"CacheBuster":               true,
+	"Persist":                   true,
+	"Expires":                   true,
+	"TTL":                       true,
+	"Watermark":                 true,
+	"PreferWebP":                true,
+	"EnforceWebP":               true,
+	"PreferAvif":                true,
+	"EnforceAvif":               true,
+	"Filename":                  true,
+	"ContentType":               true,
+	"UsedPresets":               true,
+	"FastMode":                  true,
+}
+
+func isNoopProcessing(img *vipsImage, imgdata *imageData, po *processingOptions) bool {
+	if po.Format != imgdata.Type {
+		return false
+	}
+
+	// Any other option that differs from the default means the image should be processed
+	for _, entry := range po.Diff() {
+		if !noopOptions[entry.Name] {
+			return false
+		}
+	}
+
+	// High bit depth images are converted to 8 bits unless 16 bits are requested
+	if img.IsHighBitDepth() && po.BitDepth != 16 {
+		return false
+	}
+
+	// Non-sRGB colors are converted to sRGB
+	if img.HasNonSRGBProfile() {
+		return false
+	}
+
+	if po.Watermark.Enabled && hasWatermark(&po.Watermark) {
+		return false
+	}
+
+	if po.MaxBytes > 0 && len(imgdata.Data) > po.MaxBytes {
+		return false
+	}
+
+	if nPages, err := img.GetIntDefault("n-pages", 1); err != nil || nPages > 1 || po.Frame > 0 {
+		return false
+	}
+
+	if po.AutoRotate && img.Orientation() != 1 {
+		return false
+	}
+
+	srcWidth, srcHeight := img.Width(), img.Height()
+
+	if calcScale(srcWidth, srcHeight, po, imgdata.Type) != 1 {
+		return false
+	}
+
+	dprWidth, dprHeight := calcDprSize(po)
+
+	// Check if the image will be cropped
+	if po.ResizingType != resizeMin && ((dprWidth > 0 && dprWidth < srcWidth) || (dprHeight > 0 && dprHeight < srcHeight)) {
+		return false
+	}
+
+	// Check if the image will be extended
+	if po.Extend.Enabled && (dprWidth > srcWidth || dprHeight > srcHeight) {
+		return false
+	}
+
+	if po.ExtendAspectRatio.Enabled {
+		if w, h := calcExtendAspectRatioSize(srcWidth, srcHeight, dprWidth, dprHeight); w != srcWidth || h != srcHeight {
+			return false
+		}
+	}
+
+	return true
+}
+
+// loadPdfPage renders the requested page of the PDF document
+func loadPdfPage(img *vipsImage, imgdata *imageData, page int, dpi float64) error {
+	if err := img.LoadPdf(imgdata.Data, 0, dpi); err != nil {
+		return err
+	}
+
+	if page > 0 {
+		pagesCount, err := img.GetIntDefault("n-pages", 1)
+		if err != nil {
+			return err
+		}
+
+		if page >= pagesCount {
+			return newError(
+				422,
+				fmt.Sprintf("Page %d is out of range, source document has %d pages", page, pagesCount),
+				"Invalid page",
+			).SetCategory("invalid_options")
+		}
+
+		if err = img.LoadPdf(imgdata.Data, page, dpi); err != nil {
+			return err
+		}
+	}
+
+	// PDF pages have no pixel dimensions, so we can check them only after rendering
+	return checkDimensions(img.Width(), img.Height())
+}
+
+func extractAnimationFrame(img *vipsImage, imgdata *imageData, frame int) error {
+	framesCount, err := img.GetIntDefault("n-pages", 1)
+	if err != nil {
+		return err
+	}
+
+	if frame >= framesCount {
+		return newError(
+			422,
+			fmt.Sprintf("Frame %d is out of range, source image has %d frames", frame, framesCount),
+			"Invalid frame",
+		).SetCategory("invalid_options")
+	}
+
+	if frame == 0 {
+		return nil
+	}
+
+	// Load frames up to the needed one
+	if err = img.Load(imgdata.Data, imgdata.Type, 1, 1.0, frame+1); err != nil {
+		return err
+	}
+
+	frameHeight, err := img.GetIntDefault("page-height", img.Height())
+	if err != nil {
+		return err
+	}
+
+	// Double check dimensions because we loaded many frames
+	if err = checkDimensions(img.Width(), frameHeight*(frame+1)); err != nil {
+		return err
+	}
+
+	return img.Crop(0, frame*frameHeight, img.Width(), frameHeight)
+}
+
+func getRawPreviewData(imgdata *imageData) (*imageData, error) {
+	offset, size, err := imagemeta.FindRawPreview(imgdata.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	data := imgdata.Data[offset : offset+size]
+
+	if _, err = checkTypeAndDimensions(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+
+	return &imageData{
+		Data: data,
+		Type: imageTypeJPEG,
+	}, nil
+}
+
 func getIcoData(imgdata *imageData) (*imageData, error) {
 	icoMeta, err := imagemeta.DecodeIcoMeta(bytes.NewReader(imgdata.Data))
 	if err != nil {
@@ -735,29 +1304,106 @@ func getIcoData(imgdata *imageData) (*imageData, error) {
 }
 
 func saveImageToFitBytes(ctx context.Context, po *processingOptions, img *vipsImage) ([]byte, context.CancelFunc, error) {
-	var diff float64
 	quality := po.getQuality()
 
-	for {
-		result, cancel, err := img.Save(po.Format, quality)
-		if len(result) <= po.MaxBytes || quality <= 10 || err != nil {
-			return result, cancel, err
-		}
+	result, cancel, err := img.Save(po.Format, quality, po.getSaveOptions())
+	if err != nil || len(result) <= po.MaxBytes {
+		return result, cancel, err
+	}
+
+	// result keeps the lowest quality result that doesn't fit,
+	// fitResult keeps the highest quality result that fits
+	var (
+		fitResult []byte
+		fitCancel context.CancelFunc
+	)
+
+	release := func() {
 		cancel()
+		if fitCancel != nil {
+			fitCancel()
+		}
+	}
 
-		checkTimeout(ctx)
+	low, high := 1, quality-1
 
-		delta := float64(len(result)) / float64(po.MaxBytes)
-		switch {
-		case delta > 3:
-			diff = 0.25
-		case delta > 1.5:
-			diff = 0.5
-		default:
-			diff = 0.75
+	for i := 0; i < maxBytesIterations && low <= high; i++ {
+		if ctx.Err() != nil {
+			release()
+			checkTimeout(ctx)
+		}
+
+		q := (low + high) / 2
+
+		r, c, err := img.Save(po.Format, q, po.getSaveOptions())
+		if err != nil {
+			release()
+			return nil, func() {}, err
 		}
-		quality = int(float64(quality) * diff)
+
+		if len(r) <= po.MaxBytes {
+			if fitCancel != nil {
+				fitCancel()
+			}
+			fitResult, fitCancel = r, c
+			low = q + 1
+		} else {
+			cancel()
+			result, cancel = r, c
+			high = q - 1
+		}
+	}
+
+	if fitCancel != nil {
+		cancel()
+		return fitResult, fitCancel, nil
 	}
+
+	logWarning("Can't fit the image into %d bytes, the lowest quality result is %d bytes", po.MaxBytes, len(result))
+
+	return result, cancel, nil
+}
+
+// processImageWithFastRetry reserves IMGPROXY_FAST_RETRY_TIMEOUT seconds before
+// the deadline to retry processing with cheaper settings if the first attempt
+// doesn't fit the rest of time
+func processImageWithFastRetry(ctx context.Context) ([]byte, context.CancelFunc, error) {
+	deadline, ok := ctx.Deadline()
+	if conf.FastRetryTimeout <= 0 || !ok {
+		return processImage(ctx)
+	}
+
+	attemptCtx, attemptCancel := context.WithDeadline(
+		ctx, deadline.Add(-time.Duration(conf.FastRetryTimeout)*time.Second),
+	)
+	defer attemptCancel()
+
+	if data, cancel, timedOut, err := tryProcessImage(ctx, attemptCtx); !timedOut {
+		return data, cancel, err
+	}
+
+	logWarning("Processing of %s didn't fit the deadline, retrying in fast mode", getImageURL(ctx))
+
+	getProcessingOptions(ctx).FastMode = true
+
+	return processImage(ctx)
+}
+
+func tryProcessImage(ctx, attemptCtx context.Context) (data []byte, cancel context.CancelFunc, timedOut bool, err error) {
+	defer func() {
+		if rerr := recover(); rerr != nil {
+			// Retry only if the attempt deadline is exceeded while the request is still alive
+			if attemptCtx.Err() != context.DeadlineExceeded || ctx.Err() != nil {
+				panic(rerr)
+			}
+
+			timedOut = true
+		}
+	}()
+
+	data, cancel, err = processImage(attemptCtx)
+
+	return
 }
 
 func processImage(ctx context.Context) ([]byte, context.CancelFunc, error) {
@@ -769,13 +1415,12 @@ func processImage(ctx context.Context) ([]byte, context.CancelFunc, error) {
 		defer newRelicCancel()
 	}
 
-	if prometheusEnabled {
-		defer startPrometheusDuration(prometheusProcessingDuration)()
-	}
-
 	defer vipsCleanup()
 
 	po := getProcessingOptions(ctx)
+
+	defer startProcessingDuration(po)()
+
 	imgdata := getImageData(ctx)
 
 	switch {
@@ -785,6 +1430,8 @@ func processImage(ctx context.Context) ([]byte, context.CancelFunc, error) {
 			po.Format = imageTypeAVIF
 		case po.PreferWebP && canSwitchFormat(imgdata.Type, imageTypeUnknown, imageTypeWEBP):
 			po.Format = imageTypeWEBP
+		case po.AutoFormat:
+			po.Format = autoFormat(imgdata)
 		case imageTypeSaveSupport(imgdata.Type) && imageTypeGoodForWeb(imgdata.Type):
 			po.Format = imgdata.Type
 		default:
@@ -817,27 +1464,48 @@ func processImage(ctx context.Context) ([]byte, context.CancelFunc, error) {
 		imgdata = icodata
 	}
 
+	if imgdata.Type == imageTypeRAW && conf.RawUseEmbeddedPreview {
+		if previewdata, err := getRawPreviewData(imgdata); err == nil {
+			imgdata = previewdata
+		} else {
+			logWarning("Can't use RAW embedded preview, decoding the full image: %s", err)
+		}
+	}
+
+	if conf.EnableFaceDetection {
+		resolveFaceGravity(po, getDetectedFaces(ctx))
+	}
+
 	if !vipsSupportSmartcrop {
 		if po.Gravity.Type == gravitySmart {
 			logWarning(msgSmartCropNotSupported)
-			po.Gravity.Type = gravityCenter
+			po.Gravity.Type = conf.SmartCropFallback
 		}
 		if po.Crop.Gravity.Type == gravitySmart {
 			logWarning(msgSmartCropNotSupported)
-			po.Crop.Gravity.Type = gravityCenter
+			po.Crop.Gravity.Type = conf.SmartCropFallback
 		}
 	}
 
 	if po.ResizingType == resizeCrop {
 		logWarning("`crop` resizing type is deprecated and will be removed in future versions. Use `crop` processing option instead")
 
-		po.Crop.Width, po.Crop.Height = float64(po.Width), float64(po.Height)
-
 		po.ResizingType = resizeFit
-		po.Width, po.Height = 0, 0
+
+		// The crop processing option takes precedence over the deprecated resizing type,
+		// so in this case the resizing type just acts like fit
+		if po.Crop.Width == 0 && po.Crop.Height == 0 {
+			po.Crop.Width, po.Crop.Height = float64(po.Width), float64(po.Height)
+			po.Width, po.Height = 0, 0
+		}
 	}
 
-	animationSupport := conf.MaxAnimationFrames > 1 && vipsSupportAnimation(imgdata.Type) && vipsSupportAnimation(po.Format)
+	extractFrame := po.Frame >= 0 && vipsSupportAnimation(imgdata.Type)
+
+	animationSupport := !extractFrame &&
+		conf.MaxAnimationFrames > 1 &&
+		vipsSupportAnimation(imgdata.Type) &&
+		vipsSupportAnimation(po.Format)
 
 	pages := 1
 	if animationSupport {
@@ -847,16 +1515,62 @@ func processImage(ctx context.Context) ([]byte, context.CancelFunc, error) {
 	img := new(vipsImage)
 	defer img.Clear()
 
-	if err := img.Load(imgdata.Data, imgdata.Type, 1, 1.0, pages); err != nil {
+	if imgdata.Type == imageTypePDF {
+		if err := loadPdfPage(img, imgdata, maxInt(po.Frame, 0), po.Dpi); err != nil {
+			return nil, func() {}, err
+		}
+	} else if err := img.Load(imgdata.Data, imgdata.Type, 1, 1.0, pages); err != nil {
 		return nil, func() {}, err
 	}
 
+	// Dimensions in RAW headers may belong to a reduced preview,
+	// so we need to check the actual ones
+	if imgdata.Type == imageTypeRAW {
+		if err := checkDimensions(img.Width(), img.Height()); err != nil {
+			return nil, func() {}, err
+		}
+	}
+
+	if conf.DisallowAnimated && vipsSupportAnimation(imgdata.Type) {
+		// n-pages contains the number of frames even if only the first one is loaded
+		if nPages, _ := img.GetIntDefault("n-pages", 1); nPages > 1 {
+			if !conf.DisallowAnimatedUseFirstFrame {
+				return nil, func() {}, errSourceAnimated
+			}
+
+			if animationSupport {
+				animationSupport = false
+
+				if err := img.Load(imgdata.Data, imgdata.Type, 1, 1.0, 1); err != nil {
+					return nil, func() {}, err
+				}
+			}
+		}
+	}
+
+	if conf.SkipNoopProcessing && isNoopProcessing(img, imgdata, po) {
+		return imgdata.Data, func() {}, nil
+	}
+
+	data := imgdata.Data
+
+	if extractFrame {
+		if err := extractAnimationFrame(img, imgdata, po.Frame); err != nil {
+			return nil, func() {}, err
+		}
+
+		// Scale-on-load would reload the first frame, so we need to disable it
+		if po.Frame > 0 {
+			data = nil
+		}
+	}
+
 	if animationSupport && img.IsAnimated() {
-		if err := transformAnimated(ctx, img, imgdata.Data, po, imgdata.Type); err != nil {
+		if err := transformAnimated(ctx, img, data, po, imgdata.Type); err != nil {
 			return nil, func() {}, err
 		}
 	} else {
-		if err := transformImage(ctx, img, imgdata.Data, po, imgdata.Type); err != nil {
+		if err := transformImage(ctx, img, data, po, imgdata.Type); err != nil {
 			return nil, func() {}, err
 		}
 	}
@@ -869,5 +1583,10 @@ func processImage(ctx context.Context) ([]byte, context.CancelFunc, error) {
 		return saveImageToFitBytes(ctx, po, img)
 	}
 
-	return img.Save(po.Format, po.getQuality())
+	if stream := getResponseStream(ctx); stream != nil && vipsSupportSaveToWriter(po.Format) {
+		stream.Streamed = true
+		return nil, func() {}, img.SaveToWriter(stream, po.Format, po.getQuality(), po.getSaveOptions())
+	}
+
+	return img.Save(po.Format, po.getQuality(), po.getSaveOptions())
 }
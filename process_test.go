@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+	"time"
+
+	"github.com/imgproxy/imgproxy/v2/imagemeta"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type ProcessTestSuite struct{ MainTestSuite }
+
+func (s *ProcessTestSuite) getJpegData() []byte {
+	return s.getSizedJpegData(100, 100)
+}
+
+func (s *ProcessTestSuite) getSizedJpegData(width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	require.Nil(s.T(), jpeg.Encode(buf, img, &jpeg.Options{Quality: 95}))
+
+	return buf.Bytes()
+}
+
+func (s *ProcessTestSuite) getAnimatedGifData(framesCount int) []byte {
+	anim := &gif.GIF{}
+	for i := 0; i < framesCount; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 50, 50), color.Palette{color.Black, color.White})
+		for x := 0; x < 50; x++ {
+			frame.SetColorIndex(x, i, 1)
+		}
+
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+
+	buf := new(bytes.Buffer)
+	require.Nil(s.T(), gif.EncodeAll(buf, anim))
+
+	return buf.Bytes()
+}
+
+func (s *ProcessTestSuite) process(data []byte, po *processingOptions) []byte {
+	return s.processType(data, imageTypeJPEG, po)
+}
+
+func (s *ProcessTestSuite) processType(data []byte, imgtype imageType, po *processingOptions) []byte {
+	ctx := setTimerSince(context.Background())
+	ctx = context.WithValue(ctx, imageDataCtxKey, &imageData{Data: data, Type: imgtype})
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	result, cancel, err := processImage(ctx)
+	require.Nil(s.T(), err)
+	defer cancel()
+
+	return append([]byte(nil), result...)
+}
+
+func (s *ProcessTestSuite) TestSkipNoopProcessing() {
+	conf.SkipNoopProcessing = true
+
+	data := s.getJpegData()
+
+	po := newProcessingOptions()
+	po.Format = imageTypeJPEG
+	po.Width = 100
+
+	assert.Equal(s.T(), data, s.process(data, po))
+}
+
+func (s *ProcessTestSuite) TestSkipNoopProcessingWithQuality() {
+	conf.SkipNoopProcessing = true
+
+	data := s.getJpegData()
+
+	po := newProcessingOptions()
+	po.Format = imageTypeJPEG
+	po.Quality = 50
+
+	assert.NotEqual(s.T(), data, s.process(data, po))
+}
+
+func (s *ProcessTestSuite) TestSkipNoopProcessingWithResize() {
+	conf.SkipNoopProcessing = true
+
+	data := s.getJpegData()
+
+	po := newProcessingOptions()
+	po.Format = imageTypeJPEG
+	po.Width = 50
+
+	assert.NotEqual(s.T(), data, s.process(data, po))
+}
+
+func (s *ProcessTestSuite) TestSkipNoopProcessingWithGifOptions() {
+	conf.SkipNoopProcessing = true
+
+	data := s.getAnimatedGifData(1)
+
+	po := newProcessingOptions()
+	po.Format = imageTypeGIF
+
+	assert.Equal(s.T(), data, s.processType(data, imageTypeGIF, po))
+
+	po.GifOptions.Effort = po.GifOptions.Effort%10 + 1
+
+	assert.NotEqual(s.T(), data, s.processType(data, imageTypeGIF, po))
+}
+
+func (s *ProcessTestSuite) TestSkipNoopProcessingHighBitDepth() {
+	conf.SkipNoopProcessing = true
+
+	img := image.NewRGBA64(image.Rect(0, 0, 50, 50))
+	for x := 0; x < 50; x++ {
+		for y := 0; y < 50; y++ {
+			img.Set(x, y, color.RGBA64{uint16(x * 1000), uint16(y * 1000), 32768, 65535})
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(buf, img))
+	data := buf.Bytes()
+
+	po := newProcessingOptions()
+	po.Format = imageTypePNG
+
+	assert.NotEqual(s.T(), data, s.processType(data, imageTypePNG, po))
+
+	po.BitDepth = 16
+
+	assert.Equal(s.T(), data, s.processType(data, imageTypePNG, po))
+}
+
+func (s *ProcessTestSuite) TestSkipNoopProcessingDisabled() {
+	conf.SkipNoopProcessing = false
+
+	data := s.getJpegData()
+
+	po := newProcessingOptions()
+	po.Format = imageTypeJPEG
+
+	assert.NotEqual(s.T(), data, s.process(data, po))
+}
+
+func (s *ProcessTestSuite) TestCalcScaleMegapixels() {
+	po := newProcessingOptions()
+	po.Megapixels = 0.5
+	po.Width = 100
+	po.Dpr = 2
+
+	assert.InDelta(s.T(), 0.5, calcScale(2000, 1000, po, imageTypeJPEG), 0.0001)
+}
+
+func (s *ProcessTestSuite) TestCalcScaleMegapixelsEnlarge() {
+	po := newProcessingOptions()
+	po.Megapixels = 8
+
+	assert.Equal(s.T(), 1.0, calcScale(2000, 1000, po, imageTypeJPEG))
+
+	po.Enlarge = true
+
+	assert.InDelta(s.T(), 2.0, calcScale(2000, 1000, po, imageTypeJPEG), 0.0001)
+}
+
+func (s *ProcessTestSuite) TestCalcScaleMin() {
+	po := newProcessingOptions()
+	po.ResizingType = resizeMin
+	po.Width = 100
+	po.Height = 100
+
+	// Landscape: the height reaches 100 while the width is larger
+	assert.InDelta(s.T(), 0.1, calcScale(2000, 1000, po, imageTypeJPEG), 0.0001)
+	// Portrait: the width reaches 100 while the height is larger
+	assert.InDelta(s.T(), 0.1, calcScale(1000, 2000, po, imageTypeJPEG), 0.0001)
+}
+
+func (s *ProcessTestSuite) TestCalcScaleMinEnlarge() {
+	po := newProcessingOptions()
+	po.ResizingType = resizeMin
+	po.Width = 100
+	po.Height = 100
+
+	assert.Equal(s.T(), 1.0, calcScale(80, 40, po, imageTypeJPEG))
+	assert.Equal(s.T(), 1.0, calcScale(40, 80, po, imageTypeJPEG))
+
+	po.Enlarge = true
+
+	assert.InDelta(s.T(), 2.5, calcScale(80, 40, po, imageTypeJPEG), 0.0001)
+	assert.InDelta(s.T(), 2.5, calcScale(40, 80, po, imageTypeJPEG), 0.0001)
+}
+
+func (s *ProcessTestSuite) TestResizeMinKeepsProjectingParts() {
+	po := newProcessingOptions()
+	po.Format = imageTypePNG
+	po.ResizingType = resizeMin
+	po.Width = 50
+	po.Height = 25
+
+	img := new(vipsImage)
+	defer img.Clear()
+
+	require.Nil(s.T(), img.Load(s.process(s.getJpegData(), po), imageTypePNG, 1, 1.0, 1))
+
+	// 100x100 source is shrunk so both sides are at least 50x25, nothing is cropped
+	assert.Equal(s.T(), 50, img.Width())
+	assert.Equal(s.T(), 50, img.Height())
+}
+
+func (s *ProcessTestSuite) TestCalcZoomedCropSize() {
+	// No zoom, no crop
+	assert.Equal(s.T(), 0, calcZoomedCropSize(1000, 0, 1))
+	// Whole source is zoomed when crop isn't set
+	assert.Equal(s.T(), 500, calcZoomedCropSize(1000, 0, 2))
+	// Crop area is zoomed
+	assert.Equal(s.T(), 200, calcZoomedCropSize(1000, 400, 2))
+	// Zoom out can't make the area larger than the source
+	assert.Equal(s.T(), 1000, calcZoomedCropSize(1000, 800, 0.5))
+}
+
+func (s *ProcessTestSuite) TestZoom() {
+	po := newProcessingOptions()
+	po.Format = imageTypePNG
+	po.Width = 50
+	po.Height = 50
+	po.ZoomWidth = 2
+	po.ZoomHeight = 2
+
+	img := new(vipsImage)
+	defer img.Clear()
+
+	require.Nil(s.T(), img.Load(s.process(s.getJpegData(), po), imageTypePNG, 1, 1.0, 1))
+
+	assert.Equal(s.T(), 50, img.Width())
+	assert.Equal(s.T(), 50, img.Height())
+
+	pixels, err := img.SRGBPixels()
+	require.Nil(s.T(), err)
+
+	// The central 50x50 area of the 100x100 source is rendered without downscaling,
+	// so the top left pixel is the source's pixel at 25x25
+	assert.InDelta(s.T(), 25, int(pixels[0]), 3)
+	assert.InDelta(s.T(), 25, int(pixels[1]), 3)
+}
+
+func (s *ProcessTestSuite) TestCalcAspectRatioCropSize() {
+	// Landscape source cropped to 1:1
+	w, h := calcAspectRatioCropSize(400, 200, 1)
+	assert.Equal(s.T(), 200, w)
+	assert.Equal(s.T(), 200, h)
+
+	// Portrait source cropped to 16:9
+	w, h = calcAspectRatioCropSize(200, 400, 16.0/9.0)
+	assert.Equal(s.T(), 200, w)
+	assert.Equal(s.T(), 113, h)
+}
+
+func (s *ProcessTestSuite) TestAspectRatio() {
+	testCases := []struct {
+		srcWidth, srcHeight int
+		width, height       int
+		expWidth, expHeight int
+	}{
+		// Source is cropped at its native resolution
+		{200, 100, 0, 0, 100, 100},
+		{100, 200, 0, 0, 100, 100},
+		// Missing dimension is derived
+		{200, 100, 50, 0, 50, 50},
+		{100, 200, 0, 50, 50, 50},
+		// Aspect ratio is ignored when both dimensions are set
+		{200, 100, 60, 20, 60, 20},
+	}
+
+	for _, tc := range testCases {
+		po := newProcessingOptions()
+		po.Format = imageTypePNG
+		po.ResizingType = resizeFill
+		po.Width = tc.width
+		po.Height = tc.height
+		po.AspectRatio = 1
+
+		img := new(vipsImage)
+
+		require.Nil(s.T(), img.Load(s.process(s.getSizedJpegData(tc.srcWidth, tc.srcHeight), po), imageTypePNG, 1, 1.0, 1))
+
+		assert.Equal(s.T(), tc.expWidth, img.Width(), "%+v", tc)
+		assert.Equal(s.T(), tc.expHeight, img.Height(), "%+v", tc)
+
+		img.Clear()
+	}
+}
+
+func (s *ProcessTestSuite) TestAutoFormat() {
+	transparent := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	transparent.Set(0, 0, color.NRGBA{255, 0, 0, 128})
+
+	buf := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(buf, transparent))
+
+	opaque := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	for x := 0; x < 10; x++ {
+		for y := 0; y < 10; y++ {
+			opaque.Set(x, y, color.RGBA{255, 0, 0, 255})
+		}
+	}
+
+	opaqueBuf := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(opaqueBuf, opaque))
+
+	po := newProcessingOptions()
+	po.AutoFormat = true
+
+	s.processType(buf.Bytes(), imageTypePNG, po)
+	assert.Equal(s.T(), imageTypePNG, po.Format)
+
+	po = newProcessingOptions()
+	po.AutoFormat = true
+
+	s.processType(opaqueBuf.Bytes(), imageTypePNG, po)
+	assert.Equal(s.T(), imageTypeJPEG, po.Format)
+
+	po = newProcessingOptions()
+	po.AutoFormat = true
+	po.PreferWebP = true
+
+	s.processType(buf.Bytes(), imageTypePNG, po)
+	assert.Equal(s.T(), imageTypeWEBP, po.Format)
+}
+
+func (s *ProcessTestSuite) TestAutoFormatKeepsAnimation() {
+	conf.MaxAnimationFrames = 10
+
+	po := newProcessingOptions()
+	po.AutoFormat = true
+
+	s.processType(s.getAnimatedGifData(3), imageTypeGIF, po)
+	assert.Equal(s.T(), imageTypeGIF, po.Format)
+}
+
+func (s *ProcessTestSuite) TestAnimatedGifToGif() {
+	conf.MaxAnimationFrames = 10
+
+	po := newProcessingOptions()
+	po.Format = imageTypeGIF
+	po.Width = 25
+
+	res, err := gif.DecodeAll(bytes.NewReader(s.processType(s.getAnimatedGifData(3), imageTypeGIF, po)))
+	require.Nil(s.T(), err)
+
+	assert.Len(s.T(), res.Image, 3)
+}
+
+func (s *ProcessTestSuite) TestAnimatedProcessingTimeout() {
+	conf.MaxAnimationFrames = 10
+
+	data := s.getAnimatedGifData(3)
+
+	img := new(vipsImage)
+	defer img.Clear()
+
+	require.Nil(s.T(), img.Load(data, imageTypeGIF, 1, 1.0, 3))
+
+	ctx, cancel := context.WithDeadline(setTimerSince(context.Background()), time.Now().Add(-time.Second))
+	defer cancel()
+	ctx = context.WithValue(ctx, processingTimeoutCtxKey, true)
+
+	// The timeout is checked before each frame is processed
+	ierr := panicError(func() {
+		transformAnimated(ctx, img, data, newProcessingOptions(), imageTypeGIF)
+	})
+
+	require.NotNil(s.T(), ierr)
+	assert.Equal(s.T(), 504, ierr.StatusCode)
+}
+
+func (s *ProcessTestSuite) TestAnimatedGifToWebp() {
+	if !vipsSupportAnimation(imageTypeWEBP) {
+		s.T().Skip("Animated WebP is not supported")
+	}
+
+	conf.MaxAnimationFrames = 10
+
+	po := newProcessingOptions()
+	po.Format = imageTypeWEBP
+	po.Width = 25
+
+	frames, err := imagemeta.DecodeWebpFrames(bytes.NewReader(s.processType(s.getAnimatedGifData(3), imageTypeGIF, po)))
+	require.Nil(s.T(), err)
+
+	assert.Len(s.T(), frames, 3)
+}
+
+func (s *ProcessTestSuite) TestAnimatedGifToWebpLimitFrames() {
+	if !vipsSupportAnimation(imageTypeWEBP) {
+		s.T().Skip("Animated WebP is not supported")
+	}
+
+	conf.MaxAnimationFrames = 2
+
+	po := newProcessingOptions()
+	po.Format = imageTypeWEBP
+
+	frames, err := imagemeta.DecodeWebpFrames(bytes.NewReader(s.processType(s.getAnimatedGifData(3), imageTypeGIF, po)))
+	require.Nil(s.T(), err)
+
+	assert.Len(s.T(), frames, 2)
+}
+
+func (s *ProcessTestSuite) TestFramesDelay() {
+	assert.Equal(s.T(), []int{100, 200}, framesDelay([]int{100, 200, 300}, -1, 2))
+	assert.Equal(s.T(), []int{100, 200, 200}, framesDelay([]int{100, 200}, -1, 3))
+	assert.Equal(s.T(), []int{70, 70}, framesDelay(nil, 7, 2))
+	assert.Equal(s.T(), []int{40, 40}, framesDelay(nil, -1, 2))
+}
+
+func (s *ProcessTestSuite) TestCalcExtendAspectRatioSize() {
+	// Landscape image padded to a square
+	w, h := calcExtendAspectRatioSize(300, 200, 100, 100)
+	assert.Equal(s.T(), 300, w)
+	assert.Equal(s.T(), 300, h)
+
+	// Square image padded to a landscape ratio
+	w, h = calcExtendAspectRatioSize(200, 200, 160, 90)
+	assert.Equal(s.T(), 356, w)
+	assert.Equal(s.T(), 200, h)
+
+	// Image already has the requested aspect ratio
+	w, h = calcExtendAspectRatioSize(320, 180, 160, 90)
+	assert.Equal(s.T(), 320, w)
+	assert.Equal(s.T(), 180, h)
+
+	// Aspect ratio can't be calculated without both dimensions
+	w, h = calcExtendAspectRatioSize(300, 200, 100, 0)
+	assert.Equal(s.T(), 300, w)
+	assert.Equal(s.T(), 200, h)
+}
+
+func (s *ProcessTestSuite) TestExtendAspectRatio() {
+	po := newProcessingOptions()
+	po.Format = imageTypePNG
+	po.Width = 200
+	po.Height = 100
+	po.ExtendAspectRatio.Enabled = true
+
+	img := new(vipsImage)
+	defer img.Clear()
+
+	require.Nil(s.T(), img.Load(s.process(s.getJpegData(), po), imageTypePNG, 1, 1.0, 1))
+
+	// Image is resized to fit 200x100 and then padded to 2:1
+	assert.Equal(s.T(), 200, img.Width())
+	assert.Equal(s.T(), 100, img.Height())
+}
+
+func (s *ProcessTestSuite) TestExtendBackgroundAlpha() {
+	po := newProcessingOptions()
+	po.Format = imageTypePNG
+	po.Width = 200
+	po.Height = 100
+	po.Extend.Enabled = true
+	po.Flatten = true
+	po.Background = rgbColor{255, 0, 0}
+	po.BackgroundAlpha = 0.5
+
+	img, err := png.Decode(bytes.NewReader(s.process(s.getJpegData(), po)))
+	require.Nil(s.T(), err)
+
+	// The extended area has the background color with its opacity
+	r, g, b, a := img.At(0, 0).RGBA()
+	assert.InDelta(s.T(), 0x7fff, a, 0x200)
+	assert.InDelta(s.T(), 0x7fff, r, 0x200)
+	assert.Zero(s.T(), g)
+	assert.Zero(s.T(), b)
+
+	// The image itself stays opaque
+	_, _, _, a = img.At(100, 50).RGBA()
+	assert.Equal(s.T(), uint32(0xffff), a)
+}
+
+func TestProcess(t *testing.T) {
+	suite.Run(t, new(ProcessTestSuite))
+}
+
+func benchmarkSlightResize(b *testing.B, threshold float64) {
+	oldConf := conf
+	defer func() { conf = oldConf }()
+
+	conf.UseLinearColorspace = true
+
+	data := getBenchmarkJpegData(b, 2000, 2000)
+
+	po := newProcessingOptions()
+	po.Width = 1900
+	po.LinearColorspaceThreshold = threshold
+
+	ctx := setTimerSince(context.Background())
+	ctx = context.WithValue(ctx, imageDataCtxKey, &imageData{Data: data, Type: imageTypeJPEG})
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, cancel, err := processImage(ctx)
+		require.Nil(b, err)
+
+		cancel()
+	}
+}
+
+// BenchmarkSlightResizeLinear and BenchmarkSlightResizeBelowLinearThreshold
+// compare the processing time of a slight resize with and without
+// the linear colorspace conversion
+func BenchmarkSlightResizeLinear(b *testing.B) {
+	benchmarkSlightResize(b, 1)
+}
+
+func BenchmarkSlightResizeBelowLinearThreshold(b *testing.B) {
+	benchmarkSlightResize(b, 0.9)
+}
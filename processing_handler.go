@@ -4,8 +4,11 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,16 +17,37 @@ var (
 	responseGzipPool    *gzipPool
 
 	processingSem chan struct{}
+	downloadSem   chan struct{}
 
+	// inFlightRequests is the number of the processing requests
+	// that are being handled at the moment
+	inFlightRequests int64
+
+	varyHeaders     []string
 	headerVaryValue string
 	fallbackImage   *imageData
+
+	responseStatusCodeCtxKey = ctxKey("responseStatusCode")
+)
+
+const (
+	encodingGzip   = "gzip"
+	encodingBrotli = "br"
 )
 
+func getInFlightRequests() int64 {
+	return atomic.LoadInt64(&inFlightRequests)
+}
+
 func initProcessingHandler() error {
 	var err error
 
 	processingSem = make(chan struct{}, conf.Concurrency)
 
+	if conf.DownloadConcurrency > 0 {
+		downloadSem = make(chan struct{}, conf.DownloadConcurrency)
+	}
+
 	if conf.GZipCompression > 0 {
 		responseGzipBufPool = newBufPool("gzip", conf.Concurrency, conf.GZipBufferSize)
 		if responseGzipPool, err = newGzipPool(conf.Concurrency); err != nil {
@@ -31,40 +55,175 @@ func initProcessingHandler() error {
 		}
 	}
 
-	vary := make([]string, 0)
+	varyHeaders = make([]string, 0)
 
-	if conf.EnableWebpDetection || conf.EnforceWebp {
-		vary = append(vary, "Accept")
+	if conf.EnableWebpDetection || conf.EnforceWebp ||
+		conf.EnableAvifDetection || conf.EnforceAvif || conf.EnableFormatDetection {
+		varyHeaders = append(varyHeaders, "Accept")
 	}
 
-	if conf.GZipCompression > 0 {
-		vary = append(vary, "Accept-Encoding")
+	if conf.GZipCompression > 0 || conf.BrotliCompression > 0 {
+		varyHeaders = append(varyHeaders, "Accept-Encoding")
 	}
 
 	if conf.EnableClientHints {
-		vary = append(vary, "DPR", "Viewport-Width", "Width")
+		varyHeaders = append(varyHeaders, "DPR", "Viewport-Width", "Width")
 	}
 
-	headerVaryValue = strings.Join(vary, ", ")
+	// Source image may depend on the forwarded headers
+	varyHeaders = append(varyHeaders, conf.ForwardHeaders...)
+
+	headerVaryValue = strings.Join(varyHeaders, ", ")
+
+	if err = checkPersistURLTemplate(); err != nil {
+		return err
+	}
 
 	if fallbackImage, err = getFallbackImageData(); err != nil {
 		return err
 	}
 
+	if err = initResultCache(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
+func getResponseStatusCode(ctx context.Context) int {
+	if statusCode, ok := ctx.Value(responseStatusCodeCtxKey).(int); ok {
+		return statusCode
+	}
+	return 200
+}
+
+// responseEncoding chooses the encoding of the response negotiated via Accept-Encoding.
+// Raster formats are already compressed, so only textual formats are encoded
+func responseEncoding(r *http.Request, format imageType) string {
+	if !format.IsTextual() {
+		return ""
+	}
+
+	acceptEncoding := r.Header.Get("Accept-Encoding")
+
+	switch {
+	case conf.BrotliCompression > 0 && acceptsEncoding(acceptEncoding, encodingBrotli):
+		return encodingBrotli
+	case conf.GZipCompression > 0 && acceptsEncoding(acceptEncoding, encodingGzip):
+		return encodingGzip
+	}
+
+	return ""
+}
+
+// acceptsEncoding checks if the Accept-Encoding header value allows the encoding
+func acceptsEncoding(acceptEncoding, encoding string) bool {
+	for _, entry := range strings.Split(acceptEncoding, ",") {
+		name, params := entry, ""
+		if i := strings.IndexByte(entry, ';'); i >= 0 {
+			name, params = entry[:i], entry[i+1:]
+		}
+
+		if !strings.EqualFold(strings.TrimSpace(name), encoding) {
+			continue
+		}
+
+		params = strings.ReplaceAll(params, " ", "")
+		if strings.HasPrefix(params, "q=") {
+			q, err := strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64)
+			return err == nil && q > 0
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// isDownloadRequest checks if the image should be sent as an attachment
+func isDownloadRequest(r *http.Request) bool {
+	query, err := url.ParseQuery(trimBefore(r.RequestURI, '?'))
+	if err != nil {
+		return false
+	}
+
+	download := query.Get(downloadQueryParam)
+	return len(download) > 0 && parseBoolOption(download)
+}
+
 func respondWithImage(ctx context.Context, reqID string, r *http.Request, rw http.ResponseWriter, data []byte) {
 	po := getProcessingOptions(ctx)
+	statusCode := getResponseStatusCode(ctx)
+
+	setImageResponseHeaders(ctx, r, rw)
+
+	encoding := responseEncoding(r, po.Format)
+
+	switch encoding {
+	case encodingBrotli:
+		if brData, err := brotliCompress(data, conf.BrotliCompression); err == nil {
+			data = brData
+		} else {
+			logWarning("Can't compress the response: %s", err)
+			encoding = ""
+		}
+	case encodingGzip:
+		buf := responseGzipBufPool.Get(0)
+		defer responseGzipBufPool.Put(buf)
+
+		gz := responseGzipPool.Get(buf)
+		defer responseGzipPool.Put(gz)
+
+		gz.Write(data)
+		gz.Close()
+
+		data = buf.Bytes()
+	}
+
+	if len(encoding) > 0 {
+		rw.Header().Set("Content-Encoding", encoding)
+
+		// Encoded representation should have its own ETag
+		if eTag := rw.Header().Get("ETag"); len(eTag) > 0 {
+			rw.Header().Set("ETag", encodedETag(eTag, encoding))
+		}
+	}
+
+	rw.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	rw.WriteHeader(statusCode)
+	rw.Write(data)
+
+	imageURL := getImageURL(ctx)
+
+	incrementResponsesTotal(statusCode, po.Format)
+
+	logResponse(reqID, r, statusCode, nil, &imageURL, po)
+	// logResponse(reqID, r, 200, getTimerSince(ctx), getImageURL(ctx), po))
+}
+
+// setImageResponseHeaders sets the headers that describe the resulting image
+func setImageResponseHeaders(ctx context.Context, r *http.Request, rw http.ResponseWriter) {
+	po := getProcessingOptions(ctx)
+
+	download := isDownloadRequest(r)
 
 	var contentDisposition string
 	if len(po.Filename) > 0 {
-		contentDisposition = po.Format.ContentDisposition(po.Filename)
+		contentDisposition = po.Format.ContentDisposition(po.Filename, download)
 	} else {
-		contentDisposition = po.Format.ContentDispositionFromURL(getImageURL(ctx))
+		contentDisposition = po.Format.ContentDispositionFromURL(getImageURL(ctx), download)
 	}
 
-	rw.Header().Set("Content-Type", po.Format.Mime())
+	contentType := po.Format.Mime()
+	if len(po.ContentType) > 0 {
+		if po.ContentType != contentType {
+			logWarning("Content type %s is forced for %s result", po.ContentType, po.Format)
+		}
+
+		contentType = po.ContentType
+	}
+
+	rw.Header().Set("Content-Type", contentType)
 	rw.Header().Set("Content-Disposition", contentDisposition)
 
 	if conf.SetCanonicalHeader {
@@ -75,16 +234,96 @@ func respondWithImage(ctx context.Context, reqID string, r *http.Request, rw htt
 		}
 	}
 
+	setCacheHeaders(ctx, rw)
+	setServerTimingHeader(ctx, rw)
+
+	if conf.EnableDebugHeaders {
+		// Source image data is not available when responding with a cached result
+		if imgdata, ok := ctx.Value(imageDataCtxKey).(*imageData); ok {
+			rw.Header().Set("X-Origin-Content-Length", strconv.Itoa(len(imgdata.Data)))
+		}
+	}
+}
+
+// clampCacheHeaders limits the source max-age, s-maxage, and Expires
+// with maxTTL so the source can't make the result cached for too long
+func clampCacheHeaders(cacheControl, expires string, maxTTL int) (string, string) {
+	if len(cacheControl) > 0 {
+		directives := strings.Split(cacheControl, ",")
+
+		for i, directive := range directives {
+			directives[i] = strings.TrimSpace(directive)
+
+			parts := strings.SplitN(directives[i], "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+
+			if !strings.EqualFold(parts[0], "max-age") && !strings.EqualFold(parts[0], "s-maxage") {
+				continue
+			}
+
+			if age, err := strconv.Atoi(parts[1]); err == nil && age > maxTTL {
+				directives[i] = fmt.Sprintf("%s=%d", parts[0], maxTTL)
+			}
+		}
+
+		cacheControl = strings.Join(directives, ", ")
+	}
+
+	if len(expires) > 0 {
+		maxExpires := time.Now().Add(time.Duration(maxTTL) * time.Second)
+
+		if t, err := http.ParseTime(expires); err == nil && t.After(maxExpires) {
+			expires = maxExpires.Format(http.TimeFormat)
+		}
+	}
+
+	return cacheControl, expires
+}
+
+// urlTTL returns the number of seconds left until the URL expires.
+// The result shouldn't be cached after the URL expires
+func urlTTL(po *processingOptions) (int, bool) {
+	if po.Expires == 0 {
+		return 0, false
+	}
+
+	return maxInt(int(po.Expires-time.Now().Unix()), 0), true
+}
+
+// setCacheHeaders sets Cache-Control, Expires, and Vary headers of the response
+func setCacheHeaders(ctx context.Context, rw http.ResponseWriter) {
 	var cacheControl, expires string
 
-	if conf.CacheControlPassthrough {
-		cacheControl = getCacheControlHeader(ctx)
-		expires = getExpiresHeader(ctx)
+	po := getProcessingOptions(ctx)
+
+	// The ttl option is signed, so it takes precedence over the source headers
+	ttl := po.TTL
+
+	expiresTTL, urlExpires := urlTTL(po)
+
+	if conf.CacheControlPassthrough && ttl == 0 {
+		maxTTL := conf.MaxTTL
+		if urlExpires {
+			maxTTL = minInt(maxTTL, expiresTTL)
+		}
+
+		sourceCacheControl, sourceExpires := sourceCacheHeaders(ctx)
+		cacheControl, expires = clampCacheHeaders(sourceCacheControl, sourceExpires, maxTTL)
 	}
 
 	if len(cacheControl) == 0 && len(expires) == 0 {
-		cacheControl = fmt.Sprintf("max-age=%d, public", conf.TTL)
-		expires = time.Now().Add(time.Second * time.Duration(conf.TTL)).Format(http.TimeFormat)
+		if ttl == 0 {
+			ttl = conf.TTL
+		}
+
+		if urlExpires {
+			ttl = minInt(ttl, expiresTTL)
+		}
+
+		cacheControl = fmt.Sprintf("max-age=%d, public", ttl)
+		expires = time.Now().Add(time.Second * time.Duration(ttl)).Format(http.TimeFormat)
 	}
 
 	if len(cacheControl) > 0 {
@@ -97,67 +336,127 @@ func respondWithImage(ctx context.Context, reqID string, r *http.Request, rw htt
 	if len(headerVaryValue) > 0 {
 		rw.Header().Set("Vary", headerVaryValue)
 	}
+}
 
-	if conf.EnableDebugHeaders {
-		imgdata := getImageData(ctx)
-		rw.Header().Set("X-Origin-Content-Length", strconv.Itoa(len(imgdata.Data)))
+func respondWithCachedImage(ctx context.Context, reqID string, r *http.Request, rw http.ResponseWriter, data []byte, meta *resultCacheMeta) {
+	getProcessingOptions(ctx).Format = imageTypes[meta.Format]
+
+	ctx = context.WithValue(ctx, cacheControlHeaderCtxKey, meta.CacheControl)
+	ctx = context.WithValue(ctx, expiresHeaderCtxKey, meta.Expires)
+
+	if len(meta.ETag) > 0 {
+		rw.Header().Set("ETag", meta.ETag)
+
+		if matched, ok := matchETag(meta.ETag, r.Header.Get("If-None-Match")); ok {
+			respondWithNotModified(ctx, reqID, r, rw, matched)
+			return
+		}
 	}
 
-	if conf.GZipCompression > 0 && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-		buf := responseGzipBufPool.Get(0)
-		defer responseGzipBufPool.Put(buf)
+	respondWithImage(ctx, reqID, r, rw, data)
+}
 
-		gz := responseGzipPool.Get(buf)
-		defer responseGzipPool.Put(gz)
+// respondWithNotModified responds with 304 and no body.
+// The response contains the same ETag and caching headers the full response would contain
+func respondWithNotModified(ctx context.Context, reqID string, r *http.Request, rw http.ResponseWriter, eTag string) {
+	rw.Header().Set("ETag", eTag)
+	setCacheHeaders(ctx, rw)
 
-		gz.Write(data)
-		gz.Close()
+	rw.WriteHeader(304)
 
-		rw.Header().Set("Content-Encoding", "gzip")
-		rw.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	incrementResponsesTotal(304, getProcessingOptions(ctx).Format)
 
-		rw.WriteHeader(200)
-		rw.Write(buf.Bytes())
-	} else {
-		rw.Header().Set("Content-Length", strconv.Itoa(len(data)))
-		rw.WriteHeader(200)
-		rw.Write(data)
+	imageURL := getImageURL(ctx)
+
+	logResponse(reqID, r, 304, nil, &imageURL, getProcessingOptions(ctx))
+}
+
+// acquireProcessingSem waits for a free processing slot.
+// Call the returned function to release the slot. The function
+// can be called more than once, so the slot can be released early
+func acquireProcessingSem(ctx context.Context) func() {
+	select {
+	case processingSem <- struct{}{}:
+	case <-ctx.Done():
+		checkTimeout(ctx)
 	}
 
-	imageURL := getImageURL(ctx)
+	var once sync.Once
 
-	logResponse(reqID, r, 200, nil, &imageURL, po)
-	// logResponse(reqID, r, 200, getTimerSince(ctx), getImageURL(ctx), po))
+	return func() { once.Do(func() { <-processingSem }) }
 }
 
-func respondWithNotModified(ctx context.Context, reqID string, r *http.Request, rw http.ResponseWriter) {
-	rw.WriteHeader(304)
+// tryAcquireProcessingSem takes a free processing slot without waiting.
+// Returns false if there are no free slots
+func tryAcquireProcessingSem() (func(), bool) {
+	select {
+	case processingSem <- struct{}{}:
+		return func() { <-processingSem }, true
+	default:
+		return nil, false
+	}
+}
 
-	imageURL := getImageURL(ctx)
+// acquireDownloadSem waits for a free download slot when
+// IMGPROXY_DOWNLOAD_CONCURRENCY is set. Call the returned function to release the slot.
+// The returned function can be called more than once
+func acquireDownloadSem(ctx context.Context) func() {
+	if downloadSem == nil {
+		return func() {}
+	}
 
-	logResponse(reqID, r, 304, nil, &imageURL, getProcessingOptions(ctx))
+	select {
+	case downloadSem <- struct{}{}:
+	default:
+		// The limit is reached, so we wait for another download to finish
+		incrementDownloadsLimitedTotal()
+
+		select {
+		case downloadSem <- struct{}{}:
+		case <-ctx.Done():
+			checkTimeout(ctx)
+		}
+	}
+
+	addDownloadsInProgress(1)
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			addDownloadsInProgress(-1)
+			<-downloadSem
+		})
+	}
 }
 
 func handleProcessing(reqID string, rw http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
+	// Custom headers are set first so computed headers can override them
+	setCustomResponseHeaders(rw)
+
 	if newRelicEnabled {
 		var newRelicCancel context.CancelFunc
 		ctx, newRelicCancel, rw = startNewRelicTransaction(ctx, rw, r)
 		defer newRelicCancel()
 	}
 
-	if prometheusEnabled {
-		prometheusRequestsTotal.Inc()
-		defer startPrometheusDuration(prometheusRequestDuration)()
-	}
+	atomic.AddInt64(&inFlightRequests, 1)
+	defer atomic.AddInt64(&inFlightRequests, -1)
 
-	select {
-	case processingSem <- struct{}{}:
-	case <-ctx.Done():
-		panic(newError(499, "Request was cancelled before processing", "Cancelled"))
+	incrementRequestsTotal()
+	defer startRequestDuration()()
+
+	var releaseProcessingSem func()
+
+	// When downloads are limited separately, the processing slot
+	// is acquired after the image is downloaded
+	if downloadSem == nil {
+		releaseProcessingSem = acquireProcessingSem(ctx)
+		defer releaseProcessingSem()
+		defer startRequestInProgress()()
 	}
-	defer func() { <-processingSem }()
 
 	ctx, timeoutCancel := context.WithTimeout(ctx, time.Duration(conf.WriteTimeout)*time.Second)
 	defer timeoutCancel()
@@ -167,37 +466,97 @@ func handleProcessing(reqID string, rw http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
-	ctx, downloadcancel, err := downloadImage(ctx)
+	var cacheKey string
+
+	if resultCache != nil {
+		cacheKey = resultCacheKey(r)
+
+		if data, meta, ok := resultCache.Get(cacheKey); ok {
+			respondWithCachedImage(ctx, reqID, r, rw, data, meta)
+			return
+		}
+	}
+
+	// The source ETag allows us to answer conditional requests
+	// without downloading and processing the image
+	if conf.ETagEnabled && conf.ETagFromSource && len(r.Header.Get("If-None-Match")) > 0 {
+		if hctx, err := fetchSourceHeaders(ctx, r.Header); err == nil && len(getSourceETag(hctx)) > 0 {
+			if matched, ok := matchETag(calcETag(hctx), r.Header.Get("If-None-Match")); ok {
+				respondWithNotModified(hctx, reqID, r, rw, matched)
+				return
+			}
+		}
+	}
+
+	usedFallback := false
+
+	ctx = withServerTiming(ctx)
+
+	releaseDownloadSem := acquireDownloadSem(ctx)
+	// The slot is released right after the download,
+	// this one releases it if the download panics
+	defer releaseDownloadSem()
+
+	stopDownloadTiming := startDownloadTiming(ctx)
+	ctx, downloadcancel, err := downloadImage(ctx, r.Header)
+	stopDownloadTiming()
+	releaseDownloadSem()
 	defer downloadcancel()
 	if err != nil {
 		if newRelicEnabled {
 			sendErrorToNewRelic(ctx, err)
 		}
-		if prometheusEnabled {
-			incrementPrometheusErrorsTotal("download")
-		}
+		incrementErrorsTotal("download")
+
+		ierr, ok := err.(*imgproxyError)
 
-		if fallbackImage == nil {
+		// Fallback image is used only when the source image is unreachable or invalid
+		if fallbackImage == nil || !ok || (ierr.StatusCode != 404 && ierr.StatusCode != 422) {
 			panic(err)
 		}
 
-		if ierr, ok := err.(*imgproxyError); !ok || ierr.Unexpected {
+		if ierr.Unexpected {
 			reportError(err, r)
 		}
 
 		logWarning("Could not load image %s. Using fallback image. %s", getImageURL(ctx), err.Error())
 		ctx = context.WithValue(ctx, imageDataCtxKey, fallbackImage)
+		usedFallback = true
+
+		statusCode := conf.FallbackImageHTTPCode
+		if statusCode == 0 {
+			statusCode = ierr.StatusCode
+		}
+		ctx = context.WithValue(ctx, responseStatusCodeCtxKey, statusCode)
 	}
 
 	checkTimeout(ctx)
 
+	// Face detection doesn't need libvips, so it's done before processing
+	// to not hold a locked OS thread while waiting for the service
+	ctx = withDetectedFaces(ctx)
+
+	checkTimeout(ctx)
+
+	if downloadSem != nil {
+		releaseProcessingSem = acquireProcessingSem(ctx)
+		defer releaseProcessingSem()
+		defer startRequestInProgress()()
+	}
+
+	var eTag string
+
 	if conf.ETagEnabled {
-		eTag := calcETag(ctx)
+		eTag = calcETag(ctx)
 		rw.Header().Set("ETag", eTag)
 
-		if eTag == r.Header.Get("If-None-Match") {
-			respondWithNotModified(ctx, reqID, r, rw)
-			return
+		// Conditional requests make sense only for successful responses,
+		// so we don't respond with 304 when the fallback image is used
+		if !usedFallback {
+			if matched, ok := matchETag(eTag, r.Header.Get("If-None-Match")); ok {
+				respondWithNotModified(ctx, reqID, r, rw, matched)
+				return
+			}
 		}
 	}
 
@@ -218,19 +577,96 @@ func handleProcessing(reqID string, rw http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	imageData, processcancel, err := processImage(ctx)
+	if len(getProcessingOptions(ctx).FrameURL) > 0 {
+		var framecancel context.CancelFunc
+
+		ctx, framecancel, err = downloadFrameImage(ctx)
+		defer framecancel()
+		if err != nil {
+			if newRelicEnabled {
+				sendErrorToNewRelic(ctx, err)
+			}
+			incrementErrorsTotal("download")
+			panic(err)
+		}
+
+		checkTimeout(ctx)
+	}
+
+	var stream *responseStream
+
+	// Result cache and persisting need the whole result
+	if conf.StreamResponse && resultCache == nil && !getProcessingOptions(ctx).Persist {
+		stream = newResponseStream(ctx, r, rw)
+		ctx = context.WithValue(ctx, responseStreamCtxKey, stream)
+	}
+
+	processingCtx, processingCancel := withProcessingTimeout(ctx)
+	defer processingCancel()
+
+	stopProcessingTiming := startProcessingTiming(ctx)
+	imageData, processcancel, err := processImageWithFastRetry(processingCtx)
+	stopProcessingTiming()
 	defer processcancel()
 	if err != nil {
 		if newRelicEnabled {
 			sendErrorToNewRelic(ctx, err)
 		}
-		if prometheusEnabled {
-			incrementPrometheusErrorsTotal("processing")
+		incrementErrorsTotal("processing")
+
+		if stream != nil && stream.Started {
+			releaseProcessingSem()
+			stream.Abort()
+
+			// The response is partially sent, so we can only abort it
+			// to let the client know the image is incomplete
+			logError("Processing of %s failed while streaming the response: %s", getImageURL(ctx), err)
+			panic(http.ErrAbortHandler)
 		}
+
 		panic(err)
 	}
 
+	if stream != nil && stream.Streamed {
+		// The result is encoded, so the processing slot
+		// isn't held while the rest of it is sent to the client
+		releaseProcessingSem()
+		stream.Finish()
+
+		po := getProcessingOptions(ctx)
+		statusCode := getResponseStatusCode(ctx)
+		imageURL := getImageURL(ctx)
+
+		incrementResponsesTotal(statusCode, po.Format)
+		logResponse(reqID, r, statusCode, nil, &imageURL, po)
+
+		return
+	}
+
 	checkTimeout(ctx)
 
 	respondWithImage(ctx, reqID, r, rw, imageData)
+
+	if resultCache != nil && !usedFallback {
+		if ttl := resultCacheTTL(ctx); ttl > 0 {
+			meta := resultCacheMeta{
+				Format:       getProcessingOptions(ctx).Format.String(),
+				CacheControl: getCacheControlHeader(ctx),
+				Expires:      getExpiresHeader(ctx),
+				ETag:         eTag,
+				ExpiresAt:    time.Now().Add(ttl),
+			}
+
+			if err := resultCache.Set(cacheKey, imageData, &meta); err != nil {
+				logWarning("Can't store the result in cache: %s", err)
+			}
+		}
+	}
+
+	if getProcessingOptions(ctx).Persist && !usedFallback {
+		if err := persistImage(ctx, r, imageData); err != nil {
+			logError("%s", err)
+			reportError(err, r)
+		}
+	}
 }
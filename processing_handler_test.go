@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type ProcessingHandlerTestSuite struct {
+	MainTestSuite
+
+	oldProcessingSem chan struct{}
+}
+
+func (s *ProcessingHandlerTestSuite) SetupTest() {
+	s.MainTestSuite.SetupTest()
+
+	s.oldProcessingSem = processingSem
+	processingSem = make(chan struct{}, 1)
+
+	conf.AllowInsecure = true
+	conf.AllowLoopback = true
+	conf.AllowPrivateSources = true
+}
+
+func (s *ProcessingHandlerTestSuite) TearDownTest() {
+	processingSem = s.oldProcessingSem
+
+	s.MainTestSuite.TearDownTest()
+}
+
+func (s *ProcessingHandlerTestSuite) TestClampCacheHeadersMaxAge() {
+	cacheControl, _ := clampCacheHeaders("public, max-age=7200, must-revalidate", "", 3600)
+	assert.Equal(s.T(), "public, max-age=3600, must-revalidate", cacheControl)
+
+	cacheControl, _ = clampCacheHeaders("public, max-age=60", "", 3600)
+	assert.Equal(s.T(), "public, max-age=60", cacheControl)
+}
+
+func (s *ProcessingHandlerTestSuite) TestClampCacheHeadersSMaxAge() {
+	cacheControl, _ := clampCacheHeaders("max-age=60, S-MaxAge=7200", "", 3600)
+	assert.Equal(s.T(), "max-age=60, S-MaxAge=3600", cacheControl)
+}
+
+func (s *ProcessingHandlerTestSuite) TestClampCacheHeadersInvalidMaxAge() {
+	cacheControl, _ := clampCacheHeaders("no-cache,max-age=abc", "", 3600)
+	assert.Equal(s.T(), "no-cache, max-age=abc", cacheControl)
+}
+
+func (s *ProcessingHandlerTestSuite) TestClampCacheHeadersExpires() {
+	farExpires := time.Now().Add(48 * time.Hour).Format(http.TimeFormat)
+
+	_, expires := clampCacheHeaders("", farExpires, 3600)
+
+	t, err := http.ParseTime(expires)
+	require.Nil(s.T(), err)
+	assert.WithinDuration(s.T(), time.Now().Add(time.Hour), t, 2*time.Second)
+
+	nearExpires := time.Now().Add(10 * time.Minute).Format(http.TimeFormat)
+
+	_, expires = clampCacheHeaders("", nearExpires, 3600)
+	assert.Equal(s.T(), nearExpires, expires)
+
+	_, expires = clampCacheHeaders("", "0", 3600)
+	assert.Equal(s.T(), "0", expires)
+}
+
+// startETagServer starts the source server that responds with the provided ETag
+// and counts HEAD and GET requests. GET requests receive a non-image body,
+// so the download fails if the image isn't answered with 304
+func (s *ProcessingHandlerTestSuite) startETagServer(eTag string, heads, gets *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			atomic.AddInt32(heads, 1)
+		} else {
+			atomic.AddInt32(gets, 1)
+		}
+
+		rw.Header().Set("ETag", eTag)
+		rw.WriteHeader(200)
+
+		if r.Method != http.MethodHead {
+			rw.Write([]byte("not an image"))
+		}
+	}))
+}
+
+func (s *ProcessingHandlerTestSuite) getPath(srv *httptest.Server) string {
+	return "/unsafe/" + base64.RawURLEncoding.EncodeToString([]byte(srv.URL+"/test.jpg"))
+}
+
+// getSourceBasedETag calculates the ETag imgproxy derives from the source ETag
+func (s *ProcessingHandlerTestSuite) getSourceBasedETag(path, sourceETag string) string {
+	ctx, err := parsePath(context.Background(), httptest.NewRequest(http.MethodGet, path, nil))
+	require.Nil(s.T(), err)
+
+	header := make(http.Header)
+	header.Set("ETag", sourceETag)
+
+	return calcETag(withSourceHeaders(ctx, header))
+}
+
+func (s *ProcessingHandlerTestSuite) request(path, ifNoneMatch string) *httptest.ResponseRecorder {
+	r := newRouter("")
+	r.PanicHandler = handlePanic
+	r.GET("/", handleProcessing, false)
+
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("If-None-Match", ifNoneMatch)
+
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw, req)
+
+	return rw
+}
+
+func (s *ProcessingHandlerTestSuite) TestETagFromSourceNotModified() {
+	conf.ETagEnabled = true
+	conf.ETagFromSource = true
+
+	var heads, gets int32
+
+	srv := s.startETagServer(`"source"`, &heads, &gets)
+	defer srv.Close()
+
+	path := s.getPath(srv)
+	eTag := s.getSourceBasedETag(path, `"source"`)
+
+	rw := s.request(path, eTag)
+
+	assert.Equal(s.T(), 304, rw.Code)
+	assert.Equal(s.T(), eTag, rw.Header().Get("ETag"))
+	assert.Equal(s.T(), int32(1), atomic.LoadInt32(&heads))
+	assert.Zero(s.T(), atomic.LoadInt32(&gets))
+}
+
+func (s *ProcessingHandlerTestSuite) TestETagFromSourceChanged() {
+	conf.ETagEnabled = true
+	conf.ETagFromSource = true
+
+	var heads, gets int32
+
+	srv := s.startETagServer(`"changed"`, &heads, &gets)
+	defer srv.Close()
+
+	path := s.getPath(srv)
+
+	rw := s.request(path, s.getSourceBasedETag(path, `"source"`))
+
+	assert.NotEqual(s.T(), 304, rw.Code)
+	assert.Equal(s.T(), int32(1), atomic.LoadInt32(&heads))
+	assert.Equal(s.T(), int32(1), atomic.LoadInt32(&gets))
+}
+
+func (s *ProcessingHandlerTestSuite) TestETagFromSourceWeak() {
+	conf.ETagEnabled = true
+	conf.ETagFromSource = true
+
+	var heads, gets int32
+
+	srv := s.startETagServer(`W/"source"`, &heads, &gets)
+	defer srv.Close()
+
+	// Weak ETags are ignored, so the image is downloaded even if any ETag matches
+	rw := s.request(s.getPath(srv), "*")
+
+	assert.NotEqual(s.T(), 304, rw.Code)
+	assert.Equal(s.T(), int32(1), atomic.LoadInt32(&gets))
+}
+
+func (s *ProcessingHandlerTestSuite) TestETagFromSourceDisabled() {
+	conf.ETagEnabled = true
+	conf.ETagFromSource = false
+
+	var heads, gets int32
+
+	srv := s.startETagServer(`"source"`, &heads, &gets)
+	defer srv.Close()
+
+	rw := s.request(s.getPath(srv), "*")
+
+	assert.NotEqual(s.T(), 304, rw.Code)
+	assert.Zero(s.T(), atomic.LoadInt32(&heads))
+	assert.Equal(s.T(), int32(1), atomic.LoadInt32(&gets))
+}
+
+func TestProcessingHandler(t *testing.T) {
+	suite.Run(t, new(ProcessingHandlerTestSuite))
+}
@@ -8,9 +8,11 @@ import (
 	"net/http"
 	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/imgproxy/imgproxy/v2/structdiff"
 )
@@ -43,6 +45,7 @@ const (
 	gravitySouthEast
 	gravitySmart
 	gravityFocusPoint
+	gravityFace
 )
 
 var gravityTypes = map[string]gravityType{
@@ -57,6 +60,31 @@ var gravityTypes = map[string]gravityType{
 	"soea": gravitySouthEast,
 	"sm":   gravitySmart,
 	"fp":   gravityFocusPoint,
+	"face": gravityFace,
+}
+
+type smartCropStrategy int
+
+const (
+	smartCropAttention smartCropStrategy = iota
+	smartCropEntropy
+)
+
+var smartCropStrategies = map[string]smartCropStrategy{
+	"attention": smartCropAttention,
+	"entropy":   smartCropEntropy,
+}
+
+type blurMode int
+
+const (
+	blurGaussian blurMode = iota
+	blurBox
+)
+
+var blurModes = map[string]blurMode{
+	"gaussian": blurGaussian,
+	"box":      blurBox,
 }
 
 type resizeType int
@@ -66,6 +94,7 @@ const (
 	resizeFill
 	resizeCrop
 	resizeAuto
+	resizeMin
 )
 
 var resizeTypes = map[string]resizeType{
@@ -73,20 +102,37 @@ var resizeTypes = map[string]resizeType{
 	"fill": resizeFill,
 	"crop": resizeCrop,
 	"auto": resizeAuto,
+	"min":  resizeMin,
 }
 
 type rgbColor struct{ R, G, B uint8 }
 
 var hexColorRegex = regexp.MustCompile("^([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$")
 
+// contentTypeOverrides is the allowlist of the content_type option values.
+// SVG is not allowed since browsers can run scripts embedded into it
+var contentTypeOverrides = map[string]bool{
+	"image/jpeg":               true,
+	"image/png":                true,
+	"image/webp":               true,
+	"image/gif":                true,
+	"image/avif":               true,
+	"image/heif":               true,
+	"image/bmp":                true,
+	"image/tiff":               true,
+	"image/x-icon":             true,
+	"application/octet-stream": true,
+}
+
 const (
 	hexColorLongFormat  = "%02x%02x%02x"
 	hexColorShortFormat = "%1x%1x%1x"
 )
 
 type gravityOptions struct {
-	Type gravityType
-	X, Y float64
+	Type     gravityType
+	X, Y     float64
+	Strategy smartCropStrategy
 }
 
 type extendOptions struct {
@@ -101,11 +147,24 @@ type cropOptions struct {
 }
 
 type paddingOptions struct {
+	Enabled  bool
+	Top      int
+	Right    int
+	Bottom   int
+	Left     int
+	HasColor bool
+	Color    rgbColor
+}
+
+type roundCornerOptions struct {
 	Enabled bool
-	Top     int
-	Right   int
-	Bottom  int
-	Left    int
+	Rx      int
+	Ry      int
+}
+
+type normalizeOptions struct {
+	Enabled bool
+	Clip    float64
 }
 
 type trimOptions struct {
@@ -123,54 +182,151 @@ type watermarkOptions struct {
 	Replicate bool
 	Gravity   gravityOptions
 	Scale     float64
+	Text      string
+	Name      string
+}
+
+// compressionProfile maps a compression level to the format-specific
+// quality and effort parameters
+type compressionProfile struct {
+	Quality        int
+	AvifQuality    int
+	PngCompression int
+	WebpEffort     int
+	AvifSpeed      int
+}
+
+var compressionProfiles = map[int]compressionProfile{
+	1: {Quality: 90, AvifQuality: 70, PngCompression: 3, WebpEffort: 2, AvifSpeed: 8},
+	2: {Quality: 85, AvifQuality: 60, PngCompression: 5, WebpEffort: 3, AvifSpeed: 7},
+	3: {Quality: 80, AvifQuality: 50, PngCompression: 6, WebpEffort: 4, AvifSpeed: 5},
+	4: {Quality: 70, AvifQuality: 40, PngCompression: 8, WebpEffort: 5, AvifSpeed: 3},
+	5: {Quality: 60, AvifQuality: 30, PngCompression: 9, WebpEffort: 6, AvifSpeed: 1},
+}
+
+type gifOptions struct {
+	Dither   float64
+	Effort   int
+	Bitdepth int
+}
+
+type jpegOptions struct {
+	NoSubsample bool
+}
+
+type pngOptions struct {
+	Quantize bool
+	Colors   int
+}
+
+type webpOptions struct {
+	Lossless     bool
+	NearLossless int
+}
+
+// saveOptions contains the options that affect image saving
+type saveOptions struct {
+	Compression int
+	Jpeg        jpegOptions
+	Png         pngOptions
+	Webp        webpOptions
+	Gif         gifOptions
 }
 
 type processingOptions struct {
 	ResizingType      resizeType
 	Width             int
 	Height            int
+	Megapixels        float64
 	Dpr               float64
 	Gravity           gravityOptions
 	Enlarge           bool
 	Extend            extendOptions
+	ExtendAspectRatio extendOptions
 	Crop              cropOptions
+	ZoomWidth         float64
+	ZoomHeight        float64
+	AspectRatio       float64
 	Padding           paddingOptions
+	RoundCorner       roundCornerOptions
 	Trim              trimOptions
 	Rotate            int
 	Format            imageType
+	AutoFormat        bool
 	Quality           int
+	Compression       int
+	BitDepth          int
 	MaxBytes          int
+	GifOptions        gifOptions
+	JpegOptions       jpegOptions
+	PngOptions        pngOptions
+	WebpOptions       webpOptions
 	Flatten           bool
 	Background        rgbColor
+	BackgroundAlpha   float64
 	Blur              float32
+	BlurMode          blurMode
 	Sharpen           float32
+	SharpenAmount     float32
+	SharpenThreshold  float32
+	Pixelate          int
+	Filter            string
+	Grayscale         bool
+	Normalize         normalizeOptions
+	Gamma             float64
 	StripMetadata     bool
+	KeepCopyright     bool
 	StripColorProfile bool
 	AutoRotate        bool
+	Frame             int
+	Dpi               float64
+
+	LinearColorspaceThreshold float64
 
 	CacheBuster string
+	Persist     bool
+	Expires     int64
+	TTL         int
 
 	Watermark watermarkOptions
+	FrameURL  string
 
 	PreferWebP  bool
 	EnforceWebP bool
 	PreferAvif  bool
 	EnforceAvif bool
 
-	Filename string
+	Filename    string
+	ContentType string
 
 	UsedPresets []string
+
+	// FastMode is set when processing is retried with cheaper settings
+	// because the first attempt didn't fit the deadline
+	FastMode bool
 }
 
 const (
 	imageURLCtxKey          = ctxKey("imageUrl")
 	processingOptionsCtxKey = ctxKey("processingOptions")
 	urlTokenPlain           = "plain"
-	maxClientHintDPR        = 8
-
-	msgForbidden     = "Forbidden"
-	msgInvalidURL    = "Invalid URL"
-	msgInvalidSource = "Invalid Source"
+	maxDpr                  = 8
+	minGamma                = 0.1
+	maxGamma                = 10
+	maxCompressionLevel     = 5
+	defaultPngCompression   = 6
+	defaultWebpEffort       = 4
+	defaultPdfDpi           = 72
+	defaultSharpenAmount    = 3
+	defaultSharpenThreshold = 2
+	maxPdfDpi               = 1200
+
+	downloadQueryParam = "download"
+
+	msgForbidden         = "Forbidden"
+	msgExpiredURL        = "Expired URL"
+	msgInvalidURL        = "Invalid URL"
+	msgInvalidBackground = "Invalid background"
 )
 
 func (gt gravityType) String() string {
@@ -191,6 +347,42 @@ func (gt gravityType) MarshalJSON() ([]byte, error) {
 	return []byte("null"), nil
 }
 
+func (s smartCropStrategy) String() string {
+	for k, v := range smartCropStrategies {
+		if v == s {
+			return k
+		}
+	}
+	return ""
+}
+
+func (s smartCropStrategy) MarshalJSON() ([]byte, error) {
+	for k, v := range smartCropStrategies {
+		if v == s {
+			return []byte(fmt.Sprintf("%q", k)), nil
+		}
+	}
+	return []byte("null"), nil
+}
+
+func (m blurMode) String() string {
+	for k, v := range blurModes {
+		if v == m {
+			return k
+		}
+	}
+	return ""
+}
+
+func (m blurMode) MarshalJSON() ([]byte, error) {
+	for k, v := range blurModes {
+		if v == m {
+			return []byte(fmt.Sprintf("%q", k)), nil
+		}
+	}
+	return []byte("null"), nil
+}
+
 func (rt resizeType) String() string {
 	for k, v := range resizeTypes {
 		if v == rt {
@@ -223,20 +415,41 @@ func newProcessingOptions() *processingOptions {
 			Gravity:           gravityOptions{Type: gravityCenter},
 			Enlarge:           false,
 			Extend:            extendOptions{Enabled: false, Gravity: gravityOptions{Type: gravityCenter}},
+			ExtendAspectRatio: extendOptions{Enabled: false, Gravity: gravityOptions{Type: gravityCenter}},
 			Padding:           paddingOptions{Enabled: false},
 			Trim:              trimOptions{Enabled: false, Threshold: 10, Smart: true},
 			Rotate:            0,
 			Quality:           0,
+			Compression:       conf.CompressionProfile,
+			BitDepth:          8,
 			MaxBytes:          0,
 			Format:            imageTypeUnknown,
 			Background:        rgbColor{255, 255, 255},
+			BackgroundAlpha:   1,
 			Blur:              0,
+			BlurMode:          blurGaussian,
 			Sharpen:           0,
+			SharpenAmount:     defaultSharpenAmount,
+			SharpenThreshold:  defaultSharpenThreshold,
+			Pixelate:          0,
+			Normalize:         normalizeOptions{Enabled: false, Clip: 1},
+			Gamma:             1,
 			Dpr:               1,
+			ZoomWidth:         1,
+			ZoomHeight:        1,
 			Watermark:         watermarkOptions{Opacity: 1, Replicate: false, Gravity: gravityOptions{Type: gravityCenter}},
 			StripMetadata:     conf.StripMetadata,
+			KeepCopyright:     conf.KeepCopyright,
 			StripColorProfile: conf.StripColorProfile,
 			AutoRotate:        conf.AutoRotate,
+			Frame:             -1,
+			Dpi:               defaultPdfDpi,
+			GifOptions:        gifOptions{Dither: conf.GifDither, Effort: conf.GifEffort, Bitdepth: conf.GifBitdepth},
+			JpegOptions:       jpegOptions{NoSubsample: conf.JpegNoSubsample},
+			PngOptions:        pngOptions{Quantize: conf.PngQuantize, Colors: conf.PngQuantizationColors},
+			WebpOptions:       webpOptions{Lossless: conf.WebpLossless, NearLossless: conf.WebpNearLossless},
+
+			LinearColorspaceThreshold: conf.LinearColorspaceThreshold,
 		}
 	})
 
@@ -246,9 +459,27 @@ func newProcessingOptions() *processingOptions {
 	return &po
 }
 
+func (po *processingOptions) getSaveOptions() *saveOptions {
+	return &saveOptions{
+		Compression: po.Compression,
+		Jpeg:        po.JpegOptions,
+		Png:         po.PngOptions,
+		Webp:        po.WebpOptions,
+		Gif:         po.GifOptions,
+	}
+}
+
 func (po *processingOptions) getQuality() int {
 	q := po.Quality
 
+	if profile, ok := compressionProfiles[po.Compression]; q == 0 && ok {
+		if po.Format == imageTypeAVIF {
+			q = profile.AvifQuality
+		} else {
+			q = profile.Quality
+		}
+	}
+
 	if q == 0 {
 		q = conf.FormatQuality[po.Format]
 	}
@@ -304,6 +535,15 @@ func colorFromHex(hexcolor string) (rgbColor, error) {
 	return c, nil
 }
 
+func addBaseURL(imageURL string) string {
+	// Data URIs are self-contained
+	if strings.HasPrefix(imageURL, dataURIPrefix) {
+		return imageURL
+	}
+
+	return fmt.Sprintf("%s%s", conf.BaseURL, imageURL)
+}
+
 func decodeBase64URL(parts []string) (string, string, error) {
 	var format string
 
@@ -327,9 +567,7 @@ func decodeBase64URL(parts []string) (string, string, error) {
 		return "", "", fmt.Errorf("Invalid url encoding: %s", encoded)
 	}
 
-	fullURL := fmt.Sprintf("%s%s", conf.BaseURL, string(imageURL))
-
-	return fullURL, format, nil
+	return addBaseURL(string(imageURL)), format, nil
 }
 
 func decodePlainURL(parts []string) (string, string, error) {
@@ -355,9 +593,7 @@ func decodePlainURL(parts []string) (string, string, error) {
 		return "", "", fmt.Errorf("Invalid url encoding: %s", encoded)
 	}
 
-	fullURL := fmt.Sprintf("%s%s", conf.BaseURL, unescaped)
-
-	return fullURL, format, nil
+	return addBaseURL(unescaped), format, nil
 }
 
 func decodeURL(parts []string) (string, string, error) {
@@ -413,8 +649,34 @@ func parseGravity(g *gravityOptions, args []string) error {
 		return fmt.Errorf("Invalid gravity: %s", args[0])
 	}
 
-	if g.Type == gravitySmart && nArgs > 1 {
-		return fmt.Errorf("Invalid gravity arguments: %v", args)
+	if g.Type == gravityFace {
+		if !conf.EnableFaceDetection {
+			return errors.New("Face detection is disabled")
+		}
+
+		if nArgs > 1 {
+			return fmt.Errorf("Invalid gravity arguments: %v", args)
+		}
+
+		return nil
+	}
+
+	if g.Type == gravitySmart {
+		if nArgs > 2 {
+			return fmt.Errorf("Invalid gravity arguments: %v", args)
+		}
+
+		g.Strategy = smartCropAttention
+
+		if nArgs > 1 {
+			if s, ok := smartCropStrategies[args[1]]; ok {
+				g.Strategy = s
+			} else {
+				return fmt.Errorf("Invalid smart crop strategy: %s", args[1])
+			}
+		}
+
+		return nil
 	} else if g.Type == gravityFocusPoint && nArgs != 3 {
 		return fmt.Errorf("Invalid gravity arguments: %v", args)
 	}
@@ -454,6 +716,20 @@ func applyHeightOption(po *processingOptions, args []string) error {
 	return parseDimension(&po.Height, "height", args[0])
 }
 
+func applyMegapixelsOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid megapixels arguments: %v", args)
+	}
+
+	if mp, err := strconv.ParseFloat(args[0], 64); err == nil && mp >= 0 {
+		po.Megapixels = mp
+	} else {
+		return fmt.Errorf("Invalid megapixels: %s", args[0])
+	}
+
+	return nil
+}
+
 func applyEnlargeOption(po *processingOptions, args []string) error {
 	if len(args) > 1 {
 		return fmt.Errorf("Invalid enlarge arguments: %v", args)
@@ -464,26 +740,38 @@ func applyEnlargeOption(po *processingOptions, args []string) error {
 	return nil
 }
 
-func applyExtendOption(po *processingOptions, args []string) error {
+func parseExtend(opts *extendOptions, name string, args []string) error {
 	if len(args) > 4 {
-		return fmt.Errorf("Invalid extend arguments: %v", args)
+		return fmt.Errorf("Invalid %s arguments: %v", name, args)
 	}
 
-	po.Extend.Enabled = parseBoolOption(args[0])
+	opts.Enabled = parseBoolOption(args[0])
 
 	if len(args) > 1 {
-		if err := parseGravity(&po.Extend.Gravity, args[1:]); err != nil {
+		if err := parseGravity(&opts.Gravity, args[1:]); err != nil {
 			return err
 		}
 
-		if po.Extend.Gravity.Type == gravitySmart {
-			return errors.New("extend doesn't support smart gravity")
+		if opts.Gravity.Type == gravitySmart {
+			return fmt.Errorf("%s doesn't support smart gravity", name)
+		}
+
+		if opts.Gravity.Type == gravityFace {
+			return fmt.Errorf("%s doesn't support face gravity", name)
 		}
 	}
 
 	return nil
 }
 
+func applyExtendOption(po *processingOptions, args []string) error {
+	return parseExtend(&po.Extend, "extend", args)
+}
+
+func applyExtendAspectRatioOption(po *processingOptions, args []string) error {
+	return parseExtend(&po.ExtendAspectRatio, "extend_aspect_ratio", args)
+}
+
 func applySizeOption(po *processingOptions, args []string) (err error) {
 	if len(args) > 7 {
 		return fmt.Errorf("Invalid size arguments: %v", args)
@@ -555,7 +843,7 @@ func applyDprOption(po *processingOptions, args []string) error {
 		return fmt.Errorf("Invalid dpr arguments: %v", args)
 	}
 
-	if d, err := strconv.ParseFloat(args[0], 64); err == nil && d > 0 {
+	if d, err := strconv.ParseFloat(args[0], 64); err == nil && d > 0 && d <= maxDpr {
 		po.Dpr = d
 	} else {
 		return fmt.Errorf("Invalid dpr: %s", args[0])
@@ -594,10 +882,57 @@ func applyCropOption(po *processingOptions, args []string) error {
 	return nil
 }
 
+func applyZoomOption(po *processingOptions, args []string) error {
+	if len(args) > 2 {
+		return fmt.Errorf("Invalid zoom arguments: %v", args)
+	}
+
+	if z, err := strconv.ParseFloat(args[0], 64); err == nil && z > 0 {
+		po.ZoomWidth = z
+		po.ZoomHeight = z
+	} else {
+		return fmt.Errorf("Invalid zoom value: %s", args[0])
+	}
+
+	if len(args) > 1 {
+		if z, err := strconv.ParseFloat(args[1], 64); err == nil && z > 0 {
+			po.ZoomHeight = z
+		} else {
+			return fmt.Errorf("Invalid zoom value: %s", args[1])
+		}
+	}
+
+	return nil
+}
+
+func applyAspectRatioOption(po *processingOptions, args []string) error {
+	if len(args) > 2 {
+		return fmt.Errorf("Invalid aspect ratio arguments: %v", args)
+	}
+
+	ratio, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || ratio <= 0 {
+		return fmt.Errorf("Invalid aspect ratio: %s", strings.Join(args, ":"))
+	}
+
+	if len(args) > 1 {
+		h, err := strconv.ParseFloat(args[1], 64)
+		if err != nil || h <= 0 {
+			return fmt.Errorf("Invalid aspect ratio: %s", strings.Join(args, ":"))
+		}
+
+		ratio /= h
+	}
+
+	po.AspectRatio = ratio
+
+	return nil
+}
+
 func applyPaddingOption(po *processingOptions, args []string) error {
 	nArgs := len(args)
 
-	if nArgs < 1 || nArgs > 4 {
+	if nArgs < 1 || nArgs > 5 {
 		return fmt.Errorf("Invalid padding arguments: %v", args)
 	}
 
@@ -631,6 +966,16 @@ func applyPaddingOption(po *processingOptions, args []string) error {
 		}
 	}
 
+	if nArgs > 4 && len(args[4]) > 0 {
+		c, err := colorFromHex(args[4])
+		if err != nil {
+			return fmt.Errorf("Invalid padding color: %s", err)
+		}
+
+		po.Padding.HasColor = true
+		po.Padding.Color = c
+	}
+
 	if po.Padding.Top == 0 && po.Padding.Right == 0 && po.Padding.Bottom == 0 && po.Padding.Left == 0 {
 		po.Padding.Enabled = false
 	}
@@ -638,6 +983,29 @@ func applyPaddingOption(po *processingOptions, args []string) error {
 	return nil
 }
 
+func applyRoundCornerOption(po *processingOptions, args []string) error {
+	nArgs := len(args)
+
+	if nArgs < 1 || nArgs > 2 {
+		return fmt.Errorf("Invalid round corner arguments: %v", args)
+	}
+
+	if err := parseDimension(&po.RoundCorner.Rx, "round corner radius", args[0]); err != nil {
+		return err
+	}
+	po.RoundCorner.Ry = po.RoundCorner.Rx
+
+	if nArgs > 1 && len(args[1]) > 0 {
+		if err := parseDimension(&po.RoundCorner.Ry, "round corner vertical radius", args[1]); err != nil {
+			return err
+		}
+	}
+
+	po.RoundCorner.Enabled = po.RoundCorner.Rx > 0 && po.RoundCorner.Ry > 0
+
+	return nil
+}
+
 func applyTrimOption(po *processingOptions, args []string) error {
 	nArgs := len(args)
 
@@ -700,6 +1068,34 @@ func applyQualityOption(po *processingOptions, args []string) error {
 	return nil
 }
 
+func applyCompressionOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid compression arguments: %v", args)
+	}
+
+	if c, err := strconv.Atoi(args[0]); err == nil && c >= 0 && c <= maxCompressionLevel {
+		po.Compression = c
+	} else {
+		return fmt.Errorf("Invalid compression: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyBitDepthOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid bit depth arguments: %v", args)
+	}
+
+	if d, err := strconv.Atoi(args[0]); err == nil && (d == 8 || d == 16) {
+		po.BitDepth = d
+	} else {
+		return fmt.Errorf("Invalid bit depth: %s", args[0])
+	}
+
+	return nil
+}
+
 func applyMaxBytesOption(po *processingOptions, args []string) error {
 	if len(args) > 1 {
 		return fmt.Errorf("Invalid max_bytes arguments: %v", args)
@@ -718,58 +1114,91 @@ func applyBackgroundOption(po *processingOptions, args []string) error {
 	switch len(args) {
 	case 1:
 		if len(args[0]) == 0 {
-			po.Flatten = false
+			po.Background = rgbColor{255, 255, 255}
+			po.BackgroundAlpha = 1
 		} else if c, err := colorFromHex(args[0]); err == nil {
-			po.Flatten = true
 			po.Background = c
+			po.BackgroundAlpha = 1
 		} else {
-			return fmt.Errorf("Invalid background argument: %s", err)
+			return newError(422, fmt.Sprintf("Invalid background argument: %s", err), msgInvalidBackground).SetCategory("invalid_options")
 		}
 
-	case 3:
-		po.Flatten = true
-
+	case 3, 4:
 		if r, err := strconv.ParseUint(args[0], 10, 8); err == nil && r <= 255 {
 			po.Background.R = uint8(r)
 		} else {
-			return fmt.Errorf("Invalid background red channel: %s", args[0])
+			return newError(422, fmt.Sprintf("Invalid background red channel: %s", args[0]), msgInvalidBackground).SetCategory("invalid_options")
 		}
 
 		if g, err := strconv.ParseUint(args[1], 10, 8); err == nil && g <= 255 {
 			po.Background.G = uint8(g)
 		} else {
-			return fmt.Errorf("Invalid background green channel: %s", args[1])
+			return newError(422, fmt.Sprintf("Invalid background green channel: %s", args[1]), msgInvalidBackground).SetCategory("invalid_options")
 		}
 
 		if b, err := strconv.ParseUint(args[2], 10, 8); err == nil && b <= 255 {
 			po.Background.B = uint8(b)
 		} else {
-			return fmt.Errorf("Invalid background blue channel: %s", args[2])
+			return newError(422, fmt.Sprintf("Invalid background blue channel: %s", args[2]), msgInvalidBackground).SetCategory("invalid_options")
+		}
+
+		po.BackgroundAlpha = 1
+
+		if len(args) == 4 {
+			if a, err := strconv.ParseFloat(args[3], 64); err == nil && a >= 0 && a <= 1 {
+				po.BackgroundAlpha = a
+			} else {
+				return newError(422, fmt.Sprintf("Invalid background alpha channel: %s", args[3]), msgInvalidBackground).SetCategory("invalid_options")
+			}
 		}
 
 	default:
-		return fmt.Errorf("Invalid background arguments: %v", args)
+		return newError(422, fmt.Sprintf("Invalid background arguments: %v", args), msgInvalidBackground).SetCategory("invalid_options")
 	}
 
 	return nil
 }
 
-func applyBlurOption(po *processingOptions, args []string) error {
+func applyFlattenOption(po *processingOptions, args []string) error {
 	if len(args) > 1 {
+		return fmt.Errorf("Invalid flatten arguments: %v", args)
+	}
+
+	po.Flatten = parseBoolOption(args[0])
+
+	return nil
+}
+
+func applyBlurOption(po *processingOptions, args []string) error {
+	if len(args) > 2 {
 		return fmt.Errorf("Invalid blur arguments: %v", args)
 	}
 
 	if b, err := strconv.ParseFloat(args[0], 32); err == nil && b >= 0 {
+		// Huge sigmas are extremely slow, so we clamp them
+		if b > conf.MaxBlurSigma {
+			b = conf.MaxBlurSigma
+		}
 		po.Blur = float32(b)
 	} else {
 		return fmt.Errorf("Invalid blur: %s", args[0])
 	}
 
+	po.BlurMode = blurGaussian
+
+	if len(args) > 1 && len(args[1]) > 0 {
+		if m, ok := blurModes[args[1]]; ok {
+			po.BlurMode = m
+		} else {
+			return fmt.Errorf("Invalid blur mode: %s", args[1])
+		}
+	}
+
 	return nil
 }
 
 func applySharpenOption(po *processingOptions, args []string) error {
-	if len(args) > 1 {
+	if len(args) > 3 {
 		return fmt.Errorf("Invalid sharpen arguments: %v", args)
 	}
 
@@ -779,6 +1208,102 @@ func applySharpenOption(po *processingOptions, args []string) error {
 		return fmt.Errorf("Invalid sharpen: %s", args[0])
 	}
 
+	po.SharpenAmount = defaultSharpenAmount
+	po.SharpenThreshold = defaultSharpenThreshold
+
+	if len(args) > 1 && len(args[1]) > 0 {
+		if a, err := strconv.ParseFloat(args[1], 32); err == nil && a > 0 {
+			po.SharpenAmount = float32(a)
+		} else {
+			return fmt.Errorf("Invalid sharpen amount: %s", args[1])
+		}
+	}
+
+	if len(args) > 2 && len(args[2]) > 0 {
+		if t, err := strconv.ParseFloat(args[2], 32); err == nil && t >= 0 {
+			po.SharpenThreshold = float32(t)
+		} else {
+			return fmt.Errorf("Invalid sharpen threshold: %s", args[2])
+		}
+	}
+
+	return nil
+}
+
+func applyPixelateOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid pixelate arguments: %v", args)
+	}
+
+	if p, err := strconv.Atoi(args[0]); err == nil && p >= 1 {
+		po.Pixelate = p
+	} else {
+		return fmt.Errorf("Invalid pixelate: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyFilterOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid filter arguments: %v", args)
+	}
+
+	if len(args[0]) == 0 {
+		po.Filter = ""
+		return nil
+	}
+
+	if _, ok := luts[args[0]]; !ok {
+		return fmt.Errorf("Unknown filter: %s", args[0])
+	}
+
+	po.Filter = args[0]
+
+	return nil
+}
+
+func applyGrayscaleOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid grayscale arguments: %v", args)
+	}
+
+	po.Grayscale = parseBoolOption(args[0])
+
+	return nil
+}
+
+func applyNormalizeOption(po *processingOptions, args []string) error {
+	nArgs := len(args)
+
+	if nArgs > 2 {
+		return fmt.Errorf("Invalid normalize arguments: %v", args)
+	}
+
+	po.Normalize.Enabled = parseBoolOption(args[0])
+
+	if nArgs > 1 && len(args[1]) > 0 {
+		if c, err := strconv.ParseFloat(args[1], 64); err == nil && c >= 0 && c < 50 {
+			po.Normalize.Clip = c
+		} else {
+			return fmt.Errorf("Invalid normalize clip percentile: %s", args[1])
+		}
+	}
+
+	return nil
+}
+
+func applyGammaOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid gamma arguments: %v", args)
+	}
+
+	if g, err := strconv.ParseFloat(args[0], 64); err == nil && g >= minGamma && g <= maxGamma {
+		po.Gamma = g
+	} else {
+		return fmt.Errorf("Invalid gamma: %s", args[0])
+	}
+
 	return nil
 }
 
@@ -818,7 +1343,7 @@ func applyWatermarkOption(po *processingOptions, args []string) error {
 	if len(args) > 1 && len(args[1]) > 0 {
 		if args[1] == "re" {
 			po.Watermark.Replicate = true
-		} else if g, ok := gravityTypes[args[1]]; ok && g != gravityFocusPoint && g != gravitySmart {
+		} else if g, ok := gravityTypes[args[1]]; ok && g != gravityFocusPoint && g != gravitySmart && g != gravityFace {
 			po.Watermark.Gravity.Type = g
 		} else {
 			return fmt.Errorf("Invalid watermark position: %s", args[1])
@@ -852,11 +1377,162 @@ func applyWatermarkOption(po *processingOptions, args []string) error {
 	return nil
 }
 
+func applyWatermarkTextOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid watermark text arguments: %v", args)
+	}
+
+	text, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(args[0], "="))
+	if err != nil {
+		return fmt.Errorf("Invalid watermark text: %s", args[0])
+	}
+
+	if len(text) > conf.WatermarkTextMaxLength {
+		return fmt.Errorf("Watermark text is too long: %d bytes, max %d", len(text), conf.WatermarkTextMaxLength)
+	}
+
+	po.Watermark.Text = string(text)
+
+	return nil
+}
+
+func applyFrameURLOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid frame URL arguments: %v", args)
+	}
+
+	if len(args[0]) == 0 {
+		po.FrameURL = ""
+		return nil
+	}
+
+	frameURL, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(args[0], "="))
+	if err != nil {
+		return fmt.Errorf("Invalid frame URL: %s", args[0])
+	}
+
+	if err = checkSourceURL(string(frameURL)); err != nil {
+		return err
+	}
+
+	po.FrameURL = string(frameURL)
+
+	return nil
+}
+
+func applyGifSaveOptionsOption(po *processingOptions, args []string) error {
+	if len(args) > 3 {
+		return fmt.Errorf("Invalid GIF save options arguments: %v", args)
+	}
+
+	if len(args) > 0 && len(args[0]) > 0 {
+		if d, err := strconv.ParseFloat(args[0], 64); err == nil && d >= 0 && d <= 1 {
+			po.GifOptions.Dither = d
+		} else {
+			return fmt.Errorf("Invalid GIF dither: %s", args[0])
+		}
+	}
+
+	if len(args) > 1 && len(args[1]) > 0 {
+		if e, err := strconv.Atoi(args[1]); err == nil && e >= 1 && e <= 10 {
+			po.GifOptions.Effort = e
+		} else {
+			return fmt.Errorf("Invalid GIF effort: %s", args[1])
+		}
+	}
+
+	if len(args) > 2 && len(args[2]) > 0 {
+		if b, err := strconv.Atoi(args[2]); err == nil && b >= 1 && b <= 8 {
+			po.GifOptions.Bitdepth = b
+		} else {
+			return fmt.Errorf("Invalid GIF bitdepth: %s", args[2])
+		}
+	}
+
+	return nil
+}
+
+func applyJpegNoSubsampleOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid JPEG no subsample arguments: %v", args)
+	}
+
+	po.JpegOptions.NoSubsample = parseBoolOption(args[0])
+
+	return nil
+}
+
+func applyPngQuantizeOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid PNG quantize arguments: %v", args)
+	}
+
+	po.PngOptions.Quantize = parseBoolOption(args[0])
+
+	return nil
+}
+
+func applyPngColorsOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid PNG colors arguments: %v", args)
+	}
+
+	if c, err := strconv.Atoi(args[0]); err == nil && c >= 2 && c <= 256 {
+		po.PngOptions.Colors = c
+	} else {
+		return fmt.Errorf("Invalid PNG colors: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyWebpLosslessOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid WebP lossless arguments: %v", args)
+	}
+
+	po.WebpOptions.Lossless = parseBoolOption(args[0])
+
+	return nil
+}
+
+func applyWebpNearLosslessOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid WebP near-lossless arguments: %v", args)
+	}
+
+	if n, err := strconv.Atoi(args[0]); err == nil && n >= 0 && n <= 100 {
+		po.WebpOptions.NearLossless = n
+	} else {
+		return fmt.Errorf("Invalid WebP near-lossless: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyWatermarkNameOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid watermark name arguments: %v", args)
+	}
+
+	po.Watermark.Name = args[0]
+
+	return nil
+}
+
 func applyFormatOption(po *processingOptions, args []string) error {
 	if len(args) > 1 {
 		return fmt.Errorf("Invalid format arguments: %v", args)
 	}
 
+	po.AutoFormat = args[0] == "auto"
+
+	if po.AutoFormat {
+		// The format is selected by the source image during processing
+		po.Format = imageTypeUnknown
+		return nil
+	}
+
 	if f, ok := imageTypes[args[0]]; ok {
 		po.Format = f
 	} else {
@@ -880,6 +1556,55 @@ func applyCacheBusterOption(po *processingOptions, args []string) error {
 	return nil
 }
 
+func applyExpiresOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid expires arguments: %v", args)
+	}
+
+	if exp, err := strconv.ParseInt(args[0], 10, 64); err == nil && exp > 0 {
+		po.Expires = exp
+	} else {
+		return fmt.Errorf("Invalid expires: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyTTLOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid ttl arguments: %v", args)
+	}
+
+	ttl, err := strconv.Atoi(args[0])
+	if err != nil || ttl <= 0 {
+		return fmt.Errorf("Invalid ttl: %s", args[0])
+	}
+
+	po.TTL = minInt(ttl, conf.MaxTTL)
+
+	return nil
+}
+
+func applyPersistOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid persist arguments: %v", args)
+	}
+
+	persist := parseBoolOption(args[0])
+
+	if persist && len(conf.PersistURLTemplate) == 0 {
+		return errors.New("Persisting is disabled")
+	}
+
+	if persist && conf.AllowInsecure {
+		return errors.New("Persisting is allowed only for signed URLs")
+	}
+
+	po.Persist = persist
+
+	return nil
+}
+
 func applyFilenameOption(po *processingOptions, args []string) error {
 	if len(args) > 1 {
 		return fmt.Errorf("Invalid filename arguments: %v", args)
@@ -890,6 +1615,28 @@ func applyFilenameOption(po *processingOptions, args []string) error {
 	return nil
 }
 
+func applyContentTypeOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid content type arguments: %v", args)
+	}
+
+	// The value contains a slash, so it should be escaped in the path
+	contentType, err := url.PathUnescape(args[0])
+	if err != nil {
+		return fmt.Errorf("Invalid content type: %s", args[0])
+	}
+
+	contentType = strings.ToLower(contentType)
+
+	if len(contentType) > 0 && !contentTypeOverrides[contentType] {
+		return fmt.Errorf("Content type is not allowed: %s", contentType)
+	}
+
+	po.ContentType = contentType
+
+	return nil
+}
+
 func applyStripMetadataOption(po *processingOptions, args []string) error {
 	if len(args) > 1 {
 		return fmt.Errorf("Invalid strip metadata arguments: %v", args)
@@ -900,6 +1647,16 @@ func applyStripMetadataOption(po *processingOptions, args []string) error {
 	return nil
 }
 
+func applyKeepCopyrightOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid keep copyright arguments: %v", args)
+	}
+
+	po.KeepCopyright = parseBoolOption(args[0])
+
+	return nil
+}
+
 func applyStripColorProfileOption(po *processingOptions, args []string) error {
 	if len(args) > 1 {
 		return fmt.Errorf("Invalid strip color profile arguments: %v", args)
@@ -920,6 +1677,48 @@ func applyAutoRotateOption(po *processingOptions, args []string) error {
 	return nil
 }
 
+func applyLinearColorspaceThresholdOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid linear colorspace threshold arguments: %v", args)
+	}
+
+	if t, err := strconv.ParseFloat(args[0], 64); err == nil && t > 0 && t <= 1 {
+		po.LinearColorspaceThreshold = t
+	} else {
+		return fmt.Errorf("Invalid linear colorspace threshold: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyFrameOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid frame arguments: %v", args)
+	}
+
+	if f, err := strconv.Atoi(args[0]); err == nil && f >= 0 {
+		po.Frame = f
+	} else {
+		return fmt.Errorf("Invalid frame: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyDpiOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid dpi arguments: %v", args)
+	}
+
+	if d, err := strconv.ParseFloat(args[0], 64); err == nil && d > 0 && d <= maxPdfDpi {
+		po.Dpi = d
+	} else {
+		return fmt.Errorf("Invalid dpi: %s", args[0])
+	}
+
+	return nil
+}
+
 func applyProcessingOption(po *processingOptions, name string, args []string) error {
 	switch name {
 	case "format", "f", "ext":
@@ -934,46 +1733,106 @@ func applyProcessingOption(po *processingOptions, name string, args []string) er
 		return applyWidthOption(po, args)
 	case "height", "h":
 		return applyHeightOption(po, args)
+	case "megapixels", "mp":
+		return applyMegapixelsOption(po, args)
 	case "enlarge", "el":
 		return applyEnlargeOption(po, args)
 	case "extend", "ex":
 		return applyExtendOption(po, args)
+	case "extend_aspect_ratio", "extend_ar", "exar":
+		return applyExtendAspectRatioOption(po, args)
 	case "dpr":
 		return applyDprOption(po, args)
 	case "gravity", "g":
 		return applyGravityOption(po, args)
 	case "crop", "c":
 		return applyCropOption(po, args)
+	case "zoom", "z":
+		return applyZoomOption(po, args)
+	case "aspect_ratio":
+		return applyAspectRatioOption(po, args)
 	case "trim", "t":
 		return applyTrimOption(po, args)
 	case "rotate", "rot":
 		return applyRotateOption(po, args)
 	case "padding", "pd":
 		return applyPaddingOption(po, args)
+	case "round_corner", "rc":
+		return applyRoundCornerOption(po, args)
 	case "quality", "q":
 		return applyQualityOption(po, args)
+	case "compression", "cmp":
+		return applyCompressionOption(po, args)
+	case "bit_depth", "bd":
+		return applyBitDepthOption(po, args)
 	case "max_bytes", "mb":
 		return applyMaxBytesOption(po, args)
+	case "gif_save_options", "gifso":
+		return applyGifSaveOptionsOption(po, args)
+	case "jpeg_no_subsample", "jpns":
+		return applyJpegNoSubsampleOption(po, args)
+	case "png_quantize", "pngq":
+		return applyPngQuantizeOption(po, args)
+	case "png_colors", "pngc":
+		return applyPngColorsOption(po, args)
+	case "webp_lossless", "wpl":
+		return applyWebpLosslessOption(po, args)
+	case "webp_near_lossless", "wpnl":
+		return applyWebpNearLosslessOption(po, args)
 	case "background", "bg":
 		return applyBackgroundOption(po, args)
+	case "flatten", "fl":
+		return applyFlattenOption(po, args)
 	case "blur", "bl":
 		return applyBlurOption(po, args)
 	case "sharpen", "sh":
 		return applySharpenOption(po, args)
+	case "pixelate", "pix":
+		return applyPixelateOption(po, args)
+	case "filter", "flt":
+		return applyFilterOption(po, args)
+	case "grayscale", "gs", "monochrome":
+		return applyGrayscaleOption(po, args)
+	case "normalize", "auto_levels", "norm":
+		return applyNormalizeOption(po, args)
+	case "gamma", "gm":
+		return applyGammaOption(po, args)
 	case "watermark", "wm":
 		return applyWatermarkOption(po, args)
+	case "watermark_text", "wmt":
+		return applyWatermarkTextOption(po, args)
+	case "watermark_name", "wmn":
+		return applyWatermarkNameOption(po, args)
+	case "frame_url", "fru":
+		return applyFrameURLOption(po, args)
 	case "preset", "pr":
 		return applyPresetOption(po, args)
 	case "cachebuster", "cb":
 		return applyCacheBusterOption(po, args)
+	case "persist", "pst":
+		return applyPersistOption(po, args)
+	case "expires", "exp":
+		return applyExpiresOption(po, args)
+	case "ttl":
+		return applyTTLOption(po, args)
 	case "strip_metadata", "sm":
 		return applyStripMetadataOption(po, args)
+	case "keep_copyright", "kcr":
+		return applyKeepCopyrightOption(po, args)
 	case "strip_color_profile", "scp":
 		return applyStripColorProfileOption(po, args)
 	case "auto_rotate", "ar":
 		return applyAutoRotateOption(po, args)
+	case "frame", "fr", "page", "pg":
+		return applyFrameOption(po, args)
+	case "dpi":
+		return applyDpiOption(po, args)
+	case "linear_colorspace_threshold", "lct":
+		return applyLinearColorspaceThresholdOption(po, args)
 	case "filename", "fn":
 		return applyFilenameOption(po, args)
+	case "content_type", "ct":
+		return applyContentTypeOption(po, args)
 	}
 
 	return fmt.Errorf("Unknown processing option: %s", name)
@@ -1030,13 +1889,15 @@ func parseURLOptions(opts []string) (urlOptions, []string) {
 func defaultProcessingOptions(headers *processingHeaders) (*processingOptions, error) {
 	po := newProcessingOptions()
 
+	// Auto format enables both AVIF and WebP detection. Detected formats
+	// are used only when the format is not set explicitly
 	if strings.Contains(headers.Accept, "image/webp") {
-		po.PreferWebP = conf.EnableWebpDetection || conf.EnforceWebp
+		po.PreferWebP = conf.EnableWebpDetection || conf.EnforceWebp || conf.EnableFormatDetection
 		po.EnforceWebP = conf.EnforceWebp
 	}
 
 	if strings.Contains(headers.Accept, "image/avif") {
-		po.PreferAvif = conf.EnableAvifDetection || conf.EnforceAvif
+		po.PreferAvif = conf.EnableAvifDetection || conf.EnforceAvif || conf.EnableFormatDetection
 		po.EnforceAvif = conf.EnforceAvif
 	}
 
@@ -1051,7 +1912,7 @@ func defaultProcessingOptions(headers *processingHeaders) (*processingOptions, e
 		}
 	}
 	if conf.EnableClientHints && len(headers.DPR) > 0 {
-		if dpr, err := strconv.ParseFloat(headers.DPR, 64); err == nil && (dpr > 0 && dpr <= maxClientHintDPR) {
+		if dpr, err := strconv.ParseFloat(headers.DPR, 64); err == nil && (dpr > 0 && dpr <= maxDpr) {
 			po.Dpr = dpr
 		}
 	}
@@ -1064,12 +1925,42 @@ func defaultProcessingOptions(headers *processingHeaders) (*processingOptions, e
 	return po, nil
 }
 
-func parsePathAdvanced(parts []string, headers *processingHeaders) (string, *processingOptions, error) {
+// parseQueryOptions parses processing options from the query string.
+// Option arguments are divided by colon just like in the path
+func parseQueryOptions(query url.Values) urlOptions {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	options := make(urlOptions, 0, len(names))
+
+	for _, name := range names {
+		// Download mode is handled while responding and doesn't affect processing
+		if name == downloadQueryParam {
+			continue
+		}
+
+		for _, value := range query[name] {
+			options = append(options, urlOption{Name: name, Args: strings.Split(value, ":")})
+		}
+	}
+
+	return options
+}
+
+func parsePathAdvanced(parts []string, queryOptions urlOptions, headers *processingHeaders) (string, *processingOptions, error) {
 	po, err := defaultProcessingOptions(headers)
 	if err != nil {
 		return "", po, err
 	}
 
+	// Query options are applied first so the path options take precedence
+	if err = applyProcessingOptions(po, queryOptions); err != nil {
+		return "", po, err
+	}
+
 	options, urlParts := parseURLOptions(parts)
 
 	if err = applyProcessingOptions(po, options); err != nil {
@@ -1117,7 +2008,7 @@ func parsePathPresets(parts []string, headers *processingHeaders) (string, *proc
 	return url, po, nil
 }
 
-func parsePathBasic(parts []string, headers *processingHeaders) (string, *processingOptions, error) {
+func parsePathBasic(parts []string, queryOptions urlOptions, headers *processingHeaders) (string, *processingOptions, error) {
 	if len(parts) < 6 {
 		return "", nil, fmt.Errorf("Invalid basic URL format arguments: %s", strings.Join(parts, "/"))
 	}
@@ -1127,6 +2018,10 @@ func parsePathBasic(parts []string, headers *processingHeaders) (string, *proces
 		return "", po, err
 	}
 
+	if err = applyProcessingOptions(po, queryOptions); err != nil {
+		return "", po, err
+	}
+
 	po.ResizingType = resizeTypes[parts[0]]
 
 	if err = applyWidthOption(po, parts[1:2]); err != nil {
@@ -1173,12 +2068,29 @@ func parsePath(ctx context.Context, r *http.Request) (context.Context, error) {
 	parts := strings.Split(path, "/")
 
 	if len(parts) < 2 {
-		return ctx, newError(404, fmt.Sprintf("Invalid path: %s", path), msgInvalidURL)
+		return ctx, newError(404, fmt.Sprintf("Invalid path: %s", path), msgInvalidURL).SetCategory("invalid_url")
+	}
+
+	signedPath := strings.TrimPrefix(path, parts[0])
+
+	var queryOptions urlOptions
+
+	if conf.EnableQueryOptions && !conf.OnlyPresets {
+		query, err := url.ParseQuery(trimBefore(r.RequestURI, '?'))
+		if err != nil {
+			return ctx, newError(404, fmt.Sprintf("Invalid query string: %s", err), msgInvalidURL).SetCategory("invalid_url")
+		}
+
+		if len(query) > 0 {
+			// Encode sorts the query by key, so we can use it as the canonical form
+			signedPath += "?" + query.Encode()
+			queryOptions = parseQueryOptions(query)
+		}
 	}
 
 	if !conf.AllowInsecure {
-		if err = validatePath(parts[0], strings.TrimPrefix(path, parts[0])); err != nil {
-			return ctx, newError(403, err.Error(), msgForbidden)
+		if err = validatePath(parts[0], signedPath); err != nil {
+			return ctx, newError(403, err.Error(), msgForbidden).SetCategory("invalid_signature")
 		}
 	}
 
@@ -1195,17 +2107,23 @@ func parsePath(ctx context.Context, r *http.Request) (context.Context, error) {
 	if conf.OnlyPresets {
 		imageURL, po, err = parsePathPresets(parts[1:], headers)
 	} else if _, ok := resizeTypes[parts[1]]; ok {
-		imageURL, po, err = parsePathBasic(parts[1:], headers)
+		imageURL, po, err = parsePathBasic(parts[1:], queryOptions, headers)
 	} else {
-		imageURL, po, err = parsePathAdvanced(parts[1:], headers)
+		imageURL, po, err = parsePathAdvanced(parts[1:], queryOptions, headers)
 	}
 
-	if err != nil {
-		return ctx, newError(404, err.Error(), msgInvalidURL)
+	if ierr, ok := err.(*imgproxyError); ok {
+		return ctx, ierr
+	} else if err != nil {
+		return ctx, newError(404, err.Error(), msgInvalidURL).SetCategory("invalid_url")
+	}
+
+	if po.Expires > 0 && time.Now().Unix() > po.Expires {
+		return ctx, newError(403, errExpiredURL.Error(), msgExpiredURL).SetCategory("expired_url")
 	}
 
-	if !isAllowedSource(imageURL) {
-		return ctx, newError(404, "Invalid source", msgInvalidSource)
+	if err = checkSourceURL(imageURL); err != nil {
+		return ctx, err
 	}
 
 	ctx = context.WithValue(ctx, imageURLCtxKey, imageURL)
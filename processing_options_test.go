@@ -5,9 +5,11 @@ import (
 	"encoding/base64"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"regexp"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -62,6 +64,17 @@ func (s *ProcessingOptionsTestSuite) TestParsePlainURL() {
 	assert.Equal(s.T(), imageTypePNG, getProcessingOptions(ctx).Format)
 }
 
+func (s *ProcessingOptionsTestSuite) TestParsePlainDataURIWithBase() {
+	imageURL := "data:image/png;base64,iVBORw0KGgo+AAAA/"
+	conf.BaseURL = "http://images.dev/"
+
+	req := s.getRequest(fmt.Sprintf("/unsafe/size:100:100/plain/%s@png", imageURL))
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), imageURL, getImageURL(ctx))
+}
+
 func (s *ProcessingOptionsTestSuite) TestParsePlainURLWithoutExtension() {
 	imageURL := "http://images.dev/lorem/ipsum.jpg"
 	req := s.getRequest(fmt.Sprintf("/unsafe/size:100:100/plain/%s", imageURL))
@@ -164,6 +177,35 @@ func (s *ProcessingOptionsTestSuite) TestParseURLAllowedSources() {
 	}
 }
 
+func (s *ProcessingOptionsTestSuite) TestParseURLNotAllowedSource() {
+	conf.AllowedSources = []*regexp.Regexp{regexpFromPattern("http://images.dev/")}
+
+	req := s.getRequest("/unsafe/plain/http://other.dev/lorem/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+	assert.Equal(s.T(), 403, err.(*imgproxyError).StatusCode)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParseURLLoopback() {
+	for _, u := range []string{"http://localhost/ipsum.jpg", "http://127.0.0.1:8080/ipsum.jpg", "https://[::1]/ipsum.jpg"} {
+		req := s.getRequest("/unsafe/plain/" + u)
+		_, err := parsePath(context.Background(), req)
+
+		require.Error(s.T(), err, u)
+		assert.Equal(s.T(), 403, err.(*imgproxyError).StatusCode)
+	}
+}
+
+func (s *ProcessingOptionsTestSuite) TestParseURLLoopbackAllowed() {
+	conf.AllowLoopback = true
+
+	req := s.getRequest("/unsafe/plain/http://127.0.0.1:8080/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+}
+
 func (s *ProcessingOptionsTestSuite) TestParsePathBasic() {
 	req := s.getRequest("/unsafe/fill/100/200/noea/1/plain/http://images.dev/lorem/ipsum.jpg@png")
 	ctx, err := parsePath(context.Background(), req)
@@ -189,6 +231,28 @@ func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedFormat() {
 	assert.Equal(s.T(), imageTypeWEBP, po.Format)
 }
 
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedFormatAuto() {
+	req := s.getRequest("/unsafe/format:auto/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.True(s.T(), po.AutoFormat)
+	assert.Equal(s.T(), imageTypeUnknown, po.Format)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedFormatAutoOverridden() {
+	req := s.getRequest("/unsafe/format:auto/plain/http://images.dev/lorem/ipsum.jpg@png")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.False(s.T(), po.AutoFormat)
+	assert.Equal(s.T(), imageTypePNG, po.Format)
+}
+
 func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedResize() {
 	req := s.getRequest("/unsafe/resize:fill:100:200:1/plain/http://images.dev/lorem/ipsum.jpg")
 	ctx, err := parsePath(context.Background(), req)
@@ -267,6 +331,68 @@ func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedExtend() {
 	assert.Equal(s.T(), 20.0, po.Extend.Gravity.Y)
 }
 
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedExtendAspectRatio() {
+	req := s.getRequest("/unsafe/extend_aspect_ratio:1:we/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), true, po.ExtendAspectRatio.Enabled)
+	assert.Equal(s.T(), gravityWest, po.ExtendAspectRatio.Gravity.Type)
+	assert.False(s.T(), po.Extend.Enabled)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedZoom() {
+	req := s.getRequest("/unsafe/zoom:2/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 2.0, po.ZoomWidth)
+	assert.Equal(s.T(), 2.0, po.ZoomHeight)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedZoomXY() {
+	req := s.getRequest("/unsafe/zoom:1.5:3/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 1.5, po.ZoomWidth)
+	assert.Equal(s.T(), 3.0, po.ZoomHeight)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedZoomInvalid() {
+	for _, zoom := range []string{"0", "-1", "abc", "2:0", "1:2:3"} {
+		req := s.getRequest("/unsafe/zoom:" + zoom + "/plain/http://images.dev/lorem/ipsum.jpg")
+		_, err := parsePath(context.Background(), req)
+
+		require.Error(s.T(), err, zoom)
+	}
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedAspectRatio() {
+	req := s.getRequest("/unsafe/aspect_ratio:16:9/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.InDelta(s.T(), 16.0/9.0, po.AspectRatio, 0.0001)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedAspectRatioInvalid() {
+	for _, ar := range []string{"0", "16:0", "-1:1", "abc", "1:2:3"} {
+		req := s.getRequest("/unsafe/aspect_ratio:" + ar + "/plain/http://images.dev/lorem/ipsum.jpg")
+		_, err := parsePath(context.Background(), req)
+
+		require.Error(s.T(), err, ar)
+	}
+}
+
 func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedGravity() {
 	req := s.getRequest("/unsafe/gravity:soea/plain/http://images.dev/lorem/ipsum.jpg")
 	ctx, err := parsePath(context.Background(), req)
@@ -277,6 +403,45 @@ func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedGravity() {
 	assert.Equal(s.T(), gravitySouthEast, po.Gravity.Type)
 }
 
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedGravitySmartStrategy() {
+	req := s.getRequest("/unsafe/gravity:sm:entropy/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), gravitySmart, po.Gravity.Type)
+	assert.Equal(s.T(), smartCropEntropy, po.Gravity.Strategy)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedGravitySmartStrategyInvalid() {
+	req := s.getRequest("/unsafe/gravity:sm:unknown/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedGravityFace() {
+	conf.EnableFaceDetection = true
+
+	req := s.getRequest("/unsafe/gravity:face/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), gravityFace, po.Gravity.Type)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedGravityFaceDisabled() {
+	conf.EnableFaceDetection = false
+
+	req := s.getRequest("/unsafe/gravity:face/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+}
+
 func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedGravityFocuspoint() {
 	req := s.getRequest("/unsafe/gravity:fp:0.5:0.75/plain/http://images.dev/lorem/ipsum.jpg")
 	ctx, err := parsePath(context.Background(), req)
@@ -306,7 +471,7 @@ func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedBackground() {
 	require.Nil(s.T(), err)
 
 	po := getProcessingOptions(ctx)
-	assert.True(s.T(), po.Flatten)
+	assert.False(s.T(), po.Flatten)
 	assert.Equal(s.T(), uint8(128), po.Background.R)
 	assert.Equal(s.T(), uint8(129), po.Background.G)
 	assert.Equal(s.T(), uint8(130), po.Background.B)
@@ -319,7 +484,7 @@ func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedBackgroundHex() {
 	require.Nil(s.T(), err)
 
 	po := getProcessingOptions(ctx)
-	assert.True(s.T(), po.Flatten)
+	assert.False(s.T(), po.Flatten)
 	assert.Equal(s.T(), uint8(0xff), po.Background.R)
 	assert.Equal(s.T(), uint8(0xdd), po.Background.G)
 	assert.Equal(s.T(), uint8(0xee), po.Background.B)
@@ -335,6 +500,34 @@ func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedBackgroundDisable() {
 	assert.False(s.T(), po.Flatten)
 }
 
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedPadding() {
+	req := s.getRequest("/unsafe/padding:10:20:30:40:ff0000/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.True(s.T(), po.Padding.Enabled)
+	assert.Equal(s.T(), 10, po.Padding.Top)
+	assert.Equal(s.T(), 20, po.Padding.Right)
+	assert.Equal(s.T(), 30, po.Padding.Bottom)
+	assert.Equal(s.T(), 40, po.Padding.Left)
+	assert.True(s.T(), po.Padding.HasColor)
+	assert.Equal(s.T(), rgbColor{255, 0, 0}, po.Padding.Color)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedRoundCorner() {
+	req := s.getRequest("/unsafe/round_corner:10:20/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.True(s.T(), po.RoundCorner.Enabled)
+	assert.Equal(s.T(), 10, po.RoundCorner.Rx)
+	assert.Equal(s.T(), 20, po.RoundCorner.Ry)
+}
+
 func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedBlur() {
 	req := s.getRequest("/unsafe/blur:0.2/plain/http://images.dev/lorem/ipsum.jpg")
 	ctx, err := parsePath(context.Background(), req)
@@ -345,6 +538,37 @@ func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedBlur() {
 	assert.Equal(s.T(), float32(0.2), po.Blur)
 }
 
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedBlurMode() {
+	req := s.getRequest("/unsafe/blur:2:box/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), float32(2), po.Blur)
+	assert.Equal(s.T(), blurBox, po.BlurMode)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedBlurInvalidMode() {
+	req := s.getRequest("/unsafe/blur:2:motion/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedBlurClamp() {
+	conf.MaxBlurSigma = 10
+
+	req := s.getRequest("/unsafe/blur:1000/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), float32(10), po.Blur)
+	assert.Equal(s.T(), blurGaussian, po.BlurMode)
+}
+
 func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedSharpen() {
 	req := s.getRequest("/unsafe/sharpen:0.2/plain/http://images.dev/lorem/ipsum.jpg")
 	ctx, err := parsePath(context.Background(), req)
@@ -353,7 +577,78 @@ func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedSharpen() {
 
 	po := getProcessingOptions(ctx)
 	assert.Equal(s.T(), float32(0.2), po.Sharpen)
+	assert.Equal(s.T(), float32(defaultSharpenAmount), po.SharpenAmount)
+	assert.Equal(s.T(), float32(defaultSharpenThreshold), po.SharpenThreshold)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedSharpenUnsharpMask() {
+	req := s.getRequest("/unsafe/sharpen:0.5:1.5:4/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), float32(0.5), po.Sharpen)
+	assert.Equal(s.T(), float32(1.5), po.SharpenAmount)
+	assert.Equal(s.T(), float32(4), po.SharpenThreshold)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedSharpenInvalid() {
+	for _, args := range []string{"-1", "0.5:0", "0.5:1:-1", "0.5:1:2:3"} {
+		req := s.getRequest(fmt.Sprintf("/unsafe/sharpen:%s/plain/http://images.dev/lorem/ipsum.jpg", args))
+		_, err := parsePath(context.Background(), req)
+
+		require.Error(s.T(), err, args)
+	}
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedPixelate() {
+	req := s.getRequest("/unsafe/pixelate:8/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 8, po.Pixelate)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedPixelateInvalid() {
+	req := s.getRequest("/unsafe/pixelate:0/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedFilter() {
+	luts["warm"] = &lut3D{Size: 2, Data: make([]float32, 2*2*2*3)}
+	defer delete(luts, "warm")
+
+	req := s.getRequest("/unsafe/filter:warm/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), "warm", po.Filter)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedFilterUnknown() {
+	req := s.getRequest("/unsafe/filter:unknown/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
 }
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedGrayscale() {
+	req := s.getRequest("/unsafe/grayscale:1/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.True(s.T(), po.Grayscale)
+}
+
 func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedDpr() {
 	req := s.getRequest("/unsafe/dpr:2/plain/http://images.dev/lorem/ipsum.jpg")
 	ctx, err := parsePath(context.Background(), req)
@@ -377,6 +672,86 @@ func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedWatermark() {
 	assert.Equal(s.T(), 0.6, po.Watermark.Scale)
 }
 
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedWatermarkText() {
+	text := "<b>© imgproxy</b>"
+	req := s.getRequest(fmt.Sprintf("/unsafe/watermark_text:%s/plain/http://images.dev/lorem/ipsum.jpg", base64.RawURLEncoding.EncodeToString([]byte(text))))
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), text, po.Watermark.Text)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedWatermarkTextTooLong() {
+	conf.WatermarkTextMaxLength = 10
+
+	text := "<b>© imgproxy</b>"
+	req := s.getRequest(fmt.Sprintf("/unsafe/watermark_text:%s/plain/http://images.dev/lorem/ipsum.jpg", base64.RawURLEncoding.EncodeToString([]byte(text))))
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedFrameURL() {
+	frameURL := "http://images.dev/frames/winter.png"
+	req := s.getRequest(fmt.Sprintf("/unsafe/frame_url:%s/plain/http://images.dev/lorem/ipsum.jpg", base64.RawURLEncoding.EncodeToString([]byte(frameURL))))
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), frameURL, po.FrameURL)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedFrameURLNotAllowed() {
+	conf.AllowedSources = []*regexp.Regexp{regexpFromPattern("http://images.dev/")}
+
+	frameURL := "http://other.dev/frames/winter.png"
+	req := s.getRequest(fmt.Sprintf("/unsafe/frame_url:%s/plain/http://images.dev/lorem/ipsum.jpg", base64.RawURLEncoding.EncodeToString([]byte(frameURL))))
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedGamma() {
+	req := s.getRequest("/unsafe/gamma:2.2/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 2.2, po.Gamma)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedGammaInvalid() {
+	req := s.getRequest("/unsafe/gamma:20/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedNormalize() {
+	req := s.getRequest("/unsafe/normalize:1:2.5/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.True(s.T(), po.Normalize.Enabled)
+	assert.Equal(s.T(), 2.5, po.Normalize.Clip)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedWatermarkName() {
+	req := s.getRequest("/unsafe/watermark_name:brand_a/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), "brand_a", po.Watermark.Name)
+}
+
 func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedPreset() {
 	conf.Presets["test1"] = urlOptions{
 		urlOption{Name: "resizing_type", Args: []string{"fill"}},
@@ -455,39 +830,241 @@ func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedStripMetadata() {
 	assert.True(s.T(), po.StripMetadata)
 }
 
-func (s *ProcessingOptionsTestSuite) TestParsePathWebpDetection() {
-	conf.EnableWebpDetection = true
-
-	req := s.getRequest("/unsafe/plain/http://images.dev/lorem/ipsum.jpg")
-	req.Header.Set("Accept", "image/webp")
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedKeepCopyright() {
+	req := s.getRequest("/unsafe/keep_copyright:true/plain/http://images.dev/lorem/ipsum.jpg")
 	ctx, err := parsePath(context.Background(), req)
 
 	require.Nil(s.T(), err)
 
 	po := getProcessingOptions(ctx)
-	assert.Equal(s.T(), true, po.PreferWebP)
-	assert.Equal(s.T(), false, po.EnforceWebP)
+	assert.True(s.T(), po.KeepCopyright)
 }
 
-func (s *ProcessingOptionsTestSuite) TestParsePathWebpEnforce() {
-	conf.EnforceWebp = true
-
-	req := s.getRequest("/unsafe/plain/http://images.dev/lorem/ipsum.jpg@png")
-	req.Header.Set("Accept", "image/webp")
+func (s *ProcessingOptionsTestSuite) TestParsePathKeepCopyrightDisabledByDefault() {
+	req := s.getRequest("/unsafe/plain/http://images.dev/lorem/ipsum.jpg")
 	ctx, err := parsePath(context.Background(), req)
 
 	require.Nil(s.T(), err)
 
 	po := getProcessingOptions(ctx)
-	assert.Equal(s.T(), true, po.PreferWebP)
-	assert.Equal(s.T(), true, po.EnforceWebP)
+	assert.False(s.T(), po.KeepCopyright)
 }
 
-func (s *ProcessingOptionsTestSuite) TestParsePathWidthHeader() {
-	conf.EnableClientHints = true
-
-	req := s.getRequest("/unsafe/plain/http://images.dev/lorem/ipsum.jpg@png")
-	req.Header.Set("Width", "100")
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedGifSaveOptions() {
+	req := s.getRequest("/unsafe/gif_save_options:0.5::4/plain/http://images.dev/lorem/ipsum.gif")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 0.5, po.GifOptions.Dither)
+	assert.Equal(s.T(), conf.GifEffort, po.GifOptions.Effort)
+	assert.Equal(s.T(), 4, po.GifOptions.Bitdepth)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedJpegNoSubsample() {
+	req := s.getRequest("/unsafe/jpeg_no_subsample:1/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.True(s.T(), po.JpegOptions.NoSubsample)
+	assert.True(s.T(), po.getSaveOptions().Jpeg.NoSubsample)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedPngQuantize() {
+	req := s.getRequest("/unsafe/png_quantize:1/png_colors:16/plain/http://images.dev/lorem/ipsum.png")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.True(s.T(), po.PngOptions.Quantize)
+	assert.Equal(s.T(), 16, po.PngOptions.Colors)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedPngColorsInvalid() {
+	for _, colors := range []string{"1", "257", "many"} {
+		req := s.getRequest(fmt.Sprintf("/unsafe/png_colors:%s/plain/http://images.dev/lorem/ipsum.png", colors))
+		_, err := parsePath(context.Background(), req)
+
+		require.Error(s.T(), err, colors)
+	}
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedWebpLossless() {
+	req := s.getRequest("/unsafe/webp_lossless:1/wpnl:60/plain/http://images.dev/lorem/ipsum.png@webp")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.True(s.T(), po.WebpOptions.Lossless)
+	assert.Equal(s.T(), 60, po.WebpOptions.NearLossless)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedWebpNearLosslessInvalid() {
+	req := s.getRequest("/unsafe/webp_near_lossless:101/plain/http://images.dev/lorem/ipsum.png@webp")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedFrame() {
+	req := s.getRequest("/unsafe/frame:3/plain/http://images.dev/lorem/ipsum.gif")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 3, po.Frame)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedMegapixels() {
+	req := s.getRequest("/unsafe/mp:2.5/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 2.5, po.Megapixels)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedPageAndDpi() {
+	req := s.getRequest("/unsafe/page:2/dpi:150/plain/http://images.dev/lorem/ipsum.pdf")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 2, po.Frame)
+	assert.Equal(s.T(), 150.0, po.Dpi)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedDpiInvalid() {
+	for _, dpi := range []string{"0", "-72", "5000"} {
+		req := s.getRequest(fmt.Sprintf("/unsafe/dpi:%s/plain/http://images.dev/lorem/ipsum.pdf", dpi))
+		_, err := parsePath(context.Background(), req)
+
+		require.Error(s.T(), err)
+	}
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedPage() {
+	req := s.getRequest("/unsafe/page:0/plain/http://images.dev/lorem/ipsum.gif")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 0, po.Frame)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedFrameInvalid() {
+	req := s.getRequest("/unsafe/frame:-1/plain/http://images.dev/lorem/ipsum.gif")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedBackgroundAlphaAndFlatten() {
+	req := s.getRequest("/unsafe/bg:10:20:30:0.5/flatten:1/plain/http://images.dev/lorem/ipsum.png")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), rgbColor{10, 20, 30}, po.Background)
+	assert.Equal(s.T(), 0.5, po.BackgroundAlpha)
+	assert.True(s.T(), po.Flatten)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedBackgroundInvalid() {
+	for _, bg := range []string{"ff80", "fg8000", "256:0:0", "0:0:0:1.5", "0:0"} {
+		req := s.getRequest(fmt.Sprintf("/unsafe/bg:%s/plain/http://images.dev/lorem/ipsum.jpg", bg))
+		_, err := parsePath(context.Background(), req)
+
+		require.Error(s.T(), err, bg)
+		assert.Equal(s.T(), 422, err.(*imgproxyError).StatusCode, bg)
+	}
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedLinearColorspaceThreshold() {
+	req := s.getRequest("/unsafe/linear_colorspace_threshold:0.5/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 0.5, po.LinearColorspaceThreshold)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathWebpDetection() {
+	conf.EnableWebpDetection = true
+
+	req := s.getRequest("/unsafe/plain/http://images.dev/lorem/ipsum.jpg")
+	req.Header.Set("Accept", "image/webp")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), true, po.PreferWebP)
+	assert.Equal(s.T(), false, po.EnforceWebP)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathWebpEnforce() {
+	conf.EnforceWebp = true
+
+	req := s.getRequest("/unsafe/plain/http://images.dev/lorem/ipsum.jpg@png")
+	req.Header.Set("Accept", "image/webp")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), true, po.PreferWebP)
+	assert.Equal(s.T(), true, po.EnforceWebP)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathFormatDetection() {
+	conf.EnableFormatDetection = true
+
+	req := s.getRequest("/unsafe/plain/http://images.dev/lorem/ipsum.jpg")
+	req.Header.Set("Accept", "image/avif,image/webp,*/*")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), imageTypeUnknown, po.Format)
+	assert.True(s.T(), po.PreferAvif)
+	assert.True(s.T(), po.PreferWebP)
+	assert.False(s.T(), po.EnforceAvif)
+	assert.False(s.T(), po.EnforceWebP)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathFormatDetectionExplicitFormat() {
+	conf.EnableFormatDetection = true
+
+	req := s.getRequest("/unsafe/plain/http://images.dev/lorem/ipsum.jpg@png")
+	req.Header.Set("Accept", "image/avif,image/webp,*/*")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), imageTypePNG, po.Format)
+	assert.False(s.T(), po.EnforceAvif)
+	assert.False(s.T(), po.EnforceWebP)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathWidthHeader() {
+	conf.EnableClientHints = true
+
+	req := s.getRequest("/unsafe/plain/http://images.dev/lorem/ipsum.jpg@png")
+	req.Header.Set("Width", "100")
 	ctx, err := parsePath(context.Background(), req)
 
 	require.Nil(s.T(), err)
@@ -557,6 +1134,30 @@ func (s *ProcessingOptionsTestSuite) TestParsePathViewportWidthHeaderRedefine()
 	assert.Equal(s.T(), 150, po.Width)
 }
 
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedDprInvalid() {
+	for _, dpr := range []string{"0", "-1", "8.5", "abc"} {
+		req := s.getRequest("/unsafe/dpr:" + dpr + "/plain/http://images.dev/lorem/ipsum.jpg")
+		_, err := parsePath(context.Background(), req)
+
+		require.Error(s.T(), err, dpr)
+	}
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathRetinaPreset() {
+	conf.Presets["retina"] = urlOptions{
+		urlOption{Name: "dpr", Args: []string{"2"}},
+	}
+
+	req := s.getRequest("/unsafe/width:300/preset:retina/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 300, po.Width)
+	assert.Equal(s.T(), 2.0, po.Dpr)
+}
+
 func (s *ProcessingOptionsTestSuite) TestParsePathDprHeader() {
 	conf.EnableClientHints = true
 
@@ -570,6 +1171,19 @@ func (s *ProcessingOptionsTestSuite) TestParsePathDprHeader() {
 	assert.Equal(s.T(), 2.0, po.Dpr)
 }
 
+func (s *ProcessingOptionsTestSuite) TestParsePathDprHeaderRedefine() {
+	conf.EnableClientHints = true
+
+	req := s.getRequest("/unsafe/dpr:3/plain/http://images.dev/lorem/ipsum.jpg@png")
+	req.Header.Set("DPR", "2")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 3.0, po.Dpr)
+}
+
 func (s *ProcessingOptionsTestSuite) TestParsePathDprHeaderDisabled() {
 	req := s.getRequest("/unsafe/plain/http://images.dev/lorem/ipsum.jpg@png")
 	req.Header.Set("DPR", "2")
@@ -604,6 +1218,316 @@ func (s *ProcessingOptionsTestSuite) TestParsePathSignedInvalid() {
 	assert.Equal(s.T(), errInvalidSignature.Error(), err.Error())
 }
 
+func (s *ProcessingOptionsTestSuite) TestParsePathCompression() {
+	req := s.getRequest("/unsafe/compression:4/plain/http://images.dev/lorem/ipsum.jpg@avif")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 4, po.Compression)
+	assert.Equal(s.T(), 40, po.getQuality())
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathCompressionWithQuality() {
+	req := s.getRequest("/unsafe/compression:5/quality:75/plain/http://images.dev/lorem/ipsum.jpg@jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 5, po.Compression)
+	assert.Equal(s.T(), 75, po.getQuality())
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedCrop() {
+	req := s.getRequest("/unsafe/crop:200:100:soea:10:20/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 200.0, po.Crop.Width)
+	assert.Equal(s.T(), 100.0, po.Crop.Height)
+	assert.Equal(s.T(), gravitySouthEast, po.Crop.Gravity.Type)
+	assert.Equal(s.T(), 10.0, po.Crop.Gravity.X)
+	assert.Equal(s.T(), 20.0, po.Crop.Gravity.Y)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedCropFocusPoint() {
+	req := s.getRequest("/unsafe/c:0.5:0.5:fp:0.25:0.75/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 0.5, po.Crop.Width)
+	assert.Equal(s.T(), 0.5, po.Crop.Height)
+	assert.Equal(s.T(), gravityFocusPoint, po.Crop.Gravity.Type)
+	assert.Equal(s.T(), 0.25, po.Crop.Gravity.X)
+	assert.Equal(s.T(), 0.75, po.Crop.Gravity.Y)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedCropInvalid() {
+	for _, crop := range []string{"-1:100", "100:abc", "100:100:fp:1.5:0.5", "100:100:fp:0.5"} {
+		req := s.getRequest("/unsafe/crop:" + crop + "/plain/http://images.dev/lorem/ipsum.jpg")
+		_, err := parsePath(context.Background(), req)
+
+		require.Error(s.T(), err, crop)
+	}
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathBitDepth() {
+	req := s.getRequest("/unsafe/bit_depth:16/plain/http://images.dev/lorem/ipsum.jpg@png")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 16, po.BitDepth)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathBitDepthInvalid() {
+	req := s.getRequest("/unsafe/bit_depth:12/plain/http://images.dev/lorem/ipsum.jpg@png")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathExpires() {
+	conf.Keys = []securityKey{securityKey("test-key")}
+	conf.Salts = []securityKey{securityKey("test-salt")}
+	conf.AllowInsecure = false
+
+	exp := time.Now().Add(time.Hour).Unix()
+
+	path := fmt.Sprintf("/exp:%d/plain/http://images.dev/lorem/ipsum.jpg", exp)
+	signature := base64.RawURLEncoding.EncodeToString(signatureFor(path, 0))
+
+	req := s.getRequest("/" + signature + path)
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), exp, po.Expires)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathExpired() {
+	conf.Keys = []securityKey{securityKey("test-key")}
+	conf.Salts = []securityKey{securityKey("test-salt")}
+	conf.AllowInsecure = false
+
+	path := fmt.Sprintf("/exp:%d/plain/http://images.dev/lorem/ipsum.jpg", time.Now().Add(-time.Hour).Unix())
+	signature := base64.RawURLEncoding.EncodeToString(signatureFor(path, 0))
+
+	req := s.getRequest("/" + signature + path)
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+	assert.Equal(s.T(), errExpiredURL.Error(), err.Error())
+	assert.Equal(s.T(), 403, err.(*imgproxyError).StatusCode)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathExpiresLimitsCacheHeaders() {
+	conf.TTL = 86400
+	conf.MaxTTL = 86400
+
+	path := fmt.Sprintf("/exp:%d/plain/http://images.dev/lorem/ipsum.jpg", time.Now().Add(10*time.Minute).Unix())
+
+	req := s.getRequest("/unsafe" + path)
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	rw := httptest.NewRecorder()
+	setCacheHeaders(ctx, rw)
+
+	assert.Regexp(s.T(), `^max-age=(59\d|600), public$`, rw.Header().Get("Cache-Control"))
+
+	expires, err := http.ParseTime(rw.Header().Get("Expires"))
+	require.Nil(s.T(), err)
+	assert.WithinDuration(s.T(), time.Now().Add(10*time.Minute), expires, 2*time.Second)
+
+	req = s.getRequest("/unsafe/ttl:3600" + path)
+	ctx, err = parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	rw = httptest.NewRecorder()
+	setCacheHeaders(ctx, rw)
+
+	assert.Regexp(s.T(), `^max-age=(59\d|600), public$`, rw.Header().Get("Cache-Control"))
+
+	conf.CacheControlPassthrough = true
+
+	req = s.getRequest("/unsafe" + path)
+	ctx, err = parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	ctx = context.WithValue(ctx, cacheControlHeaderCtxKey, "public, max-age=3600")
+	ctx = context.WithValue(ctx, expiresHeaderCtxKey, time.Now().Add(time.Hour).Format(http.TimeFormat))
+
+	rw = httptest.NewRecorder()
+	setCacheHeaders(ctx, rw)
+
+	assert.Regexp(s.T(), `^public, max-age=(59\d|600)$`, rw.Header().Get("Cache-Control"))
+
+	expires, err = http.ParseTime(rw.Header().Get("Expires"))
+	require.Nil(s.T(), err)
+	assert.WithinDuration(s.T(), time.Now().Add(10*time.Minute), expires, 2*time.Second)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathQueryOptions() {
+	conf.EnableQueryOptions = true
+
+	req := s.getRequest("/unsafe/width:200/plain/http://images.dev/lorem/ipsum.jpg?width=300&resize=fill:100:150&q=55")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), resizeFill, po.ResizingType)
+	assert.Equal(s.T(), 200, po.Width)
+	assert.Equal(s.T(), 150, po.Height)
+	assert.Equal(s.T(), 55, po.Quality)
+	assert.Equal(s.T(), "http://images.dev/lorem/ipsum.jpg", getImageURL(ctx))
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathTTL() {
+	req := s.getRequest("/unsafe/ttl:86400/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 86400, po.TTL)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathTTLBounded() {
+	conf.MaxTTL = 3600
+
+	req := s.getRequest("/unsafe/ttl:86400/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 3600, po.TTL)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathContentType() {
+	req := s.getRequest("/unsafe/content_type:image%2Fwebp/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), "image/webp", po.ContentType)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathQueryContentType() {
+	conf.EnableQueryOptions = true
+
+	req := s.getRequest("/unsafe/plain/http://images.dev/lorem/ipsum.jpg?content_type=image/avif")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), "image/avif", po.ContentType)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathContentTypeNotAllowed() {
+	req := s.getRequest("/unsafe/content_type:text%2Fhtml/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathQueryOptionsDownload() {
+	conf.EnableQueryOptions = true
+
+	req := s.getRequest("/unsafe/plain/http://images.dev/lorem/ipsum.jpg?width=300&download=1")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 300, po.Width)
+	assert.True(s.T(), isDownloadRequest(req))
+}
+
+func (s *ProcessingOptionsTestSuite) TestContentDisposition() {
+	assert.Equal(s.T(), `inline; filename="test.jpg"`, imageTypeJPEG.ContentDisposition("test", false))
+	assert.Equal(s.T(), `attachment; filename="test.png"`, imageTypePNG.ContentDisposition("test", true))
+	assert.Equal(s.T(), `attachment; filename="ipsum.webp"`, imageTypeWEBP.ContentDispositionFromURL("http://images.dev/lorem/ipsum.jpg", true))
+	assert.Equal(s.T(), `attachment; filename="testX-Injected: 1.jpg"`, imageTypeJPEG.ContentDisposition("test\"\r\nX-Injected: 1", true))
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathQueryOptionsDisabled() {
+	req := s.getRequest("/unsafe/plain/http://images.dev/lorem/ipsum.jpg?width=300")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 0, po.Width)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathQueryOptionsSigned() {
+	conf.Keys = []securityKey{securityKey("test-key")}
+	conf.Salts = []securityKey{securityKey("test-salt")}
+	conf.AllowInsecure = false
+	conf.EnableQueryOptions = true
+
+	path := "/plain/http://images.dev/lorem/ipsum.jpg"
+	signature := base64.RawURLEncoding.EncodeToString(signatureFor(path+"?h=100&w=300", 0))
+
+	req := s.getRequest("/" + signature + path + "?w=300&h=100")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 300, po.Width)
+	assert.Equal(s.T(), 100, po.Height)
+
+	req = s.getRequest("/" + signature + path + "?w=400&h=100")
+	_, err = parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+	assert.Equal(s.T(), errInvalidSignature.Error(), err.Error())
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathPersist() {
+	conf.Keys = []securityKey{securityKey("test-key")}
+	conf.Salts = []securityKey{securityKey("test-salt")}
+	conf.AllowInsecure = false
+	conf.PersistURLTemplate = "s3://test/%hash"
+
+	path := "/persist:1/plain/http://images.dev/lorem/ipsum.jpg"
+	signature := base64.RawURLEncoding.EncodeToString(signatureFor(path, 0))
+
+	req := s.getRequest("/" + signature + path)
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.True(s.T(), po.Persist)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathPersistInsecure() {
+	conf.PersistURLTemplate = "s3://test/%hash"
+
+	req := s.getRequest("/unsafe/persist:1/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+}
+
 func (s *ProcessingOptionsTestSuite) TestParsePathOnlyPresets() {
 	conf.OnlyPresets = true
 	conf.Presets["test1"] = urlOptions{
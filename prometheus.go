@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -13,19 +12,38 @@ import (
 var (
 	prometheusEnabled = false
 
-	prometheusRequestsTotal      prometheus.Counter
-	prometheusErrorsTotal        *prometheus.CounterVec
-	prometheusRequestDuration    prometheus.Histogram
-	prometheusDownloadDuration   prometheus.Histogram
-	prometheusProcessingDuration prometheus.Histogram
-	prometheusBufferSize         *prometheus.HistogramVec
-	prometheusBufferDefaultSize  *prometheus.GaugeVec
-	prometheusBufferMaxSize      *prometheus.GaugeVec
-	prometheusVipsMemory         prometheus.GaugeFunc
-	prometheusVipsMaxMemory      prometheus.GaugeFunc
-	prometheusVipsAllocs         prometheus.GaugeFunc
+	prometheusRequestsTotal       prometheus.Counter
+	prometheusRequestsInProgress  prometheus.Gauge
+	prometheusDownloadsInProgress prometheus.Gauge
+	prometheusDownloadsLimited    prometheus.Counter
+	prometheusMaxClients          prometheus.Gauge
+	prometheusConnectionsLimited  prometheus.Counter
+	prometheusErrorsTotal         *prometheus.CounterVec
+	prometheusErrorResponses      *prometheus.CounterVec
+	prometheusRequestDuration     prometheus.Histogram
+	prometheusDownloadDuration    prometheus.Histogram
+	prometheusDownloadRetries     prometheus.Counter
+	prometheusProcessingDuration  prometheus.Histogram
+	prometheusBufferSize          *prometheus.HistogramVec
+	prometheusBufferDefaultSize   *prometheus.GaugeVec
+	prometheusBufferMaxSize       *prometheus.GaugeVec
+	prometheusBufferPoolSize      *prometheus.GaugeVec
+	prometheusBuffersInUse        *prometheus.GaugeVec
+	prometheusVipsMemory          prometheus.GaugeFunc
+	prometheusVipsMaxMemory       prometheus.GaugeFunc
+	prometheusVipsAllocs          prometheus.GaugeFunc
 )
 
+// prometheusBuckets returns the configured buckets or the default ones
+// if the buckets are not configured
+func prometheusBuckets(buckets []float64) []float64 {
+	if len(buckets) == 0 {
+		return prometheus.DefBuckets
+	}
+
+	return buckets
+}
+
 func initPrometheus() {
 	if len(conf.PrometheusBind) == 0 {
 		return
@@ -37,12 +55,48 @@ func initPrometheus() {
 		Help:      "A counter of the total number of HTTP requests imgproxy processed.",
 	})
 
+	prometheusRequestsInProgress = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: conf.PrometheusNamespace,
+		Name:      "requests_in_progress",
+		Help:      "A gauge of the number of images currently being processed.",
+	})
+
+	prometheusDownloadsInProgress = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: conf.PrometheusNamespace,
+		Name:      "downloads_in_progress",
+		Help:      "A gauge of the number of source images currently being downloaded.",
+	})
+
+	prometheusDownloadsLimited = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: conf.PrometheusNamespace,
+		Name:      "downloads_limited_total",
+		Help:      "A counter of the times downloads had to wait because the download concurrency limit was reached.",
+	})
+
+	prometheusMaxClients = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: conf.PrometheusNamespace,
+		Name:      "max_clients",
+		Help:      "A gauge of the maximum number of simultaneous active connections.",
+	})
+
+	prometheusConnectionsLimited = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: conf.PrometheusNamespace,
+		Name:      "connections_limited_total",
+		Help:      "A counter of the times new connections had to wait because the max clients limit was reached.",
+	})
+
 	prometheusErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: conf.PrometheusNamespace,
 		Name:      "errors_total",
 		Help:      "A counter of the occurred errors separated by type.",
 	}, []string{"type"})
 
+	prometheusErrorResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: conf.PrometheusNamespace,
+		Name:      "error_responses_total",
+		Help:      "A counter of the error responses separated by error category.",
+	}, []string{"category"})
+
 	prometheusRequestDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
 		Namespace: conf.PrometheusNamespace,
 		Name:      "request_duration_seconds",
@@ -53,12 +107,20 @@ func initPrometheus() {
 		Namespace: conf.PrometheusNamespace,
 		Name:      "download_duration_seconds",
 		Help:      "A histogram of the source image downloading latency.",
+		Buckets:   prometheusBuckets(conf.PrometheusDownloadBuckets),
+	})
+
+	prometheusDownloadRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: conf.PrometheusNamespace,
+		Name:      "download_retries_total",
+		Help:      "A counter of the source image request retries.",
 	})
 
 	prometheusProcessingDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
 		Namespace: conf.PrometheusNamespace,
 		Name:      "processing_duration_seconds",
 		Help:      "A histogram of the image processing latency.",
+		Buckets:   prometheusBuckets(conf.PrometheusProcessingBuckets),
 	})
 
 	prometheusBufferSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
@@ -80,6 +142,18 @@ func initPrometheus() {
 		Help:      "A gauge of the buffer max size in bytes.",
 	}, []string{"type"})
 
+	prometheusBufferPoolSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: conf.PrometheusNamespace,
+		Name:      "buffer_pool_size",
+		Help:      "A gauge of the number of buffers the pool can keep.",
+	}, []string{"type"})
+
+	prometheusBuffersInUse = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: conf.PrometheusNamespace,
+		Name:      "buffers_in_use",
+		Help:      "A gauge of the number of buffers currently checked out of the pool.",
+	}, []string{"type"})
+
 	prometheusVipsMemory = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
 		Namespace: conf.PrometheusNamespace,
 		Name:      "vips_memory_bytes",
@@ -100,13 +174,22 @@ func initPrometheus() {
 
 	prometheus.MustRegister(
 		prometheusRequestsTotal,
+		prometheusRequestsInProgress,
+		prometheusDownloadsInProgress,
+		prometheusDownloadsLimited,
+		prometheusMaxClients,
+		prometheusConnectionsLimited,
 		prometheusErrorsTotal,
+		prometheusErrorResponses,
 		prometheusRequestDuration,
 		prometheusDownloadDuration,
+		prometheusDownloadRetries,
 		prometheusProcessingDuration,
 		prometheusBufferSize,
 		prometheusBufferDefaultSize,
 		prometheusBufferMaxSize,
+		prometheusBufferPoolSize,
+		prometheusBuffersInUse,
 		prometheusVipsMemory,
 		prometheusVipsMaxMemory,
 		prometheusVipsAllocs,
@@ -133,26 +216,3 @@ func startPrometheusServer(cancel context.CancelFunc) error {
 
 	return nil
 }
-
-func startPrometheusDuration(m prometheus.Histogram) func() {
-	t := time.Now()
-	return func() {
-		m.Observe(time.Since(t).Seconds())
-	}
-}
-
-func incrementPrometheusErrorsTotal(t string) {
-	prometheusErrorsTotal.With(prometheus.Labels{"type": t}).Inc()
-}
-
-func observePrometheusBufferSize(t string, size int) {
-	prometheusBufferSize.With(prometheus.Labels{"type": t}).Observe(float64(size))
-}
-
-func setPrometheusBufferDefaultSize(t string, size int) {
-	prometheusBufferDefaultSize.With(prometheus.Labels{"type": t}).Set(float64(size))
-}
-
-func setPrometheusBufferMaxSize(t string, size int) {
-	prometheusBufferMaxSize.With(prometheus.Labels{"type": t}).Set(float64(size))
-}
@@ -0,0 +1,86 @@
+// +build libraw
+
+package main
+
+/*
+#cgo pkg-config: libraw
+#include <libraw/libraw.h>
+#include "vips.h"
+
+#define LIBRAW_RESOLUTION_TOO_BIG 2
+
+static int
+vips_librawload_go(void *buf, size_t len, int half_size, int quality, int max_resolution, VipsImage **out) {
+  libraw_data_t *raw = libraw_init(0);
+  if (!raw) {
+    vips_error("vips_librawload_go", "Can't initialize libraw");
+    return 1;
+  }
+
+  raw->params.half_size = half_size;
+  raw->params.user_qual = quality;
+  raw->params.output_bps = 8;
+  raw->params.use_camera_wb = 1;
+
+  int ret = LIBRAW_SUCCESS;
+  libraw_processed_image_t *processed = NULL;
+
+  if ((ret = libraw_open_buffer(raw, buf, len)) != LIBRAW_SUCCESS) {
+    vips_error("vips_librawload_go", "%s", libraw_strerror(ret));
+    libraw_close(raw);
+    return 1;
+  }
+
+  // Unpacking allocates memory for the whole image, so we check the resolution
+  // before it. The sizes are already known after opening
+  if ((double)raw->sizes.width * raw->sizes.height > max_resolution) {
+    libraw_close(raw);
+    return LIBRAW_RESOLUTION_TOO_BIG;
+  }
+
+  if (
+    (ret = libraw_unpack(raw)) != LIBRAW_SUCCESS ||
+    (ret = libraw_dcraw_process(raw)) != LIBRAW_SUCCESS ||
+    !(processed = libraw_dcraw_make_mem_image(raw, &ret))
+  ) {
+    vips_error("vips_librawload_go", "%s", libraw_strerror(ret));
+    libraw_close(raw);
+    return 1;
+  }
+
+  // libraw has already applied the orientation, so the image doesn't need to be rotated
+  *out = vips_image_new_from_memory_copy(processed->data, processed->data_size, processed->width, processed->height, processed->colors, VIPS_FORMAT_UCHAR);
+
+  libraw_dcraw_clear_mem(processed);
+  libraw_close(raw);
+
+  return *out ? 0 : 1;
+}
+*/
+import "C"
+import "unsafe"
+
+const librawSupported = true
+
+// loadLibraw decodes the RAW image using libraw, so the decoding quality
+// and the half-size mode can be controlled
+func (img *vipsImage) loadLibraw(data []byte) error {
+	var tmp *C.VipsImage
+
+	halfSize := 0
+	if conf.RawHalfSize {
+		halfSize = 1
+	}
+
+	switch C.vips_librawload_go(unsafe.Pointer(&data[0]), C.size_t(len(data)), C.int(halfSize), C.int(conf.RawQuality), C.int(conf.MaxSrcResolution), &tmp) {
+	case 0:
+	case C.LIBRAW_RESOLUTION_TOO_BIG:
+		return errSourceResolutionTooBig
+	default:
+		return vipsError()
+	}
+
+	C.swap_and_clear(&img.VipsImage, tmp)
+
+	return nil
+}
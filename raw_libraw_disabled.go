@@ -0,0 +1,11 @@
+// +build !libraw
+
+package main
+
+import "errors"
+
+const librawSupported = false
+
+func (img *vipsImage) loadLibraw(data []byte) error {
+	return errors.New("imgproxy is built without libraw support")
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// responseStreamBufferSize is the size of the chunks the result is sent by.
+// Results that fit a single chunk are sent with Content-Length,
+// larger ones use chunked encoding
+const responseStreamBufferSize = 64 * 1024
+
+var (
+	responseStreamCtxKey = ctxKey("responseStream")
+
+	errResponseStreamAborted = errors.New("Response stream is aborted")
+)
+
+// responseStream writes the processed image to the response while libvips
+// encodes it, so the whole result is usually never kept in memory.
+//
+// libvips writes to the stream while the request holds a processing slot,
+// so the stream never waits for the client. The encoded chunks are queued
+// and sent to the client by a separate goroutine. When the client is slower
+// than the encoder, the queue grows up to the whole result, which is
+// the same amount of memory non-streamed responses use
+type responseStream struct {
+	rw          http.ResponseWriter
+	startHeader func()
+
+	buf []byte
+
+	mu      sync.Mutex
+	queue   [][]byte
+	closed  bool
+	aborted bool
+	err     error
+
+	signal chan struct{}
+	done   chan struct{}
+
+	// Streamed is set when the image is saved to the stream
+	// instead of being returned by processImage
+	Streamed bool
+	// Started is set when the response headers are sent,
+	// so it's too late to respond with an error
+	Started bool
+}
+
+func newResponseStream(ctx context.Context, r *http.Request, rw http.ResponseWriter) *responseStream {
+	// The format is resolved during processing,
+	// so the headers are set right before the response is started
+	return newResponseStreamWithHeader(rw, func() {
+		setImageResponseHeaders(ctx, r, rw)
+		rw.WriteHeader(getResponseStatusCode(ctx))
+	})
+}
+
+func newResponseStreamWithHeader(rw http.ResponseWriter, startHeader func()) *responseStream {
+	return &responseStream{
+		rw:          rw,
+		startHeader: startHeader,
+		buf:         make([]byte, 0, responseStreamBufferSize),
+		signal:      make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+}
+
+func getResponseStream(ctx context.Context) *responseStream {
+	stream, _ := ctx.Value(responseStreamCtxKey).(*responseStream)
+	return stream
+}
+
+// Write is called by libvips. It doesn't retain p and never waits for the client
+func (s *responseStream) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) > 0 {
+		if len(s.buf) == cap(s.buf) {
+			if err := s.flush(); err != nil {
+				return 0, err
+			}
+		}
+
+		l := minInt(len(p), cap(s.buf)-len(s.buf))
+		s.buf = append(s.buf, p[:l]...)
+		p = p[l:]
+	}
+
+	return n, nil
+}
+
+// flush queues the buffered chunk. The response is started
+// when the first chunk is queued
+func (s *responseStream) flush() error {
+	if !s.Started {
+		s.Started = true
+		s.startHeader()
+
+		go s.writeLoop()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The client is gone, so there is no reason to continue encoding
+	if s.err != nil {
+		return s.err
+	}
+
+	s.queue = append(s.queue, s.buf)
+	s.buf = make([]byte, 0, responseStreamBufferSize)
+
+	s.notify()
+
+	return nil
+}
+
+func (s *responseStream) notify() {
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (s *responseStream) writeLoop() {
+	defer close(s.done)
+
+	for {
+		s.mu.Lock()
+		queue, closed, aborted := s.queue, s.closed, s.aborted
+		s.queue = nil
+		s.mu.Unlock()
+
+		if aborted {
+			return
+		}
+
+		for _, chunk := range queue {
+			if _, err := s.rw.Write(chunk); err != nil {
+				s.mu.Lock()
+				s.err = err
+				s.mu.Unlock()
+				return
+			}
+		}
+
+		if closed && len(queue) == 0 {
+			return
+		}
+
+		if len(queue) == 0 {
+			<-s.signal
+		}
+	}
+}
+
+// Finish sends the rest of the result and waits until it's written.
+// If the response is not started yet, the result is sent with Content-Length
+func (s *responseStream) Finish() {
+	if !s.Started {
+		s.Started = true
+
+		s.rw.Header().Set("Content-Length", strconv.Itoa(len(s.buf)))
+		s.startHeader()
+		s.rw.Write(s.buf)
+
+		s.buf = nil
+
+		return
+	}
+
+	if len(s.buf) > 0 {
+		s.flush()
+	}
+	s.buf = nil
+
+	s.close(false)
+}
+
+// Abort stops sending the result and waits until the chunk
+// that is being written is sent
+func (s *responseStream) Abort() {
+	if !s.Started {
+		return
+	}
+
+	s.close(true)
+}
+
+func (s *responseStream) close(abort bool) {
+	s.mu.Lock()
+	s.closed = true
+	if abort {
+		s.aborted = true
+		s.queue = nil
+		if s.err == nil {
+			s.err = errResponseStreamAborted
+		}
+	}
+	s.mu.Unlock()
+
+	s.notify()
+
+	<-s.done
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type ResponseStreamTestSuite struct{ MainTestSuite }
+
+func (s *ResponseStreamTestSuite) newStream(rw http.ResponseWriter) *responseStream {
+	return newResponseStreamWithHeader(rw, func() {
+		rw.Header().Set("Content-Type", "image/jpeg")
+		rw.WriteHeader(200)
+	})
+}
+
+// write writes data by small pieces like libvips does
+func (s *ResponseStreamTestSuite) write(stream *responseStream, data []byte) error {
+	for len(data) > 0 {
+		l := minInt(len(data), 8*1024)
+
+		n, err := stream.Write(data[:l])
+		if err != nil {
+			return err
+		}
+		require.Equal(s.T(), l, n)
+
+		data = data[l:]
+	}
+
+	return nil
+}
+
+func (s *ResponseStreamTestSuite) getData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	return data
+}
+
+func (s *ResponseStreamTestSuite) TestSmallResult() {
+	rw := httptest.NewRecorder()
+	stream := s.newStream(rw)
+	data := s.getData(responseStreamBufferSize)
+
+	require.Nil(s.T(), s.write(stream, data))
+	assert.False(s.T(), stream.Started)
+
+	stream.Finish()
+
+	assert.Equal(s.T(), 200, rw.Code)
+	assert.Equal(s.T(), "image/jpeg", rw.Header().Get("Content-Type"))
+	assert.Equal(s.T(), "65536", rw.Header().Get("Content-Length"))
+	assert.Equal(s.T(), data, rw.Body.Bytes())
+}
+
+func (s *ResponseStreamTestSuite) TestLargeResult() {
+	rw := httptest.NewRecorder()
+	stream := s.newStream(rw)
+	data := s.getData(5*responseStreamBufferSize + 100)
+
+	require.Nil(s.T(), s.write(stream, data))
+	assert.True(s.T(), stream.Started)
+
+	stream.Finish()
+
+	assert.Equal(s.T(), 200, rw.Code)
+	assert.Empty(s.T(), rw.Header().Get("Content-Length"))
+	assert.Equal(s.T(), data, rw.Body.Bytes())
+}
+
+func (s *ResponseStreamTestSuite) TestAbortAfterStart() {
+	rw := httptest.NewRecorder()
+	stream := s.newStream(rw)
+	data := s.getData(2*responseStreamBufferSize + 100)
+
+	require.Nil(s.T(), s.write(stream, data))
+	require.True(s.T(), stream.Started)
+
+	stream.Abort()
+
+	assert.Less(s.T(), rw.Body.Len(), len(data))
+	assert.Equal(s.T(), errResponseStreamAborted, s.write(stream, data))
+}
+
+func (s *ResponseStreamTestSuite) TestAbortBeforeStart() {
+	rw := httptest.NewRecorder()
+	stream := s.newStream(rw)
+
+	require.Nil(s.T(), s.write(stream, s.getData(100)))
+
+	stream.Abort()
+
+	assert.False(s.T(), stream.Started)
+	assert.Zero(s.T(), rw.Body.Len())
+}
+
+type failingResponseWriter struct{ *httptest.ResponseRecorder }
+
+var errFailingResponseWriter = errors.New("connection reset by peer")
+
+func (rw failingResponseWriter) Write(p []byte) (int, error) {
+	return 0, errFailingResponseWriter
+}
+
+func (s *ResponseStreamTestSuite) TestClientGone() {
+	stream := s.newStream(failingResponseWriter{httptest.NewRecorder()})
+
+	require.Nil(s.T(), s.write(stream, s.getData(responseStreamBufferSize+100)))
+
+	// Wait until the writer fails
+	<-stream.done
+
+	assert.Equal(s.T(), errFailingResponseWriter, s.write(stream, s.getData(responseStreamBufferSize)))
+}
+
+func TestResponseStream(t *testing.T) {
+	suite.Run(t, new(ResponseStreamTestSuite))
+}
+
+func getBenchmarkJpegData(b *testing.B, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), uint8(x + y), 255})
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	require.Nil(b, jpeg.Encode(buf, img, &jpeg.Options{Quality: 95}))
+
+	return buf.Bytes()
+}
+
+// peakMemResponseWriter tracks the peak size of the encoded result
+// that is kept in memory by the stream
+type peakMemResponseWriter struct {
+	*httptest.ResponseRecorder
+
+	stream *responseStream
+	peak   int
+}
+
+func (rw *peakMemResponseWriter) Write(p []byte) (int, error) {
+	rw.stream.mu.Lock()
+	size := len(p) + responseStreamBufferSize
+	for _, chunk := range rw.stream.queue {
+		size += len(chunk)
+	}
+	rw.stream.mu.Unlock()
+
+	if size > rw.peak {
+		rw.peak = size
+	}
+
+	return len(p), nil
+}
+
+// BenchmarkSaveJPEG and BenchmarkSaveJPEGToStream compare the peak size
+// of the encoded result kept in memory with and without streaming
+func BenchmarkSaveJPEG(b *testing.B) {
+	data := getBenchmarkJpegData(b, 4000, 4000)
+	po := newProcessingOptions()
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	defer vipsCleanup()
+
+	peak := 0
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		img := new(vipsImage)
+		require.Nil(b, img.Load(data, imageTypeJPEG, 1, 1.0, 1))
+
+		result, cancel, err := img.Save(imageTypeJPEG, 80, po.getSaveOptions())
+		require.Nil(b, err)
+
+		peak = maxInt(peak, len(result))
+
+		cancel()
+		img.Clear()
+	}
+
+	b.ReportMetric(float64(peak), "peak-result-B")
+}
+
+func BenchmarkSaveJPEGToStream(b *testing.B) {
+	if !vipsSupportSaveToWriter(imageTypeJPEG) {
+		b.Skip("Saving to writer is not supported by libvips")
+	}
+
+	data := getBenchmarkJpegData(b, 4000, 4000)
+	po := newProcessingOptions()
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	defer vipsCleanup()
+
+	peak := 0
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		rw := &peakMemResponseWriter{ResponseRecorder: httptest.NewRecorder()}
+		stream := newResponseStreamWithHeader(rw, func() { rw.WriteHeader(200) })
+		rw.stream = stream
+
+		img := new(vipsImage)
+		require.Nil(b, img.Load(data, imageTypeJPEG, 1, 1.0, 1))
+
+		require.Nil(b, img.SaveToWriter(stream, imageTypeJPEG, 80, po.getSaveOptions()))
+		stream.Finish()
+
+		// The stream is finished, so the writer isn't used anymore
+		peak = maxInt(peak, rw.peak)
+
+		img.Clear()
+	}
+
+	b.ReportMetric(float64(peak), "peak-result-B")
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const resultCacheMetaLenSize = 4
+
+// resultCacheStorage stores processed images between requests
+type resultCacheStorage interface {
+	Get(key string) ([]byte, *resultCacheMeta, bool)
+	Set(key string, data []byte, meta *resultCacheMeta) error
+}
+
+var (
+	resultCache resultCacheStorage
+
+	errResultCacheMalformedEntry = errors.New("Malformed result cache entry")
+)
+
+// resultCacheMeta is stored in the beginning of the cache entry file
+type resultCacheMeta struct {
+	Format       string    `json:"format"`
+	CacheControl string    `json:"cache_control,omitempty"`
+	Expires      string    `json:"expires,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+type resultCacheItem struct {
+	name      string
+	size      int64
+	expiresAt time.Time
+}
+
+// diskResultCache stores processed images on the local disk
+// and evicts the least recently used ones when the total size exceeds the limit
+type diskResultCache struct {
+	path    string
+	maxSize int64
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+func initResultCache() error {
+	var err error
+
+	switch {
+	case len(conf.CachePath) > 0:
+		resultCache, err = newDiskResultCache()
+	case len(conf.RedisURL) > 0:
+		resultCache, err = newRedisResultCache()
+	}
+
+	return err
+}
+
+func newDiskResultCache() (*diskResultCache, error) {
+	c := &diskResultCache{
+		path:    conf.CachePath,
+		maxSize: int64(conf.CacheSizeMB) * 1024 * 1024,
+		lru:     list.New(),
+		items:   make(map[string]*list.Element),
+	}
+
+	if err := os.MkdirAll(c.path, 0755); err != nil {
+		return nil, fmt.Errorf("Can't create result cache dir: %s", err)
+	}
+
+	if err := c.restore(); err != nil {
+		return nil, fmt.Errorf("Can't restore result cache: %s", err)
+	}
+
+	return c, nil
+}
+
+func resultCacheKey(r *http.Request) string {
+	h := sha256.New()
+	h.Write([]byte(r.URL.Path))
+	writeResultVariant(h, r)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// resultQuery returns the canonical query string the result depends on
+func resultQuery(r *http.Request) string {
+	if !conf.EnableQueryOptions {
+		return ""
+	}
+
+	return r.URL.Query().Encode()
+}
+
+// resultVaryHeaders returns the headers we vary on that affect the result itself.
+// Compression is applied to the result when responding, so Accept-Encoding is skipped
+func resultVaryHeaders() []string {
+	headers := make([]string, 0, len(varyHeaders))
+
+	for _, name := range varyHeaders {
+		if name != "Accept-Encoding" {
+			headers = append(headers, name)
+		}
+	}
+
+	return headers
+}
+
+// writeResultVariant writes the request data the result depends on
+// besides the path: the query string and the headers we vary on
+func writeResultVariant(w io.Writer, r *http.Request) {
+	if query := resultQuery(r); len(query) > 0 {
+		w.Write([]byte{'?'})
+		w.Write([]byte(query))
+	}
+
+	for _, name := range resultVaryHeaders() {
+		w.Write([]byte{0})
+		w.Write([]byte(r.Header.Get(name)))
+	}
+}
+
+// resultCacheTTL calculates how long the result can be cached
+// respecting the source Cache-Control and Expires headers unless they are ignored.
+// Returns 0 if the result should not be cached
+func resultCacheTTL(ctx context.Context) time.Duration {
+	ttl := time.Duration(conf.CacheTTL) * time.Second
+
+	cacheControl, expires := sourceCacheHeaders(ctx)
+
+	if len(cacheControl) > 0 {
+		maxAge := -1
+
+		for _, directive := range strings.Split(cacheControl, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+
+			switch {
+			case directive == "no-store", directive == "no-cache", directive == "private":
+				return 0
+			case strings.HasPrefix(directive, "max-age="):
+				var err error
+				if maxAge, err = strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err != nil || maxAge <= 0 {
+					return 0
+				}
+			}
+		}
+
+		if maxAge > 0 {
+			if d := time.Duration(maxAge) * time.Second; d < ttl {
+				ttl = d
+			}
+			// max-age takes precedence over Expires
+			return ttl
+		}
+	}
+
+	if len(expires) > 0 {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		if d := time.Until(t); d < ttl {
+			ttl = d
+		}
+	}
+
+	if ttl < 0 {
+		return 0
+	}
+
+	return ttl
+}
+
+func (c *diskResultCache) filePath(name string) string {
+	return filepath.Join(c.path, name[:2], name)
+}
+
+// Get returns the cached result and its meta if it's available
+func (c *diskResultCache) Get(key string) ([]byte, *resultCacheMeta, bool) {
+	c.mu.Lock()
+	el, ok := c.items[key]
+	if ok {
+		if time.Now().After(el.Value.(*resultCacheItem).expiresAt) {
+			c.removeElement(el)
+			ok = false
+		} else {
+			c.lru.MoveToFront(el)
+		}
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		return nil, nil, false
+	}
+
+	data, meta, err := readResultCacheFile(c.filePath(key))
+	if err != nil {
+		logWarning("Can't read result cache entry: %s", err)
+
+		c.mu.Lock()
+		if el, ok := c.items[key]; ok {
+			c.removeElement(el)
+		}
+		c.mu.Unlock()
+
+		return nil, nil, false
+	}
+
+	return data, meta, true
+}
+
+// Set stores the result in the cache and evicts the least recently used
+// results if the cache size exceeds the limit
+func (c *diskResultCache) Set(key string, data []byte, meta *resultCacheMeta) error {
+	buf, err := encodeResultCacheEntry(data, meta)
+	if err != nil {
+		return err
+	}
+
+	size := int64(len(buf))
+	if size > c.maxSize {
+		return nil
+	}
+
+	path := c.filePath(key)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(buf)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.size -= el.Value.(*resultCacheItem).size
+		c.lru.Remove(el)
+	}
+
+	c.add(&resultCacheItem{name: key, size: size, expiresAt: meta.ExpiresAt})
+	c.evict()
+
+	return nil
+}
+
+func (c *diskResultCache) add(item *resultCacheItem) {
+	c.items[item.name] = c.lru.PushFront(item)
+	c.size += item.size
+}
+
+func (c *diskResultCache) evict() {
+	for c.size > c.maxSize {
+		el := c.lru.Back()
+		if el == nil {
+			return
+		}
+		c.removeElement(el)
+	}
+}
+
+func (c *diskResultCache) removeElement(el *list.Element) {
+	item := el.Value.(*resultCacheItem)
+
+	c.lru.Remove(el)
+	delete(c.items, item.name)
+	c.size -= item.size
+
+	if err := os.Remove(c.filePath(item.name)); err != nil && !os.IsNotExist(err) {
+		logWarning("Can't remove result cache entry: %s", err)
+	}
+}
+
+// restore loads the index of the entries that are already stored on the disk.
+// Entries are ordered by their modification time since we don't store access time
+func (c *diskResultCache) restore() error {
+	type storedItem struct {
+		item    *resultCacheItem
+		modTime time.Time
+	}
+
+	var stored []storedItem
+
+	now := time.Now()
+
+	err := filepath.Walk(c.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		name := info.Name()
+
+		if strings.HasPrefix(name, ".tmp-") {
+			os.Remove(path)
+			return nil
+		}
+
+		// Don't touch the files that don't look like cache entries
+		if _, err := hex.DecodeString(name); err != nil || len(name) != sha256.Size*2 {
+			return nil
+		}
+
+		meta, err := readResultCacheMeta(path)
+		if err != nil || now.After(meta.ExpiresAt) {
+			os.Remove(path)
+			return nil
+		}
+
+		stored = append(stored, storedItem{
+			item:    &resultCacheItem{name: name, size: info.Size(), expiresAt: meta.ExpiresAt},
+			modTime: info.ModTime(),
+		})
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].modTime.Before(stored[j].modTime)
+	})
+
+	for _, s := range stored {
+		c.add(s.item)
+	}
+
+	c.evict()
+
+	return nil
+}
+
+func readResultCacheMeta(path string) (*resultCacheMeta, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lenBuf := make([]byte, resultCacheMetaLenSize)
+	if _, err = io.ReadFull(f, lenBuf); err != nil {
+		return nil, errResultCacheMalformedEntry
+	}
+
+	meta := new(resultCacheMeta)
+
+	dec := json.NewDecoder(io.LimitReader(f, int64(binary.BigEndian.Uint32(lenBuf))))
+	if err = dec.Decode(meta); err != nil {
+		return nil, errResultCacheMalformedEntry
+	}
+
+	return meta, nil
+}
+
+func readResultCacheFile(path string) ([]byte, *resultCacheMeta, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return decodeResultCacheEntry(buf)
+}
+
+// encodeResultCacheEntry packs the result and its meta into a single value.
+// The value starts with the length of the JSON-encoded meta followed by the meta and the data
+func encodeResultCacheEntry(data []byte, meta *resultCacheMeta) ([]byte, error) {
+	metaData, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, resultCacheMetaLenSize, resultCacheMetaLenSize+len(metaData)+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(metaData)))
+	buf = append(buf, metaData...)
+	buf = append(buf, data...)
+
+	return buf, nil
+}
+
+func decodeResultCacheEntry(buf []byte) ([]byte, *resultCacheMeta, error) {
+	if len(buf) < resultCacheMetaLenSize {
+		return nil, nil, errResultCacheMalformedEntry
+	}
+
+	metaEnd := resultCacheMetaLenSize + int(binary.BigEndian.Uint32(buf))
+	if metaEnd > len(buf) {
+		return nil, nil, errResultCacheMalformedEntry
+	}
+
+	meta := new(resultCacheMeta)
+	if err := json.Unmarshal(buf[resultCacheMetaLenSize:metaEnd], meta); err != nil {
+		return nil, nil, errResultCacheMalformedEntry
+	}
+
+	return buf[metaEnd:], meta, nil
+}
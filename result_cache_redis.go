@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// redisResultCache stores processed images in Redis
+// so the cache can be shared between imgproxy instances
+type redisResultCache struct {
+	pool *redis.Pool
+}
+
+func newRedisResultCache() (*redisResultCache, error) {
+	timeout := time.Duration(conf.RedisTimeout) * time.Second
+
+	pool := &redis.Pool{
+		MaxIdle:     conf.Concurrency,
+		IdleTimeout: 5 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(
+				conf.RedisURL,
+				redis.DialConnectTimeout(timeout),
+				redis.DialReadTimeout(timeout),
+				redis.DialWriteTimeout(timeout),
+			)
+		},
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("PING"); err != nil {
+		return nil, fmt.Errorf("Can't connect to Redis: %s", err)
+	}
+
+	return &redisResultCache{pool}, nil
+}
+
+func (c *redisResultCache) key(key string) string {
+	return conf.RedisKeyPrefix + key
+}
+
+func (c *redisResultCache) Get(key string) ([]byte, *resultCacheMeta, bool) {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	buf, err := redis.Bytes(conn.Do("GET", c.key(key)))
+	if err != nil {
+		if err != redis.ErrNil {
+			logWarning("Can't get result from Redis: %s", err)
+		}
+		return nil, nil, false
+	}
+
+	data, meta, err := decodeResultCacheEntry(buf)
+	if err != nil {
+		logWarning("Can't read result cache entry: %s", err)
+		return nil, nil, false
+	}
+
+	return data, meta, true
+}
+
+func (c *redisResultCache) Set(key string, data []byte, meta *resultCacheMeta) error {
+	if len(data) > conf.RedisMaxValueSize {
+		return nil
+	}
+
+	ttl := time.Until(meta.ExpiresAt).Milliseconds()
+	if ttl <= 0 {
+		return nil
+	}
+
+	buf, err := encodeResultCacheEntry(data, meta)
+	if err != nil {
+		return err
+	}
+
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("SET", c.key(key), buf, "PX", ttl)
+
+	return err
+}
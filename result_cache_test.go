@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type ResultCacheTestSuite struct {
+	MainTestSuite
+
+	dir string
+}
+
+func (s *ResultCacheTestSuite) SetupTest() {
+	s.MainTestSuite.SetupTest()
+
+	dir, err := ioutil.TempDir("", "imgproxy-cache")
+	require.Nil(s.T(), err)
+
+	s.dir = dir
+	conf.CachePath = dir
+}
+
+func (s *ResultCacheTestSuite) TearDownTest() {
+	os.RemoveAll(s.dir)
+	resultCache = nil
+
+	s.MainTestSuite.TearDownTest()
+}
+
+func (s *ResultCacheTestSuite) newMeta() *resultCacheMeta {
+	return &resultCacheMeta{Format: "png", ExpiresAt: time.Now().Add(time.Hour)}
+}
+
+func (s *ResultCacheTestSuite) TestSetGet() {
+	require.Nil(s.T(), initResultCache())
+
+	key := strings.Repeat("ab", 32)
+	require.Nil(s.T(), resultCache.Set(key, []byte("result"), s.newMeta()))
+
+	data, meta, ok := resultCache.Get(key)
+
+	require.True(s.T(), ok)
+	assert.Equal(s.T(), []byte("result"), data)
+	assert.Equal(s.T(), "png", meta.Format)
+}
+
+func (s *ResultCacheTestSuite) TestExpired() {
+	require.Nil(s.T(), initResultCache())
+
+	key := strings.Repeat("ab", 32)
+	meta := s.newMeta()
+	meta.ExpiresAt = time.Now().Add(-time.Second)
+
+	require.Nil(s.T(), resultCache.Set(key, []byte("result"), meta))
+
+	_, _, ok := resultCache.Get(key)
+
+	assert.False(s.T(), ok)
+}
+
+func (s *ResultCacheTestSuite) TestEviction() {
+	conf.CacheSizeMB = 1
+	require.Nil(s.T(), initResultCache())
+
+	data := make([]byte, 400*1024)
+
+	keys := []string{strings.Repeat("a1", 32), strings.Repeat("b2", 32), strings.Repeat("c3", 32)}
+	for _, key := range keys {
+		require.Nil(s.T(), resultCache.Set(key, data, s.newMeta()))
+	}
+
+	_, _, ok := resultCache.Get(keys[0])
+	assert.False(s.T(), ok)
+
+	_, _, ok = resultCache.Get(keys[2])
+	assert.True(s.T(), ok)
+}
+
+func (s *ResultCacheTestSuite) TestRestore() {
+	require.Nil(s.T(), initResultCache())
+
+	key := strings.Repeat("ab", 32)
+	require.Nil(s.T(), resultCache.Set(key, []byte("result"), s.newMeta()))
+
+	require.Nil(s.T(), initResultCache())
+
+	data, _, ok := resultCache.Get(key)
+
+	require.True(s.T(), ok)
+	assert.Equal(s.T(), []byte("result"), data)
+}
+
+func (s *ResultCacheTestSuite) TestTTL() {
+	conf.CacheTTL = 3600
+
+	ctxWith := func(cacheControl, expires string) context.Context {
+		ctx := context.WithValue(context.Background(), cacheControlHeaderCtxKey, cacheControl)
+		return context.WithValue(ctx, expiresHeaderCtxKey, expires)
+	}
+
+	assert.Equal(s.T(), time.Hour, resultCacheTTL(ctxWith("", "")))
+	assert.Equal(s.T(), time.Minute, resultCacheTTL(ctxWith("public, max-age=60", "")))
+	assert.Equal(s.T(), time.Hour, resultCacheTTL(ctxWith("max-age=86400", "")))
+	assert.Equal(s.T(), time.Duration(0), resultCacheTTL(ctxWith("no-store", "")))
+	assert.Equal(s.T(), time.Duration(0), resultCacheTTL(ctxWith("private, max-age=60", "")))
+
+	past := time.Now().Add(-time.Hour).Format(http.TimeFormat)
+	assert.Equal(s.T(), time.Duration(0), resultCacheTTL(ctxWith("", past)))
+}
+
+func (s *ResultCacheTestSuite) ctxWithCacheHeaders(cacheControl, expires string) context.Context {
+	ctx := context.WithValue(context.Background(), cacheControlHeaderCtxKey, cacheControl)
+	return context.WithValue(ctx, expiresHeaderCtxKey, expires)
+}
+
+func (s *ResultCacheTestSuite) TestTTLCacheControlPrecedence() {
+	conf.CacheTTL = 86400
+	conf.CacheHeadersPrecedence = cacheHeadersPrecedenceCacheControl
+
+	inHour := time.Now().Add(time.Hour).Format(http.TimeFormat)
+
+	assert.Equal(s.T(), time.Minute, resultCacheTTL(s.ctxWithCacheHeaders("max-age=60", inHour)))
+	assert.Equal(s.T(), time.Duration(0), resultCacheTTL(s.ctxWithCacheHeaders("no-store", inHour)))
+	assert.InDelta(s.T(), float64(time.Hour), float64(resultCacheTTL(s.ctxWithCacheHeaders("public", inHour))), float64(2*time.Second))
+	assert.InDelta(s.T(), float64(time.Hour), float64(resultCacheTTL(s.ctxWithCacheHeaders("", inHour))), float64(2*time.Second))
+}
+
+func (s *ResultCacheTestSuite) TestTTLExpiresPrecedence() {
+	conf.CacheTTL = 86400
+	conf.CacheHeadersPrecedence = cacheHeadersPrecedenceExpires
+
+	inHour := time.Now().Add(time.Hour).Format(http.TimeFormat)
+	past := time.Now().Add(-time.Hour).Format(http.TimeFormat)
+
+	assert.InDelta(s.T(), float64(time.Hour), float64(resultCacheTTL(s.ctxWithCacheHeaders("max-age=60", inHour))), float64(2*time.Second))
+	assert.Equal(s.T(), time.Duration(0), resultCacheTTL(s.ctxWithCacheHeaders("no-store", inHour)))
+	assert.Equal(s.T(), time.Duration(0), resultCacheTTL(s.ctxWithCacheHeaders("private, max-age=60", inHour)))
+	assert.Equal(s.T(), time.Duration(0), resultCacheTTL(s.ctxWithCacheHeaders("max-age=60", past)))
+	assert.Equal(s.T(), time.Duration(0), resultCacheTTL(s.ctxWithCacheHeaders("max-age=60", "invalid")))
+	assert.Equal(s.T(), time.Minute, resultCacheTTL(s.ctxWithCacheHeaders("max-age=60", "")))
+}
+
+func (s *ResultCacheTestSuite) TestTTLIgnoreSourceHeaders() {
+	conf.CacheTTL = 3600
+	conf.IgnoreSourceCacheHeaders = true
+
+	inMinute := time.Now().Add(time.Minute).Format(http.TimeFormat)
+
+	for _, precedence := range []string{cacheHeadersPrecedenceCacheControl, cacheHeadersPrecedenceExpires} {
+		conf.CacheHeadersPrecedence = precedence
+
+		assert.Equal(s.T(), time.Hour, resultCacheTTL(s.ctxWithCacheHeaders("max-age=60", "")))
+		assert.Equal(s.T(), time.Hour, resultCacheTTL(s.ctxWithCacheHeaders("no-store", "")))
+		assert.Equal(s.T(), time.Hour, resultCacheTTL(s.ctxWithCacheHeaders("", inMinute)))
+		assert.Equal(s.T(), time.Hour, resultCacheTTL(s.ctxWithCacheHeaders("max-age=60", inMinute)))
+	}
+}
+
+func (s *ResultCacheTestSuite) TestSourceCacheHeaders() {
+	inHour := time.Now().Add(time.Hour).Format(http.TimeFormat)
+
+	conf.CacheHeadersPrecedence = cacheHeadersPrecedenceCacheControl
+
+	cacheControl, expires := sourceCacheHeaders(s.ctxWithCacheHeaders("max-age=60", inHour))
+	assert.Equal(s.T(), "max-age=60", cacheControl)
+	assert.Equal(s.T(), inHour, expires)
+
+	conf.CacheHeadersPrecedence = cacheHeadersPrecedenceExpires
+
+	cacheControl, expires = sourceCacheHeaders(s.ctxWithCacheHeaders("max-age=60", inHour))
+	assert.Regexp(s.T(), `^max-age=(3599|3600), public$`, cacheControl)
+	assert.Equal(s.T(), inHour, expires)
+
+	cacheControl, _ = sourceCacheHeaders(s.ctxWithCacheHeaders("private, max-age=60, must-revalidate", inHour))
+	assert.Regexp(s.T(), `^private, must-revalidate, max-age=(3599|3600)$`, cacheControl)
+
+	cacheControl, _ = sourceCacheHeaders(s.ctxWithCacheHeaders("no-store", inHour))
+	assert.Regexp(s.T(), `^no-store, max-age=(3599|3600)$`, cacheControl)
+
+	cacheControl, expires = sourceCacheHeaders(s.ctxWithCacheHeaders("max-age=60", ""))
+	assert.Equal(s.T(), "max-age=60", cacheControl)
+	assert.Empty(s.T(), expires)
+
+	conf.IgnoreSourceCacheHeaders = true
+
+	cacheControl, expires = sourceCacheHeaders(s.ctxWithCacheHeaders("max-age=60", inHour))
+	assert.Empty(s.T(), cacheControl)
+	assert.Empty(s.T(), expires)
+}
+
+func TestResultCache(t *testing.T) {
+	suite.Run(t, new(ResultCacheTestSuite))
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
 	"regexp"
 	"strings"
@@ -14,6 +15,8 @@ const (
 
 var (
 	requestIDRe = regexp.MustCompile(`^[A-Za-z0-9_\-]+$`)
+
+	errRequestBodyNotAllowed = newError(400, "Request body is not allowed", "Request body is not allowed").SetCategory("request_body_not_allowed")
 )
 
 type routeHandler func(string, http.ResponseWriter, *http.Request)
@@ -33,10 +36,6 @@ type router struct {
 }
 
 func (r *route) IsMatch(req *http.Request) bool {
-	if r.Method != req.Method {
-		return false
-	}
-
 	if r.Exact {
 		return req.URL.Path == r.Prefix
 	}
@@ -71,7 +70,8 @@ func (r *router) HEAD(prefix string, handler routeHandler, exact bool) {
 }
 
 func (r *router) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	req = req.WithContext(setTimerSince(req.Context()))
+	ctx, rw := withBytesWritten(setTimerSince(req.Context()), rw)
+	req = req.WithContext(ctx)
 
 	reqID := req.Header.Get(xRequestIDHeader)
 
@@ -82,8 +82,17 @@ func (r *router) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	rw.Header().Set("Server", "imgproxy")
 	rw.Header().Set(xRequestIDHeader, reqID)
 
+	if conf.EnableClientHints {
+		rw.Header().Set("Accept-CH", "DPR, Viewport-Width, Width")
+	}
+
 	defer func() {
 		if rerr := recover(); rerr != nil {
+			// Aborting is the only way to report an error once the response is started
+			if rerr == http.ErrAbortHandler {
+				panic(rerr)
+			}
+
 			if err, ok := rerr.(error); ok && r.PanicHandler != nil {
 				r.PanicHandler(reqID, rw, req, err)
 			} else {
@@ -94,14 +103,47 @@ func (r *router) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 
 	logRequest(reqID, req)
 
+	// None of the routes expect a request body. Unknown length means
+	// the body is sent chunked
+	if req.ContentLength != 0 {
+		panic(errRequestBodyNotAllowed)
+	}
+
+	var allowed []string
+
 	for _, rr := range r.Routes {
-		if rr.IsMatch(req) {
+		if !rr.IsMatch(req) {
+			continue
+		}
+
+		if rr.Method == req.Method {
 			rr.Handler(reqID, rw, req)
 			return
 		}
+
+		allowed = appendMethod(allowed, rr.Method)
+	}
+
+	if len(allowed) > 0 {
+		rw.Header().Set("Allow", strings.Join(allowed, ", "))
+		panic(newError(
+			405,
+			fmt.Sprintf("Method %s is not allowed for %s", req.Method, req.URL.Path),
+			"Method Not Allowed",
+		).SetCategory("method_not_allowed"))
 	}
 
 	logWarning("Route for %s is not defined", req.URL.Path)
 
 	rw.WriteHeader(404)
 }
+
+func appendMethod(methods []string, method string) []string {
+	for _, m := range methods {
+		if m == method {
+			return methods
+		}
+	}
+
+	return append(methods, method)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type RouterTestSuite struct{ MainTestSuite }
+
+func (s *RouterTestSuite) getRouter() *router {
+	r := newRouter("")
+	r.PanicHandler = handlePanic
+
+	r.GET("/", func(reqID string, rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(200)
+	}, false)
+	r.OPTIONS("/", func(reqID string, rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(200)
+	}, false)
+
+	return r
+}
+
+func (s *RouterTestSuite) TestGet() {
+	rw := httptest.NewRecorder()
+	s.getRouter().ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/test", nil))
+
+	assert.Equal(s.T(), 200, rw.Code)
+}
+
+func (s *RouterTestSuite) TestAcceptClientHints() {
+	conf.EnableClientHints = true
+
+	rw := httptest.NewRecorder()
+	s.getRouter().ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/test", nil))
+
+	assert.Equal(s.T(), "DPR, Viewport-Width, Width", rw.Header().Get("Accept-CH"))
+}
+
+func (s *RouterTestSuite) TestAcceptClientHintsDisabled() {
+	rw := httptest.NewRecorder()
+	s.getRouter().ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/test", nil))
+
+	assert.Empty(s.T(), rw.Header().Get("Accept-CH"))
+}
+
+func (s *RouterTestSuite) TestMethodNotAllowed() {
+	rw := httptest.NewRecorder()
+	s.getRouter().ServeHTTP(rw, httptest.NewRequest(http.MethodDelete, "/test", nil))
+
+	assert.Equal(s.T(), 405, rw.Code)
+	assert.Equal(s.T(), "GET, OPTIONS", rw.Header().Get("Allow"))
+}
+
+func (s *RouterTestSuite) TestRequestBodyNotAllowed() {
+	rw := httptest.NewRecorder()
+	s.getRouter().ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/test", strings.NewReader("body")))
+
+	assert.Equal(s.T(), 400, rw.Code)
+}
+
+func TestRouter(t *testing.T) {
+	suite.Run(t, new(RouterTestSuite))
+}
@@ -1,32 +1,83 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
 	http "net/http"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
+// s3Profile is a set of S3 settings used to access specific buckets
+type s3Profile struct {
+	Name            string
+	Buckets         []string
+	Region          string
+	Endpoint        string
+	AccessKeyID     string
+	SecretAccessKey string
+	AssumeRoleArn   string
+}
+
 // s3Transport implements RoundTripper for the 's3' protocol.
 type s3Transport struct {
-	svc *s3.S3
+	defaultSvc *s3.S3
+	// bucketSvcs maps bucket names to the clients of their profiles
+	bucketSvcs map[string]*s3.S3
 }
 
 func newS3Transport() (http.RoundTripper, error) {
+	defaultSvc, err := newS3Client(s3Profile{
+		Region:        conf.S3Region,
+		Endpoint:      conf.S3Endpoint,
+		AssumeRoleArn: conf.S3AssumeRoleArn,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	bucketSvcs := make(map[string]*s3.S3)
+
+	for _, profile := range conf.S3Profiles {
+		svc, err := newS3Client(profile)
+		if err != nil {
+			return nil, fmt.Errorf("Can't create S3 client for profile %s: %s", profile.Name, err)
+		}
+
+		for _, bucket := range profile.Buckets {
+			bucketSvcs[bucket] = svc
+		}
+	}
+
+	return s3Transport{defaultSvc: defaultSvc, bucketSvcs: bucketSvcs}, nil
+}
+
+func newS3Client(profile s3Profile) (*s3.S3, error) {
 	s3Conf := aws.NewConfig()
 
-	if len(conf.S3Region) != 0 {
-		s3Conf.Region = aws.String(conf.S3Region)
+	if len(profile.Region) != 0 {
+		s3Conf.Region = aws.String(profile.Region)
 	}
 
-	if len(conf.S3Endpoint) != 0 {
-		s3Conf.Endpoint = aws.String(conf.S3Endpoint)
+	if len(profile.Endpoint) != 0 {
+		s3Conf.Endpoint = aws.String(profile.Endpoint)
 		s3Conf.S3ForcePathStyle = aws.Bool(true)
 	}
 
-	sess, err := session.NewSession()
+	sessConf := aws.NewConfig()
+
+	// Static credentials replace the default credentials chain
+	if len(profile.AccessKeyID) != 0 {
+		sessConf.Credentials = credentials.NewStaticCredentials(profile.AccessKeyID, profile.SecretAccessKey, "")
+	}
+
+	sess, err := session.NewSession(sessConf)
 	if err != nil {
 		return nil, fmt.Errorf("Can't create S3 session: %s", err)
 	}
@@ -35,10 +86,30 @@ func newS3Transport() (http.RoundTripper, error) {
 		sess.Config.Region = aws.String("us-west-1")
 	}
 
-	return s3Transport{s3.New(sess, s3Conf)}, nil
+	// The role is assumed using the session credentials,
+	// and the temporary credentials are refreshed automatically
+	if len(profile.AssumeRoleArn) != 0 {
+		s3Conf.Credentials = stscreds.NewCredentials(sess, profile.AssumeRoleArn)
+	}
+
+	return s3.New(sess, s3Conf), nil
+}
+
+// svc returns the client of the profile the bucket belongs to.
+// Buckets that don't belong to any profile are accessed with the default client
+func (t s3Transport) svc(bucket string) *s3.S3 {
+	if svc, ok := t.bucketSvcs[bucket]; ok {
+		return svc
+	}
+
+	return t.defaultSvc
 }
 
 func (t s3Transport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	if req.Method == http.MethodPut {
+		return t.put(req)
+	}
+
 	input := &s3.GetObjectInput{
 		Bucket: aws.String(req.URL.Host),
 		Key:    aws.String(req.URL.Path),
@@ -48,7 +119,62 @@ func (t s3Transport) RoundTrip(req *http.Request) (resp *http.Response, err erro
 		input.VersionId = aws.String(req.URL.RawQuery)
 	}
 
-	s3req, _ := t.svc.GetObjectRequest(input)
+	s3req, _ := t.svc(req.URL.Host).GetObjectRequest(input)
+
+	if err := s3req.Send(); err != nil {
+		return nil, err
+	}
+
+	return s3req.HTTPResponse, nil
+}
+
+func (t s3Transport) List(ctx context.Context, bucket, prefix string, limit int) ([]string, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(bucket),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int64(int64(limit)),
+	}
+
+	output, err := t.svc(bucket).ListObjectsV2WithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(output.Contents))
+	for _, obj := range output.Contents {
+		keys = append(keys, aws.StringValue(obj.Key))
+	}
+
+	return keys, nil
+}
+
+func (t s3Transport) put(req *http.Request) (*http.Response, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(req.URL.Host),
+		Key:    aws.String(req.URL.Path),
+		Body:   bytes.NewReader(body),
+	}
+
+	if contentType := req.Header.Get("Content-Type"); len(contentType) > 0 {
+		input.ContentType = aws.String(contentType)
+	}
+
+	// Objects encrypted with SSE-S3 or SSE-KMS are decrypted by S3 transparently,
+	// so the encryption headers are needed only when writing
+	if len(conf.S3SSE) > 0 {
+		input.ServerSideEncryption = aws.String(conf.S3SSE)
+	}
+
+	if len(conf.S3SSEKMSKeyID) > 0 {
+		input.SSEKMSKeyId = aws.String(conf.S3SSEKMSKeyID)
+	}
+
+	s3req, _ := t.svc(req.URL.Host).PutObjectRequest(input)
 
 	if err := s3req.Send(); err != nil {
 		return nil, err
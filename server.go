@@ -3,17 +3,45 @@ package main
 import (
 	"context"
 	"crypto/subtle"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"golang.org/x/net/netutil"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
+const unixSocketBindPrefix = "unix:"
+
 var (
 	imgproxyIsRunningMsg = []byte("imgproxy is running")
+	imgproxyIsReadyMsg   = []byte("imgproxy is ready")
+	imgproxyNotReadyMsg  = []byte("imgproxy is not ready")
+	imgproxyOverloadMsg  = []byte("imgproxy is overloaded")
+
+	// serverReady is set to 1 when the initialization is completed
+	// and imgproxy is able to process images
+	serverReady int32
+
+	// tlsRedirectServer is the plain HTTP server that redirects to HTTPS.
+	// It's shut down together with the main server
+	tlsRedirectServer *http.Server
+
+	errInvalidSecret = newError(403, "Invalid secret", "Forbidden").SetCategory("invalid_secret")
 
-	errInvalidSecret = newError(403, "Invalid secret", "Forbidden")
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
 )
 
 func buildRouter() *router {
@@ -23,7 +51,19 @@ func buildRouter() *router {
 
 	r.GET("/", handleLanding, true)
 	r.GET("/health", handleHealth, true)
+	r.GET("/ready", handleReady, true)
 	r.GET("/favicon.ico", handleFavicon, true)
+	if len(conf.StorageCheckPrefix) > 0 {
+		r.GET("/storage_check", withAdminSecret(handleStorageCheck), true)
+	}
+	// Presets are internals, so they are exposed only to admins
+	if len(conf.AdminSecret) > 0 {
+		r.GET(presetsPath, withAdminSecret(handlePresets), true)
+	}
+	r.GET(infoPathPrefix+"/", withCORS(withSecret(handleInfo)), false)
+	r.GET(colorPathPrefix+"/", withCORS(withSecret(handleColor)), false)
+	r.GET(blurhashPathPrefix+"/", withCORS(withSecret(handleBlurhash)), false)
+	r.GET(thumbhashPathPrefix+"/", withCORS(withSecret(handleThumbhash)), false)
 	r.GET("/", withCORS(withSecret(handleProcessing)), false)
 	r.HEAD("/", withCORS(handleHead), false)
 	r.OPTIONS("/", withCORS(handleHead), false)
@@ -31,17 +71,73 @@ func buildRouter() *router {
 	return r
 }
 
+// bindNetwork returns the network and the address to listen on.
+// Bindings like unix:/path/to/socket make imgproxy listen on a Unix socket
+func bindNetwork(network, bind string) (string, string) {
+	if strings.HasPrefix(bind, unixSocketBindPrefix) {
+		return "unix", strings.TrimPrefix(bind, unixSocketBindPrefix)
+	}
+
+	return network, bind
+}
+
+func isUnixNetwork(network string) bool {
+	return network == "unix" || network == "unixpacket"
+}
+
+// removeStaleSocket removes the socket file left by the previous run.
+// Other files are not touched so we don't remove anything by mistake.
+// The socket is removed only when nobody accepts connections on it,
+// so we don't steal the socket of another running instance
+func removeStaleSocket(network, path string) error {
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+
+	conn, err := net.DialTimeout(network, path, time.Second)
+	if err == nil {
+		conn.Close()
+		return nil
+	}
+
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return nil
+	}
+
+	return os.Remove(path)
+}
+
 func startServer(cancel context.CancelFunc) (*http.Server, error) {
-	l, err := listenReuseport(conf.Network, conf.Bind)
+	network, address := bindNetwork(conf.Network, conf.Bind)
+
+	if isUnixNetwork(network) {
+		if err := removeStaleSocket(network, address); err != nil {
+			return nil, fmt.Errorf("Can't remove stale socket: %s", err)
+		}
+	}
+
+	// Unix listener unlinks the socket file when it's closed during shutdown
+	l, err := listenReuseport(network, address)
 	if err != nil {
 		return nil, fmt.Errorf("Can't start server: %s", err)
 	}
-	l = netutil.LimitListener(l, conf.MaxClients)
+	l = newMaxClientsListener(l, conf.MaxClients)
+	setMaxClients(conf.MaxClients)
+
+	if conf.MaxConnectionsPerClient > 0 {
+		if isUnixNetwork(network) {
+			// All the connections to a Unix socket have the same remote address
+			logWarning("IMGPROXY_MAX_CONNECTIONS_PER_CLIENT is ignored when listening on a Unix socket")
+		} else {
+			l = newClientLimitListener(l, conf.MaxConnectionsPerClient)
+		}
+	}
 
 	s := &http.Server{
 		Handler:        buildRouter(),
 		ReadTimeout:    time.Duration(conf.ReadTimeout) * time.Second,
-		MaxHeaderBytes: 1 << 20,
+		MaxHeaderBytes: conf.MaxHeaderBytes,
 	}
 
 	if conf.KeepAliveTimeout > 0 {
@@ -50,12 +146,116 @@ func startServer(cancel context.CancelFunc) (*http.Server, error) {
 		s.SetKeepAlivesEnabled(false)
 	}
 
+	tlsEnabled := len(conf.TLSCert) > 0 && len(conf.TLSKey) > 0
+
+	if tlsEnabled {
+		// Load the certificate here so misconfiguration is reported on startup
+		cert, err := tls.LoadX509KeyPair(conf.TLSCert, conf.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("Can't load TLS certificate: %s", err)
+		}
+
+		s.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tlsVersions[conf.TLSMinVersion],
+		}
+	}
+
+	if err := configureHTTP2(s, tlsEnabled); err != nil {
+		return nil, err
+	}
+
 	if err := initProcessingHandler(); err != nil {
 		return nil, err
 	}
 
+	if tlsEnabled && len(conf.TLSRedirectBind) > 0 {
+		rs, err := startTLSRedirectServer(cancel)
+		if err != nil {
+			return nil, err
+		}
+		tlsRedirectServer = rs
+	}
+
 	go func() {
-		logNotice("Starting server at %s", conf.Bind)
+		var err error
+
+		if tlsEnabled {
+			logNotice("Starting server at %s (TLS)", conf.Bind)
+			err = s.ServeTLS(l, "", "")
+		} else {
+			logNotice("Starting server at %s", conf.Bind)
+			err = s.Serve(l)
+		}
+
+		if err != nil && err != http.ErrServerClosed {
+			logError(err.Error())
+		}
+		cancel()
+	}()
+
+	return s, nil
+}
+
+// configureHTTP2 enables HTTP/2 negotiated via ALPN when TLS is enabled,
+// and HTTP/2 over cleartext (h2c) when TLS is disabled and h2c is enabled
+// explicitly. When HTTP/2 is disabled, only HTTP/1.1 is served
+func configureHTTP2(s *http.Server, tlsEnabled bool) error {
+	if !conf.HTTP2Enabled {
+		// Non-nil empty map disables the automatic HTTP/2 setup of ServeTLS
+		s.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		return nil
+	}
+
+	h2s := &http2.Server{
+		IdleTimeout: s.IdleTimeout,
+		// Connection limits don't take the streams into account,
+		// so the number of requests per connection is limited here
+		MaxConcurrentStreams: uint32(conf.HTTP2MaxConcurrentStreams),
+	}
+
+	// This also lets the HTTP/2 connections be closed gracefully on shutdown
+	if err := http2.ConfigureServer(s, h2s); err != nil {
+		return fmt.Errorf("Can't configure HTTP/2: %s", err)
+	}
+
+	// h2c allows upgrading connections that a front proxy may treat
+	// as plain HTTP/1.1, so it's enabled only explicitly
+	if !tlsEnabled && conf.HTTP2Cleartext {
+		s.Handler = h2c.NewHandler(s.Handler, h2s)
+	}
+
+	return nil
+}
+
+// startTLSRedirectServer starts a plain HTTP server that redirects all requests to HTTPS
+func startTLSRedirectServer(cancel context.CancelFunc) (*http.Server, error) {
+	_, httpsPort, _ := net.SplitHostPort(conf.Bind)
+
+	s := &http.Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			host, _, err := net.SplitHostPort(r.Host)
+			if err != nil {
+				host = r.Host
+			}
+
+			if len(httpsPort) > 0 && httpsPort != "443" {
+				host = net.JoinHostPort(host, httpsPort)
+			}
+
+			http.Redirect(rw, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+		}),
+		ReadTimeout:    time.Duration(conf.ReadTimeout) * time.Second,
+		MaxHeaderBytes: conf.MaxHeaderBytes,
+	}
+
+	l, err := listenReuseport("tcp", conf.TLSRedirectBind)
+	if err != nil {
+		return nil, fmt.Errorf("Can't start TLS redirect server: %s", err)
+	}
+
+	go func() {
+		logNotice("Starting TLS redirect server at %s", conf.TLSRedirectBind)
 		if err := s.Serve(l); err != nil && err != http.ErrServerClosed {
 			logError(err.Error())
 		}
@@ -65,13 +265,42 @@ func startServer(cancel context.CancelFunc) (*http.Server, error) {
 	return s, nil
 }
 
+func setServerReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&serverReady, v)
+}
+
+func isServerReady() bool {
+	return atomic.LoadInt32(&serverReady) == 1
+}
+
 func shutdownServer(s *http.Server) {
 	logNotice("Shutting down the server...")
 
-	ctx, close := context.WithTimeout(context.Background(), 5*time.Second)
+	// Let the orchestrator know we don't accept new requests anymore
+	setServerReady(false)
+
+	// The orchestrator notices that the server isn't ready only on the next readiness check,
+	// so we keep serving new requests for a while to not drop the ones that are already routed here
+	if conf.ShutdownDrainDelay > 0 {
+		time.Sleep(time.Duration(conf.ShutdownDrainDelay) * time.Second)
+	}
+
+	ctx, close := context.WithTimeout(context.Background(), time.Duration(conf.GracefulShutdownTimeout)*time.Second)
 	defer close()
 
-	s.Shutdown(ctx)
+	// The server stops accepting new connections and waits for the active ones
+	// to finish until the timeout is exceeded
+	if err := s.Shutdown(ctx); err == context.DeadlineExceeded {
+		logWarning("Graceful shutdown timeout exceeded, %d requests are still in flight", getInFlightRequests())
+	}
+
+	if tlsRedirectServer != nil {
+		tlsRedirectServer.Shutdown(ctx)
+	}
 }
 
 func withCORS(h routeHandler) routeHandler {
@@ -115,7 +344,21 @@ func handlePanic(reqID string, rw http.ResponseWriter, r *http.Request, err erro
 		reportError(err, r)
 	}
 
-	logResponse(reqID, r, ierr.StatusCode, ierr, nil, nil)
+	incrementResponsesTotal(ierr.StatusCode, imageTypeUnknown)
+	incrementErrorResponsesTotal(ierr.Category())
+
+	// Log the response after it's written so the duration and the size are accurate
+	defer logResponse(reqID, r, ierr.StatusCode, ierr, nil, nil)
+
+	if len(ierr.RetryAfter) > 0 {
+		rw.Header().Set("Retry-After", ierr.RetryAfter)
+	}
+
+	if conf.ErrorImage && r.Method == http.MethodGet && respondWithErrorImage(rw, r, ierr) {
+		return
+	}
+
+	setCustomResponseHeaders(rw)
 
 	rw.WriteHeader(ierr.StatusCode)
 
@@ -126,19 +369,48 @@ func handlePanic(reqID string, rw http.ResponseWriter, r *http.Request, err erro
 	}
 }
 
+// setCustomResponseHeaders sets the headers from IMGPROXY_CUSTOM_RESPONSE_HEADERS
+// that aren't set yet
+func setCustomResponseHeaders(rw http.ResponseWriter) {
+	header := rw.Header()
+
+	for k, v := range conf.CustomResponseHeaders {
+		if _, ok := header[k]; !ok {
+			header.Set(k, v)
+		}
+	}
+}
+
 func handleHealth(reqID string, rw http.ResponseWriter, r *http.Request) {
-	logResponse(reqID, r, 200, nil, nil, nil)
 	rw.WriteHeader(200)
 	rw.Write(imgproxyIsRunningMsg)
+	logResponse(reqID, r, 200, nil, nil, nil)
+}
+
+// handleReady reports whether imgproxy is able to serve requests.
+// Unlike /health, it fails until the initialization is completed
+// and while the number of in-flight requests is at IMGPROXY_MAX_CLIENTS
+func handleReady(reqID string, rw http.ResponseWriter, r *http.Request) {
+	status, msg := 200, imgproxyIsReadyMsg
+
+	if !isServerReady() {
+		status, msg = 503, imgproxyNotReadyMsg
+	} else if conf.MaxClients > 0 && getInFlightRequests() >= int64(conf.MaxClients) {
+		status, msg = 503, imgproxyOverloadMsg
+	}
+
+	rw.WriteHeader(status)
+	rw.Write(msg)
+	logResponse(reqID, r, status, nil, nil, nil)
 }
 
 func handleHead(reqID string, rw http.ResponseWriter, r *http.Request) {
-	logResponse(reqID, r, 200, nil, nil, nil)
 	rw.WriteHeader(200)
+	logResponse(reqID, r, 200, nil, nil, nil)
 }
 
 func handleFavicon(reqID string, rw http.ResponseWriter, r *http.Request) {
-	logResponse(reqID, r, 200, nil, nil, nil)
 	// TODO: Add a real favicon maybe?
 	rw.WriteHeader(200)
+	logResponse(reqID, r, 200, nil, nil, nil)
 }
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/net/http2"
+)
+
+type ServerTestSuite struct{ MainTestSuite }
+
+func (s *ServerTestSuite) getRouter() *router {
+	r := newRouter("")
+	r.PanicHandler = handlePanic
+
+	r.GET("/", func(reqID string, rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("X-Proto", req.Proto)
+		rw.WriteHeader(200)
+	}, false)
+
+	return r
+}
+
+func (s *ServerTestSuite) startServer(tlsEnabled bool) *httptest.Server {
+	srv := httptest.NewUnstartedServer(s.getRouter())
+
+	require.Nil(s.T(), configureHTTP2(srv.Config, tlsEnabled))
+
+	if tlsEnabled {
+		// Use ALPN protocols configured for the server
+		srv.TLS = srv.Config.TLSConfig
+		srv.StartTLS()
+	} else {
+		srv.Start()
+	}
+
+	return srv
+}
+
+func (s *ServerTestSuite) getTLSClient() *http.Client {
+	return &http.Client{
+		Transport: &http2.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+}
+
+// getH2CClient returns the client that uses HTTP/2 over cleartext
+// with prior knowledge
+func (s *ServerTestSuite) getH2CClient() *http.Client {
+	return &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		},
+	}
+}
+
+func (s *ServerTestSuite) TestHTTP2OverTLS() {
+	srv := s.startServer(true)
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/test", nil)
+	req.Header.Set(xRequestIDHeader, "test-request-id")
+
+	res, err := s.getTLSClient().Do(req)
+	require.Nil(s.T(), err)
+	res.Body.Close()
+
+	assert.Equal(s.T(), 200, res.StatusCode)
+	assert.Equal(s.T(), "HTTP/2.0", res.Header.Get("X-Proto"))
+	assert.Equal(s.T(), "test-request-id", res.Header.Get(xRequestIDHeader))
+	assert.Equal(s.T(), "imgproxy", res.Header.Get("Server"))
+}
+
+func (s *ServerTestSuite) TestHTTP2MethodNotAllowed() {
+	srv := s.startServer(true)
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/test", nil)
+
+	res, err := s.getTLSClient().Do(req)
+	require.Nil(s.T(), err)
+	res.Body.Close()
+
+	assert.Equal(s.T(), 405, res.StatusCode)
+	assert.Equal(s.T(), "GET", res.Header.Get("Allow"))
+	assert.NotEmpty(s.T(), res.Header.Get(xRequestIDHeader))
+}
+
+func (s *ServerTestSuite) TestHTTP2RequestBodyNotAllowed() {
+	srv := s.startServer(true)
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/test", strings.NewReader("body"))
+
+	res, err := s.getTLSClient().Do(req)
+	require.Nil(s.T(), err)
+	res.Body.Close()
+
+	assert.Equal(s.T(), 400, res.StatusCode)
+}
+
+func (s *ServerTestSuite) TestH2CDisabledByDefault() {
+	srv := s.startServer(false)
+	defer srv.Close()
+
+	_, err := s.getH2CClient().Get(srv.URL + "/test")
+	assert.NotNil(s.T(), err)
+
+	// HTTP/1.1 is still served
+	res, err := srv.Client().Get(srv.URL + "/test")
+	require.Nil(s.T(), err)
+	res.Body.Close()
+
+	assert.Equal(s.T(), "HTTP/1.1", res.Header.Get("X-Proto"))
+}
+
+func (s *ServerTestSuite) TestH2C() {
+	conf.HTTP2Cleartext = true
+
+	srv := s.startServer(false)
+	defer srv.Close()
+
+	res, err := s.getH2CClient().Get(srv.URL + "/test")
+	require.Nil(s.T(), err)
+	res.Body.Close()
+
+	assert.Equal(s.T(), 200, res.StatusCode)
+	assert.Equal(s.T(), "HTTP/2.0", res.Header.Get("X-Proto"))
+	assert.NotEmpty(s.T(), res.Header.Get(xRequestIDHeader))
+}
+
+func (s *ServerTestSuite) TestHTTP2Disabled() {
+	conf.HTTP2Enabled = false
+
+	srv := s.startServer(true)
+	defer srv.Close()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		},
+	}
+
+	res, err := client.Get(srv.URL + "/test")
+	require.Nil(s.T(), err)
+	res.Body.Close()
+
+	assert.Equal(s.T(), "HTTP/1.1", res.Header.Get("X-Proto"))
+}
+
+func (s *ServerTestSuite) tempDir() string {
+	dir, err := ioutil.TempDir("", "imgproxy-test")
+	require.Nil(s.T(), err)
+
+	return dir
+}
+
+func (s *ServerTestSuite) TestRemoveStaleSocket() {
+	dir := s.tempDir()
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "imgproxy.sock")
+
+	l, err := net.Listen("unix", path)
+	require.Nil(s.T(), err)
+
+	// The socket of the running server should be kept
+	require.Nil(s.T(), removeStaleSocket("unix", path))
+	assert.FileExists(s.T(), path)
+
+	// Simulate a crashed server that left the socket file behind
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	require.Nil(s.T(), removeStaleSocket("unix", path))
+	assert.NoFileExists(s.T(), path)
+}
+
+func (s *ServerTestSuite) TestRemoveStaleSocketKeepsRegularFiles() {
+	dir := s.tempDir()
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "imgproxy.sock")
+	require.Nil(s.T(), ioutil.WriteFile(path, []byte("data"), 0644))
+
+	require.Nil(s.T(), removeStaleSocket("unix", path))
+	assert.FileExists(s.T(), path)
+}
+
+func (s *ServerTestSuite) TestShutdownDrainDelay() {
+	conf.ShutdownDrainDelay = 1
+
+	srv := s.startServer(false)
+	defer srv.Close()
+
+	setServerReady(true)
+
+	done := make(chan struct{})
+	go func() {
+		shutdownServer(srv.Config)
+		close(done)
+	}()
+
+	assert.Eventually(s.T(), func() bool { return !isServerReady() }, time.Second, 10*time.Millisecond)
+
+	// The server isn't ready anymore but still serves requests during the drain delay
+	res, err := srv.Client().Get(srv.URL + "/test")
+	require.Nil(s.T(), err)
+	res.Body.Close()
+
+	assert.Equal(s.T(), 200, res.StatusCode)
+
+	select {
+	case <-done:
+		s.T().Error("Server is shut down before the drain delay is over")
+	default:
+	}
+
+	<-done
+}
+
+func TestServer(t *testing.T) {
+	suite.Run(t, new(ServerTestSuite))
+}
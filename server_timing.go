@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var serverTimingCtxKey = ctxKey("serverTiming")
+
+// serverTiming collects the durations of the request stages
+// that are sent in the Server-Timing response header
+type serverTiming struct {
+	Download   time.Duration
+	Processing time.Duration
+}
+
+func withServerTiming(ctx context.Context) context.Context {
+	if !conf.EnableServerTiming {
+		return ctx
+	}
+
+	return context.WithValue(ctx, serverTimingCtxKey, new(serverTiming))
+}
+
+func getServerTiming(ctx context.Context) *serverTiming {
+	timing, _ := ctx.Value(serverTimingCtxKey).(*serverTiming)
+	return timing
+}
+
+// startDownloadTiming starts measuring the download stage.
+// Call the returned function when the download is finished
+func startDownloadTiming(ctx context.Context) func() {
+	timing := getServerTiming(ctx)
+	if timing == nil {
+		return func() {}
+	}
+
+	return startDuration(func(d time.Duration) { timing.Download = d })
+}
+
+// startProcessingTiming starts measuring the processing stage.
+// Call the returned function when the processing is finished
+func startProcessingTiming(ctx context.Context) func() {
+	timing := getServerTiming(ctx)
+	if timing == nil {
+		return func() {}
+	}
+
+	return startDuration(func(d time.Duration) { timing.Processing = d })
+}
+
+// Header returns the Server-Timing header value. Stages that are not
+// finished yet, like processing of a streamed response, are omitted
+func (t *serverTiming) Header() string {
+	metrics := make([]string, 0, 2)
+
+	if t.Download > 0 {
+		metrics = append(metrics, formatServerTimingMetric("download", t.Download))
+	}
+
+	if t.Processing > 0 {
+		metrics = append(metrics, formatServerTimingMetric("process", t.Processing))
+	}
+
+	return strings.Join(metrics, ", ")
+}
+
+func formatServerTimingMetric(name string, d time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.3f", name, float64(d)/float64(time.Millisecond))
+}
+
+func setServerTimingHeader(ctx context.Context, rw http.ResponseWriter) {
+	timing := getServerTiming(ctx)
+	if timing == nil {
+		return
+	}
+
+	if header := timing.Header(); len(header) > 0 {
+		rw.Header().Set("Server-Timing", header)
+	}
+}
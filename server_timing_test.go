@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type ServerTimingTestSuite struct{ MainTestSuite }
+
+func (s *ServerTimingTestSuite) TestHeader() {
+	timing := serverTiming{
+		Download:   120521 * time.Microsecond,
+		Processing: 45 * time.Millisecond,
+	}
+
+	assert.Equal(s.T(), "download;dur=120.521, process;dur=45.000", timing.Header())
+}
+
+func (s *ServerTimingTestSuite) TestHeaderUnfinishedProcessing() {
+	timing := serverTiming{Download: 10 * time.Millisecond}
+
+	assert.Equal(s.T(), "download;dur=10.000", timing.Header())
+}
+
+func (s *ServerTimingTestSuite) TestSetHeader() {
+	conf.EnableServerTiming = true
+
+	ctx := withServerTiming(context.Background())
+	require.NotNil(s.T(), getServerTiming(ctx))
+
+	getServerTiming(ctx).Download = time.Millisecond
+
+	rw := httptest.NewRecorder()
+	setServerTimingHeader(ctx, rw)
+
+	assert.Equal(s.T(), "download;dur=1.000", rw.Header().Get("Server-Timing"))
+}
+
+func (s *ServerTimingTestSuite) TestDisabled() {
+	ctx := withServerTiming(context.Background())
+	assert.Nil(s.T(), getServerTiming(ctx))
+
+	startDownloadTiming(ctx)()
+
+	rw := httptest.NewRecorder()
+	setServerTimingHeader(ctx, rw)
+
+	assert.Empty(s.T(), rw.Header().Get("Server-Timing"))
+}
+
+func TestServerTiming(t *testing.T) {
+	suite.Run(t, new(ServerTimingTestSuite))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// sourceHeader is a static header sent to the sources matching the prefix
+type sourceHeader struct {
+	Scheme     string
+	Host       string
+	PathPrefix string
+	Name       string
+	Value      string
+}
+
+func parseSourceHeader(sh *[]sourceHeader, headerStr string) error {
+	headerStr = strings.Trim(headerStr, " ")
+
+	if len(headerStr) == 0 || strings.HasPrefix(headerStr, "#") {
+		return nil
+	}
+
+	// Header values like Base64-encoded credentials may contain "=",
+	// so we split by the first one
+	parts := strings.SplitN(headerStr, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("Invalid source header string: %s", headerStr)
+	}
+
+	prefix, err := url.Parse(strings.Trim(parts[0], " "))
+	if err != nil || len(prefix.Scheme) == 0 || len(prefix.Host) == 0 {
+		return fmt.Errorf("Invalid source header prefix: %s", headerStr)
+	}
+
+	header := strings.SplitN(parts[1], ":", 2)
+	if len(header) != 2 {
+		return fmt.Errorf("Invalid source header: %s", headerStr)
+	}
+
+	name := textproto.CanonicalMIMEHeaderKey(strings.Trim(header[0], " "))
+	if len(name) == 0 {
+		return fmt.Errorf("Empty source header name: %s", headerStr)
+	}
+
+	switch name {
+	case "Host", "Content-Length", "Transfer-Encoding", "Connection":
+		return fmt.Errorf("Source header %s can't be customized", name)
+	}
+
+	pathPrefix := prefix.Path
+	if len(pathPrefix) == 0 {
+		pathPrefix = "/"
+	}
+
+	*sh = append(*sh, sourceHeader{
+		Scheme:     strings.ToLower(prefix.Scheme),
+		Host:       strings.ToLower(prefix.Host),
+		PathPrefix: pathPrefix,
+		Name:       name,
+		Value:      strings.Trim(header[1], " "),
+	})
+
+	return nil
+}
+
+// Match checks if the URL matches the prefix. Scheme and host are compared
+// as is so the headers can't be sent to a host that just starts with the same
+// name. Path is cleaned so dot segments can't escape the prefix
+func (h sourceHeader) Match(u *url.URL) bool {
+	if strings.ToLower(u.Scheme) != h.Scheme || strings.ToLower(u.Host) != h.Host {
+		return false
+	}
+
+	p := path.Clean("/" + u.Path)
+	if strings.HasSuffix(u.Path, "/") && p != "/" {
+		p += "/"
+	}
+
+	return strings.HasPrefix(p, h.PathPrefix)
+}
+
+// sourceHeadersTransport adds the configured source headers to the requests.
+// Headers are added on every hop, so they don't leak to redirect targets
+// that don't match the prefix
+type sourceHeadersTransport struct {
+	http.RoundTripper
+
+	headers []sourceHeader
+}
+
+func newSourceHeadersTransport(rt http.RoundTripper, headers []sourceHeader) http.RoundTripper {
+	if len(headers) == 0 {
+		return rt
+	}
+
+	return sourceHeadersTransport{RoundTripper: rt, headers: headers}
+}
+
+func (t sourceHeadersTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cloned := false
+
+	for _, h := range t.headers {
+		if !h.Match(req.URL) {
+			continue
+		}
+
+		// RoundTripper should not modify the request
+		if !cloned {
+			req = req.Clone(req.Context())
+			cloned = true
+		}
+
+		// Source headers override the forwarded ones
+		req.Header.Set(h.Name, h.Value)
+	}
+
+	return t.RoundTripper.RoundTrip(req)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type SourceHeadersTestSuite struct{ MainTestSuite }
+
+func (s *SourceHeadersTestSuite) TestParseSourceHeader() {
+	var sh []sourceHeader
+
+	err := parseSourceHeader(&sh, "https://API.example.com/images/=authorization: Basic dXNlcjpwYXNz==")
+
+	require.Nil(s.T(), err)
+
+	assert.Equal(s.T(), []sourceHeader{{
+		Scheme:     "https",
+		Host:       "api.example.com",
+		PathPrefix: "/images/",
+		Name:       "Authorization",
+		Value:      "Basic dXNlcjpwYXNz==",
+	}}, sh)
+}
+
+func (s *SourceHeadersTestSuite) TestParseSourceHeaderInvalid() {
+	for _, str := range []string{
+		"Authorization:Basic dXNlcjpwYXNz",
+		"api.example.com=Authorization:Basic dXNlcjpwYXNz",
+		"https://api.example.com=Authorization",
+		"https://api.example.com=:Basic dXNlcjpwYXNz",
+		"https://api.example.com=Host:evil.com",
+	} {
+		var sh []sourceHeader
+
+		assert.Error(s.T(), parseSourceHeader(&sh, str), str)
+		assert.Empty(s.T(), sh, str)
+	}
+}
+
+func (s *SourceHeadersTestSuite) TestSourceHeaderMatch() {
+	var sh []sourceHeader
+
+	require.Nil(s.T(), parseSourceHeader(&sh, "https://api.example.com/images/=X-Api-Key:secret"))
+
+	matches := map[string]bool{
+		"https://api.example.com/images/test.png":           true,
+		"HTTPS://API.EXAMPLE.COM/images/test.png":           true,
+		"https://api.example.com/images/../private/key.png": false,
+		"https://api.example.com/private/test.png":          false,
+		"http://api.example.com/images/test.png":            false,
+		"https://api.example.com.evil.com/images/test.png":  false,
+		"https://api.example.com@evil.com/images/test.png":  false,
+		"https://api.example.com:8443/images/test.png":      false,
+	}
+
+	for u, expected := range matches {
+		parsed, err := url.Parse(u)
+		require.Nil(s.T(), err)
+
+		assert.Equal(s.T(), expected, sh[0].Match(parsed), u)
+	}
+}
+
+func (s *SourceHeadersTestSuite) TestSourceHeadersNotSentToRedirectTarget() {
+	var targetHeader string
+
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		targetHeader = r.Header.Get("X-Api-Key")
+		rw.WriteHeader(200)
+	}))
+	defer target.Close()
+
+	var sourceValue string
+
+	source := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		sourceValue = r.Header.Get("X-Api-Key")
+		http.Redirect(rw, r, target.URL+"/test.png", http.StatusFound)
+	}))
+	defer source.Close()
+
+	var sh []sourceHeader
+	require.Nil(s.T(), parseSourceHeader(&sh, source.URL+"/=X-Api-Key:secret"))
+
+	client := http.Client{Transport: newSourceHeadersTransport(http.DefaultTransport, sh)}
+
+	req, _ := http.NewRequest("GET", source.URL+"/test.png", nil)
+	req.Header.Set("X-Api-Key", "forwarded")
+
+	res, err := client.Do(req)
+	require.Nil(s.T(), err)
+	res.Body.Close()
+
+	assert.Equal(s.T(), "secret", sourceValue)
+	assert.Equal(s.T(), "forwarded", targetHeader)
+	assert.Equal(s.T(), "forwarded", req.Header.Get("X-Api-Key"))
+}
+
+func TestSourceHeaders(t *testing.T) {
+	suite.Run(t, new(SourceHeadersTestSuite))
+}
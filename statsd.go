@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	statsdEnabled = false
+
+	statsdConn net.Conn
+)
+
+func initStatsd() error {
+	if len(conf.StatsdAddr) == 0 {
+		return nil
+	}
+
+	conn, err := net.Dial("udp", conf.StatsdAddr)
+	if err != nil {
+		return fmt.Errorf("Can't connect to StatsD: %s", err)
+	}
+
+	statsdConn = conn
+	statsdEnabled = true
+
+	return nil
+}
+
+// statsdSend sends a single metric using the DogStatsD format.
+// Metrics are sent over UDP, so errors are ignored
+func statsdSend(name, value, metricType string, tags []string) {
+	var b strings.Builder
+
+	if len(conf.StatsdPrefix) > 0 {
+		b.WriteString(conf.StatsdPrefix)
+		b.WriteByte('.')
+	}
+
+	b.WriteString(name)
+	b.WriteByte(':')
+	b.WriteString(value)
+	b.WriteByte('|')
+	b.WriteString(metricType)
+
+	if len(tags) > 0 {
+		b.WriteString("|#")
+		b.WriteString(strings.Join(tags, ","))
+	}
+
+	statsdConn.Write([]byte(b.String()))
+}
+
+func statsdCount(name string, value int, tags ...string) {
+	statsdSend(name, strconv.Itoa(value), "c", tags)
+}
+
+func statsdGauge(name string, value int, tags ...string) {
+	statsdSend(name, strconv.Itoa(value), "g", tags)
+}
+
+// statsdGaugeDelta changes the gauge value by the delta instead of setting it
+func statsdGaugeDelta(name string, delta int, tags ...string) {
+	value := strconv.Itoa(delta)
+	if delta >= 0 {
+		value = "+" + value
+	}
+
+	statsdSend(name, value, "g", tags)
+}
+
+func statsdHistogram(name string, value int, tags ...string) {
+	statsdSend(name, strconv.Itoa(value), "h", tags)
+}
+
+func statsdTiming(name string, d time.Duration, tags ...string) {
+	statsdSend(name, strconv.FormatFloat(d.Seconds()*1000, 'f', 3, 64), "ms", tags)
+}
+
+func statsdTag(name, value string) string {
+	return name + ":" + value
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const storageCheckLimit = 10
+
+// storageLister is implemented by storage transports that can list objects
+type storageLister interface {
+	List(ctx context.Context, bucket, prefix string, limit int) ([]string, error)
+}
+
+var (
+	storageListers = make(map[string]storageLister)
+
+	errInvalidAdminSecret = newError(403, "Invalid admin secret", "Forbidden").SetCategory("invalid_secret")
+)
+
+func registerStorageLister(scheme string, t http.RoundTripper) {
+	if l, ok := t.(storageLister); ok {
+		storageListers[scheme] = l
+	}
+}
+
+func withAdminSecret(h routeHandler) routeHandler {
+	authHeader := []byte(fmt.Sprintf("Bearer %s", conf.AdminSecret))
+
+	return func(reqID string, rw http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), authHeader) == 1 {
+			h(reqID, rw, r)
+		} else {
+			panic(errInvalidAdminSecret)
+		}
+	}
+}
+
+func handleStorageCheck(reqID string, rw http.ResponseWriter, r *http.Request) {
+	u, err := url.Parse(conf.StorageCheckPrefix)
+	if err != nil {
+		panic(newError(500, fmt.Sprintf("Invalid storage check prefix: %s", err), "Storage check failed").SetCategory("storage_check"))
+	}
+
+	lister, ok := storageListers[u.Scheme]
+	if !ok {
+		panic(newError(500, fmt.Sprintf("Storage %s doesn't support listing", u.Scheme), "Storage check failed").SetCategory("storage_check"))
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(conf.DownloadTimeout)*time.Second)
+	defer cancel()
+
+	keys, err := lister.List(ctx, u.Host, strings.TrimPrefix(u.Path, "/"), storageCheckLimit)
+	if err != nil {
+		panic(newError(502, fmt.Sprintf("Can't list %s: %s", conf.StorageCheckPrefix, err), "Storage check failed").SetCategory("storage_check"))
+	}
+
+	rw.Header().Set("Content-Type", "text/plain")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(200)
+
+	for _, k := range keys {
+		fmt.Fprintln(rw, k)
+	}
+
+	logResponse(reqID, r, 200, nil, nil, nil)
+}
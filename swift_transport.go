@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const swiftTokenRefreshLead = 5 * time.Minute
+
+// swiftTransport implements RoundTripper for the 'swift' protocol.
+// It authenticates via Keystone v3 and caches the token until it expires
+// or Swift rejects it
+type swiftTransport struct {
+	client *http.Client
+
+	mu         sync.Mutex
+	token      string
+	storageURL string
+	expiresAt  time.Time
+}
+
+type swiftAuthResponse struct {
+	Token struct {
+		ExpiresAt time.Time `json:"expires_at"`
+		Catalog   []struct {
+			Type      string `json:"type"`
+			Endpoints []struct {
+				Interface string `json:"interface"`
+				Region    string `json:"region"`
+				URL       string `json:"url"`
+			} `json:"endpoints"`
+		} `json:"catalog"`
+	} `json:"token"`
+}
+
+func newSwiftTransport() (http.RoundTripper, error) {
+	// Swift is configured explicitly, so it's trusted
+	// and can be accessed in private networks
+	t := &swiftTransport{
+		client: &http.Client{
+			Transport: newHTTPTransport(&net.Dialer{}),
+		},
+	}
+
+	// Authenticate right away so misconfiguration is reported on startup
+	if _, _, err := t.auth(context.Background(), false); err != nil {
+		return nil, fmt.Errorf("Can't authenticate in Swift: %s", err)
+	}
+
+	return t, nil
+}
+
+// auth returns the cached token and storage URL. When force is true or
+// the token is about to expire, it requests a new token from Keystone
+func (t *swiftTransport) auth(ctx context.Context, force bool) (string, string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !force && len(t.token) > 0 && time.Until(t.expiresAt) > swiftTokenRefreshLead {
+		return t.token, t.storageURL, nil
+	}
+
+	token, storageURL, expiresAt, err := requestSwiftToken(ctx, t.client)
+	if err != nil {
+		return "", "", err
+	}
+
+	t.token, t.storageURL, t.expiresAt = token, storageURL, expiresAt
+
+	return token, storageURL, nil
+}
+
+func requestSwiftToken(ctx context.Context, client *http.Client) (string, string, time.Time, error) {
+	domain := map[string]string{"name": conf.SwiftDomain}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"auth": map[string]interface{}{
+			"identity": map[string]interface{}{
+				"methods": []string{"password"},
+				"password": map[string]interface{}{
+					"user": map[string]interface{}{
+						"name":     conf.SwiftUsername,
+						"password": conf.SwiftPassword,
+						"domain":   domain,
+					},
+				},
+			},
+			"scope": map[string]interface{}{
+				"project": map[string]interface{}{
+					"name":   conf.SwiftTenant,
+					"domain": domain,
+				},
+			},
+		},
+	})
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	authURL := strings.TrimSuffix(conf.SwiftAuthURL, "/") + "/auth/tokens"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, authURL, bytes.NewReader(body))
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		return "", "", time.Time{}, fmt.Errorf("Status: %s", res.Status)
+	}
+
+	var authRes swiftAuthResponse
+
+	if err = json.NewDecoder(res.Body).Decode(&authRes); err != nil {
+		return "", "", time.Time{}, err
+	}
+
+	for _, service := range authRes.Token.Catalog {
+		if service.Type != "object-store" {
+			continue
+		}
+
+		for _, endpoint := range service.Endpoints {
+			if endpoint.Interface != "public" {
+				continue
+			}
+
+			if len(conf.SwiftRegion) > 0 && endpoint.Region != conf.SwiftRegion {
+				continue
+			}
+
+			return res.Header.Get("X-Subject-Token"), endpoint.URL, authRes.Token.ExpiresAt, nil
+		}
+	}
+
+	return "", "", time.Time{}, fmt.Errorf("Object storage endpoint not found in the service catalog")
+}
+
+func (t *swiftTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, storageURL, err := t.auth(req.Context(), false)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := t.get(req, token, storageURL)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+
+	// The token was revoked or has expired earlier than expected,
+	// so we request a new one and try again
+	res.Body.Close()
+
+	if token, storageURL, err = t.auth(req.Context(), true); err != nil {
+		return nil, err
+	}
+
+	return t.get(req, token, storageURL)
+}
+
+func (t *swiftTransport) get(req *http.Request, token, storageURL string) (*http.Response, error) {
+	objectURL := strings.TrimSuffix(storageURL, "/") + "/" + req.URL.Host + req.URL.EscapedPath()
+
+	swiftReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, objectURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	swiftReq.Header.Set("X-Auth-Token", token)
+
+	return t.client.Do(swiftReq)
+}
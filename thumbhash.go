@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"math"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+const (
+	thumbhashPathPrefix = "/thumbhash"
+
+	// thumbhashImageSize is the maximum image size ThumbHash is designed for
+	thumbhashImageSize = 100
+)
+
+// jsRound rounds half up like JavaScript's Math.round does,
+// so the result matches the reference ThumbHash implementation
+func jsRound(v float64) int {
+	return int(math.Floor(v + 0.5))
+}
+
+// thumbhashEncodeChannel calculates the DCT of the channel.
+// It returns the DC component, the AC components normalized to [0, 1], and their scale
+func thumbhashEncodeChannel(channel []float64, width, height, nx, ny int) (float64, []float64, float64) {
+	var (
+		dc, scale float64
+		ac        []float64
+	)
+
+	fx := make([]float64, width)
+
+	for cy := 0; cy < ny; cy++ {
+		for cx := 0; cx*ny < nx*(ny-cy); cx++ {
+			for x := 0; x < width; x++ {
+				fx[x] = math.Cos(math.Pi / float64(width) * float64(cx) * (float64(x) + 0.5))
+			}
+
+			f := 0.0
+
+			for y := 0; y < height; y++ {
+				fy := math.Cos(math.Pi / float64(height) * float64(cy) * (float64(y) + 0.5))
+
+				for x := 0; x < width; x++ {
+					f += channel[x+y*width] * fx[x] * fy
+				}
+			}
+
+			f /= float64(width * height)
+
+			if cx > 0 || cy > 0 {
+				ac = append(ac, f)
+				scale = math.Max(scale, math.Abs(f))
+			} else {
+				dc = f
+			}
+		}
+	}
+
+	if scale > 0 {
+		for i := range ac {
+			ac[i] = 0.5 + 0.5/scale*ac[i]
+		}
+	}
+
+	return dc, ac, scale
+}
+
+// encodeThumbhash encodes the 8-bit RGB pixels to a ThumbHash.
+// The pixels are opaque, so the hash never contains the alpha channel
+func encodeThumbhash(pixels []byte, width, height int) []byte {
+	n := width * height
+
+	l := make([]float64, n)
+	p := make([]float64, n)
+	q := make([]float64, n)
+
+	for i := 0; i < n; i++ {
+		r := float64(pixels[i*3]) / 255
+		g := float64(pixels[i*3+1]) / 255
+		b := float64(pixels[i*3+2]) / 255
+
+		l[i] = (r + g + b) / 3
+		p[i] = (r+g)/2 - b
+		q[i] = r - g
+	}
+
+	const lLimit = 7
+
+	maxSide := float64(maxInt(width, height))
+	lx := maxInt(1, jsRound(lLimit*float64(width)/maxSide))
+	ly := maxInt(1, jsRound(lLimit*float64(height)/maxSide))
+
+	lDC, lAC, lScale := thumbhashEncodeChannel(l, width, height, maxInt(3, lx), maxInt(3, ly))
+	pDC, pAC, pScale := thumbhashEncodeChannel(p, width, height, 3, 3)
+	qDC, qAC, qScale := thumbhashEncodeChannel(q, width, height, 3, 3)
+
+	isLandscape := 0
+	sideL := lx
+	if width > height {
+		isLandscape = 1
+		sideL = ly
+	}
+
+	header24 := jsRound(63*lDC) |
+		jsRound(31.5+31.5*pDC)<<6 |
+		jsRound(31.5+31.5*qDC)<<12 |
+		jsRound(31*lScale)<<18
+	header16 := sideL |
+		jsRound(63*pScale)<<3 |
+		jsRound(63*qScale)<<9 |
+		isLandscape<<15
+
+	acCount := len(lAC) + len(pAC) + len(qAC)
+
+	hash := make([]byte, 5, 5+(acCount+1)/2)
+	hash[0] = byte(header24)
+	hash[1] = byte(header24 >> 8)
+	hash[2] = byte(header24 >> 16)
+	hash[3] = byte(header16)
+	hash[4] = byte(header16 >> 8)
+
+	acIndex := 0
+
+	for _, ac := range [][]float64{lAC, pAC, qAC} {
+		for _, f := range ac {
+			if acIndex&1 == 0 {
+				hash = append(hash, 0)
+			}
+
+			hash[len(hash)-1] |= byte(jsRound(15*f) << ((acIndex & 1) << 2))
+			acIndex++
+		}
+	}
+
+	return hash
+}
+
+func calcThumbhash(imgdata *imageData) ([]byte, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	defer vipsCleanup()
+
+	img := new(vipsImage)
+	defer img.Clear()
+
+	if err := loadThumbnail(img, imgdata, thumbhashImageSize); err != nil {
+		return nil, err
+	}
+
+	pixels, err := img.SRGBPixels()
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeThumbhash(pixels, img.Width(), img.Height()), nil
+}
+
+func handleThumbhash(reqID string, rw http.ResponseWriter, r *http.Request) {
+	ctx, timeoutCancel := context.WithTimeout(r.Context(), time.Duration(conf.WriteTimeout)*time.Second)
+	defer timeoutCancel()
+
+	ctx, err := parseSourcePath(ctx, r, thumbhashPathPrefix)
+	if err != nil {
+		panic(err)
+	}
+
+	ctx, downloadcancel, err := downloadImage(ctx, r.Header)
+	defer downloadcancel()
+	if err != nil {
+		incrementErrorsTotal("download")
+		panic(err)
+	}
+
+	checkTimeout(ctx)
+
+	// Encoding decodes the image, so it shares the limit with processing
+	defer acquireProcessingSem(ctx)()
+
+	hash, err := calcThumbhash(getImageData(ctx))
+	if err != nil {
+		incrementErrorsTotal("processing")
+		panic(newError(422, err.Error(), "Invalid source image").SetCategory("invalid_source_image"))
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(hash)
+
+	rw.Header().Set("Content-Type", "text/plain")
+	rw.Header().Set("Content-Length", strconv.Itoa(len(encoded)))
+	rw.WriteHeader(200)
+	rw.Write([]byte(encoded))
+
+	imageURL := getImageURL(ctx)
+	logResponse(reqID, r, 200, nil, &imageURL, nil)
+}
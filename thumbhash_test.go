@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type ThumbhashTestSuite struct{ MainTestSuite }
+
+func (s *ThumbhashTestSuite) TestEncodeSolidWhite() {
+	pixels := bytes.Repeat([]byte{255, 255, 255}, 8*8)
+
+	hash := encodeThumbhash(pixels, 8, 8)
+
+	// Header with white DC and 7x7 luminance components,
+	// followed by 37 AC components packed in 4 bits each
+	assert.Equal(s.T(), []byte{0x3f, 0x08, 0x02, 0x07, 0x00}, hash[:5])
+	assert.Len(s.T(), hash, 5+19)
+}
+
+func (s *ThumbhashTestSuite) TestEncodeLandscape() {
+	pixels := make([]byte, 16*8*3)
+	for i := range pixels {
+		pixels[i] = byte(i)
+	}
+
+	hash := encodeThumbhash(pixels, 16, 8)
+
+	// The landscape flag is the highest bit of the header
+	assert.Equal(s.T(), byte(0x80), hash[4]&0x80)
+	// The header keeps the number of luminance components of the shorter side
+	assert.Equal(s.T(), byte(4), hash[3]&0x07)
+}
+
+func TestThumbhash(t *testing.T) {
+	suite.Run(t, new(ThumbhashTestSuite))
+}
@@ -1,12 +1,61 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"time"
 )
 
-var timerSinceCtxKey = ctxKey("timerSince")
+var (
+	timerSinceCtxKey        = ctxKey("timerSince")
+	bytesWrittenCtxKey      = ctxKey("bytesWritten")
+	processingTimeoutCtxKey = ctxKey("processingTimeout")
+)
+
+// countingResponseWriter counts the bytes of the response body
+type countingResponseWriter struct {
+	http.ResponseWriter
+	written *int64
+}
+
+func (rw countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := rw.ResponseWriter.Write(p)
+	*rw.written += int64(n)
+	return n, err
+}
+
+// Flush sends the buffered data to the client if the wrapped writer supports it
+func (rw countingResponseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets the handler take over the connection if the wrapped writer supports it
+func (rw countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := rw.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("Response writer doesn't support hijacking")
+}
+
+// withBytesWritten wraps the response writer so the number of written bytes
+// is available from the context
+func withBytesWritten(ctx context.Context, rw http.ResponseWriter) (context.Context, http.ResponseWriter) {
+	written := new(int64)
+	return context.WithValue(ctx, bytesWrittenCtxKey, written), countingResponseWriter{rw, written}
+}
+
+func getBytesWritten(ctx context.Context) int64 {
+	if written, ok := ctx.Value(bytesWrittenCtxKey).(*int64); ok {
+		return *written
+	}
+	return 0
+}
 
 func setTimerSince(ctx context.Context) context.Context {
 	return context.WithValue(ctx, timerSinceCtxKey, time.Now())
@@ -16,24 +65,45 @@ func getTimerSince(ctx context.Context) time.Duration {
 	return time.Since(ctx.Value(timerSinceCtxKey).(time.Time))
 }
 
+// withProcessingTimeout limits the processing time with IMGPROXY_PROCESSING_TIMEOUT.
+// The mark is set only when the processing deadline is earlier than the request one,
+// so checkTimeout can tell which of them is exceeded
+func withProcessingTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if conf.ProcessingTimeout <= 0 {
+		return ctx, func() {}
+	}
+
+	timeout := time.Duration(conf.ProcessingTimeout) * time.Second
+
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= timeout {
+		return ctx, func() {}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+
+	return context.WithValue(ctx, processingTimeoutCtxKey, true), cancel
+}
+
 func checkTimeout(ctx context.Context) {
 	select {
 	case <-ctx.Done():
 		d := getTimerSince(ctx)
 
 		if ctx.Err() != context.DeadlineExceeded {
-			panic(newError(499, fmt.Sprintf("Request was cancelled after %v", d), "Cancelled"))
+			panic(newError(499, fmt.Sprintf("Request was cancelled after %v", d), "Cancelled").SetCategory("cancelled"))
 		}
 
 		if newRelicEnabled {
 			sendTimeoutToNewRelic(ctx, d)
 		}
 
-		if prometheusEnabled {
-			incrementPrometheusErrorsTotal("timeout")
+		incrementErrorsTotal("timeout")
+
+		if processingTimeout, _ := ctx.Value(processingTimeoutCtxKey).(bool); processingTimeout {
+			panic(newError(504, fmt.Sprintf("Processing timeout after %v", d), "Timeout").SetCategory("processing_timeout"))
 		}
 
-		panic(newError(503, fmt.Sprintf("Timeout after %v", d), "Timeout"))
+		panic(newError(503, fmt.Sprintf("Timeout after %v", d), "Timeout").SetCategory("timeout"))
 	default:
 		// Go ahead
 	}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type TimerTestSuite struct{ MainTestSuite }
+
+// panicError returns the error f panics with
+func panicError(f func()) (ierr *imgproxyError) {
+	defer func() {
+		if r := recover(); r != nil {
+			ierr = r.(*imgproxyError)
+		}
+	}()
+
+	f()
+
+	return nil
+}
+
+func checkTimeoutError(ctx context.Context) *imgproxyError {
+	return panicError(func() { checkTimeout(ctx) })
+}
+
+func (s *TimerTestSuite) TestProcessingTimeoutDisabled() {
+	conf.ProcessingTimeout = 0
+
+	ctx, cancel := withProcessingTimeout(setTimerSince(context.Background()))
+	defer cancel()
+
+	_, ok := ctx.Deadline()
+	assert.False(s.T(), ok)
+}
+
+func (s *TimerTestSuite) TestProcessingTimeoutLaterThanRequestTimeout() {
+	conf.ProcessingTimeout = 10
+
+	reqCtx, reqCancel := context.WithTimeout(setTimerSince(context.Background()), time.Second)
+	defer reqCancel()
+
+	ctx, cancel := withProcessingTimeout(reqCtx)
+	defer cancel()
+
+	reqDeadline, _ := reqCtx.Deadline()
+	deadline, _ := ctx.Deadline()
+	assert.Equal(s.T(), reqDeadline, deadline)
+
+	// The request timeout is exceeded first, so it's reported as a request timeout
+	<-ctx.Done()
+
+	ierr := checkTimeoutError(ctx)
+	require.NotNil(s.T(), ierr)
+	assert.Equal(s.T(), 503, ierr.StatusCode)
+	assert.Equal(s.T(), "timeout", ierr.Category())
+}
+
+func (s *TimerTestSuite) TestProcessingTimeout() {
+	conf.ProcessingTimeout = 1
+
+	reqCtx, reqCancel := context.WithTimeout(setTimerSince(context.Background()), 10*time.Second)
+	defer reqCancel()
+
+	ctx, cancel := withProcessingTimeout(reqCtx)
+	defer cancel()
+
+	deadline, ok := ctx.Deadline()
+	require.True(s.T(), ok)
+	assert.WithinDuration(s.T(), time.Now().Add(time.Second), deadline, 100*time.Millisecond)
+
+	assert.Nil(s.T(), checkTimeoutError(ctx))
+
+	<-ctx.Done()
+
+	ierr := checkTimeoutError(ctx)
+	require.NotNil(s.T(), ierr)
+	assert.Equal(s.T(), 504, ierr.StatusCode)
+	assert.Equal(s.T(), "processing_timeout", ierr.Category())
+
+	// The request itself is not timed out yet
+	assert.Nil(s.T(), reqCtx.Err())
+}
+
+func (s *TimerTestSuite) TestBytesWrittenFlush() {
+	rec := httptest.NewRecorder()
+	ctx, rw := withBytesWritten(context.Background(), rec)
+
+	flusher, ok := rw.(http.Flusher)
+	require.True(s.T(), ok)
+
+	rw.Write([]byte("test"))
+	flusher.Flush()
+
+	assert.True(s.T(), rec.Flushed)
+	assert.Equal(s.T(), int64(4), getBytesWritten(ctx))
+}
+
+func (s *TimerTestSuite) TestBytesWrittenHijack() {
+	hijacked := make(chan bool, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, rw := withBytesWritten(r.Context(), w)
+
+		conn, _, err := rw.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+
+		hijacked <- err == nil
+	}))
+	defer srv.Close()
+
+	srv.Client().Get(srv.URL)
+
+	assert.True(s.T(), <-hijacked)
+}
+
+func (s *TimerTestSuite) TestBytesWrittenHijackNotSupported() {
+	_, rw := withBytesWritten(context.Background(), httptest.NewRecorder())
+
+	_, _, err := rw.(http.Hijacker).Hijack()
+	assert.NotNil(s.T(), err)
+}
+
+func TestTimer(t *testing.T) {
+	suite.Run(t, new(TimerTestSuite))
+}
@@ -51,6 +51,14 @@ func trimAfter(s string, sep byte) string {
 	return s[:i]
 }
 
+func trimBefore(s string, sep byte) string {
+	i := strings.IndexByte(s, sep)
+	if i < 0 {
+		return ""
+	}
+	return s[i+1:]
+}
+
 func ptrToBytes(ptr unsafe.Pointer, size int) []byte {
 	return (*[math.MaxInt32]byte)(ptr)[:int(size):int(size)]
 }
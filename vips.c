@@ -13,6 +13,9 @@
 #define VIPS_SUPPORT_SVG \
   (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 3))
 
+#define VIPS_SUPPORT_PDF \
+  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 3))
+
 #define VIPS_SUPPORT_TIFF \
   (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 6))
 
@@ -28,6 +31,12 @@
 #define VIPS_SUPPORT_WEBP_ANIMATION \
   (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 8))
 
+#define VIPS_SUPPORT_JPEG_SUBSAMPLE_MODE \
+  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 13))
+
+#define VIPS_SUPPORT_WEBP_EFFORT \
+  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 8))
+
 #define VIPS_SUPPORT_ARRAY_HEADERS \
   (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 9))
 
@@ -51,6 +60,24 @@
 #define VIPS_SUPPORT_PNG_BITDEPTH \
   (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 10))
 
+#define VIPS_SUPPORT_TEXT_RGBA \
+  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 9))
+
+#define VIPS_SUPPORT_TEXT_AUTOFIT \
+  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 8))
+
+// vips_text renders the text with 72 DPI by default
+#define VIPS_TEXT_DEFAULT_DPI 72
+
+#define VIPS_SUPPORT_GIFSAVE \
+  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 12))
+
+#define VIPS_SUPPORT_TARGET \
+  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 9))
+
+#define VIPS_SUPPORT_MAPIM \
+  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 7))
+
 #define EXIF_ORIENTATION "exif-ifd0-Orientation"
 
 #if (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 8))
@@ -102,6 +129,10 @@ vips_type_find_load_go(int imgtype) {
     return vips_type_find("VipsOperation", "magickload_buffer");
   case (TIFF):
     return vips_type_find("VipsOperation", "tiffload_buffer");
+  case (RAW):
+    return vips_type_find("VipsOperation", "magickload_buffer");
+  case (PDF):
+    return vips_type_find("VipsOperation", "pdfload_buffer");
   }
   return 0;
 }
@@ -117,7 +148,11 @@ vips_type_find_save_go(int imgtype) {
   case (WEBP):
     return vips_type_find("VipsOperation", "webpsave_buffer");
   case (GIF):
+#if VIPS_SUPPORT_GIFSAVE
+    return vips_type_find("VipsOperation", "gifsave_buffer");
+#else
     return vips_type_find("VipsOperation", "magicksave_buffer");
+#endif
 #if VIPS_SUPPORT_AVIF
   case (AVIF):
     return vips_type_find("VipsOperation", "heifsave_buffer");
@@ -227,6 +262,26 @@ vips_tiffload_go(void *buf, size_t len, VipsImage **out) {
 #endif
 }
 
+int
+vips_rawload_go(void *buf, size_t len, VipsImage **out) {
+#if VIPS_SUPPORT_MAGICK
+  return vips_magickload_buffer(buf, len, out, NULL);
+#else
+  vips_error("vips_rawload_go", "Loading RAW is not supported");
+  return 1;
+#endif
+}
+
+int
+vips_pdfload_go(void *buf, size_t len, int page, double dpi, VipsImage **out) {
+#if VIPS_SUPPORT_PDF
+  return vips_pdfload_buffer(buf, len, out, "page", page, "dpi", dpi, "access", VIPS_ACCESS_SEQUENTIAL, NULL);
+#else
+  vips_error("vips_pdfload_go", "Loading PDF is not supported (libvips 8.3+ reuired)");
+  return 1;
+#endif
+}
+
 int
 vips_get_orientation(VipsImage *image) {
 #ifdef VIPS_META_ORIENTATION
@@ -253,6 +308,16 @@ vips_support_smartcrop() {
   return VIPS_SUPPORT_SMARTCROP;
 }
 
+int
+vips_support_png_quantization() {
+  return VIPS_SUPPORT_PNG_QUANTIZATION;
+}
+
+int
+vips_support_target() {
+  return VIPS_SUPPORT_TARGET;
+}
+
 VipsBandFormat
 vips_band_format(VipsImage *in) {
   return in->BandFmt;
@@ -319,12 +384,12 @@ vips_rad2float_go(VipsImage *in, VipsImage **out) {
 }
 
 int
-vips_resize_go(VipsImage *in, VipsImage **out, double scale) {
-  return vips_resize(in, out, scale, NULL);
+vips_resize_go(VipsImage *in, VipsImage **out, double scale, VipsKernel kernel) {
+  return vips_resize(in, out, scale, "kernel", kernel, NULL);
 }
 
 int
-vips_resize_with_premultiply(VipsImage *in, VipsImage **out, double scale) {
+vips_resize_with_premultiply(VipsImage *in, VipsImage **out, double scale, VipsKernel kernel) {
 	VipsBandFormat format;
   VipsImage *tmp1, *tmp2;
 
@@ -333,7 +398,7 @@ vips_resize_with_premultiply(VipsImage *in, VipsImage **out, double scale) {
   if (vips_premultiply(in, &tmp1, NULL))
     return 1;
 
-	if (vips_resize(tmp1, &tmp2, scale, NULL)) {
+	if (vips_resize(tmp1, &tmp2, scale, "kernel", kernel, NULL)) {
     clear_image(&tmp1);
 		return 1;
   }
@@ -397,18 +462,18 @@ vips_icc_import_go(VipsImage *in, VipsImage **out) {
 }
 
 int
-vips_icc_export_go(VipsImage *in, VipsImage **out) {
-  return vips_icc_export(in, out, NULL);
+vips_icc_export_go(VipsImage *in, VipsImage **out, int depth) {
+  return vips_icc_export(in, out, "depth", depth, NULL);
 }
 
 int
-vips_icc_export_srgb(VipsImage *in, VipsImage **out) {
-  return vips_icc_export(in, out, "output_profile", "sRGB", NULL);
+vips_icc_export_srgb(VipsImage *in, VipsImage **out, int depth) {
+  return vips_icc_export(in, out, "output_profile", "sRGB", "depth", depth, NULL);
 }
 
 int
-vips_icc_transform_go(VipsImage *in, VipsImage **out) {
-  return vips_icc_transform(in, out, "sRGB", "embedded", TRUE, "pcs", VIPS_PCS_XYZ, NULL);
+vips_icc_transform_go(VipsImage *in, VipsImage **out, int depth) {
+  return vips_icc_transform(in, out, "sRGB", "embedded", TRUE, "pcs", VIPS_PCS_XYZ, "depth", depth, NULL);
 }
 
 int
@@ -436,9 +501,13 @@ vips_flip_horizontal_go(VipsImage *in, VipsImage **out) {
 }
 
 int
-vips_smartcrop_go(VipsImage *in, VipsImage **out, int width, int height) {
+vips_smartcrop_go(VipsImage *in, VipsImage **out, int width, int height, int strategy) {
 #if VIPS_SUPPORT_SMARTCROP
-  return vips_smartcrop(in, out, width, height, NULL);
+  VipsInteresting interesting = VIPS_INTERESTING_ATTENTION;
+  if (strategy == SMARTCROP_ENTROPY)
+    interesting = VIPS_INTERESTING_ENTROPY;
+
+  return vips_smartcrop(in, out, width, height, "interesting", interesting, NULL);
 #else
   vips_error("vips_smartcrop_go", "Smart crop is not supported (libvips 8.5+ reuired)");
   return 1;
@@ -451,18 +520,441 @@ vips_gaussblur_go(VipsImage *in, VipsImage **out, double sigma) {
 }
 
 int
-vips_sharpen_go(VipsImage *in, VipsImage **out, double sigma) {
-  return vips_sharpen(in, out, "sigma", sigma, NULL);
+vips_boxblur_go(VipsImage *in, VipsImage **out, int radius) {
+  VipsImage *base = vips_image_new();
+  VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 2);
+
+  int size = radius * 2 + 1;
+
+  if (!(t[0] = vips_image_new_matrix(size, 1))) {
+    clear_image(&base);
+    return 1;
+  }
+
+  for (int i = 0; i < size; i++)
+    *VIPS_MATRIX(t[0], i, 0) = 1;
+
+  vips_image_set_double(t[0], "scale", size);
+
+  // Box mask is separable, so we convolve rows and columns separately
+  int res =
+    vips_convsep(in, &t[1], t[0], NULL) ||
+    vips_cast(t[1], out, vips_image_get_format(in), NULL);
+
+  clear_image(&base);
+
+  return res;
+}
+
+int
+vips_unsharp_go(VipsImage *in, VipsImage **out, double sigma, double amount, double threshold) {
+  return vips_sharpen(in, out, "sigma", sigma, "m2", amount, "x1", threshold, NULL);
+}
+
+int
+vips_pixelate(VipsImage *in, VipsImage **out, int pixels) {
+  VipsImage *base = vips_image_new();
+  VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 3);
+
+  int w = in->Xsize;
+  int h = in->Ysize;
+
+  // Extend the image to the size that is a multiple of the pixel size
+  // so the last row and column get pixelated too
+  int tw = (int)(VIPS_CEIL((double)w / pixels)) * pixels;
+  int th = (int)(VIPS_CEIL((double)h / pixels)) * pixels;
+
+  if (
+    vips_embed(in, &t[0], 0, 0, tw, th, "extend", VIPS_EXTEND_COPY, NULL) ||
+    vips_subsample(t[0], &t[1], pixels, pixels, NULL) ||
+    vips_zoom(t[1], &t[2], pixels, pixels, NULL) ||
+    vips_extract_area(t[2], out, 0, 0, w, h, NULL)
+  ) {
+    clear_image(&base);
+    return 1;
+  }
+
+  clear_image(&base);
+
+  return 0;
+}
+
+static double
+vips_image_max_value(VipsImage *in) {
+  switch (in->Type) {
+    case VIPS_INTERPRETATION_scRGB:
+      return 1.0;
+    case VIPS_INTERPRETATION_RGB16:
+    case VIPS_INTERPRETATION_GREY16:
+      return 65535.0;
+    default:
+      return 255.0;
+  }
+}
+
+int
+vips_normalize_go(VipsImage *in, VipsImage **out, double clip) {
+  VipsImage *base = vips_image_new();
+  VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 8);
+
+  VipsImage *color = in;
+  gboolean has_alpha = vips_image_hasalpha(in);
+  double max = vips_image_max_value(in);
+  int low, high;
+
+  if (has_alpha) {
+    if (
+      vips_extract_band(in, &t[0], 0, "n", in->Bands - 1, NULL) ||
+      vips_extract_band(in, &t[1], in->Bands - 1, "n", 1, NULL)
+    ) {
+      clear_image(&base);
+      return 1;
+    }
+
+    color = t[0];
+  }
+
+  // Histograms can be found only for integer images, so we scale the mean
+  // band to ushort. This works both for sRGB and linear images
+  if (
+    vips_bandmean(color, &t[2], NULL) ||
+    vips_linear1(t[2], &t[3], 65535.0 / max, 0, NULL) ||
+    vips_cast(t[3], &t[4], VIPS_FORMAT_USHORT, NULL) ||
+    vips_percent(t[4], clip, &low, NULL) ||
+    vips_percent(t[4], 100.0 - clip, &high, NULL)
+  ) {
+    clear_image(&base);
+    return 1;
+  }
+
+  // Nothing to stretch
+  if (high <= low) {
+    clear_image(&base);
+    return vips_copy(in, out, NULL);
+  }
+
+  double a = 65535.0 / (high - low);
+  double b = -low * max / (high - low);
+
+  if (
+    vips_linear1(color, &t[5], a, b, NULL) ||
+    vips_cast(t[5], &t[6], color->BandFmt, NULL)
+  ) {
+    clear_image(&base);
+    return 1;
+  }
+
+  int res;
+
+  if (has_alpha)
+    res = vips_bandjoin2(t[6], t[1], out, NULL);
+  else
+    res = vips_copy(t[6], out, NULL);
+
+  clear_image(&base);
+
+  return res;
+}
+
+int
+vips_gamma_go(VipsImage *in, VipsImage **out, double gamma) {
+  if (!vips_image_hasalpha(in))
+    return vips_gamma(in, out, "exponent", gamma, NULL);
+
+  VipsImage *base = vips_image_new();
+  VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 3);
+
+  // Alpha shouldn't be affected
+  if (
+    vips_extract_band(in, &t[0], 0, "n", in->Bands - 1, NULL) ||
+    vips_extract_band(in, &t[1], in->Bands - 1, "n", 1, NULL) ||
+    vips_gamma(t[0], &t[2], "exponent", gamma, NULL) ||
+    vips_bandjoin2(t[2], t[1], out, NULL)
+  ) {
+    clear_image(&base);
+    return 1;
+  }
+
+  clear_image(&base);
+
+  return 0;
+}
+
+int
+vips_stretch_go(VipsImage *in, VipsImage **out, int width, int height) {
+  double hscale = (double)width / in->Xsize;
+  double vscale = (double)height / in->Ysize;
+
+  if (!vips_image_hasalpha(in))
+    return vips_resize(in, out, hscale, "vscale", vscale, NULL);
+
+  VipsImage *base = vips_image_new();
+  VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 3);
+
+  if (
+    vips_premultiply(in, &t[0], NULL) ||
+    vips_resize(t[0], &t[1], hscale, "vscale", vscale, NULL) ||
+    vips_unpremultiply(t[1], &t[2], NULL) ||
+    vips_cast(t[2], out, vips_image_get_format(in), NULL)
+  ) {
+    clear_image(&base);
+    return 1;
+  }
+
+  clear_image(&base);
+
+  return 0;
+}
+
+// vips_clamp_go clamps the image values to [min, max].
+// vips_clamp is available only since libvips 8.13, so we use
+// clamp(x) = (|x - min| - |x - max| + min + max) / 2
+static int
+vips_clamp_go(VipsImage *in, VipsImage **out, double min, double max) {
+  VipsImage *base = vips_image_new();
+  VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 5);
+
+  if (
+    vips_linear1(in, &t[0], 1, -min, NULL) ||
+    vips_abs(t[0], &t[1], NULL) ||
+    vips_linear1(in, &t[2], 1, -max, NULL) ||
+    vips_abs(t[2], &t[3], NULL) ||
+    vips_subtract(t[1], t[3], &t[4], NULL) ||
+    vips_linear1(t[4], out, 0.5, (min + max) / 2, NULL)
+  ) {
+    clear_image(&base);
+    return 1;
+  }
+
+  clear_image(&base);
+
+  return 0;
+}
+
+int
+vips_lut3d_go(VipsImage *in, VipsImage **out, float *lut, int size, double *domain_min, double *domain_max) {
+#if VIPS_SUPPORT_MAPIM
+  if (in->Bands < 3)
+    return vips_copy(in, out, NULL);
+
+  VipsImage *base = vips_image_new();
+  VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 24);
+
+  gboolean has_alpha = vips_image_hasalpha(in);
+  double max = vips_image_max_value(in);
+  int last = size - 1;
+
+  // LUT nodes are ordered so red changes fastest, so we store the LUT
+  // as a 2D image where x is the red index and y is the green index
+  // plus the blue index multiplied by the size
+  t[0] = vips_image_new_from_memory_copy(
+    lut, (size_t) size * size * size * 3 * sizeof(float),
+    size, size * size, 3, VIPS_FORMAT_FLOAT
+  );
+  if (!t[0]) {
+    clear_image(&base);
+    return 1;
+  }
+
+  // Scale the pixel values from the LUT domain to the LUT indexes
+  double a[3], b[3];
+  for (int i = 0; i < 3; i++) {
+    double d = domain_max[i] - domain_min[i];
+    a[i] = last / (d * max);
+    b[i] = -domain_min[i] * last / d;
+  }
+
+  // Coordinates of the next blue slice
+  double slice_mul[2] = {1, 1};
+  double slice_add[2] = {0, size};
+
+  // Red and green are interpolated by mapim, and blue is interpolated
+  // between two adjacent blue slices
+  VipsInterpolate *interpolate = vips_interpolate_new("bilinear");
+
+  int res =
+    vips_extract_band(in, &t[1], 0, "n", 3, NULL) ||
+    vips_linear(t[1], &t[2], a, b, 3, NULL) ||
+    vips_clamp_go(t[2], &t[3], 0, last) ||
+    vips_extract_band(t[3], &t[4], 0, NULL) ||
+    vips_extract_band(t[3], &t[5], 1, NULL) ||
+    vips_extract_band(t[3], &t[6], 2, NULL) ||
+    vips_clamp_go(t[6], &t[7], 0, VIPS_MAX(last - 1, 0)) ||
+    vips_floor(t[7], &t[8], NULL) ||
+    vips_subtract(t[6], t[8], &t[9], NULL) ||
+    vips_linear1(t[8], &t[10], size, 0, NULL) ||
+    vips_add(t[5], t[10], &t[11], NULL) ||
+    vips_bandjoin2(t[4], t[11], &t[12], NULL) ||
+    vips_linear(t[12], &t[13], slice_mul, slice_add, 2, NULL) ||
+    vips_mapim(t[0], &t[14], t[12], "interpolate", interpolate, NULL) ||
+    vips_mapim(t[0], &t[15], t[13], "interpolate", interpolate, NULL) ||
+    vips_subtract(t[15], t[14], &t[16], NULL) ||
+    vips_multiply(t[16], t[9], &t[17], NULL) ||
+    vips_add(t[14], t[17], &t[18], NULL) ||
+    vips_clamp_go(t[18], &t[19], 0, 1) ||
+    vips_linear1(t[19], &t[20], max, 0, NULL);
+
+  g_object_unref(interpolate);
+
+  if (res) {
+    clear_image(&base);
+    return 1;
+  }
+
+  VipsImage *tmp = t[20];
+
+  if (!vips_band_format_isfloat(in->BandFmt)) {
+    if (vips_rint(tmp, &t[21], NULL)) {
+      clear_image(&base);
+      return 1;
+    }
+    tmp = t[21];
+  }
+
+  if (
+    vips_cast(tmp, &t[22], in->BandFmt, NULL) ||
+    vips_copy(t[22], &t[23], "interpretation", in->Type, NULL)
+  ) {
+    clear_image(&base);
+    return 1;
+  }
+
+  if (has_alpha) {
+    VipsImage *alpha;
+
+    if (vips_extract_band(in, &alpha, in->Bands - 1, "n", 1, NULL)) {
+      clear_image(&base);
+      return 1;
+    }
+
+    res = vips_bandjoin2(t[23], alpha, out, NULL);
+    clear_image(&alpha);
+  } else {
+    res = vips_copy(t[23], out, NULL);
+  }
+
+  clear_image(&base);
+
+  return res;
+#else
+  vips_error("vips_lut3d_go", "Color filters are not supported (libvips 8.7+ reuired)");
+  return 1;
+#endif
 }
 
 int
 vips_flatten_go(VipsImage *in, VipsImage **out, double r, double g, double b) {
-  VipsArrayDouble *bg = vips_array_double_newv(3, r, g, b);
-  int res = vips_flatten(in, out, "background", bg, NULL);
+  // Background color is defined in 8-bit space
+  double max = vips_image_max_value(in);
+  double scale = max / 255.0;
+
+  VipsArrayDouble *bg = vips_array_double_newv(3, r * scale, g * scale, b * scale);
+  int res = vips_flatten(in, out, "background", bg, "max_alpha", max, NULL);
   vips_area_unref((VipsArea *)bg);
   return res;
 }
 
+// vips_flatten_srgb flattens the image onto white and converts it to 8-bit sRGB
+static int
+vips_flatten_srgb(VipsImage *in, VipsImage **out) {
+  VipsImage *base = vips_image_new();
+  VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 2);
+
+  VipsImage *color = in;
+
+  if (vips_image_hasalpha(in)) {
+    if (vips_flatten_go(in, &t[0], 255.0, 255.0, 255.0)) {
+      clear_image(&base);
+      return 1;
+    }
+
+    color = t[0];
+  }
+
+  if (
+    vips_colourspace(color, &t[1], VIPS_INTERPRETATION_sRGB, NULL) ||
+    vips_cast(t[1], out, VIPS_FORMAT_UCHAR, NULL)
+  ) {
+    clear_image(&base);
+    return 1;
+  }
+
+  clear_image(&base);
+
+  return 0;
+}
+
+int
+vips_average_color_go(VipsImage *in, double *r, double *g, double *b) {
+  VipsImage *base = vips_image_new();
+  VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 2);
+
+  if (
+    vips_flatten_srgb(in, &t[0]) ||
+    vips_stats(t[0], &t[1], NULL)
+  ) {
+    clear_image(&base);
+    return 1;
+  }
+
+  // The first row of the stats contains all the bands,
+  // the next rows contain the bands one by one. The mean is in the 5th column
+  *r = *VIPS_MATRIX(t[1], 4, 1);
+  *g = *VIPS_MATRIX(t[1], 4, 2);
+  *b = *VIPS_MATRIX(t[1], 4, 3);
+
+  clear_image(&base);
+
+  return 0;
+}
+
+int
+vips_srgb_pixels_go(VipsImage *in, void **buf, size_t *len) {
+  VipsImage *tmp;
+
+  if (vips_flatten_srgb(in, &tmp))
+    return 1;
+
+  *buf = vips_image_write_to_memory(tmp, len);
+
+  clear_image(&tmp);
+
+  return *buf == NULL ? 1 : 0;
+}
+
+int
+vips_background_go(VipsImage *in, VipsImage **out, double r, double g, double b, double a) {
+#if VIPS_SUPPORT_COMPOSITE
+  VipsImage *base = vips_image_new();
+  VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 5);
+
+  // Background color is defined in 8-bit space
+  double max = vips_image_max_value(in);
+  double scale = max / 255.0;
+
+  double mul[4] = {0, 0, 0, 0};
+  double add[4] = {r * scale, g * scale, b * scale, a * max};
+
+  // Grayscale image has a single color band followed by alpha
+  if (in->Bands == 2)
+    add[1] = a * max;
+
+  int res =
+    vips_black(&t[0], in->Xsize, in->Ysize, "bands", in->Bands, NULL) ||
+    vips_linear(t[0], &t[1], mul, add, in->Bands, NULL) ||
+    vips_copy(t[1], &t[2], "interpretation", in->Type, NULL) ||
+    vips_composite2(t[2], in, &t[3], VIPS_BLEND_MODE_OVER, "compositing_space", in->Type, NULL) ||
+    vips_cast(t[3], out, vips_image_get_format(in), NULL);
+
+  clear_image(&base);
+
+  return res;
+#else
+  vips_error("vips_background_go", "Semi-transparent background is not supported (libvips 8.6+ reuired)");
+  return 1;
+#endif
+}
+
 int
 vips_extract_area_go(VipsImage *in, VipsImage **out, int left, int top, int width, int height) {
   return vips_extract_area(in, out, left, top, width, height, NULL);
@@ -563,6 +1055,12 @@ vips_replicate_go(VipsImage *in, VipsImage **out, int width, int height) {
 
 int
 vips_embed_go(VipsImage *in, VipsImage **out, int x, int y, int width, int height, double *bg, int bgn) {
+  // Background color is defined in 8-bit space
+  double scale = vips_image_max_value(in) / 255.0;
+
+  for (int i = 0; i < bgn; i++)
+    bg[i] *= scale;
+
   VipsArrayDouble *bga = vips_array_double_new(bg, bgn);
   int ret = vips_embed(
     in, out, x, y, width, height,
@@ -580,7 +1078,7 @@ vips_ensure_alpha(VipsImage *in, VipsImage **out) {
     return vips_copy(in, out, NULL);
   }
 
-  return vips_bandjoin_const1(in, out, 255, NULL);
+  return vips_bandjoin_const1(in, out, vips_image_max_value(in), NULL);
 }
 
 int
@@ -619,13 +1117,152 @@ vips_apply_watermark(VipsImage *in, VipsImage *watermark, VipsImage **out, doubl
 #endif
 }
 
+// vips_text_render_go renders the text wrapped to max_width. When the text
+// doesn't fit max_height, it's rendered with the DPI that fits it
+static int
+vips_text_render_go(VipsImage **out, const char *text, const char *font, int max_width, int max_height) {
+#if VIPS_SUPPORT_TEXT_AUTOFIT
+  // When the height is set, libvips looks for the largest DPI
+  // the text fits the box with. We don't want to enlarge the text,
+  // so we use the autofit result only when it's less than the default DPI
+  VipsImage *fit;
+  int dpi;
+
+  if (vips_text(
+    &fit, text,
+    "font", font,
+    "width", max_width,
+    "height", max_height,
+    "autofit_dpi", &dpi,
+#if VIPS_SUPPORT_TEXT_RGBA
+    "rgba", TRUE,
+#endif
+    NULL
+  ))
+    return 1;
+
+  if (dpi < VIPS_TEXT_DEFAULT_DPI) {
+    *out = fit;
+    return 0;
+  }
+
+  clear_image(&fit);
+#endif
+
+  return vips_text(
+    out, text,
+    "font", font,
+    "width", max_width,
+#if VIPS_SUPPORT_TEXT_RGBA
+    "rgba", TRUE,
+#endif
+    NULL
+  );
+}
+
+int
+vips_text_go(VipsImage **out, const char *text, const char *font, int max_width, int max_height) {
+#if VIPS_SUPPORT_TEXT_RGBA
+  return vips_text_render_go(out, text, font, max_width, max_height);
+#else
+  VipsImage *base = vips_image_new();
+  VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 4);
+
+  // Old versions of libvips render text as a single-band mask,
+  // so we use it as an alpha channel of a white image
+  if (
+    vips_text_render_go(&t[0], text, font, max_width, max_height) ||
+    vips_linear1(t[0], &t[1], 0, 255, NULL) ||
+    vips_cast(t[1], &t[2], VIPS_FORMAT_UCHAR, NULL)
+  ) {
+    clear_image(&base);
+    return 1;
+  }
+
+  VipsImage *bands[4] = {t[2], t[2], t[2], t[0]};
+
+  int res =
+    vips_bandjoin(bands, &t[3], 4, NULL) ||
+    vips_copy(t[3], out, "interpretation", VIPS_INTERPRETATION_sRGB, NULL);
+
+  clear_image(&base);
+
+  return res;
+#endif
+}
+
+int
+vips_round_corners(VipsImage *in, VipsImage **out, int rx, int ry) {
+#if VIPS_SUPPORT_SVG && VIPS_SUPPORT_COMPOSITE
+  VipsImage *base = vips_image_new();
+  VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 4);
+
+  int w = in->Xsize;
+  int h = in->Ysize;
+
+  gchar *svg = g_strdup_printf(
+    "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\">"
+    "<rect x=\"0\" y=\"0\" width=\"%d\" height=\"%d\" rx=\"%d\" ry=\"%d\" fill=\"#fff\"/>"
+    "</svg>",
+    w, h, w, h, rx, ry
+  );
+
+  if (vips_svgload_buffer(svg, strlen(svg), &t[0], NULL)) {
+    g_free(svg);
+    clear_image(&base);
+    return 1;
+  }
+
+  // SVG loader reads the buffer lazily, so we render the mask
+  // before freeing the buffer
+  t[1] = vips_image_copy_memory(t[0]);
+  g_free(svg);
+
+  if (
+    !t[1] ||
+    vips_ensure_alpha(in, &t[2]) ||
+    vips_composite2(t[2], t[1], &t[3], VIPS_BLEND_MODE_DEST_IN, "compositing_space", in->Type, NULL) ||
+    vips_cast(t[3], out, vips_image_get_format(in), NULL)
+  ) {
+    clear_image(&base);
+    return 1;
+  }
+
+  clear_image(&base);
+
+  return 0;
+#else
+  vips_error("vips_round_corners", "Rounding corners is not supported (libvips 8.6+ reuired)");
+  return 1;
+#endif
+}
+
+int
+vips_solid_go(VipsImage **out, int width, int height, double r, double g, double b) {
+  VipsImage *base = vips_image_new();
+  VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 3);
+
+  double ones[3] = {1.0, 1.0, 1.0};
+  double color[3] = {r, g, b};
+
+  int res =
+    vips_black(&t[0], width, height, "bands", 3, NULL) ||
+    vips_linear(t[0], &t[1], ones, color, 3, NULL) ||
+    vips_cast(t[1], &t[2], VIPS_FORMAT_UCHAR, NULL) ||
+    vips_copy(t[2], out, "interpretation", VIPS_INTERPRETATION_sRGB, NULL);
+
+  clear_image(&base);
+
+  return res;
+}
+
 int
 vips_arrayjoin_go(VipsImage **in, VipsImage **out, int n) {
   return vips_arrayjoin(in, out, n, "across", 1, NULL);
 }
 
 int
-vips_strip(VipsImage *in, VipsImage **out) {
+vips_strip(VipsImage *in, VipsImage **out, gboolean keep_exif_copyright) {
   static double default_resolution = 72.0 / 25.4;
 
   if (vips_copy(
@@ -642,6 +1279,8 @@ vips_strip(VipsImage *in, VipsImage **out) {
 
     if (strcmp(name, VIPS_META_ICC_NAME) == 0) continue;
 
+    if (keep_exif_copyright && strcmp(name, "exif-ifd0-Copyright") == 0) continue;
+
     vips_image_remove(*out, name);
   }
 
@@ -650,59 +1289,161 @@ vips_strip(VipsImage *in, VipsImage **out) {
   return 0;
 }
 
-int
-vips_jpegsave_go(VipsImage *in, void **buf, size_t *len, int quality, int interlace) {
-  return vips_jpegsave_buffer(
-    in, buf, len,
+// Savers are created as operations so the same saving options are used
+// for both saving to a buffer and saving to a target
+
+static VipsOperation *
+vips_jpegsave_op_go(const char *name, int quality, int interlace, gboolean no_subsample) {
+  VipsOperation *op = vips_operation_new(name);
+  if (!op)
+    return NULL;
+
+  if (vips_object_set(
+    VIPS_OBJECT(op),
     "Q", quality,
     "optimize_coding", TRUE,
     "interlace", interlace,
+#if VIPS_SUPPORT_JPEG_SUBSAMPLE_MODE
+    "subsample_mode", no_subsample ? VIPS_FOREIGN_SUBSAMPLE_OFF : VIPS_FOREIGN_SUBSAMPLE_AUTO,
+#else
+    "no_subsample", no_subsample,
+#endif
     NULL
-  );
-}
+  )) {
+    g_object_unref(op);
+    return NULL;
+  }
 
-int
-vips_pngsave_go(VipsImage *in, void **buf, size_t *len, int interlace, int quantize, int colors) {
-  if (!quantize)
-    return vips_pngsave_buffer(
-      in, buf, len,
-      "filter", VIPS_FOREIGN_PNG_FILTER_NONE,
-      "interlace", interlace,
-      NULL
-    );
+  return op;
+}
 
-  int bitdepth = 1;
-  if (colors > 16) bitdepth = 8;
-  else if (colors > 4) bitdepth = 4;
-  else if (colors > 2) bitdepth = 2;
+static VipsOperation *
+vips_pngsave_op_go(const char *name, int interlace, int quantize, int colors, int compression) {
+  VipsOperation *op = vips_operation_new(name);
+  if (!op)
+    return NULL;
 
-  return vips_pngsave_buffer(
-    in, buf, len,
+  int res = vips_object_set(
+    VIPS_OBJECT(op),
     "filter", VIPS_FOREIGN_PNG_FILTER_NONE,
     "interlace", interlace,
+    "compression", compression,
+    NULL
+  );
+
+  if (!res && quantize) {
 #if VIPS_SUPPORT_PNG_BITDEPTH
-    "palette", quantize,
-    "bitdepth", bitdepth,
+    int bitdepth = 1;
+    if (colors > 16) bitdepth = 8;
+    else if (colors > 4) bitdepth = 4;
+    else if (colors > 2) bitdepth = 2;
+
+    res = vips_object_set(VIPS_OBJECT(op), "palette", TRUE, "bitdepth", bitdepth, NULL);
 #elif VIPS_SUPPORT_PNG_QUANTIZATION // VIPS_SUPPORT_PNG_BITDEPTH
-    "palette", quantize,
-    "colours", colors,
+    res = vips_object_set(VIPS_OBJECT(op), "palette", TRUE, "colours", colors, NULL);
 #endif // VIPS_SUPPORT_PNG_QUANTIZATION
+  }
+
+  if (res) {
+    g_object_unref(op);
+    return NULL;
+  }
+
+  return op;
+}
+
+static VipsOperation *
+vips_webpsave_op_go(const char *name, int quality, int effort, gboolean lossless, int near_lossless) {
+  VipsOperation *op = vips_operation_new(name);
+  if (!op)
+    return NULL;
+
+  // In near-lossless mode libvips uses Q as the preprocessing level
+  if (near_lossless > 0) {
+    quality = near_lossless;
+    lossless = TRUE;
+  }
+
+  if (vips_object_set(
+    VIPS_OBJECT(op),
+    "Q", quality,
+    "lossless", lossless,
+    "near_lossless", near_lossless > 0,
+#if VIPS_SUPPORT_WEBP_EFFORT
+    "reduction_effort", effort,
+#endif
     NULL
+  )) {
+    g_object_unref(op);
+    return NULL;
+  }
+
+  return op;
+}
+
+static int
+vips_save_buffer_go(VipsOperation *op, VipsImage *in, void **buf, size_t *len) {
+  if (!op)
+    return 1;
+
+  if (vips_object_set(VIPS_OBJECT(op), "in", in, NULL) || vips_cache_operation_buildp(&op)) {
+    vips_object_unref_outputs(VIPS_OBJECT(op));
+    g_object_unref(op);
+    return 1;
+  }
+
+  VipsArea *area = NULL;
+  g_object_get(op, "buffer", &area, NULL);
+
+  // Steal the data from the blob the same way libvips buffer savers do
+  if (area) {
+    *buf = area->data;
+    *len = area->length;
+    area->free_fn = NULL;
+    vips_area_unref(area);
+  }
+
+  vips_object_unref_outputs(VIPS_OBJECT(op));
+  g_object_unref(op);
+
+  return 0;
+}
+
+int
+vips_jpegsave_go(VipsImage *in, void **buf, size_t *len, int quality, int interlace, gboolean no_subsample) {
+  return vips_save_buffer_go(
+    vips_jpegsave_op_go("jpegsave_buffer", quality, interlace, no_subsample),
+    in, buf, len
   );
 }
 
 int
-vips_webpsave_go(VipsImage *in, void **buf, size_t *len, int quality) {
-  return vips_webpsave_buffer(
-    in, buf, len,
-    "Q", quality,
-    NULL
+vips_pngsave_go(VipsImage *in, void **buf, size_t *len, int interlace, int quantize, int colors, int compression) {
+  return vips_save_buffer_go(
+    vips_pngsave_op_go("pngsave_buffer", interlace, quantize, colors, compression),
+    in, buf, len
   );
 }
 
 int
-vips_gifsave_go(VipsImage *in, void **buf, size_t *len) {
-#if VIPS_SUPPORT_MAGICK
+vips_webpsave_go(VipsImage *in, void **buf, size_t *len, int quality, int effort, gboolean lossless, int near_lossless) {
+  return vips_save_buffer_go(
+    vips_webpsave_op_go("webpsave_buffer", quality, effort, lossless, near_lossless),
+    in, buf, len
+  );
+}
+
+int
+vips_gifsave_go(VipsImage *in, void **buf, size_t *len, double dither, int effort, int bitdepth) {
+#if VIPS_SUPPORT_GIFSAVE
+  return vips_gifsave_buffer(
+    in, buf, len,
+    "dither", dither,
+    "effort", effort,
+    "bitdepth", bitdepth,
+    NULL
+  );
+#elif VIPS_SUPPORT_MAGICK
   return vips_magicksave_buffer(in, buf, len, "format", "gif", NULL);
 #else
   vips_error("vips_gifsave_go", "Saving GIF is not supported (libvips 8.7+ reuired)");
@@ -747,6 +1488,71 @@ vips_bmpsave_go(VipsImage *in, void **buf, size_t *len) {
 #endif
 }
 
+#if VIPS_SUPPORT_TARGET
+static gint64
+vips_target_write_cb(VipsTargetCustom *target, const void *data, gint64 length, void *handle) {
+  return vipsTargetWrite(GPOINTER_TO_INT(handle), (void *) data, length);
+}
+
+static VipsTarget *
+vips_target_new_go(int handle) {
+  VipsTargetCustom *target = vips_target_custom_new();
+
+  g_signal_connect(target, "write", G_CALLBACK(vips_target_write_cb), GINT_TO_POINTER(handle));
+
+  return VIPS_TARGET(target);
+}
+#endif
+
+static int
+vips_save_target_go(VipsOperation *op, VipsImage *in, int handle) {
+#if VIPS_SUPPORT_TARGET
+  if (!op)
+    return 1;
+
+  VipsTarget *target = vips_target_new_go(handle);
+
+  int res = vips_object_set(VIPS_OBJECT(op), "in", in, "target", target, NULL) ||
+    vips_cache_operation_buildp(&op);
+
+  vips_object_unref_outputs(VIPS_OBJECT(op));
+  g_object_unref(op);
+  VIPS_UNREF(target);
+
+  return res;
+#else
+  if (op)
+    g_object_unref(op);
+
+  vips_error("vips_save_target_go", "Saving to target is not supported (libvips 8.9+ reuired)");
+  return 1;
+#endif
+}
+
+int
+vips_jpegsave_target_go(VipsImage *in, int handle, int quality, int interlace, gboolean no_subsample) {
+  return vips_save_target_go(
+    vips_jpegsave_op_go("jpegsave_target", quality, interlace, no_subsample),
+    in, handle
+  );
+}
+
+int
+vips_pngsave_target_go(VipsImage *in, int handle, int interlace, int quantize, int colors, int compression) {
+  return vips_save_target_go(
+    vips_pngsave_op_go("pngsave_target", interlace, quantize, colors, compression),
+    in, handle
+  );
+}
+
+int
+vips_webpsave_target_go(VipsImage *in, int handle, int quality, int effort, gboolean lossless, int near_lossless) {
+  return vips_save_target_go(
+    vips_webpsave_op_go("webpsave_target", quality, effort, lossless, near_lossless),
+    in, handle
+  );
+}
+
 void
 vips_cleanup() {
   vips_error_clear();
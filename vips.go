@@ -13,31 +13,38 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"runtime"
+	"sync"
 	"unsafe"
 )
 
 type vipsImage struct {
 	VipsImage *C.VipsImage
+
+	// HighBitDepth makes colourspace conversions keep 16 bits per channel
+	HighBitDepth bool
 }
 
 var (
-	vipsSupportSmartcrop bool
-	vipsTypeSupportLoad  = make(map[imageType]bool)
-	vipsTypeSupportSave  = make(map[imageType]bool)
-
-	watermark *imageData
+	vipsSupportSmartcrop       bool
+	vipsSupportPngQuantization bool
+	vipsSupportTarget          bool
+	vipsTypeSupportLoad        = make(map[imageType]bool)
+	vipsTypeSupportSave        = make(map[imageType]bool)
+
+	// watermarks contains the default watermark with the empty name
+	// and the named ones
+	watermarks map[string]*imageData
 )
 
 var vipsConf struct {
-	JpegProgressive       C.int
-	PngInterlaced         C.int
-	PngQuantize           C.int
-	PngQuantizationColors C.int
-	AvifSpeed             C.int
-	WatermarkOpacity      C.double
+	JpegProgressive  C.int
+	PngInterlaced    C.int
+	AvifSpeed        C.int
+	WatermarkOpacity C.double
 }
 
 func initVips() error {
@@ -54,7 +61,9 @@ func initVips() error {
 	C.vips_cache_set_max_mem(0)
 	C.vips_cache_set_max(0)
 
-	C.vips_concurrency_set(1)
+	// Each image is processed in its own locked OS thread and libvips spawns
+	// up to this number of worker threads per image
+	C.vips_concurrency_set(C.int(conf.VipsConcurrency))
 
 	// Vector calculations cause SIGSEGV sometimes when working with JPEG.
 	// It's better to disable it since profit it quite small
@@ -69,12 +78,18 @@ func initVips() error {
 	}
 
 	vipsSupportSmartcrop = C.vips_support_smartcrop() == 1
+	vipsSupportPngQuantization = C.vips_support_png_quantization() == 1
+	vipsSupportTarget = C.vips_support_target() == 1
 
 	for _, imgtype := range imageTypes {
 		vipsTypeSupportLoad[imgtype] = int(C.vips_type_find_load_go(C.int(imgtype))) != 0
 		vipsTypeSupportSave[imgtype] = int(C.vips_type_find_save_go(C.int(imgtype))) != 0
 	}
 
+	if librawSupported {
+		vipsTypeSupportLoad[imageTypeRAW] = true
+	}
+
 	if conf.JpegProgressive {
 		vipsConf.JpegProgressive = C.int(1)
 	}
@@ -83,11 +98,6 @@ func initVips() error {
 		vipsConf.PngInterlaced = C.int(1)
 	}
 
-	if conf.PngQuantize {
-		vipsConf.PngQuantize = C.int(1)
-	}
-
-	vipsConf.PngQuantizationColors = C.int(conf.PngQuantizationColors)
 	vipsConf.AvifSpeed = C.int(conf.AvifSpeed)
 	vipsConf.WatermarkOpacity = C.double(conf.WatermarkOpacity)
 
@@ -123,9 +133,44 @@ func vipsError() error {
 	return newUnexpectedError(C.GoString(C.vips_error_buffer()), 1)
 }
 
-func vipsLoadWatermark() (err error) {
-	watermark, err = getWatermarkData()
-	return
+func vipsLoadWatermark() error {
+	var err error
+
+	if watermarks, err = getNamedWatermarksData(); err != nil {
+		return err
+	}
+
+	for name, wmData := range watermarks {
+		if err = vipsCheckDecoding(wmData); err != nil {
+			return fmt.Errorf("Can't decode watermark %s: %s", name, err)
+		}
+	}
+
+	wmData, err := getWatermarkData()
+	if err != nil {
+		return err
+	}
+
+	if wmData != nil {
+		if err = vipsCheckDecoding(wmData); err != nil {
+			return err
+		}
+
+		watermarks[defaultWatermarkName] = wmData
+	}
+
+	return nil
+}
+
+func vipsCheckDecoding(imgdata *imageData) error {
+	img := new(vipsImage)
+	defer img.Clear()
+
+	if err := img.Load(imgdata.Data, imgdata.Type, 1, 1.0, 1); err != nil {
+		return err
+	}
+
+	return img.CopyMemory()
 }
 
 func gbool(b bool) C.gboolean {
@@ -165,6 +210,13 @@ func (img *vipsImage) Load(data []byte, imgtype imageType, shrink int, scale flo
 		err = C.vips_bmpload_go(unsafe.Pointer(&data[0]), C.size_t(len(data)), &tmp)
 	case imageTypeTIFF:
 		err = C.vips_tiffload_go(unsafe.Pointer(&data[0]), C.size_t(len(data)), &tmp)
+	case imageTypeRAW:
+		if librawSupported {
+			return img.loadLibraw(data)
+		}
+		err = C.vips_rawload_go(unsafe.Pointer(&data[0]), C.size_t(len(data)), &tmp)
+	case imageTypePDF:
+		err = C.vips_pdfload_go(unsafe.Pointer(&data[0]), C.size_t(len(data)), 0, C.double(defaultPdfDpi), &tmp)
 	}
 	if err != 0 {
 		return vipsError()
@@ -175,7 +227,55 @@ func (img *vipsImage) Load(data []byte, imgtype imageType, shrink int, scale flo
 	return nil
 }
 
-func (img *vipsImage) Save(imgtype imageType, quality int) ([]byte, context.CancelFunc, error) {
+// LoadPdf renders the page of the PDF document with the provided resolution
+func (img *vipsImage) LoadPdf(data []byte, page int, dpi float64) error {
+	var tmp *C.VipsImage
+
+	if C.vips_pdfload_go(unsafe.Pointer(&data[0]), C.size_t(len(data)), C.int(page), C.double(dpi), &tmp) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(&img.VipsImage, tmp)
+
+	return nil
+}
+
+type vipsCompression struct {
+	Png  C.int
+	Webp C.int
+	Avif C.int
+}
+
+func getVipsCompression(opts *saveOptions) vipsCompression {
+	if profile, ok := compressionProfiles[opts.Compression]; ok {
+		return vipsCompression{
+			Png:  C.int(profile.PngCompression),
+			Webp: C.int(profile.WebpEffort),
+			Avif: C.int(profile.AvifSpeed),
+		}
+	}
+
+	return vipsCompression{
+		Png:  C.int(defaultPngCompression),
+		Webp: C.int(defaultWebpEffort),
+		Avif: vipsConf.AvifSpeed,
+	}
+}
+
+func (img *vipsImage) pngQuantize(opts *saveOptions) bool {
+	quantize := opts.Png.Quantize
+	if quantize && !vipsSupportPngQuantization {
+		logWarning("PNG quantization is not supported by libvips, saving PNG without palette")
+		quantize = false
+	}
+	// Palette images can't have more than 8 bits per channel
+	if img.VipsImage.BandFmt == C.VIPS_FORMAT_USHORT {
+		quantize = false
+	}
+	return quantize
+}
+
+func (img *vipsImage) Save(imgtype imageType, quality int, opts *saveOptions) ([]byte, context.CancelFunc, error) {
 	if imgtype == imageTypeICO {
 		b, err := img.SaveAsIco()
 		return b, func() {}, err
@@ -191,17 +291,19 @@ func (img *vipsImage) Save(imgtype imageType, quality int) ([]byte, context.Canc
 
 	imgsize := C.size_t(0)
 
+	compression := getVipsCompression(opts)
+
 	switch imgtype {
 	case imageTypeJPEG:
-		err = C.vips_jpegsave_go(img.VipsImage, &ptr, &imgsize, C.int(quality), vipsConf.JpegProgressive)
+		err = C.vips_jpegsave_go(img.VipsImage, &ptr, &imgsize, C.int(quality), vipsConf.JpegProgressive, gbool(opts.Jpeg.NoSubsample))
 	case imageTypePNG:
-		err = C.vips_pngsave_go(img.VipsImage, &ptr, &imgsize, vipsConf.PngInterlaced, vipsConf.PngQuantize, vipsConf.PngQuantizationColors)
+		err = C.vips_pngsave_go(img.VipsImage, &ptr, &imgsize, vipsConf.PngInterlaced, gbool(img.pngQuantize(opts)), C.int(opts.Png.Colors), compression.Png)
 	case imageTypeWEBP:
-		err = C.vips_webpsave_go(img.VipsImage, &ptr, &imgsize, C.int(quality))
+		err = C.vips_webpsave_go(img.VipsImage, &ptr, &imgsize, C.int(quality), compression.Webp, gbool(opts.Webp.Lossless), C.int(opts.Webp.NearLossless))
 	case imageTypeGIF:
-		err = C.vips_gifsave_go(img.VipsImage, &ptr, &imgsize)
+		err = C.vips_gifsave_go(img.VipsImage, &ptr, &imgsize, C.double(opts.Gif.Dither), C.int(opts.Gif.Effort), C.int(opts.Gif.Bitdepth))
 	case imageTypeAVIF:
-		err = C.vips_avifsave_go(img.VipsImage, &ptr, &imgsize, C.int(quality), vipsConf.AvifSpeed)
+		err = C.vips_avifsave_go(img.VipsImage, &ptr, &imgsize, C.int(quality), compression.Avif)
 	case imageTypeBMP:
 		err = C.vips_bmpsave_go(img.VipsImage, &ptr, &imgsize)
 	case imageTypeTIFF:
@@ -214,9 +316,104 @@ func (img *vipsImage) Save(imgtype imageType, quality int) ([]byte, context.Canc
 
 	b := ptrToBytes(ptr, int(imgsize))
 
+	if imgtype == imageTypeGIF {
+		if disposal, _ := img.GetIntDefault(gifDisposalField, 0); disposal > 0 {
+			if err := setGifDisposal(b, disposal); err != nil {
+				C.g_free_go(&ptr)
+				return nil, cancel, err
+			}
+		}
+	}
+
 	return b, cancel, nil
 }
 
+// vipsSupportSaveToWriter checks if the image of the type can be saved
+// directly to a writer without buffering the whole result
+func vipsSupportSaveToWriter(imgtype imageType) bool {
+	if !vipsSupportTarget {
+		return false
+	}
+
+	switch imgtype {
+	case imageTypeJPEG, imageTypePNG, imageTypeWEBP:
+		return true
+	}
+
+	return false
+}
+
+// SaveToWriter saves the image to the writer chunk by chunk as libvips encodes it.
+// Check vipsSupportSaveToWriter before calling it
+func (img *vipsImage) SaveToWriter(w io.Writer, imgtype imageType, quality int, opts *saveOptions) error {
+	handle := registerVipsTargetWriter(w)
+	defer unregisterVipsTargetWriter(handle)
+
+	err := C.int(0)
+
+	compression := getVipsCompression(opts)
+
+	switch imgtype {
+	case imageTypeJPEG:
+		err = C.vips_jpegsave_target_go(img.VipsImage, handle, C.int(quality), vipsConf.JpegProgressive, gbool(opts.Jpeg.NoSubsample))
+	case imageTypePNG:
+		err = C.vips_pngsave_target_go(img.VipsImage, handle, vipsConf.PngInterlaced, gbool(img.pngQuantize(opts)), C.int(opts.Png.Colors), compression.Png)
+	case imageTypeWEBP:
+		err = C.vips_webpsave_target_go(img.VipsImage, handle, C.int(quality), compression.Webp, gbool(opts.Webp.Lossless), C.int(opts.Webp.NearLossless))
+	default:
+		return fmt.Errorf("Can't save %s to writer", imgtype)
+	}
+	if err != 0 {
+		return vipsError()
+	}
+
+	return nil
+}
+
+var (
+	vipsTargetWriters           = make(map[C.int]io.Writer)
+	vipsTargetWritersMutex      sync.Mutex
+	vipsTargetWritersNextHandle C.int
+)
+
+// C code can't keep Go pointers, so the writers are passed to libvips
+// targets as handles
+func registerVipsTargetWriter(w io.Writer) C.int {
+	vipsTargetWritersMutex.Lock()
+	defer vipsTargetWritersMutex.Unlock()
+
+	vipsTargetWritersNextHandle++
+	vipsTargetWriters[vipsTargetWritersNextHandle] = w
+
+	return vipsTargetWritersNextHandle
+}
+
+func unregisterVipsTargetWriter(handle C.int) {
+	vipsTargetWritersMutex.Lock()
+	defer vipsTargetWritersMutex.Unlock()
+
+	delete(vipsTargetWriters, handle)
+}
+
+//export vipsTargetWrite
+func vipsTargetWrite(handle C.int, data unsafe.Pointer, length C.longlong) C.longlong {
+	vipsTargetWritersMutex.Lock()
+	w, ok := vipsTargetWriters[handle]
+	vipsTargetWritersMutex.Unlock()
+
+	if !ok {
+		return -1
+	}
+
+	// The data belongs to libvips, so the writer should not retain it
+	n, err := w.Write(ptrToBytes(data, int(length)))
+	if err != nil {
+		return -1
+	}
+
+	return C.longlong(n)
+}
+
 func (img *vipsImage) SaveAsIco() ([]byte, error) {
 	if img.Width() > 256 || img.Height() > 256 {
 		return nil, errors.New("Image dimensions is too big. Max dimension size for ICO is 256")
@@ -229,7 +426,7 @@ func (img *vipsImage) SaveAsIco() ([]byte, error) {
 		C.g_free_go(&ptr)
 	}()
 
-	if C.vips_pngsave_go(img.VipsImage, &ptr, &imgsize, 0, 0, 256) != 0 {
+	if C.vips_pngsave_go(img.VipsImage, &ptr, &imgsize, 0, 0, 256, C.int(defaultPngCompression)) != 0 {
 		return nil, vipsError()
 	}
 
@@ -340,6 +537,24 @@ func (img *vipsImage) GetIntDefault(name string, def int) (int, error) {
 	return img.GetInt(name)
 }
 
+func (img *vipsImage) GetStringDefault(name string, def string) (string, error) {
+	if C.vips_image_get_typeof(img.VipsImage, cachedCString(name)) == 0 {
+		return def, nil
+	}
+
+	var str *C.char
+
+	if C.vips_image_get_string(img.VipsImage, cachedCString(name), &str) != 0 {
+		return "", vipsError()
+	}
+	return C.GoString(str), nil
+}
+
+// Interpretation returns the libvips nickname of the image color space
+func (img *vipsImage) Interpretation() string {
+	return C.GoString(C.vips_enum_nick(C.vips_interpretation_get_type(), C.int(img.VipsImage.Type)))
+}
+
 func (img *vipsImage) GetIntSlice(name string) ([]int, error) {
 	var ptr unsafe.Pointer
 	size := C.int(0)
@@ -382,6 +597,38 @@ func (img *vipsImage) SetIntSlice(name string, value []int) {
 	C.vips_image_set_array_int_go(img.VipsImage, cachedCString(name), &in[0], C.int(len(value)))
 }
 
+func (img *vipsImage) CastUshort() error {
+	var tmp *C.VipsImage
+
+	if C.vips_image_get_format(img.VipsImage) != C.VIPS_FORMAT_USHORT {
+		if C.vips_cast_go(img.VipsImage, &tmp, C.VIPS_FORMAT_USHORT) != 0 {
+			return vipsError()
+		}
+		C.swap_and_clear(&img.VipsImage, tmp)
+	}
+
+	return nil
+}
+
+// IsHighBitDepth checks if the image has more than 8 bits per channel
+func (img *vipsImage) IsHighBitDepth() bool {
+	return img.VipsImage.BandFmt == C.VIPS_FORMAT_USHORT ||
+		img.VipsImage.Type == C.VIPS_INTERPRETATION_RGB16 ||
+		img.VipsImage.Type == C.VIPS_INTERPRETATION_GREY16
+}
+
+// HasNonSRGBProfile checks if the image has an embedded ICC profile that isn't sRGB
+func (img *vipsImage) HasNonSRGBProfile() bool {
+	return C.vips_has_embedded_icc(img.VipsImage) != 0 && C.vips_icc_is_srgb_iec61966(img.VipsImage) == 0
+}
+
+func (img *vipsImage) iccDepth() C.int {
+	if img.HighBitDepth {
+		return C.int(16)
+	}
+	return C.int(8)
+}
+
 func (img *vipsImage) CastUchar() error {
 	var tmp *C.VipsImage
 
@@ -408,15 +655,20 @@ func (img *vipsImage) Rad2Float() error {
 	return nil
 }
 
-func (img *vipsImage) Resize(scale float64, hasAlpa bool) error {
+func (img *vipsImage) Resize(scale float64, hasAlpa, fast bool) error {
 	var tmp *C.VipsImage
 
+	kernel := C.VipsKernel(C.VIPS_KERNEL_LANCZOS3)
+	if fast {
+		kernel = C.VIPS_KERNEL_LINEAR
+	}
+
 	if hasAlpa {
-		if C.vips_resize_with_premultiply(img.VipsImage, &tmp, C.double(scale)) != 0 {
+		if C.vips_resize_with_premultiply(img.VipsImage, &tmp, C.double(scale), kernel) != 0 {
 			return vipsError()
 		}
 	} else {
-		if C.vips_resize_go(img.VipsImage, &tmp, C.double(scale)) != 0 {
+		if C.vips_resize_go(img.VipsImage, &tmp, C.double(scale), kernel) != 0 {
 			return vipsError()
 		}
 	}
@@ -426,6 +678,19 @@ func (img *vipsImage) Resize(scale float64, hasAlpa bool) error {
 	return nil
 }
 
+// Stretch resizes the image to the exact dimensions ignoring its aspect ratio
+func (img *vipsImage) Stretch(width, height int) error {
+	var tmp *C.VipsImage
+
+	if C.vips_stretch_go(img.VipsImage, &tmp, C.int(width), C.int(height)) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(&img.VipsImage, tmp)
+
+	return nil
+}
+
 func (img *vipsImage) Orientation() C.int {
 	return C.vips_get_orientation(img.VipsImage)
 }
@@ -474,10 +739,10 @@ func (img *vipsImage) Extract(out *vipsImage, left, top, width, height int) erro
 	return nil
 }
 
-func (img *vipsImage) SmartCrop(width, height int) error {
+func (img *vipsImage) SmartCrop(width, height int, strategy smartCropStrategy) error {
 	var tmp *C.VipsImage
 
-	if C.vips_smartcrop_go(img.VipsImage, &tmp, C.int(width), C.int(height)) != 0 {
+	if C.vips_smartcrop_go(img.VipsImage, &tmp, C.int(width), C.int(height), C.int(strategy)) != 0 {
 		return vipsError()
 	}
 
@@ -524,6 +789,50 @@ func (img *vipsImage) Flatten(bg rgbColor) error {
 	return nil
 }
 
+// AverageColor returns the average sRGB color of the image.
+// Transparent pixels are flattened onto white
+func (img *vipsImage) AverageColor() (rgbColor, error) {
+	var r, g, b C.double
+
+	if C.vips_average_color_go(img.VipsImage, &r, &g, &b) != 0 {
+		return rgbColor{}, vipsError()
+	}
+
+	return rgbColor{
+		R: uint8(math.Round(float64(r))),
+		G: uint8(math.Round(float64(g))),
+		B: uint8(math.Round(float64(b))),
+	}, nil
+}
+
+// SRGBPixels returns the 8-bit sRGB pixels of the image row by row.
+// Transparent pixels are flattened onto white
+func (img *vipsImage) SRGBPixels() ([]byte, error) {
+	var ptr unsafe.Pointer
+	defer C.g_free_go(&ptr)
+
+	size := C.size_t(0)
+
+	if C.vips_srgb_pixels_go(img.VipsImage, &ptr, &size) != 0 {
+		return nil, vipsError()
+	}
+
+	return C.GoBytes(ptr, C.int(size)), nil
+}
+
+// Background composites the image over the background of the specified color
+// and opacity keeping the alpha channel
+func (img *vipsImage) Background(bg rgbColor, alpha float64) error {
+	var tmp *C.VipsImage
+
+	if C.vips_background_go(img.VipsImage, &tmp, C.double(bg.R), C.double(bg.G), C.double(bg.B), C.double(alpha)) != 0 {
+		return vipsError()
+	}
+	C.swap_and_clear(&img.VipsImage, tmp)
+
+	return nil
+}
+
 func (img *vipsImage) Blur(sigma float32) error {
 	var tmp *C.VipsImage
 
@@ -535,10 +844,113 @@ func (img *vipsImage) Blur(sigma float32) error {
 	return nil
 }
 
-func (img *vipsImage) Sharpen(sigma float32) error {
+// BoxBlur applies the box blur with the radius that gives
+// the same standard deviation as the gaussian blur with the provided sigma
+func (img *vipsImage) BoxBlur(sigma float32) error {
+	var tmp *C.VipsImage
+
+	radius := maxInt(int(math.Round((math.Sqrt(12*float64(sigma*sigma)+1)-1)/2)), 1)
+
+	if C.vips_boxblur_go(img.VipsImage, &tmp, C.int(radius)) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(&img.VipsImage, tmp)
+	return nil
+}
+
+// Unsharp applies the unsharp mask. amount is the sharpening slope for edges
+// and threshold is the difference that separates flat areas from edges
+func (img *vipsImage) Unsharp(sigma, amount, threshold float32) error {
+	var tmp *C.VipsImage
+
+	if C.vips_unsharp_go(img.VipsImage, &tmp, C.double(sigma), C.double(amount), C.double(threshold)) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(&img.VipsImage, tmp)
+	return nil
+}
+
+func (img *vipsImage) Pixelate(pixels int) error {
+	var tmp *C.VipsImage
+
+	if C.vips_pixelate(img.VipsImage, &tmp, C.int(pixels)) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(&img.VipsImage, tmp)
+	return nil
+}
+
+func (img *vipsImage) ApplyLut(lut *lut3D) error {
+	var tmp *C.VipsImage
+
+	var domainMin, domainMax [3]C.double
+	for i := 0; i < 3; i++ {
+		domainMin[i] = C.double(lut.DomainMin[i])
+		domainMax[i] = C.double(lut.DomainMax[i])
+	}
+
+	if C.vips_lut3d_go(img.VipsImage, &tmp, (*C.float)(&lut.Data[0]), C.int(lut.Size), &domainMin[0], &domainMax[0]) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(&img.VipsImage, tmp)
+	return nil
+}
+
+func (img *vipsImage) Normalize(clip float64) error {
 	var tmp *C.VipsImage
 
-	if C.vips_sharpen_go(img.VipsImage, &tmp, C.double(sigma)) != 0 {
+	if C.vips_normalize_go(img.VipsImage, &tmp, C.double(clip)) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(&img.VipsImage, tmp)
+	return nil
+}
+
+func (img *vipsImage) Gamma(gamma float64) error {
+	var tmp *C.VipsImage
+
+	if C.vips_gamma_go(img.VipsImage, &tmp, C.double(gamma)) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(&img.VipsImage, tmp)
+	return nil
+}
+
+func (img *vipsImage) Text(text, font string, maxWidth, maxHeight int) error {
+	var tmp *C.VipsImage
+
+	ctext := C.CString(text)
+	defer C.free(unsafe.Pointer(ctext))
+
+	if C.vips_text_go(&tmp, ctext, cachedCString(font), C.int(maxWidth), C.int(maxHeight)) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(&img.VipsImage, tmp)
+	return nil
+}
+
+func (img *vipsImage) Solid(width, height int, color rgbColor) error {
+	var tmp *C.VipsImage
+
+	if C.vips_solid_go(&tmp, C.int(width), C.int(height), C.double(color.R), C.double(color.G), C.double(color.B)) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(&img.VipsImage, tmp)
+	return nil
+}
+
+func (img *vipsImage) RoundCorners(rx, ry int) error {
+	var tmp *C.VipsImage
+
+	if C.vips_round_corners(img.VipsImage, &tmp, C.int(rx), C.int(ry)) != 0 {
 		return vipsError()
 	}
 
@@ -574,11 +986,11 @@ func (img *vipsImage) ExportColourProfile() error {
 	var tmp *C.VipsImage
 
 	// Don't export is there's no embedded profile or embedded profile is sRGB
-	if C.vips_has_embedded_icc(img.VipsImage) == 0 || C.vips_icc_is_srgb_iec61966(img.VipsImage) == 1 {
+	if !img.HasNonSRGBProfile() {
 		return nil
 	}
 
-	if C.vips_icc_export_go(img.VipsImage, &tmp) == 0 {
+	if C.vips_icc_export_go(img.VipsImage, &tmp, img.iccDepth()) == 0 {
 		C.swap_and_clear(&img.VipsImage, tmp)
 	} else {
 		logWarning("Can't export ICC profile: %s", vipsError())
@@ -591,11 +1003,11 @@ func (img *vipsImage) ExportColourProfileToSRGB() error {
 	var tmp *C.VipsImage
 
 	// Don't export is there's no embedded profile or embedded profile is sRGB
-	if C.vips_has_embedded_icc(img.VipsImage) == 0 || C.vips_icc_is_srgb_iec61966(img.VipsImage) == 1 {
+	if !img.HasNonSRGBProfile() {
 		return nil
 	}
 
-	if C.vips_icc_export_srgb(img.VipsImage, &tmp) == 0 {
+	if C.vips_icc_export_srgb(img.VipsImage, &tmp, img.iccDepth()) == 0 {
 		C.swap_and_clear(&img.VipsImage, tmp)
 	} else {
 		logWarning("Can't export ICC profile: %s", vipsError())
@@ -608,11 +1020,11 @@ func (img *vipsImage) TransformColourProfile() error {
 	var tmp *C.VipsImage
 
 	// Don't transform is there's no embedded profile or embedded profile is sRGB
-	if C.vips_has_embedded_icc(img.VipsImage) == 0 || C.vips_icc_is_srgb_iec61966(img.VipsImage) == 1 {
+	if !img.HasNonSRGBProfile() {
 		return nil
 	}
 
-	if C.vips_icc_transform_go(img.VipsImage, &tmp) == 0 {
+	if C.vips_icc_transform_go(img.VipsImage, &tmp, img.iccDepth()) == 0 {
 		C.swap_and_clear(&img.VipsImage, tmp)
 	} else {
 		logWarning("Can't transform ICC profile: %s", vipsError())
@@ -638,9 +1050,19 @@ func (img *vipsImage) LinearColourspace() error {
 }
 
 func (img *vipsImage) RgbColourspace() error {
+	if img.HighBitDepth {
+		return img.Colorspace(C.VIPS_INTERPRETATION_RGB16)
+	}
 	return img.Colorspace(C.VIPS_INTERPRETATION_sRGB)
 }
 
+func (img *vipsImage) GrayscaleColourspace() error {
+	if img.HighBitDepth {
+		return img.Colorspace(C.VIPS_INTERPRETATION_GREY16)
+	}
+	return img.Colorspace(C.VIPS_INTERPRETATION_B_W)
+}
+
 func (img *vipsImage) Colorspace(colorspace C.VipsInterpretation) error {
 	if img.VipsImage.Type != colorspace {
 		var tmp *C.VipsImage
@@ -654,6 +1076,12 @@ func (img *vipsImage) Colorspace(colorspace C.VipsInterpretation) error {
 	return nil
 }
 
+// MemorySize returns the number of bytes the image takes when it's copied to memory
+func (img *vipsImage) MemorySize() int64 {
+	return int64(img.Width()) * int64(img.Height()) *
+		int64(img.VipsImage.Bands) * int64(C.vips_format_sizeof(img.VipsImage.BandFmt))
+}
+
 func (img *vipsImage) CopyMemory() error {
 	var tmp *C.VipsImage
 	if tmp = C.vips_image_copy_memory(img.VipsImage); tmp == nil {
@@ -674,25 +1102,27 @@ func (img *vipsImage) Replicate(width, height int) error {
 	return nil
 }
 
-func (img *vipsImage) Embed(width, height int, offX, offY int, bg rgbColor, transpBg bool) error {
+// Embed places the image on the canvas of the specified size.
+// The canvas is filled with the background color of the specified opacity
+func (img *vipsImage) Embed(width, height int, offX, offY int, bg rgbColor, bgAlpha float64) error {
 	var tmp *C.VipsImage
 
 	if err := img.RgbColourspace(); err != nil {
 		return err
 	}
 
-	var bgc []C.double
-	if transpBg {
-		if !img.HasAlpha() {
-			if C.vips_addalpha_go(img.VipsImage, &tmp) != 0 {
-				return vipsError()
-			}
-			C.swap_and_clear(&img.VipsImage, tmp)
+	if bgAlpha < 1 && !img.HasAlpha() {
+		if C.vips_addalpha_go(img.VipsImage, &tmp) != 0 {
+			return vipsError()
 		}
+		C.swap_and_clear(&img.VipsImage, tmp)
+	}
 
+	var bgc []C.double
+	if bgAlpha <= 0 {
 		bgc = []C.double{C.double(0)}
 	} else {
-		bgc = []C.double{C.double(bg.R), C.double(bg.G), C.double(bg.B), 1.0}
+		bgc = []C.double{C.double(bg.R), C.double(bg.G), C.double(bg.B), C.double(bgAlpha * 255)}
 	}
 
 	bgn := minInt(int(img.VipsImage.Bands), len(bgc))
@@ -716,10 +1146,10 @@ func (img *vipsImage) ApplyWatermark(wm *vipsImage, opacity float64) error {
 	return nil
 }
 
-func (img *vipsImage) Strip() error {
+func (img *vipsImage) Strip(keepExifCopyright bool) error {
 	var tmp *C.VipsImage
 
-	if C.vips_strip(img.VipsImage, &tmp) != 0 {
+	if C.vips_strip(img.VipsImage, &tmp, gbool(keepExifCopyright)) != 0 {
 		return vipsError()
 	}
 	C.swap_and_clear(&img.VipsImage, tmp)
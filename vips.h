@@ -15,7 +15,14 @@ enum ImgproxyImageTypes {
   HEIC,
   AVIF,
   BMP,
-  TIFF
+  TIFF,
+  RAW,
+  PDF
+};
+
+enum ImgproxySmartCropStrategies {
+  SMARTCROP_ATTENTION = 0,
+  SMARTCROP_ENTROPY
 };
 
 int vips_initialize();
@@ -36,11 +43,15 @@ int vips_svgload_go(void *buf, size_t len, double scale, VipsImage **out);
 int vips_heifload_go(void *buf, size_t len, VipsImage **out);
 int vips_bmpload_go(void *buf, size_t len, VipsImage **out);
 int vips_tiffload_go(void *buf, size_t len, VipsImage **out);
+int vips_rawload_go(void *buf, size_t len, VipsImage **out);
+int vips_pdfload_go(void *buf, size_t len, int page, double dpi, VipsImage **out);
 
 int vips_get_orientation(VipsImage *image);
 void vips_strip_meta(VipsImage *image);
 
 int vips_support_smartcrop();
+int vips_support_png_quantization();
+int vips_support_target();
 
 VipsBandFormat vips_band_format(VipsImage *in);
 
@@ -58,15 +69,15 @@ int vips_copy_go(VipsImage *in, VipsImage **out);
 int vips_cast_go(VipsImage *in, VipsImage **out, VipsBandFormat format);
 int vips_rad2float_go(VipsImage *in, VipsImage **out);
 
-int vips_resize_go(VipsImage *in, VipsImage **out, double scale);
-int vips_resize_with_premultiply(VipsImage *in, VipsImage **out, double scale);
+int vips_resize_go(VipsImage *in, VipsImage **out, double scale, VipsKernel kernel);
+int vips_resize_with_premultiply(VipsImage *in, VipsImage **out, double scale, VipsKernel kernel);
 
 int vips_icc_is_srgb_iec61966(VipsImage *in);
 int vips_has_embedded_icc(VipsImage *in);
 int vips_icc_import_go(VipsImage *in, VipsImage **out);
-int vips_icc_export_go(VipsImage *in, VipsImage **out);
-int vips_icc_export_srgb(VipsImage *in, VipsImage **out);
-int vips_icc_transform_go(VipsImage *in, VipsImage **out);
+int vips_icc_export_go(VipsImage *in, VipsImage **out, int depth);
+int vips_icc_export_srgb(VipsImage *in, VipsImage **out, int depth);
+int vips_icc_transform_go(VipsImage *in, VipsImage **out, int depth);
 int vips_icc_remove(VipsImage *in, VipsImage **out);
 int vips_colourspace_go(VipsImage *in, VipsImage **out, VipsInterpretation cs);
 
@@ -74,15 +85,24 @@ int vips_rot_go(VipsImage *in, VipsImage **out, VipsAngle angle);
 int vips_flip_horizontal_go(VipsImage *in, VipsImage **out);
 
 int vips_extract_area_go(VipsImage *in, VipsImage **out, int left, int top, int width, int height);
-int vips_smartcrop_go(VipsImage *in, VipsImage **out, int width, int height);
+int vips_smartcrop_go(VipsImage *in, VipsImage **out, int width, int height, int strategy);
 int vips_trim(VipsImage *in, VipsImage **out, double threshold,
               gboolean smart, double r, double g, double b,
               gboolean equal_hor, gboolean equal_ver);
 
 int vips_gaussblur_go(VipsImage *in, VipsImage **out, double sigma);
-int vips_sharpen_go(VipsImage *in, VipsImage **out, double sigma);
+int vips_boxblur_go(VipsImage *in, VipsImage **out, int radius);
+int vips_unsharp_go(VipsImage *in, VipsImage **out, double sigma, double amount, double threshold);
+int vips_pixelate(VipsImage *in, VipsImage **out, int pixels);
+int vips_normalize_go(VipsImage *in, VipsImage **out, double clip);
+int vips_gamma_go(VipsImage *in, VipsImage **out, double gamma);
+int vips_stretch_go(VipsImage *in, VipsImage **out, int width, int height);
+int vips_lut3d_go(VipsImage *in, VipsImage **out, float *lut, int size, double *domain_min, double *domain_max);
 
 int vips_flatten_go(VipsImage *in, VipsImage **out, double r, double g, double b);
+int vips_average_color_go(VipsImage *in, double *r, double *g, double *b);
+int vips_srgb_pixels_go(VipsImage *in, void **buf, size_t *len);
+int vips_background_go(VipsImage *in, VipsImage **out, double r, double g, double b, double a);
 
 int vips_replicate_go(VipsImage *in, VipsImage **out, int across, int down);
 int vips_embed_go(VipsImage *in, VipsImage **out, int x, int y, int width, int height, double *bg, int bgn);
@@ -91,16 +111,28 @@ int vips_ensure_alpha(VipsImage *in, VipsImage **out);
 
 int vips_apply_watermark(VipsImage *in, VipsImage *watermark, VipsImage **out, double opacity);
 
+int vips_text_go(VipsImage **out, const char *text, const char *font, int max_width, int max_height);
+
+int vips_round_corners(VipsImage *in, VipsImage **out, int rx, int ry);
+
+int vips_solid_go(VipsImage **out, int width, int height, double r, double g, double b);
 int vips_arrayjoin_go(VipsImage **in, VipsImage **out, int n);
 
-int vips_strip(VipsImage *in, VipsImage **out);
+int vips_strip(VipsImage *in, VipsImage **out, gboolean keep_exif_copyright);
 
-int vips_jpegsave_go(VipsImage *in, void **buf, size_t *len, int quality, int interlace);
-int vips_pngsave_go(VipsImage *in, void **buf, size_t *len, int interlace, int quantize, int colors);
-int vips_webpsave_go(VipsImage *in, void **buf, size_t *len, int quality);
-int vips_gifsave_go(VipsImage *in, void **buf, size_t *len);
+int vips_jpegsave_go(VipsImage *in, void **buf, size_t *len, int quality, int interlace, gboolean no_subsample);
+int vips_pngsave_go(VipsImage *in, void **buf, size_t *len, int interlace, int quantize, int colors, int compression);
+int vips_webpsave_go(VipsImage *in, void **buf, size_t *len, int quality, int effort, gboolean lossless, int near_lossless);
+int vips_gifsave_go(VipsImage *in, void **buf, size_t *len, double dither, int effort, int bitdepth);
 int vips_avifsave_go(VipsImage *in, void **buf, size_t *len, int quality, int speed);
 int vips_bmpsave_go(VipsImage *in, void **buf, size_t *len);
 int vips_tiffsave_go(VipsImage *in, void **buf, size_t *len, int quality);
 
+// vipsTargetWrite is exported from Go and writes the saved data to the response
+extern long long vipsTargetWrite(int handle, void *data, long long length);
+
+int vips_jpegsave_target_go(VipsImage *in, int handle, int quality, int interlace, gboolean no_subsample);
+int vips_pngsave_target_go(VipsImage *in, int handle, int interlace, int quantize, int colors, int compression);
+int vips_webpsave_target_go(VipsImage *in, int handle, int quality, int effort, gboolean lossless, int near_lossless);
+
 void vips_cleanup();